@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// AttendeeStatus ответ участника на приглашение в событие
+type AttendeeStatus string
+
+const (
+	// AttendeeNeedsAction участник еще не ответил на приглашение
+	AttendeeNeedsAction AttendeeStatus = "needs-action"
+	// AttendeeAccepted участник придет
+	AttendeeAccepted AttendeeStatus = "accepted"
+	// AttendeeDeclined участник не придет, событие не показывается в его календаре
+	AttendeeDeclined AttendeeStatus = "declined"
+	// AttendeeTentative участник, возможно, придет
+	AttendeeTentative AttendeeStatus = "tentative"
+)
+
+// Attendee приглашенный в событие пользователь. Событие хранится в календаре организатора
+// (Event.UserID) и показывается в календарях участников
+type Attendee struct {
+	UserID string         `json:"user_id"`
+	Status AttendeeStatus `json:"status"`
+}
+
+// ParseAttendees разбирает список пользователей через запятую, например 35,36
+func ParseAttendees(value string) []Attendee {
+	var res []Attendee
+	for _, userID := range strings.Split(value, ",") {
+		if userID = strings.TrimSpace(userID); userID != "" {
+			res = append(res, Attendee{UserID: userID})
+		}
+	}
+	return res
+}
+
+// formatAttendees возвращает пользователей-участников через запятую, как их принимает ParseAttendees
+func formatAttendees(attendees []Attendee) string {
+	ids := make([]string, len(attendees))
+	for i, a := range attendees {
+		ids[i] = a.UserID
+	}
+	return strings.Join(ids, ",")
+}
+
+// KeepAttendees сохраняет участников изменяемого события вместе с их ответами, event.Attendees не учитывается
+func KeepAttendees() WriteOption {
+	return func(o *writeOptions) {
+		o.keepAttendees = true
+	}
+}
+
+// parseKeepAttendees возвращает KeepAttendees, если параметр attendees не передан: изменение без него
+// сохраняет участников события, а пустое значение attendees= удаляет их
+func parseKeepAttendees(v url.Values) []WriteOption {
+	if v.Has("attendees") {
+		return nil
+	}
+	return []WriteOption{KeepAttendees()}
+}
+
+// parseAttendeeStatus разбирает ответ участника на приглашение
+func parseAttendeeStatus(value string) (AttendeeStatus, error) {
+	switch status := AttendeeStatus(value); status {
+	case AttendeeAccepted, AttendeeDeclined, AttendeeTentative:
+		return status, nil
+	default:
+		return "", fmt.Errorf("status must be accepted, declined or tentative")
+	}
+}
+
+// mergeAttendees возвращает список участников requested, задаваемый организатором organizer.
+// Ответы участников берутся из stored, так как менять их может только сам участник,
+// новые участники еще не ответили. Повторы удаляются
+func mergeAttendees(organizer string, requested, stored []Attendee) ([]Attendee, error) {
+	if len(requested) == 0 {
+		return nil, nil
+	}
+	statuses := make(map[string]AttendeeStatus, len(stored))
+	for _, a := range stored {
+		statuses[a.UserID] = a.Status
+	}
+	seen := make(map[string]bool, len(requested))
+	res := make([]Attendee, 0, len(requested))
+	for _, a := range requested {
+		if a.UserID == organizer {
+			return nil, &ValidationError{Message: "organizer cannot be an attendee"}
+		}
+		if a.UserID == "" || seen[a.UserID] {
+			continue
+		}
+		seen[a.UserID] = true
+		status, ok := statuses[a.UserID]
+		if !ok {
+			status = AttendeeNeedsAction
+		}
+		res = append(res, Attendee{UserID: a.UserID, Status: status})
+	}
+	return res, nil
+}
+
+// attendee возвращает ответ пользователя userID на приглашение в событие
+func (e *Event) attendee(userID string) (AttendeeStatus, bool) {
+	for _, a := range e.Attendees {
+		if a.UserID == userID {
+			return a.Status, true
+		}
+	}
+	return "", false
+}
+
+// concerns проверяет, касается ли изменение пользователя userID: он организатор события
+// или был его участником до или после изменения
+func (c *Change) concerns(userID string) bool {
+	if c.Event.UserID == userID {
+		return true
+	}
+	if _, ok := c.Event.attendee(userID); ok {
+		return true
+	}
+	if c.Before != nil {
+		_, ok := c.Before.attendee(userID)
+		return ok
+	}
+	return false
+}
+
+// eventRef ссылка на событие в календаре организатора
+type eventRef struct {
+	userID string
+	id     string
+}
+
+// invitations индекс приглашений: участник -> события, в которые он приглашен.
+// Обновляется под блокировкой шарда организатора, поэтому при чтении индекса нельзя блокировать шарды
+type invitations struct {
+	mu   sync.RWMutex
+	refs map[string]map[eventRef]struct{}
+}
+
+// update переносит в индекс изменение события с before на c.Event
+func (inv *invitations) update(c Change, before *Event) {
+	if (before == nil || len(before.Attendees) == 0) && len(c.Event.Attendees) == 0 {
+		return
+	}
+	ref := eventRef{userID: c.Event.UserID, id: c.Event.ID}
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if before != nil {
+		for _, a := range before.Attendees {
+			delete(inv.refs[a.UserID], ref)
+			if len(inv.refs[a.UserID]) == 0 {
+				delete(inv.refs, a.UserID)
+			}
+		}
+	}
+	if c.Status == Deleted {
+		return
+	}
+	if inv.refs == nil {
+		inv.refs = make(map[string]map[eventRef]struct{})
+	}
+	for _, a := range c.Event.Attendees {
+		if inv.refs[a.UserID] == nil {
+			inv.refs[a.UserID] = make(map[eventRef]struct{})
+		}
+		inv.refs[a.UserID][ref] = struct{}{}
+	}
+}
+
+// list возвращает события, в которые приглашен пользователь userID
+func (inv *invitations) list(userID string) []eventRef {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	res := make([]eventRef, 0, len(inv.refs[userID]))
+	for ref := range inv.refs[userID] {
+		res = append(res, ref)
+	}
+	return res
+}
+
+// invitedEvents возвращает события других пользователей, в которые приглашен userID и от которых он не отказался
+func (s *MemoryStorage) invitedEvents(userID string) []Event {
+	var res []Event
+	for _, ref := range s.invitations.list(userID) {
+		sh := s.shard(ref.userID)
+		sh.mu.RLock()
+		event, err := sh.get(ref.userID, ref.id)
+		sh.mu.RUnlock()
+		if err != nil {
+			// Событие удалено после чтения индекса
+			continue
+		}
+		if status, ok := event.attendee(userID); ok && status != AttendeeDeclined {
+			res = append(res, event)
+		}
+	}
+	return res
+}
+
+// Respond записывает ответ status участника attendeeID на приглашение в событие id организатора organizerID.
+// Для серии ответ относится ко всем повторениям. Возвращает событие с новой версией
+func (s *MemoryStorage) Respond(organizerID, id, attendeeID string, status AttendeeStatus, opts ...WriteOption) (*Event, error) {
+	if organizerID == "" || id == "" || attendeeID == "" {
+		return nil, &ValidationError{Message: "empty parameters"}
+	}
+	if _, err := parseAttendeeStatus(string(status)); err != nil {
+		return nil, &ValidationError{Message: err.Error()}
+	}
+	sh := s.shard(organizerID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	event, err := sh.get(organizerID, id)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := event.attendee(attendeeID); !ok {
+		return nil, &ValidationError{Message: "User is not invited to the event", NotFound: true}
+	}
+	o := newWriteOptions(opts)
+	if err := o.checkVersion(event.Version); err != nil {
+		return nil, err
+	}
+	attendees := make([]Attendee, len(event.Attendees))
+	for i, a := range event.Attendees {
+		if a.UserID == attendeeID {
+			a.Status = status
+		}
+		attendees[i] = a
+	}
+	event.Attendees = attendees
+	event.Version++
+	if err := s.commit(sh, o, Change{Status: Updated, Event: event}); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// rsvpEvent записывает ответ участника user_id на приглашение в событие id организатора organizer_id:
+// status - accepted, declined или tentative
+func rsvpEvent(w http.ResponseWriter, r *http.Request, storage Storage) {
+	if !validatePostRequest(w, r) {
+		return
+	}
+	status, err := parseAttendeeStatus(r.PostForm.Get("status"))
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	userID := r.PostForm.Get("user_id")
+	writeOpts, err := ParseExpectedVersion(r, r.PostForm)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeOpts = append(writeOpts, requestActor(r, userID))
+	event, err := storage.Respond(r.PostForm.Get("organizer_id"), r.PostForm.Get("id"), userID, status, writeOpts...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("ETag", eventETag(event.Version))
+	marshalResponseAndWrite(w, http.StatusOK, Response{Result: PostResult{
+		ID:      event.ID,
+		Status:  Updated,
+		Version: event.Version,
+	}})
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// attendeeIDs возвращает идентификаторы событий, которые видит пользователь userID в день date
+func attendeeIDs(t *testing.T, s Storage, userID string, date time.Time) []string {
+	events, err := s.GetEventsPerDay(userID, date)
+	if err != nil {
+		return nil
+	}
+	var ids []string
+	for _, e := range events {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func TestAttendees(t *testing.T) {
+	s := NewMemoryStorage()
+	start := mustTime(t, "2024-03-04T10:00:00Z")
+
+	_, err := s.Create(&Event{UserID: "34", Name: "meeting", Start: start, End: start.Add(time.Hour), Attendees: ParseAttendees("35,34")})
+	assert.EqualError(t, err, "organizer cannot be an attendee")
+
+	event, err := s.Create(&Event{UserID: "34", Name: "meeting", Start: start, End: start.Add(time.Hour), Attendees: ParseAttendees("35, 36,35")})
+	require.NoError(t, err)
+	assert.Equal(t, []Attendee{{"35", AttendeeNeedsAction}, {"36", AttendeeNeedsAction}}, event.Attendees)
+	id := event.ID
+	for _, userID := range []string{"34", "35", "36"} {
+		assert.Equal(t, []string{id}, attendeeIDs(t, s, userID, start), userID)
+	}
+	_, err = s.GetEventsPerDay("37", start)
+	assert.Error(t, err)
+
+	// Ответить может только приглашенный пользователь
+	responded, err := s.Respond("34", id, "35", AttendeeAccepted, IfVersion(1), AsActor("35"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), responded.Version)
+	_, err = s.Respond("34", id, "37", AttendeeAccepted)
+	var validationErr *ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.True(t, validationErr.NotFound)
+	_, err = s.Respond("34", id, "35", AttendeeNeedsAction)
+	assert.Error(t, err)
+	_, err = s.Respond("34", id, "36", AttendeeDeclined)
+	require.NoError(t, err)
+	assert.Empty(t, attendeeIDs(t, s, "36", start))
+
+	// Организатор меняет участников, ответы оставшихся сохраняются
+	updated, err := s.Update(&Event{UserID: "34", ID: id, Name: "moved", Start: start.Add(time.Hour), End: start.Add(2 * time.Hour), Attendees: []Attendee{{"35", AttendeeDeclined}, {"37", AttendeeAccepted}}})
+	require.NoError(t, err)
+	assert.Equal(t, []Attendee{{"35", AttendeeAccepted}, {"37", AttendeeNeedsAction}}, updated.Attendees)
+	events, err := s.GetEventsPerDay("35", start)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "moved", events[0].Name)
+	assert.Equal(t, []string{id}, attendeeIDs(t, s, "37", start))
+	_, err = s.Respond("34", id, "36", AttendeeAccepted)
+	assert.Error(t, err)
+
+	// Удаление события убирает его из календарей участников
+	_, err = s.Delete(&Event{UserID: "34", ID: id})
+	require.NoError(t, err)
+	for _, userID := range []string{"35", "37"} {
+		assert.Empty(t, attendeeIDs(t, s, userID, start), userID)
+	}
+}
+
+func TestRecurringAttendees(t *testing.T) {
+	s := NewMemoryStorage()
+	start := mustTime(t, "2024-03-04T10:00:00Z")
+	series, err := s.Create(&Event{UserID: "34", Name: "standup", Start: start, End: start.Add(time.Hour), RRule: "FREQ=DAILY;COUNT=5", Attendees: ParseAttendees("35,36")})
+	require.NoError(t, err)
+	_, err = s.Respond("34", series.ID, "35", AttendeeTentative)
+	require.NoError(t, err)
+
+	day := start.AddDate(0, 0, 1)
+	override, err := s.UpdateOccurrence(&Event{UserID: "34", ID: series.ID, Name: "moved", Start: day.Add(time.Hour), End: day.Add(2 * time.Hour)}, day, ScopeThis)
+	require.NoError(t, err)
+	assert.Equal(t, []Attendee{{"35", AttendeeTentative}, {"36", AttendeeNeedsAction}}, override.Attendees)
+	events, err := s.GetEventsPerDay("35", day)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "moved", events[0].Name)
+	assert.Equal(t, override.Attendees, events[0].Attendees)
+
+	// Новая серия сохраняет ответы оставшихся участников
+	split := start.AddDate(0, 0, 3)
+	following, err := s.UpdateOccurrence(&Event{UserID: "34", ID: series.ID, Name: "planning", Start: split, End: split.Add(time.Hour), Attendees: ParseAttendees("35")}, split, ScopeFollowing)
+	require.NoError(t, err)
+	assert.Equal(t, []Attendee{{"35", AttendeeTentative}}, following.Attendees)
+	assert.Equal(t, []string{following.ID}, attendeeIDs(t, s, "35", split))
+	assert.Empty(t, attendeeIDs(t, s, "36", split))
+	assert.Equal(t, []string{series.ID}, attendeeIDs(t, s, "36", start))
+
+	// С KeepAttendees новая серия продолжается с участниками старой
+	split = start.AddDate(0, 0, 4)
+	following, err = s.UpdateOccurrence(&Event{UserID: "34", ID: following.ID, Name: "retro", Start: split, End: split.Add(time.Hour)}, split, ScopeFollowing, KeepAttendees())
+	require.NoError(t, err)
+	assert.Equal(t, []Attendee{{"35", AttendeeTentative}}, following.Attendees)
+}
+
+func TestAttendeesPersistence(t *testing.T) {
+	dir := t.TempDir()
+	start := mustTime(t, "2024-03-04T10:00:00Z")
+	s, err := NewFileStorage(dir, 2)
+	require.NoError(t, err)
+	first, err := s.Create(&Event{UserID: "34", Name: "first", Start: start, End: start.Add(time.Hour), Attendees: ParseAttendees("35")})
+	require.NoError(t, err)
+	_, err = s.Respond("34", first.ID, "35", AttendeeAccepted)
+	require.NoError(t, err)
+	// Второе событие попадает в журнал после снимка
+	second, err := s.Create(&Event{UserID: "36", Name: "second", Start: start, End: start.Add(time.Hour), Attendees: ParseAttendees("35")})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	restored, err := NewFileStorage(dir, 2)
+	require.NoError(t, err)
+	defer restored.Close()
+	assert.ElementsMatch(t, []string{first.ID, second.ID}, attendeeIDs(t, restored, "35", start))
+	stored, err := restored.Get("34", first.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []Attendee{{"35", AttendeeAccepted}}, stored.Attendees)
+}
+
+func TestChangeConcerns(t *testing.T) {
+	before := Event{UserID: "34", ID: "1", Attendees: ParseAttendees("35")}
+	change := Change{Status: Updated, Event: Event{UserID: "34", ID: "1", Attendees: ParseAttendees("36")}, Before: &before}
+	tests := []struct {
+		userID string
+		want   bool
+	}{
+		{"34", true},
+		// Удаленный участник узнает, что его больше нет в событии
+		{"35", true},
+		{"36", true},
+		{"37", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, change.concerns(tt.userID), tt.userID)
+	}
+}
+
+func TestRSVPHandler(t *testing.T) {
+	handler := getHandler()
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	id, err := createEventAndGetID(ts, handler, "user_id=34&start=2024-03-04T10:00:00Z&duration=1h&name=meeting&attendees=35,36")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		etag   string
+	}{
+		{"accept", "user_id=35&organizer_id=34&id=" + id + "&status=accepted", http.StatusOK, `"2"`},
+		{"decline with version", "user_id=36&organizer_id=34&id=" + id + "&status=declined&version=2", http.StatusOK, `"3"`},
+		{"stale version", "user_id=36&organizer_id=34&id=" + id + "&status=accepted&version=2", http.StatusConflict, `"3"`},
+		{"not invited", "user_id=37&organizer_id=34&id=" + id + "&status=accepted", http.StatusBadRequest, ""},
+		{"wrong status", "user_id=35&organizer_id=34&id=" + id + "&status=maybe", http.StatusBadRequest, ""},
+		{"unknown event", "user_id=35&organizer_id=34&id=missing&status=accepted", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := makePostRequest(ts, handler, "/rsvp_event/", tt.body)
+			require.Equal(t, tt.status, resp.Code, resp.Body.String())
+			assert.Equal(t, tt.etag, resp.Header().Get("ETag"))
+		})
+	}
+
+	// Участник видит событие в своем календаре, организатор - ответы участников
+	attendees := []Attendee{{"35", AttendeeAccepted}, {"36", AttendeeDeclined}}
+	for _, path := range []string{"/events_for_day/?user_id=35&date=2024-03-04", "/users/34/events?from=2024-03-04&to=2024-03-05"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code, path)
+		var res struct {
+			Result []EventResult `json:"result"`
+		}
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &res))
+		require.Len(t, res.Result, 1, path)
+		assert.Equal(t, id, res.Result[0].ID)
+		assert.Equal(t, "34", res.Result[0].Organizer)
+		assert.Equal(t, attendees, res.Result[0].Attendees)
+	}
+
+	// PATCH без attendees не меняет участников
+	req := httptest.NewRequest(http.MethodPatch, "/users/34/events/"+id, strings.NewReader(`{"name":"renamed"}`))
+	req.Header.Set("content-type", "application/json")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	req = httptest.NewRequest(http.MethodPatch, "/users/34/events/"+id, strings.NewReader(`{"attendees":["35","37"]}`))
+	req.Header.Set("content-type", "application/json")
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/users/34/events/"+id, nil)
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	var res struct {
+		Result EventResult `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &res))
+	assert.Equal(t, "renamed", res.Result.Name)
+	assert.Equal(t, []Attendee{{"35", AttendeeAccepted}, {"37", AttendeeNeedsAction}}, res.Result.Attendees)
+}
+
+func TestUpdateKeepsAttendees(t *testing.T) {
+	handler := getHandler()
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	id, err := createEventAndGetID(ts, handler, "user_id=34&start=2024-03-04T10:00:00Z&duration=1h&name=meeting&attendees=35,36")
+	require.NoError(t, err)
+	resp := makePostRequest(ts, handler, "/rsvp_event/", "user_id=35&organizer_id=34&id="+id+"&status=accepted")
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		body      string
+		attendees []Attendee
+	}{
+		{"update without attendees", http.MethodPost, "/update_event/", "user_id=34&id=" + id + "&start=2024-03-04T11:00:00Z&duration=1h&name=moved",
+			[]Attendee{{"35", AttendeeAccepted}, {"36", AttendeeNeedsAction}}},
+		{"put without attendees", http.MethodPut, "/users/34/events/" + id, `{"name":"moved","start":"2024-03-04T12:00:00Z","duration":"1h"}`,
+			[]Attendee{{"35", AttendeeAccepted}, {"36", AttendeeNeedsAction}}},
+		{"update with attendees", http.MethodPost, "/update_event/", "user_id=34&id=" + id + "&start=2024-03-04T11:00:00Z&duration=1h&name=moved&attendees=35",
+			[]Attendee{{"35", AttendeeAccepted}}},
+		{"update with empty attendees", http.MethodPost, "/update_event/", "user_id=34&id=" + id + "&start=2024-03-04T11:00:00Z&duration=1h&name=moved&attendees=",
+			nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.method == http.MethodPost {
+				resp = makePostRequest(ts, handler, tt.path, tt.body)
+			} else {
+				resp = makeJSONRequest(handler, tt.method, tt.path, tt.body)
+			}
+			require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+
+			req := httptest.NewRequest(http.MethodGet, "/users/34/events/"+id, nil)
+			resp = httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+			var res struct {
+				Result EventResult `json:"result"`
+			}
+			require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &res))
+			assert.Equal(t, tt.attendees, res.Result.Attendees)
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Role роль пользователя в токене или API ключе
+type Role string
+
+const (
+	// RoleUser может работать только со своим календарем
+	RoleUser Role = "user"
+	// RoleAdmin может работать с календарями всех пользователей
+	RoleAdmin Role = "admin"
+)
+
+// AuthConfig описывает способы аутентификации клиентов. Если в Config его нет, аутентификация выключена
+type AuthConfig struct {
+	// HMACSecret ключ подписи токенов, пустой - токены не принимаются
+	HMACSecret string `json:"hmac_secret"`
+	// APIKeys статические ключи клиентов
+	APIKeys []APIKey `json:"api_keys"`
+}
+
+// APIKey статический ключ доступа, привязанный к пользователю
+type APIKey struct {
+	Key    string `json:"key"`
+	UserID string `json:"user_id"`
+	Role   Role   `json:"role"`
+}
+
+// Principal аутентифицированный клиент. В подписанном токене хранится в виде JSON
+type Principal struct {
+	UserID string `json:"sub"`
+	Role   Role   `json:"role,omitempty"`
+	// ExpiresAt время истечения токена в секундах Unix, 0 - без срока действия
+	ExpiresAt int64 `json:"exp,omitempty"`
+}
+
+// IsAdmin проверяет, есть ли у клиента доступ ко всем календарям
+func (p *Principal) IsAdmin() bool {
+	return p.Role == RoleAdmin
+}
+
+type principalKey struct{}
+
+// PrincipalFromContext возвращает клиента, аутентифицированного authHandler, или nil
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// SignToken возвращает токен вида base64url(JSON клиента).base64url(HMAC-SHA256)
+func SignToken(secret string, p Principal) (string, error) {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(tokenSignature(secret, encoded)), nil
+}
+
+func tokenSignature(secret, payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// authenticate проверяет API ключ или подписанный токен и возвращает клиента
+func (a *AuthConfig) authenticate(token string, now time.Time) (*Principal, error) {
+	for _, key := range a.APIKeys {
+		if key.Key != "" && subtle.ConstantTimeCompare([]byte(key.Key), []byte(token)) == 1 {
+			return &Principal{UserID: key.UserID, Role: key.Role}, nil
+		}
+	}
+	if a.HMACSecret == "" {
+		return nil, fmt.Errorf("invalid token")
+	}
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, fmt.Errorf("invalid token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, tokenSignature(a.HMACSecret, payload)) {
+		return nil, fmt.Errorf("invalid token")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+	var p Principal
+	if err := json.Unmarshal(data, &p); err != nil || p.UserID == "" {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if p.ExpiresAt != 0 && now.Unix() >= p.ExpiresAt {
+		return nil, fmt.Errorf("token expired")
+	}
+	if p.Role == "" {
+		p.Role = RoleUser
+	}
+	return &p, nil
+}
+
+// authHandler проверяет токен из заголовка Authorization: Bearer и определяет по нему пользователя.
+// Если в запросе не передан user_id, он подставляется из токена. Запрос к чужому календарю
+// (user_id в query, форме или пути /users/{user_id}/) разрешен только администратору, иначе 403.
+// Исключение - /free_busy, который возвращает только занятые интервалы. Администратору в /audit_log
+// user_id не подставляется, чтобы без него журнал возвращал изменения всех пользователей
+func authHandler(auth *AuthConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeErrorMessage(w, http.StatusUnauthorized, "Authorization required")
+			return
+		}
+		principal, err := auth.authenticate(token, time.Now())
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeErrorMessage(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		// Разбираем форму здесь, чтобы проверить user_id из тела. Обработчики повторно ее не читают
+		if err := parseForm(w, r); err != nil {
+			writeErrorMessage(w, http.StatusBadRequest, "Failed to parse form")
+			return
+		}
+
+		requested := append([]string(nil), r.Form["user_id"]...)
+		if userID, _, ok := parseRESTPath(r.URL); ok {
+			requested = append(requested, userID)
+		}
+		// Занятость других пользователей доступна всем: /free_busy не раскрывает содержимое событий
+		crossUser := principal.IsAdmin() || strings.HasPrefix(r.URL.Path, "/free_busy")
+		for _, userID := range requested {
+			if userID != principal.UserID && !crossUser {
+				writeErrorMessage(w, http.StatusForbidden, "Access to calendar of another user is forbidden")
+				return
+			}
+		}
+		if len(requested) == 0 && !(principal.IsAdmin() && strings.HasPrefix(r.URL.Path, "/audit_log")) {
+			setUserID(r, principal.UserID)
+		}
+		setLogUser(r.Context(), principal.UserID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
+
+// parseForm разбирает форму запроса в формате multipart/form-data или application/x-www-form-urlencoded,
+// ограничивая размер тела maxRequestBody. Повторный разбор уже разобранной формы ничего не делает
+func parseForm(w http.ResponseWriter, r *http.Request) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBody)
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("content-type")); mediaType == "multipart/form-data" {
+		return r.ParseMultipartForm(maxMultipartMemory)
+	}
+	return r.ParseForm()
+}
+
+// setUserID подставляет user_id в query и уже разобранную форму запроса
+func setUserID(r *http.Request, userID string) {
+	query := r.URL.Query()
+	query.Set("user_id", userID)
+	r.URL.RawQuery = query.Encode()
+	r.Form.Set("user_id", userID)
+	r.PostForm.Set("user_id", userID)
+	if r.MultipartForm != nil {
+		r.MultipartForm.Value["user_id"] = []string{userID}
+	}
+}
+
+const (
+	// maxRequestBody ограничение размера тела запроса при проверке доступа
+	maxRequestBody = importMaxSize
+	// maxMultipartMemory сколько multipart формы держать в памяти, остальное пишется во временные файлы
+	maxMultipartMemory = 32 << 20
+)
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "test-secret"
+
+func newAuthHandler(t *testing.T) http.Handler {
+	cfg := &Config{Auth: &AuthConfig{
+		HMACSecret: testSecret,
+		APIKeys: []APIKey{
+			{Key: "key-34", UserID: "34", Role: RoleUser},
+			{Key: "key-admin", UserID: "root", Role: RoleAdmin},
+		},
+	}}
+	return newHandler(cfg, NewMemoryStorage(), Services{})
+}
+
+func signTestToken(t *testing.T, p Principal) string {
+	token, err := SignToken(testSecret, p)
+	require.NoError(t, err)
+	return token
+}
+
+func makeAuthRequest(handler http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestAuthentication(t *testing.T) {
+	handler := newAuthHandler(t)
+	resp := makeAuthRequest(handler, http.MethodPost, "/create_event/", "key-34", "user_id=34&date=2024-03-04&name=mine")
+	require.Equal(t, http.StatusOK, resp.Code)
+	expired := signTestToken(t, Principal{UserID: "34", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	forged, err := SignToken("other-secret", Principal{UserID: "34"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"unknown api key", "key-35", http.StatusUnauthorized},
+		{"wrong signature", forged, http.StatusUnauthorized},
+		{"expired token", expired, http.StatusUnauthorized},
+		{"api key", "key-34", http.StatusOK},
+		{"signed token", signTestToken(t, Principal{UserID: "34", ExpiresAt: time.Now().Add(time.Hour).Unix()}), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := makeAuthRequest(handler, http.MethodGet, "/events_for_day/?user_id=34&date=2024-03-04", tt.token, "")
+			assert.Equal(t, tt.status, resp.Code)
+			if tt.status == http.StatusUnauthorized {
+				assert.Contains(t, resp.Header().Get("WWW-Authenticate"), "Bearer")
+				assert.Contains(t, resp.Body.String(), `"error"`)
+			}
+		})
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	handler := newAuthHandler(t)
+	userToken := signTestToken(t, Principal{UserID: "34"})
+	adminToken := signTestToken(t, Principal{UserID: "root", Role: RoleAdmin})
+
+	resp := makeAuthRequest(handler, http.MethodPost, "/create_event/", userToken, "user_id=34&date=2024-03-04&name=mine")
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		status int
+	}{
+		{"other user in query", http.MethodGet, "/events_for_day/?user_id=35&date=2024-03-04", userToken, "", http.StatusForbidden},
+		{"other user in form", http.MethodPost, "/create_event/", userToken, "user_id=35&date=2024-03-04&name=a", http.StatusForbidden},
+		{"other user in form and own in query", http.MethodPost, "/create_event/?user_id=34", userToken, "user_id=35&date=2024-03-04&name=a", http.StatusForbidden},
+		{"other user in rest path", http.MethodGet, "/users/35/events", userToken, "", http.StatusForbidden},
+		{"other user by api key", http.MethodGet, "/events_for_day/?user_id=35&date=2024-03-04", "key-34", "", http.StatusForbidden},
+		{"own user in rest path", http.MethodGet, "/users/34/events", userToken, "", http.StatusOK},
+		{"admin reads other user", http.MethodGet, "/events_for_day/?user_id=34&date=2024-03-04", adminToken, "", http.StatusOK},
+		{"admin creates for other user", http.MethodPost, "/create_event/", "key-admin", "user_id=35&date=2024-03-04&name=a", http.StatusOK},
+		{"admin uses rest path", http.MethodGet, "/users/34/events", adminToken, "", http.StatusOK},
+		{"free busy of other user", http.MethodGet, "/free_busy/?user_id=34&user_id=35", userToken, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := makeAuthRequest(handler, tt.method, tt.path, tt.token, tt.body)
+			assert.Equal(t, tt.status, resp.Code, resp.Body.String())
+		})
+	}
+}
+
+func TestAuthInjectsUser(t *testing.T) {
+	handler := newAuthHandler(t)
+	token := signTestToken(t, Principal{UserID: "34"})
+
+	// user_id берется из токена, если его нет в запросе
+	resp := makeAuthRequest(handler, http.MethodPost, "/create_event/", token, "date=2024-03-04&name=meeting")
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+
+	resp = makeAuthRequest(handler, http.MethodGet, "/events_for_day/?date=2024-03-04", token, "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var events struct {
+		Result []EventResult `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &events))
+	require.Len(t, events.Result, 1)
+	assert.Equal(t, "meeting", events.Result[0].Name)
+
+	// Событие создано в календаре пользователя из токена
+	resp = makeAuthRequest(handler, http.MethodGet, "/events_for_day/?user_id=34&date=2024-03-04", "key-admin", "")
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &events))
+	assert.Len(t, events.Result, 1)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// batchMaxOperations максимальное количество операций в одном пакете
+const batchMaxOperations = 1000
+
+// BatchAction вид операции пакета, совпадает с путем соответствующего запроса
+type BatchAction string
+
+const (
+	// BatchCreate создает событие, как /create_event
+	BatchCreate BatchAction = "create_event"
+	// BatchUpdate изменяет событие или его повторения, как /update_event
+	BatchUpdate BatchAction = "update_event"
+	// BatchDelete удаляет событие или его повторения, как /delete_event
+	BatchDelete BatchAction = "delete_event"
+)
+
+// BatchOperation одна операция пакета. Для изменения и удаления повторений серии задается Occurrence
+type BatchOperation struct {
+	Action     BatchAction
+	Event      *Event
+	Occurrence time.Time
+	Scope      RecurrenceScope
+	Options    []WriteOption
+}
+
+// BatchError ошибка операции пакета с номером Index (с нуля). Ни одна операция пакета при этом не применена
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("operation %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// Batch применяет операции по порядку в одной транзакции: либо все, либо ни одной.
+// Каждая следующая операция видит результат предыдущих, например может изменить созданное в пакете событие.
+// Изменения пакета пишутся в журнал одной записью. Возвращает события, как их вернули бы отдельные операции.
+// При ошибке операции возвращается *BatchError
+func (s *MemoryStorage) Batch(ops []BatchOperation) ([]Event, error) {
+	if len(ops) == 0 {
+		return nil, &ValidationError{Message: "empty parameters"}
+	}
+	users := make(map[string]bool)
+	rejectConflicts := false
+	for i, op := range ops {
+		if op.Event == nil {
+			return nil, &BatchError{Index: i, Err: &ValidationError{Message: "empty parameters"}}
+		}
+		users[op.Event.UserID] = true
+		if newWriteOptions(op.Options).rejectConflicts {
+			rejectConflicts = true
+		}
+	}
+	// Шарды блокируются в порядке возрастания индекса, как в lockAll. Проверка пересечений читает
+	// календари других пользователей, поэтому с ней остальные шарды блокируются на чтение, как в lockWrite
+	seen := make(map[int]bool)
+	for userID := range users {
+		seen[shardIndex(userID)] = true
+	}
+	for i, sh := range s.shards {
+		switch {
+		case seen[i]:
+			sh.mu.Lock()
+			defer sh.mu.Unlock()
+		case rejectConflicts:
+			sh.mu.RLock()
+			defer sh.mu.RUnlock()
+		}
+	}
+
+	tx := s.begin(users)
+	res := make([]Event, len(ops))
+	for i, op := range ops {
+		event, err := tx.do(op)
+		if err != nil {
+			return nil, &BatchError{Index: i, Err: err}
+		}
+		res[i] = *event
+	}
+	if err := s.write(tx.changes); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// batchTx черновик транзакции: копия календарей пользователей пакета, к которой применяются операции,
+// и накопленные изменения. Хранилище s до фиксации не меняется
+type batchTx struct {
+	*MemoryStorage
+	changes []Change
+}
+
+// begin копирует календари пользователей users в черновик транзакции. Вызывается с заблокированными шардами users
+func (s *MemoryStorage) begin(users map[string]bool) *batchTx {
+	tx := &batchTx{MemoryStorage: NewMemoryStorage()}
+	tx.base = s
+	tx.drafted = users
+	tx.journal = func(changes []Change) error {
+		tx.changes = append(tx.changes, changes...)
+		return nil
+	}
+	for userID := range users {
+		calendar, ok := s.shard(userID).events[userID]
+		if !ok {
+			continue
+		}
+		copied := make(UserCalendar, len(calendar))
+		for id, event := range calendar {
+			copied[id] = event
+		}
+		tx.shard(userID).events[userID] = copied
+	}
+	return tx
+}
+
+// do применяет операцию к черновику
+func (tx *batchTx) do(op BatchOperation) (*Event, error) {
+	switch op.Action {
+	case BatchCreate:
+		return tx.Create(op.Event, op.Options...)
+	case BatchUpdate:
+		if op.Occurrence.IsZero() {
+			return tx.Update(op.Event, op.Options...)
+		}
+		return tx.UpdateOccurrence(op.Event, op.Occurrence, op.Scope, op.Options...)
+	case BatchDelete:
+		if op.Occurrence.IsZero() {
+			return tx.Delete(op.Event, op.Options...)
+		}
+		return tx.DeleteOccurrence(op.Event, op.Occurrence, op.Scope, op.Options...)
+	default:
+		return nil, &ValidationError{Message: fmt.Sprintf("unknown operation %q", op.Action)}
+	}
+}
+
+// BatchRequestOperation операция в теле запроса /batch. Params - те же параметры, что в форме
+// запроса Op, например {"op": "create_event", "params": {"user_id": "34", "date": "2024-03-04", "name": "action"}}
+type BatchRequestOperation struct {
+	Op     BatchAction       `json:"op"`
+	Params map[string]string `json:"params"`
+}
+
+// batchOperations описания запросов, параметры которых принимают операции пакета
+var batchOperations = map[BatchAction]*apiOperation{
+	BatchCreate: createEventOperation,
+	BatchUpdate: updateEventOperation,
+	BatchDelete: deleteEventOperation,
+}
+
+// ParseBatchOperation разбирает операцию пакета так же, как соответствующий запрос разбирает форму.
+// Параметры проверяются по описанию соответствующего запроса, нарушения возвращаются в *ParamsError.
+// Ожидаемая версия события задается только параметром version, заголовок If-Match к операциям не относится
+func ParseBatchOperation(r *http.Request, op BatchRequestOperation) (*BatchOperation, error) {
+	v := make(url.Values, len(op.Params))
+	for key, value := range op.Params {
+		v.Set(key, value)
+	}
+	if apiOp := batchOperations[op.Op]; apiOp != nil {
+		if violations := apiOp.validate(v); len(violations) > 0 {
+			return nil, &ParamsError{Violations: violations}
+		}
+	}
+	event, err := ParseEvent(v)
+	if err != nil {
+		return nil, err
+	}
+	res := &BatchOperation{Action: op.Op, Event: event}
+	switch op.Op {
+	case BatchCreate:
+		res.Options, err = ParseWriteOptions(v)
+		if err != nil {
+			return nil, err
+		}
+	case BatchUpdate, BatchDelete:
+		res.Occurrence, res.Scope, err = ParseOccurrence(v)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == BatchUpdate {
+			res.Options, err = ParseWriteOptions(v)
+			if err != nil {
+				return nil, err
+			}
+			if !res.Occurrence.IsZero() && len(res.Options) > 0 {
+				return nil, fmt.Errorf("reject_conflicts is not supported for occurrence")
+			}
+		}
+		versionOpts, err := parseVersion(v)
+		if err != nil {
+			return nil, err
+		}
+		res.Options = append(res.Options, versionOpts...)
+		if op.Op == BatchUpdate {
+			res.Options = append(res.Options, parseKeepAttendees(v)...)
+		}
+	default:
+		return nil, fmt.Errorf("op must be create_event, update_event or delete_event")
+	}
+	res.Options = append(res.Options, requestActor(r, event.UserID))
+	return res, nil
+}
+
+// batchStatus статус события после операции для PostResult
+func batchStatus(action BatchAction) Status {
+	switch action {
+	case BatchCreate:
+		return Created
+	case BatchDelete:
+		return Deleted
+	default:
+		return Updated
+	}
+}
+
+// batchEvents применяет JSON массив операций create_event, update_event и delete_event атомарно.
+// Возвращает PostResult каждой операции в том же порядке. Если операция не прошла, ни одна не применяется,
+// а в ответе с ошибкой передается номер операции operation (с нуля)
+func batchEvents(w http.ResponseWriter, r *http.Request, storage Storage) {
+	if r.Method != http.MethodPost {
+		writeErrorMessage(w, http.StatusMethodNotAllowed, "Wrong method")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, importMaxSize)
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	var req []BatchRequestOperation
+	if err := decoder.Decode(&req); err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, "Failed to parse JSON body: "+err.Error())
+		return
+	}
+	if len(req) == 0 || len(req) > batchMaxOperations {
+		writeErrorMessage(w, http.StatusBadRequest, fmt.Sprintf("batch must contain from 1 to %d operations", batchMaxOperations))
+		return
+	}
+
+	principal := PrincipalFromContext(r.Context())
+	// Операции без user_id относятся к пользователю из query, authHandler подставляет туда пользователя токена
+	defaultUserID := r.URL.Query().Get("user_id")
+	ops := make([]BatchOperation, len(req))
+	for i, reqOp := range req {
+		if reqOp.Params["user_id"] == "" && defaultUserID != "" {
+			if reqOp.Params == nil {
+				reqOp.Params = make(map[string]string)
+			}
+			reqOp.Params["user_id"] = defaultUserID
+		}
+		// authHandler не видит user_id в JSON теле, поэтому доступ проверяется здесь по тем же правилам
+		if principal != nil && reqOp.Params["user_id"] != principal.UserID && !principal.IsAdmin() {
+			writeBatchErrorMessage(w, http.StatusForbidden, i, "Access to calendar of another user is forbidden")
+			return
+		}
+		op, err := ParseBatchOperation(r, reqOp)
+		if err != nil {
+			if _, ok := err.(*ParamsError); !ok {
+				err = &ValidationError{Message: err.Error()}
+			}
+			writeError(w, &BatchError{Index: i, Err: err})
+			return
+		}
+		ops[i] = *op
+	}
+
+	events, err := storage.Batch(ops)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	res := make([]PostResult, len(events))
+	for i, event := range events {
+		res[i] = PostResult{ID: event.ID, Status: batchStatus(ops[i].Action), Version: event.Version}
+	}
+	marshalResponseAndWrite(w, http.StatusOK, Response{Result: res})
+}
+
+// writeBatchErrorMessage отвечает ошибкой операции index пакета
+func writeBatchErrorMessage(w http.ResponseWriter, statusCode, index int, message string) {
+	marshalResponseAndWrite(w, statusCode, ErrorResponse{Error: message, Operation: &index})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	s := NewMemoryStorage()
+	start := mustTime(t, "2024-03-04T10:00:00Z")
+	existing, err := s.Create(&Event{UserID: "34", Name: "existing", Start: start, End: start.Add(time.Hour)})
+	require.NoError(t, err)
+	series, err := s.Create(&Event{UserID: "35", Name: "series", Start: start, End: start.Add(time.Hour), RRule: "FREQ=DAILY;COUNT=3"})
+	require.NoError(t, err)
+	var notified [][]Change
+	s.OnChange(func(changes []Change) {
+		notified = append(notified, changes)
+	})
+
+	// Ошибка в любой операции отменяет весь пакет
+	_, err = s.Batch([]BatchOperation{
+		{Action: BatchCreate, Event: &Event{UserID: "34", Name: "new", Start: start.Add(2 * time.Hour), End: start.Add(3 * time.Hour)}},
+		{Action: BatchDelete, Event: &Event{UserID: "34", ID: existing.ID}},
+		{Action: BatchUpdate, Event: &Event{UserID: "35", ID: series.ID, Name: "moved", Start: start, End: start.Add(time.Hour)}, Options: []WriteOption{IfVersion(5)}},
+	})
+	var batchErr *BatchError
+	require.ErrorAs(t, err, &batchErr)
+	assert.Equal(t, 2, batchErr.Index)
+	var versionErr *VersionMismatchError
+	assert.ErrorAs(t, err, &versionErr)
+	assert.Empty(t, notified)
+	events, err := s.GetEventsPerDay("34", start)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, existing.ID, events[0].ID)
+
+	day := start.AddDate(0, 0, 1)
+	created := &Event{UserID: "34", Name: "new", Start: start.Add(2 * time.Hour), End: start.Add(3 * time.Hour)}
+	results, err := s.Batch([]BatchOperation{
+		{Action: BatchCreate, Event: created, Options: []WriteOption{AsActor("34")}},
+		{Action: BatchDelete, Event: &Event{UserID: "34", ID: existing.ID}, Options: []WriteOption{IfVersion(1)}},
+		{Action: BatchUpdate, Event: &Event{UserID: "35", ID: series.ID, Name: "moved", Start: day.Add(time.Hour), End: day.Add(2 * time.Hour)}, Occurrence: day, Scope: ScopeThis},
+		{Action: BatchDelete, Event: &Event{UserID: "35", ID: series.ID}, Occurrence: start, Scope: ScopeThis},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+	assert.Equal(t, created.ID, results[0].ID)
+	assert.Equal(t, int64(1), results[0].Version)
+	assert.Equal(t, int64(2), results[1].Version)
+	// Операции над одной серией видят результат предыдущих
+	assert.Equal(t, int64(2), results[2].Version)
+	assert.Equal(t, int64(3), results[3].Version)
+
+	// Подписчики получают изменения пакета одним вызовом
+	require.Len(t, notified, 1)
+	require.Len(t, notified[0], 4)
+	assert.Equal(t, "34", notified[0][0].Actor)
+	require.NotNil(t, notified[0][3].Before)
+	assert.Equal(t, int64(2), notified[0][3].Before.Version)
+
+	assert.Equal(t, []string{created.ID}, attendeeIDs(t, s, "34", start))
+	events, err = s.GetEventsPerDay("35", start)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+	events, err = s.GetEventsPerDay("35", day)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "moved", events[0].Name)
+	assert.Equal(t, []string{created.ID}, searchIDs(t, s, "34", "new", time.Time{}, time.Time{}))
+
+	_, err = s.Batch(nil)
+	assert.Error(t, err)
+	_, err = s.Batch([]BatchOperation{{Action: "move_event", Event: &Event{UserID: "34"}}})
+	require.ErrorAs(t, err, &batchErr)
+	assert.Equal(t, 0, batchErr.Index)
+}
+
+func TestBatchPersistence(t *testing.T) {
+	dir := t.TempDir()
+	start := mustTime(t, "2024-03-04T10:00:00Z")
+	s, err := NewFileStorage(dir, 100)
+	require.NoError(t, err)
+	results, err := s.Batch([]BatchOperation{
+		{Action: BatchCreate, Event: &Event{UserID: "34", Name: "first", Start: start, End: start.Add(time.Hour)}},
+		{Action: BatchCreate, Event: &Event{UserID: "35", Name: "second", Start: start, End: start.Add(time.Hour)}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// Пакет записан в журнал одной записью
+	data, err := os.ReadFile(filepath.Join(dir, walFileName))
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(data), "\n"))
+
+	restored, err := NewFileStorage(dir, 100)
+	require.NoError(t, err)
+	defer restored.Close()
+	assert.Equal(t, []string{results[0].ID}, attendeeIDs(t, restored, "34", start))
+	assert.Equal(t, []string{results[1].ID}, attendeeIDs(t, restored, "35", start))
+}
+
+func TestBatchHandler(t *testing.T) {
+	handler := getHandler()
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	id, err := createEventAndGetID(ts, handler, "user_id=34&date=2024-03-04&name=existing")
+	require.NoError(t, err)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body))
+		req.Header.Set("content-type", "application/json")
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		want   string
+	}{
+		{"missing event", `[
+			{"op": "create_event", "params": {"user_id": "34", "date": "2024-03-05", "name": "new"}},
+			{"op": "delete_event", "params": {"user_id": "34", "id": "missing"}}
+		]`, http.StatusBadRequest, `{"error": "Event does not exist", "operation": 1}`},
+		{"stale version", `[
+			{"op": "update_event", "params": {"user_id": "34", "id": "` + id + `", "date": "2024-03-05", "name": "moved", "version": "2"}}
+		]`, http.StatusConflict, `{"error": "Event version is 1, expected 2", "operation": 0}`},
+		{"parse error", `[
+			{"op": "create_event", "params": {"user_id": "34", "date": "2024-03-05", "name": "new"}},
+			{"op": "create_event", "params": {"user_id": "34", "date": "05.03.2024", "name": "new"}}
+		]`, http.StatusBadRequest, `{"error": "Invalid request parameters", "operation": 1, "violations": [{"parameter": "date", "message": "must be a date like 2006-01-02"}]}`},
+		{"unknown parameter", `[
+			{"op": "delete_event", "params": {"user_id": "34", "id": "` + id + `", "name": "new"}}
+		]`, http.StatusBadRequest, `{"error": "Invalid request parameters", "operation": 0, "violations": [{"parameter": "name", "message": "is not allowed"}]}`},
+		{"unknown op", `[{"op": "move_event", "params": {"user_id": "34"}}]`, http.StatusBadRequest, `{"error": "op must be create_event, update_event or delete_event", "operation": 0}`},
+		{"empty", `[]`, http.StatusBadRequest, ""},
+		{"not array", `{"op": "create_event"}`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := post(tt.body)
+			require.Equal(t, tt.status, resp.Code, resp.Body.String())
+			if tt.want != "" {
+				assert.JSONEq(t, tt.want, resp.Body.String())
+			}
+		})
+	}
+	// Неудачные пакеты ничего не изменили
+	req := httptest.NewRequest(http.MethodGet, "/events_for_week/?user_id=34&date=2024-03-04", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	var week struct {
+		Result []EventResult `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &week))
+	require.Len(t, week.Result, 1)
+	assert.Equal(t, "existing", week.Result[0].Name)
+
+	resp = post(`[
+		{"op": "create_event", "params": {"user_id": "35", "date": "2024-03-05", "name": "new"}},
+		{"op": "update_event", "params": {"user_id": "34", "id": "` + id + `", "date": "2024-03-05", "name": "moved", "version": "1"}},
+		{"op": "delete_event", "params": {"user_id": "34", "id": "` + id + `"}}
+	]`)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	var res struct {
+		Result []PostResult `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &res))
+	require.Len(t, res.Result, 3)
+	assert.NotEmpty(t, res.Result[0].ID)
+	assert.Equal(t, []PostResult{
+		{ID: res.Result[0].ID, Status: Created, Version: 1},
+		{ID: id, Status: Updated, Version: 2},
+		{ID: id, Status: Deleted, Version: 3},
+	}, res.Result)
+
+	req = httptest.NewRequest(http.MethodGet, "/batch", nil)
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+}
+
+func TestBatchAuthorization(t *testing.T) {
+	handler := newHandler(&Config{Auth: &AuthConfig{APIKeys: []APIKey{{Key: "key-34", UserID: "34"}}}}, NewMemoryStorage(), Services{})
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"own calendar", `[{"op": "create_event", "params": {"user_id": "34", "date": "2024-03-04", "name": "new"}}]`, http.StatusOK},
+		{"user from token", `[{"op": "create_event", "params": {"date": "2024-03-04", "name": "new"}}]`, http.StatusOK},
+		{"other calendar", `[
+			{"op": "create_event", "params": {"date": "2024-03-04", "name": "new"}},
+			{"op": "create_event", "params": {"user_id": "35", "date": "2024-03-04", "name": "new"}}
+		]`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(tt.body))
+			req.Header.Set("content-type", "application/json")
+			req.Header.Set("Authorization", "Bearer key-34")
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+			assert.Equal(t, tt.status, resp.Code, resp.Body.String())
+		})
+	}
+}
@@ -0,0 +1,439 @@
+// Package client клиент HTTP API календаря dev11. Методы повторяют запросы API,
+// а ответы с ошибкой превращаются в *Error, который можно сравнить с ErrNotFound, ErrConflict и т.д. через errors.Is
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status результат изменения события, как в ответе API
+type Status int
+
+const (
+	// Created событие создано
+	Created Status = iota
+	// Updated событие изменено
+	Updated
+	// Deleted событие удалено
+	Deleted
+)
+
+// PostResult ответ на создание, изменение и удаление события
+type PostResult struct {
+	ID     string `json:"id"`
+	Status Status `json:"status"`
+	// Version версия события после изменения
+	Version int64 `json:"version"`
+}
+
+// Attendee участник события и его ответ на приглашение
+type Attendee struct {
+	UserID string `json:"user_id"`
+	Status string `json:"status"`
+}
+
+// Event событие или повторение серии в ответе API. Время - в часовом поясе события
+type Event struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Date дата начала события в формате 2019-09-09
+	Date     string    `json:"date"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	AllDay   bool      `json:"all_day"`
+	Timezone string    `json:"timezone"`
+	RRule    string    `json:"rrule,omitempty"`
+	// Occurrence исходное начало повторения серии, по нему можно изменить или удалить одно повторение
+	Occurrence string   `json:"occurrence,omitempty"`
+	Reminders  []string `json:"reminders,omitempty"`
+	// Version версия события, для повторения - версия серии
+	Version   int64      `json:"version"`
+	Organizer string     `json:"organizer,omitempty"`
+	Attendees []Attendee `json:"attendees,omitempty"`
+}
+
+// EventInput параметры создаваемого или изменяемого события. Пустые поля не передаются
+type EventInput struct {
+	UserID string
+	// ID задается при изменении события
+	ID          string
+	Name        string
+	Description string
+	// Start и End начало и конец события. Для события на весь день передаются только даты
+	Start time.Time
+	End   time.Time
+	// Duration длительность события, если End не задан
+	Duration time.Duration
+	AllDay   bool
+	// Timezone часовой пояс события из базы IANA, по умолчанию UTC
+	Timezone string
+	// RRule правило повторения в формате RFC 5545, например FREQ=WEEKLY;BYDAY=MO,WE;COUNT=10
+	RRule string
+	// Reminders смещения напоминаний до начала события, например 15m или 1d
+	Reminders []string
+	// Attendees приглашенные пользователи. При изменении nil сохраняет участников, а пустой список удаляет их
+	Attendees []string
+}
+
+// values возвращает параметры формы события
+func (e *EventInput) values() url.Values {
+	v := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+	set("user_id", e.UserID)
+	set("id", e.ID)
+	set("name", e.Name)
+	set("description", e.Description)
+	layout := time.RFC3339
+	if e.AllDay {
+		layout = "2006-01-02"
+		v.Set("all_day", "true")
+	}
+	if !e.Start.IsZero() {
+		v.Set("start", e.Start.Format(layout))
+	}
+	if !e.End.IsZero() {
+		v.Set("end", e.End.Format(layout))
+	} else if e.Duration != 0 {
+		v.Set("duration", e.Duration.String())
+	}
+	set("timezone", e.Timezone)
+	set("rrule", e.RRule)
+	set("reminders", strings.Join(e.Reminders, ","))
+	if e.Attendees != nil {
+		v.Set("attendees", strings.Join(e.Attendees, ","))
+	}
+	return v
+}
+
+// Scope какие повторения серии затрагивает изменение
+type Scope string
+
+const (
+	// ScopeThis только указанное повторение
+	ScopeThis Scope = "this"
+	// ScopeFollowing указанное повторение и следующие
+	ScopeFollowing Scope = "following"
+	// ScopeAll вся серия
+	ScopeAll Scope = "all"
+)
+
+// WriteOption необязательный параметр изменения события
+type WriteOption func(v url.Values)
+
+// IfVersion разрешает изменение, только если текущая версия события равна version, иначе возвращается ErrConflict
+func IfVersion(version int64) WriteOption {
+	return func(v url.Values) {
+		v.Set("version", strconv.FormatInt(version, 10))
+	}
+}
+
+// RejectConflicts запрещает запись события, пересекающегося с событиями организатора или участников.
+// Пересекающиеся события возвращаются в Error.Conflicts
+func RejectConflicts() WriteOption {
+	return func(v url.Values) {
+		v.Set("reject_conflicts", "true")
+	}
+}
+
+// Occurrence применяет изменение или удаление к повторению серии с исходным началом occurrence
+func Occurrence(occurrence time.Time, scope Scope) WriteOption {
+	return func(v url.Values) {
+		v.Set("occurrence", occurrence.Format(time.RFC3339))
+		v.Set("scope", string(scope))
+	}
+}
+
+// Ошибки, с которыми можно сравнить *Error через errors.Is
+var (
+	ErrBadRequest         = errors.New("bad request")
+	ErrUnauthorized       = errors.New("unauthorized")
+	ErrForbidden          = errors.New("forbidden")
+	ErrNotFound           = errors.New("not found")
+	ErrConflict           = errors.New("conflict")
+	ErrPreconditionFailed = errors.New("precondition failed")
+	ErrRateLimited        = errors.New("rate limited")
+	ErrUnavailable        = errors.New("service unavailable")
+)
+
+// statusErrors ошибки, соответствующие кодам ответа
+var statusErrors = map[int]error{
+	http.StatusBadRequest:         ErrBadRequest,
+	http.StatusUnauthorized:       ErrUnauthorized,
+	http.StatusForbidden:          ErrForbidden,
+	http.StatusNotFound:           ErrNotFound,
+	http.StatusConflict:           ErrConflict,
+	http.StatusPreconditionFailed: ErrPreconditionFailed,
+	http.StatusTooManyRequests:    ErrRateLimited,
+	http.StatusServiceUnavailable: ErrUnavailable,
+}
+
+// Error ответ API с ошибкой
+type Error struct {
+	StatusCode int
+	Message    string
+	// Conflicts события, с которыми пересекается записываемое событие при RejectConflicts
+	Conflicts []Event
+	// RetryAfter через сколько можно повторить запрос, если сервер это сообщил
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("calendar API: %d %s", e.StatusCode, e.Message)
+}
+
+// Is сравнивает ошибку с ErrNotFound, ErrConflict и другими ошибками по коду ответа.
+// Ответ 400 на отсутствующие пользователя или событие также считается ErrNotFound
+func (e *Error) Is(target error) bool {
+	if target == ErrNotFound && e.StatusCode == http.StatusBadRequest &&
+		(e.Message == "Event does not exist" || e.Message == "UserID does not exist") {
+		return true
+	}
+	return statusErrors[e.StatusCode] == target
+}
+
+// Client клиент API календаря. Безопасен для конкурентного использования
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	token      string
+	retry      RetryPolicy
+}
+
+// RetryPolicy повтор запросов, которые сервер отклонил, не выполнив: 429 и 503,
+// а для чтения - также при сетевых ошибках. Пауза между попытками удваивается начиная с Backoff,
+// но не меньше Retry-After из ответа
+type RetryPolicy struct {
+	// MaxAttempts количество попыток, включая первую. 0 и 1 - без повторов
+	MaxAttempts int
+	Backoff     time.Duration
+	// MaxBackoff ограничение паузы, 0 - без ограничения
+	MaxBackoff time.Duration
+}
+
+// Option настройка клиента
+type Option func(*Client)
+
+// WithHTTPClient задает HTTP клиент, по умолчанию http.DefaultClient
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithToken передает в запросах токен или API ключ в заголовке Authorization: Bearer
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithRetry задает повтор запросов
+func WithRetry(policy RetryPolicy) Option {
+	return func(c *Client) {
+		c.retry = policy
+	}
+}
+
+// New возвращает клиент сервера с адресом baseURL, например http://localhost:8080
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse base URL: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("base URL must be absolute: %q", baseURL)
+	}
+	c := &Client{baseURL: u, httpClient: http.DefaultClient}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// CreateEvent создает событие
+func (c *Client) CreateEvent(ctx context.Context, event EventInput, opts ...WriteOption) (*PostResult, error) {
+	return c.post(ctx, "/create_event/", event.values(), opts)
+}
+
+// UpdateEvent заменяет событие event.ID целиком. С Occurrence изменяет повторения серии
+func (c *Client) UpdateEvent(ctx context.Context, event EventInput, opts ...WriteOption) (*PostResult, error) {
+	return c.post(ctx, "/update_event/", event.values(), opts)
+}
+
+// DeleteEvent удаляет событие. С Occurrence удаляет повторения серии
+func (c *Client) DeleteEvent(ctx context.Context, userID, id string, opts ...WriteOption) (*PostResult, error) {
+	return c.post(ctx, "/delete_event/", url.Values{"user_id": {userID}, "id": {id}}, opts)
+}
+
+// EventsForDay возвращает события пользователя, пересекающиеся с днем date в часовом поясе date
+func (c *Client) EventsForDay(ctx context.Context, userID string, date time.Time) ([]Event, error) {
+	return c.events(ctx, "/events_for_day/", dateQuery(userID, date))
+}
+
+// EventsForWeek возвращает события пользователя, пересекающиеся с неделей от date в часовом поясе date
+func (c *Client) EventsForWeek(ctx context.Context, userID string, date time.Time) ([]Event, error) {
+	return c.events(ctx, "/events_for_week/", dateQuery(userID, date))
+}
+
+// EventsForMonth возвращает события пользователя, пересекающиеся с месяцем в часовом поясе loc (nil - UTC)
+func (c *Client) EventsForMonth(ctx context.Context, userID string, year int, month time.Month, loc *time.Location) ([]Event, error) {
+	query := url.Values{
+		"user_id": {userID},
+		"year":    {strconv.Itoa(year)},
+		"month":   {strconv.Itoa(int(month))},
+	}
+	setTimezone(query, loc)
+	return c.events(ctx, "/events_for_month/", query)
+}
+
+func dateQuery(userID string, date time.Time) url.Values {
+	query := url.Values{"user_id": {userID}, "date": {date.Format("2006-01-02")}}
+	setTimezone(query, date.Location())
+	return query
+}
+
+// setTimezone передает часовой пояс loc. Сервер не знает локальный пояс клиента, поэтому time.Local
+// передается своим именем из базы IANA, только если оно известно
+func setTimezone(query url.Values, loc *time.Location) {
+	if loc == nil || loc == time.UTC {
+		return
+	}
+	if name := loc.String(); name != "Local" {
+		query.Set("timezone", name)
+	}
+}
+
+func (c *Client) post(ctx context.Context, path string, form url.Values, opts []WriteOption) (*PostResult, error) {
+	for _, opt := range opts {
+		opt(form)
+	}
+	var res PostResult
+	if err := c.do(ctx, http.MethodPost, path, form, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (c *Client) events(ctx context.Context, path string, query url.Values) ([]Event, error) {
+	var res []Event
+	if err := c.do(ctx, http.MethodGet, path, query, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// do выполняет запрос с повторами и декодирует поле result ответа в result.
+// Для GET params передаются в query, иначе - формой в теле
+func (c *Client) do(ctx context.Context, method, path string, params url.Values, result any) error {
+	backoff := c.retry.Backoff
+	for attempt := 1; ; attempt++ {
+		err := c.doOnce(ctx, method, path, params, result)
+		if err == nil || attempt >= c.retry.MaxAttempts || !c.retryable(method, err) {
+			return err
+		}
+		wait := backoff
+		var apiErr *Error
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > wait {
+			wait = apiErr.RetryAfter
+		}
+		if c.retry.MaxBackoff > 0 && wait > c.retry.MaxBackoff {
+			wait = c.retry.MaxBackoff
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// retryable проверяет, можно ли повторить запрос после ошибки err. Запросы на изменение после
+// сетевой ошибки не повторяются: сервер мог их выполнить
+func (c *Client) retryable(method string, err error) bool {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode == http.StatusServiceUnavailable
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return method == http.MethodGet
+}
+
+func (c *Client) doOnce(ctx context.Context, method, path string, params url.Values, result any) error {
+	u := c.baseURL.JoinPath(path)
+	var body io.Reader
+	if method == http.MethodGet {
+		u.RawQuery = params.Encode()
+	} else {
+		body = strings.NewReader(params.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return newError(resp, data)
+	}
+	var res struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	if err := json.Unmarshal(res.Result, result); err != nil {
+		return fmt.Errorf("decode response result: %w", err)
+	}
+	return nil
+}
+
+// newError разбирает ответ с ошибкой вида {"error": "...", "conflicts": [...]}
+func newError(resp *http.Response, data []byte) *Error {
+	var body struct {
+		Error     string  `json:"error"`
+		Conflicts []Event `json:"conflicts"`
+	}
+	res := &Error{StatusCode: resp.StatusCode}
+	if err := json.Unmarshal(data, &body); err == nil && body.Error != "" {
+		res.Message = body.Error
+		res.Conflicts = body.Conflicts
+	} else {
+		res.Message = strings.TrimSpace(string(data))
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		res.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return res
+}
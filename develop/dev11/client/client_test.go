@@ -0,0 +1,106 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestErrorIs(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    *Error
+		target error
+		want   bool
+	}{
+		{"not found", &Error{StatusCode: http.StatusNotFound}, ErrNotFound, true},
+		{"missing event", &Error{StatusCode: http.StatusBadRequest, Message: "Event does not exist"}, ErrNotFound, true},
+		{"bad request", &Error{StatusCode: http.StatusBadRequest, Message: "date parse error"}, ErrNotFound, false},
+		{"conflict", &Error{StatusCode: http.StatusConflict}, ErrConflict, true},
+		{"precondition", &Error{StatusCode: http.StatusPreconditionFailed}, ErrConflict, false},
+		{"rate limited", &Error{StatusCode: http.StatusTooManyRequests}, ErrRateLimited, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, errors.Is(tt.err, tt.target))
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		method   string
+		attempts int32
+		wantErr  error
+	}{
+		{"rate limited read", http.StatusTooManyRequests, http.MethodGet, 3, nil},
+		{"unavailable write", http.StatusServiceUnavailable, http.MethodPost, 3, nil},
+		{"bad request is not retried", http.StatusBadRequest, http.MethodPost, 1, ErrBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, tt.method, r.Method)
+				if calls.Add(1) < 3 {
+					w.WriteHeader(tt.status)
+					w.Write([]byte(`{"error":"try again"}`))
+					return
+				}
+				if r.Method == http.MethodGet {
+					w.Write([]byte(`{"result":[]}`))
+				} else {
+					w.Write([]byte(`{"result":{"id":"1","status":1,"version":2}}`))
+				}
+			}))
+			defer ts.Close()
+			c, err := New(ts.URL, WithRetry(RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}))
+			require.NoError(t, err)
+
+			if tt.method == http.MethodGet {
+				_, err = c.EventsForDay(context.Background(), "34", time.Now())
+			} else {
+				_, err = c.UpdateEvent(context.Background(), EventInput{UserID: "34", ID: "1"})
+			}
+			assert.Equal(t, tt.attempts, calls.Load())
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRetryContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":"Too many requests"}`))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL, WithRetry(RetryPolicy{MaxAttempts: 5, Backoff: time.Millisecond}))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = c.CreateEvent(ctx, EventInput{UserID: "34", Name: "action"})
+	// Клиент ждет Retry-After, пока не отменен контекст
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 10*time.Second)
+}
+
+func TestNew(t *testing.T) {
+	_, err := New("localhost:8080")
+	assert.Error(t, err)
+	_, err = New("http://localhost:8080")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"WBL2/develop/dev11/client"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	ts := httptest.NewServer(getHandler())
+	defer ts.Close()
+	c, err := client.New(ts.URL)
+	require.NoError(t, err)
+	ctx := context.Background()
+	start := mustTime(t, "2024-03-04T10:00:00Z")
+
+	created, err := c.CreateEvent(ctx, client.EventInput{UserID: "34", Name: "meeting", Start: start, Duration: time.Hour, Attendees: []string{"35"}})
+	require.NoError(t, err)
+	assert.Equal(t, client.Created, created.Status)
+	assert.Equal(t, int64(1), created.Version)
+	_, err = c.CreateEvent(ctx, client.EventInput{UserID: "34", Name: "holiday", Start: mustTime(t, "2024-03-08T00:00:00Z"), AllDay: true})
+	require.NoError(t, err)
+
+	events, err := c.EventsForDay(ctx, "35", start)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, created.ID, events[0].ID)
+	assert.Equal(t, "34", events[0].Organizer)
+	assert.True(t, start.Equal(events[0].Start))
+	assert.True(t, start.Add(time.Hour).Equal(events[0].End))
+
+	updated, err := c.UpdateEvent(ctx, client.EventInput{UserID: "34", ID: created.ID, Name: "moved", Start: start.Add(time.Hour), End: start.Add(2 * time.Hour)}, client.IfVersion(1))
+	require.NoError(t, err)
+	assert.Equal(t, client.Updated, updated.Status)
+	assert.Equal(t, int64(2), updated.Version)
+
+	// Устаревшая версия и отсутствующее событие превращаются в типизированные ошибки
+	_, err = c.UpdateEvent(ctx, client.EventInput{UserID: "34", ID: created.ID, Name: "stale", Start: start, Duration: time.Hour}, client.IfVersion(1))
+	assert.ErrorIs(t, err, client.ErrConflict)
+	_, err = c.DeleteEvent(ctx, "34", "missing")
+	assert.ErrorIs(t, err, client.ErrNotFound)
+	_, err = c.CreateEvent(ctx, client.EventInput{UserID: "34", Name: "overlap", Start: start.Add(time.Hour), Duration: time.Hour}, client.RejectConflicts())
+	var apiErr *client.Error
+	require.ErrorAs(t, err, &apiErr)
+	require.Len(t, apiErr.Conflicts, 1)
+	assert.Equal(t, "moved", apiErr.Conflicts[0].Name)
+
+	events, err = c.EventsForWeek(ctx, "34", start)
+	require.NoError(t, err)
+	assert.Len(t, events, 2)
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	require.NoError(t, err)
+	events, err = c.EventsForMonth(ctx, "34", 2024, time.March, moscow)
+	require.NoError(t, err)
+	assert.Len(t, events, 2)
+
+	deleted, err := c.DeleteEvent(ctx, "34", created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, client.Deleted, deleted.Status)
+	_, err = c.EventsForDay(ctx, "35", start)
+	assert.ErrorIs(t, err, client.ErrNotFound)
+}
+
+func TestClientRecurrence(t *testing.T) {
+	ts := httptest.NewServer(getHandler())
+	defer ts.Close()
+	c, err := client.New(ts.URL)
+	require.NoError(t, err)
+	ctx := context.Background()
+	start := mustTime(t, "2024-03-04T10:00:00Z")
+
+	series, err := c.CreateEvent(ctx, client.EventInput{UserID: "34", Name: "standup", Start: start, Duration: 15 * time.Minute, RRule: "FREQ=DAILY;COUNT=3", Reminders: []string{"10m"}})
+	require.NoError(t, err)
+	day := start.AddDate(0, 0, 1)
+	_, err = c.DeleteEvent(ctx, "34", series.ID, client.Occurrence(day, client.ScopeThis))
+	require.NoError(t, err)
+
+	events, err := c.EventsForWeek(ctx, "34", start)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, []string{"10m0s"}, events[0].Reminders)
+	assert.Equal(t, "FREQ=DAILY;COUNT=3", events[0].RRule)
+}
+
+func TestClientAuth(t *testing.T) {
+	ts := httptest.NewServer(newHandler(&Config{Auth: &AuthConfig{APIKeys: []APIKey{{Key: "key-34", UserID: "34"}}}}, NewMemoryStorage(), Services{}))
+	defer ts.Close()
+	ctx := context.Background()
+
+	anonymous, err := client.New(ts.URL)
+	require.NoError(t, err)
+	_, err = anonymous.EventsForDay(ctx, "34", time.Now())
+	assert.ErrorIs(t, err, client.ErrUnauthorized)
+
+	c, err := client.New(ts.URL, client.WithToken("key-34"))
+	require.NoError(t, err)
+	_, err = c.CreateEvent(ctx, client.EventInput{UserID: "34", Name: "meeting", Start: time.Now(), Duration: time.Hour})
+	require.NoError(t, err)
+	_, err = c.EventsForDay(ctx, "35", time.Now())
+	assert.ErrorIs(t, err, client.ErrForbidden)
+}
@@ -0,0 +1,506 @@
+// calctl консольный клиент сервера календаря dev11.
+//
+//	calctl [-c conf.json] [-addr URL] [-token TOKEN] [-json] <command> [flags]
+//
+// Команды: add, edit, rm, day, week, month. Флаги команды выводит calctl <command> -h.
+// Адрес сервера берется из server_address конфига сервера (и переменной CALENDAR_SERVER_ADDRESS), если не задан -addr.
+//
+// Коды выхода: 0 - успех, 1 - другие ошибки API (401, 403, 404, 409 и т.д.), 2 - неверные аргументы,
+// 3 - ошибка входных данных (400), 4 - ошибка бизнес-логики (503), 5 - сервер недоступен
+package main
+
+import (
+	"WBL2/develop/dev11/client"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	exitOK = iota
+	exitAPI
+	exitUsage
+	exitValidation
+	exitBusiness
+	exitTransport
+)
+
+// requestTimeout ограничение времени одного запроса к серверу с повторами
+const requestTimeout = 30 * time.Second
+
+// serverConfig часть конфига сервера, нужная клиенту
+type serverConfig struct {
+	Address string `json:"server_address"`
+	TLS     *struct {
+		CertFile string `json:"cert_file"`
+	} `json:"tls"`
+}
+
+// serverURL возвращает адрес сервера из конфига path. Переменная окружения CALENDAR_SERVER_ADDRESS
+// переопределяет адрес так же, как для сервера
+func serverURL(path string, lookupEnv func(string) (string, bool)) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read config file: %w", err)
+	}
+	var cfg serverConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return "", fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	if value, ok := lookupEnv("CALENDAR_SERVER_ADDRESS"); ok {
+		cfg.Address = value
+	}
+	address := cfg.Address
+	if strings.HasPrefix(address, ":") {
+		// Сервер слушает все интерфейсы
+		address = "localhost" + address
+	}
+	if address == "" {
+		return "", fmt.Errorf("server_address is not set in config file %s", path)
+	}
+	scheme := "http"
+	if cfg.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + address, nil
+}
+
+// app общие настройки команд
+type app struct {
+	client *client.Client
+	json   bool
+	stdout io.Writer
+	now    func() time.Time
+}
+
+// command подкоманда: разбирает свои флаги из args и выполняет запрос
+type command struct {
+	usage string
+	run   func(a *app, ctx context.Context, args []string) error
+}
+
+var commands = map[string]command{
+	"add":   {"create event", addCommand},
+	"edit":  {"replace event or its occurrences", editCommand},
+	"rm":    {"delete event or its occurrences", rmCommand},
+	"day":   {"show agenda for a day", dayCommand},
+	"week":  {"show agenda for a week", weekCommand},
+	"month": {"show agenda for a month", monthCommand},
+}
+
+// errUsage ошибка аргументов, о которой flag уже сообщил
+var errUsage = errors.New("usage")
+
+// argError ошибка в значении аргумента команды
+type argError struct {
+	message string
+}
+
+func (e *argError) Error() string {
+	return e.message
+}
+
+func newArgError(format string, args ...any) error {
+	return &argError{message: fmt.Sprintf(format, args...)}
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr, os.LookupEnv, time.Now))
+}
+
+// run выполняет calctl с аргументами args и возвращает код выхода
+func run(args []string, stdout, stderr io.Writer, lookupEnv func(string) (string, bool), now func() time.Time) int {
+	flags := flag.NewFlagSet("calctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configName := flags.String("c", "conf.json", "name of server config file with server_address")
+	addr := flags.String("addr", "", "server URL, overrides config file, e.g. http://localhost:8089")
+	token := flags.String("token", "", "API key or token for Authorization: Bearer")
+	asJSON := flags.Bool("json", false, "print raw JSON instead of table")
+	retries := flags.Int("retries", 3, "attempts for requests rejected with 429 or 503")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: calctl [flags] <command> [command flags]")
+		fmt.Fprintln(stderr, "Commands:")
+		for _, name := range []string{"add", "edit", "rm", "day", "week", "month"} {
+			fmt.Fprintf(stderr, "  %-6s %s\n", name, commands[name].usage)
+		}
+		fmt.Fprintln(stderr, "Flags:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	cmd, ok := commands[flags.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "Unknown command %q\n", flags.Arg(0))
+		flags.Usage()
+		return exitUsage
+	}
+
+	baseURL := *addr
+	if baseURL == "" {
+		var err error
+		baseURL, err = serverURL(*configName, lookupEnv)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+	}
+	c, err := client.New(baseURL,
+		client.WithToken(*token),
+		client.WithRetry(client.RetryPolicy{MaxAttempts: *retries, Backoff: 200 * time.Millisecond, MaxBackoff: 5 * time.Second}))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	a := &app{client: c, json: *asJSON, stdout: stdout, now: now}
+	err = cmd.run(a, ctx, flags.Args()[1:])
+	if err == nil {
+		return exitOK
+	}
+	if errors.Is(err, errUsage) {
+		return exitUsage
+	}
+	var argErr *argError
+	if errors.As(err, &argErr) {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+	fmt.Fprintf(stderr, "Error: %v\n", err)
+	return exitCode(err)
+}
+
+// exitCode возвращает код выхода для ошибки запроса
+func exitCode(err error) int {
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) {
+		return exitTransport
+	}
+	switch apiErr.StatusCode {
+	case http.StatusBadRequest:
+		return exitValidation
+	case http.StatusServiceUnavailable:
+		return exitBusiness
+	default:
+		return exitAPI
+	}
+}
+
+// parseFlags разбирает флаги команды. Лишние аргументы считаются ошибкой
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(flags.Output(), "Unexpected arguments: %s\n", strings.Join(flags.Args(), " "))
+		return errUsage
+	}
+	return nil
+}
+
+// eventFlags флаги полей события для add и edit
+type eventFlags struct {
+	userID, name, description string
+	date, start, end          string
+	duration                  time.Duration
+	timezone, rrule           string
+	reminders, attendees      string
+	rejectConflicts           bool
+}
+
+func (f *eventFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.userID, "user", "", "user id")
+	flags.StringVar(&f.name, "name", "", "event name")
+	flags.StringVar(&f.description, "description", "", "event description")
+	flags.StringVar(&f.date, "date", "", "date of all-day event, e.g. 2024-03-04")
+	flags.StringVar(&f.start, "start", "", "start time in RFC 3339, e.g. 2024-03-04T10:00:00+03:00")
+	flags.StringVar(&f.end, "end", "", "end time in RFC 3339")
+	flags.DurationVar(&f.duration, "duration", 0, "duration instead of -end, e.g. 1h30m")
+	flags.StringVar(&f.timezone, "timezone", "", "IANA time zone of event, default UTC")
+	flags.StringVar(&f.rrule, "rrule", "", "recurrence rule, e.g. FREQ=WEEKLY;BYDAY=MO,WE;COUNT=10")
+	flags.StringVar(&f.reminders, "reminders", "", "comma separated reminder offsets, e.g. 15m,1d")
+	flags.StringVar(&f.attendees, "attendees", "", "comma separated invited users")
+	flags.BoolVar(&f.rejectConflicts, "reject-conflicts", false, "fail if event overlaps other events")
+}
+
+// input возвращает параметры события. Время проверяется сервером, здесь только разбирается формат
+func (f *eventFlags) input() (client.EventInput, error) {
+	in := client.EventInput{
+		UserID:      f.userID,
+		Name:        f.name,
+		Description: f.description,
+		Duration:    f.duration,
+		Timezone:    f.timezone,
+		RRule:       f.rrule,
+		Reminders:   splitList(f.reminders),
+		Attendees:   splitList(f.attendees),
+	}
+	var err error
+	if f.date != "" {
+		in.AllDay = true
+		if in.Start, err = time.Parse("2006-01-02", f.date); err != nil {
+			return in, newArgError("date parse error: %v", err)
+		}
+		if in.Duration == 0 {
+			in.End = in.Start.AddDate(0, 0, 1)
+		}
+	}
+	if f.start != "" {
+		if in.Start, err = time.Parse(time.RFC3339, f.start); err != nil {
+			return in, newArgError("start parse error: %v", err)
+		}
+	}
+	if f.end != "" {
+		if in.End, err = time.Parse(time.RFC3339, f.end); err != nil {
+			return in, newArgError("end parse error: %v", err)
+		}
+	}
+	return in, nil
+}
+
+func (f *eventFlags) options() []client.WriteOption {
+	if f.rejectConflicts {
+		return []client.WriteOption{client.RejectConflicts()}
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	var res []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// changeFlags флаги изменения существующего события для edit и rm
+type changeFlags struct {
+	id         string
+	version    int64
+	occurrence string
+	scope      string
+}
+
+func (f *changeFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.id, "id", "", "event id")
+	flags.Int64Var(&f.version, "version", 0, "expected event version, 0 - any")
+	flags.StringVar(&f.occurrence, "occurrence", "", "original start of series occurrence in RFC 3339")
+	flags.StringVar(&f.scope, "scope", string(client.ScopeThis), "occurrences to change: this, following or all")
+}
+
+func (f *changeFlags) options() ([]client.WriteOption, error) {
+	var opts []client.WriteOption
+	if f.version > 0 {
+		opts = append(opts, client.IfVersion(f.version))
+	}
+	if f.occurrence != "" {
+		occurrence, err := time.Parse(time.RFC3339, f.occurrence)
+		if err != nil {
+			return nil, newArgError("occurrence parse error: %v", err)
+		}
+		opts = append(opts, client.Occurrence(occurrence, client.Scope(f.scope)))
+	}
+	return opts, nil
+}
+
+func addCommand(a *app, ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("calctl add", flag.ContinueOnError)
+	var event eventFlags
+	event.register(flags)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	in, err := event.input()
+	if err != nil {
+		return err
+	}
+	res, err := a.client.CreateEvent(ctx, in, event.options()...)
+	if err != nil {
+		return err
+	}
+	return a.printResult(res)
+}
+
+func editCommand(a *app, ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("calctl edit", flag.ContinueOnError)
+	var event eventFlags
+	var change changeFlags
+	event.register(flags)
+	change.register(flags)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	in, err := event.input()
+	if err != nil {
+		return err
+	}
+	in.ID = change.id
+	opts, err := change.options()
+	if err != nil {
+		return err
+	}
+	res, err := a.client.UpdateEvent(ctx, in, append(event.options(), opts...)...)
+	if err != nil {
+		return err
+	}
+	return a.printResult(res)
+}
+
+func rmCommand(a *app, ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("calctl rm", flag.ContinueOnError)
+	userID := flags.String("user", "", "user id")
+	var change changeFlags
+	change.register(flags)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	opts, err := change.options()
+	if err != nil {
+		return err
+	}
+	res, err := a.client.DeleteEvent(ctx, *userID, change.id, opts...)
+	if err != nil {
+		return err
+	}
+	return a.printResult(res)
+}
+
+// agendaFlags флаги команд просмотра событий
+type agendaFlags struct {
+	userID   string
+	timezone string
+}
+
+func (f *agendaFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.userID, "user", "", "user id")
+	flags.StringVar(&f.timezone, "timezone", "", "IANA time zone of dates, default UTC")
+}
+
+func (f *agendaFlags) location() (*time.Location, error) {
+	loc, err := time.LoadLocation(f.timezone)
+	if err != nil {
+		return nil, newArgError("timezone parse error: %v", err)
+	}
+	return loc, nil
+}
+
+// dateCommand возвращает команду просмотра событий за день или неделю от -date (по умолчанию сегодня)
+func dateCommand(name string, get func(c *client.Client, ctx context.Context, userID string, date time.Time) ([]client.Event, error)) func(a *app, ctx context.Context, args []string) error {
+	return func(a *app, ctx context.Context, args []string) error {
+		flags := flag.NewFlagSet("calctl "+name, flag.ContinueOnError)
+		var agenda agendaFlags
+		agenda.register(flags)
+		date := flags.String("date", "", "date, e.g. 2024-03-04, default today")
+		if err := parseFlags(flags, args); err != nil {
+			return err
+		}
+		loc, err := agenda.location()
+		if err != nil {
+			return err
+		}
+		day := a.now().In(loc)
+		if *date != "" {
+			if day, err = time.ParseInLocation("2006-01-02", *date, loc); err != nil {
+				return newArgError("date parse error: %v", err)
+			}
+		}
+		events, err := get(a.client, ctx, agenda.userID, day)
+		if err != nil {
+			return err
+		}
+		return a.printEvents(events)
+	}
+}
+
+var (
+	dayCommand  = dateCommand("day", (*client.Client).EventsForDay)
+	weekCommand = dateCommand("week", (*client.Client).EventsForWeek)
+)
+
+func monthCommand(a *app, ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("calctl month", flag.ContinueOnError)
+	var agenda agendaFlags
+	agenda.register(flags)
+	month := flags.String("month", "", "month, e.g. 2024-03, default current")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	loc, err := agenda.location()
+	if err != nil {
+		return err
+	}
+	start := a.now().In(loc)
+	if *month != "" {
+		if start, err = time.ParseInLocation("2006-01", *month, loc); err != nil {
+			return newArgError("month parse error: %v", err)
+		}
+	}
+	events, err := a.client.EventsForMonth(ctx, agenda.userID, start.Year(), start.Month(), loc)
+	if err != nil {
+		return err
+	}
+	return a.printEvents(events)
+}
+
+func (a *app) printJSON(value any) error {
+	encoder := json.NewEncoder(a.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func (a *app) printResult(res *client.PostResult) error {
+	if a.json {
+		return a.printJSON(res)
+	}
+	status := map[client.Status]string{client.Created: "Created", client.Updated: "Updated", client.Deleted: "Deleted"}[res.Status]
+	_, err := fmt.Fprintf(a.stdout, "%s event %s (version %d)\n", status, res.ID, res.Version)
+	return err
+}
+
+// printEvents выводит события, отсортированные по началу, таблицей или JSON
+func (a *app) printEvents(events []client.Event) error {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Start.Before(events[j].Start)
+	})
+	if a.json {
+		if events == nil {
+			events = []client.Event{}
+		}
+		return a.printJSON(events)
+	}
+	if len(events) == 0 {
+		_, err := fmt.Fprintln(a.stdout, "No events")
+		return err
+	}
+	w := tabwriter.NewWriter(a.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DATE\tTIME\tNAME\tID")
+	for _, e := range events {
+		when := "all day"
+		if !e.AllDay {
+			when = e.Start.Format("15:04") + "-" + e.End.Format("15:04")
+		}
+		name := e.Name
+		if e.RRule != "" {
+			name += " (recurring)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Date, when, name, e.ID)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeServer отвечает как сервер календаря и запоминает параметры последнего запроса
+type fakeServer struct {
+	path   string
+	params map[string]string
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	s.path = r.URL.Path
+	s.params = make(map[string]string)
+	for key := range r.Form {
+		s.params[key] = r.Form.Get(key)
+	}
+	w.Header().Set("content-type", "application/json")
+	switch {
+	case r.Form.Get("user_id") == "broken":
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error":"Service unavailable"}`))
+	case r.Form.Get("id") == "missing":
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"Event does not exist"}`))
+	case r.Form.Get("version") == "1":
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error":"Event version is 2, expected 1"}`))
+	case r.Method == http.MethodPost:
+		w.Write([]byte(`{"result":{"id":"42","status":0,"version":1}}`))
+	default:
+		w.Write([]byte(`{"result":[
+			{"id":"2","name":"standup","date":"2024-03-04","start":"2024-03-04T13:00:00+03:00","end":"2024-03-04T13:15:00+03:00","timezone":"Europe/Moscow","rrule":"FREQ=DAILY","version":1},
+			{"id":"1","name":"holiday","date":"2024-03-04","start":"2024-03-04T00:00:00Z","end":"2024-03-05T00:00:00Z","all_day":true,"timezone":"UTC","version":3}
+		]}`))
+	}
+}
+
+func TestRun(t *testing.T) {
+	server := &fakeServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	now := func() time.Time { return time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		path   string
+		params map[string]string
+		stdout string
+	}{
+		{
+			name: "add",
+			args: []string{"add", "-user", "34", "-name", "meeting", "-start", "2024-03-04T10:00:00Z", "-duration", "1h", "-attendees", "35, 36"},
+			path: "/create_event/",
+			params: map[string]string{
+				"user_id": "34", "name": "meeting", "start": "2024-03-04T10:00:00Z", "duration": "1h0m0s", "attendees": "35,36",
+			},
+			stdout: "Created event 42 (version 1)\n",
+		},
+		{
+			name:   "add all day",
+			args:   []string{"add", "-user", "34", "-name", "holiday", "-date", "2024-03-08", "-reject-conflicts"},
+			path:   "/create_event/",
+			params: map[string]string{"user_id": "34", "name": "holiday", "start": "2024-03-08", "end": "2024-03-09", "all_day": "true", "reject_conflicts": "true"},
+			stdout: "Created event 42 (version 1)\n",
+		},
+		{
+			name: "edit occurrence",
+			args: []string{"edit", "-user", "34", "-id", "7", "-name", "moved", "-start", "2024-03-05T11:00:00Z", "-duration", "1h", "-occurrence", "2024-03-05T10:00:00Z", "-version", "2"},
+			path: "/update_event/",
+			params: map[string]string{
+				"user_id": "34", "id": "7", "name": "moved", "start": "2024-03-05T11:00:00Z", "duration": "1h0m0s",
+				"occurrence": "2024-03-05T10:00:00Z", "scope": "this", "version": "2",
+			},
+			stdout: "Created event 42 (version 1)\n",
+		},
+		{
+			name:   "rm",
+			args:   []string{"-json", "rm", "-user", "34", "-id", "7"},
+			path:   "/delete_event/",
+			params: map[string]string{"user_id": "34", "id": "7"},
+			stdout: "{\n  \"id\": \"42\",\n  \"status\": 0,\n  \"version\": 1\n}\n",
+		},
+		{
+			name:   "day",
+			args:   []string{"day", "-user", "34"},
+			path:   "/events_for_day/",
+			params: map[string]string{"user_id": "34", "date": "2024-03-04"},
+			stdout: "DATE        TIME         NAME                 ID\n" +
+				"2024-03-04  all day      holiday              1\n" +
+				"2024-03-04  13:00-13:15  standup (recurring)  2\n",
+		},
+		{
+			name:   "week in timezone",
+			args:   []string{"week", "-user", "34", "-date", "2024-03-04", "-timezone", "Europe/Moscow"},
+			path:   "/events_for_week/",
+			params: map[string]string{"user_id": "34", "date": "2024-03-04", "timezone": "Europe/Moscow"},
+		},
+		{
+			name:   "month",
+			args:   []string{"month", "-user", "34", "-month", "2024-02"},
+			path:   "/events_for_month/",
+			params: map[string]string{"user_id": "34", "year": "2024", "month": "2"},
+		},
+		{name: "validation error", args: []string{"rm", "-user", "34", "-id", "missing"}, code: exitValidation},
+		{name: "business error", args: []string{"-retries", "1", "day", "-user", "broken"}, code: exitBusiness},
+		{name: "version conflict", args: []string{"rm", "-user", "34", "-id", "7", "-version", "1"}, code: exitAPI},
+		{name: "no command", args: nil, code: exitUsage},
+		{name: "unknown command", args: []string{"list"}, code: exitUsage},
+		{name: "unknown flag", args: []string{"day", "-users", "34"}, code: exitUsage},
+		{name: "wrong date", args: []string{"day", "-user", "34", "-date", "04.03.2024"}, code: exitUsage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server.path = ""
+			var stdout, stderr bytes.Buffer
+			code := run(append([]string{"-addr", ts.URL}, tt.args...), &stdout, &stderr, func(string) (string, bool) { return "", false }, now)
+			require.Equal(t, tt.code, code, stderr.String())
+			if tt.path != "" {
+				assert.Equal(t, tt.path, server.path)
+				assert.Equal(t, tt.params, server.params)
+			}
+			if tt.stdout != "" {
+				assert.Equal(t, tt.stdout, stdout.String())
+			}
+		})
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-addr", "http://127.0.0.1:1", "-retries", "1", "day", "-user", "34"}, &stdout, &stderr, nil, now)
+	assert.Equal(t, exitTransport, code)
+}
+
+func TestServerURL(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name   string
+		config string
+		env    map[string]string
+		want   string
+	}{
+		{"address", `{"server_address": "localhost:8089"}`, nil, "http://localhost:8089"},
+		{"all interfaces", `{"server_address": ":8089"}`, nil, "http://localhost:8089"},
+		{"tls", `{"server_address": "calendar.local:443", "tls": {"cert_file": "cert.pem", "key_file": "key.pem"}}`, nil, "https://calendar.local:443"},
+		{"environment", `{"server_address": "localhost:8089"}`, map[string]string{"CALENDAR_SERVER_ADDRESS": "localhost:9000"}, "http://localhost:9000"},
+		{"empty", `{}`, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "conf.json")
+			require.NoError(t, os.WriteFile(path, []byte(tt.config), 0644))
+			got, err := serverURL(path, func(name string) (string, bool) {
+				value, ok := tt.env[name]
+				return value, ok
+			})
+			if tt.want == "" {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// configEnvPrefix префикс переменных окружения, которые переопределяют значения из файла конфига
+const configEnvPrefix = "CALENDAR_"
+
+// Таймауты сервера, если они не заданы в конфиге
+const (
+	defaultReadTimeout     = 15 * time.Second
+	defaultWriteTimeout    = 30 * time.Second
+	defaultIdleTimeout     = 2 * time.Minute
+	defaultShutdownTimeout = 15 * time.Second
+)
+
+// TLSConfig пути к PEM файлам сертификата и ключа сервера
+type TLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// configEnv переменные окружения (без префикса) и поля конфига, которые они задают.
+// Поле имеет тип *string, *int или *Duration, вложенные настройки создаются при обращении к ним
+var configEnv = []struct {
+	name  string
+	field func(cfg *Config) any
+}{
+	{"SERVER_ADDRESS", func(cfg *Config) any { return &cfg.Address }},
+	{"STORAGE_PATH", func(cfg *Config) any { return &cfg.StoragePath }},
+	{"SNAPSHOT_EVERY", func(cfg *Config) any { return &cfg.SnapshotEvery }},
+	{"READ_TIMEOUT", func(cfg *Config) any { return &cfg.ReadTimeout }},
+	{"WRITE_TIMEOUT", func(cfg *Config) any { return &cfg.WriteTimeout }},
+	{"IDLE_TIMEOUT", func(cfg *Config) any { return &cfg.IdleTimeout }},
+	{"SHUTDOWN_TIMEOUT", func(cfg *Config) any { return &cfg.ShutdownTimeout }},
+	{"TLS_CERT_FILE", func(cfg *Config) any { return &cfg.tlsConfig().CertFile }},
+	{"TLS_KEY_FILE", func(cfg *Config) any { return &cfg.tlsConfig().KeyFile }},
+	{"LOG_LEVEL", func(cfg *Config) any { return &cfg.logConfig().Level }},
+	{"LOG_FORMAT", func(cfg *Config) any { return &cfg.logConfig().Format }},
+	{"AUTH_HMAC_SECRET", func(cfg *Config) any { return &cfg.authConfig().HMACSecret }},
+}
+
+func (cfg *Config) tlsConfig() *TLSConfig {
+	if cfg.TLS == nil {
+		cfg.TLS = &TLSConfig{}
+	}
+	return cfg.TLS
+}
+
+func (cfg *Config) logConfig() *LogConfig {
+	if cfg.Log == nil {
+		cfg.Log = &LogConfig{}
+	}
+	return cfg.Log
+}
+
+func (cfg *Config) authConfig() *AuthConfig {
+	if cfg.Auth == nil {
+		cfg.Auth = &AuthConfig{}
+	}
+	return cfg.Auth
+}
+
+// LoadConfig читает конфиг из JSON файла path, переопределяет его значения переменными окружения
+// CALENDAR_* из lookupEnv (обычно os.LookupEnv) и проверяет результат
+func LoadConfig(path string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	if err := cfg.applyEnv(lookupEnv); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return &cfg, nil
+}
+
+// applyEnv переопределяет значения конфига заданными переменными окружения
+func (cfg *Config) applyEnv(lookupEnv func(string) (string, bool)) error {
+	for _, env := range configEnv {
+		name := configEnvPrefix + env.name
+		value, ok := lookupEnv(name)
+		if !ok {
+			continue
+		}
+		switch field := env.field(cfg).(type) {
+		case *string:
+			*field = value
+		case *int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("environment variable %s: %q is not an integer", name, value)
+			}
+			*field = n
+		case *Duration:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("environment variable %s: %w", name, err)
+			}
+			*field = Duration(d)
+		}
+	}
+	return nil
+}
+
+// Validate проверяет значения конфига, которые не проверяются при разборе JSON
+func (cfg *Config) Validate() error {
+	if cfg.SnapshotEvery < 0 {
+		return fmt.Errorf("snapshot_every must not be negative")
+	}
+	timeouts := []struct {
+		name  string
+		value Duration
+	}{
+		{"read_timeout", cfg.ReadTimeout},
+		{"write_timeout", cfg.WriteTimeout},
+		{"idle_timeout", cfg.IdleTimeout},
+		{"shutdown_timeout", cfg.ShutdownTimeout},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value < 0 {
+			return fmt.Errorf("%s must not be negative", timeout.name)
+		}
+	}
+	if cfg.TLS != nil && (cfg.TLS.CertFile == "" || cfg.TLS.KeyFile == "") {
+		return fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	if cfg.RateLimit != nil {
+		if err := cfg.RateLimit.validate(); err != nil {
+			return err
+		}
+	}
+	if cfg.History != nil {
+		if err := cfg.History.validate(); err != nil {
+			return err
+		}
+	}
+	if _, err := cfg.Log.newLogger(io.Discard); err != nil {
+		return err
+	}
+	return nil
+}
+
+// or возвращает длительность или def, если она не задана
+func (d Duration) or(def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return time.Duration(d)
+}
+
+// loadCertificate загружает сертификат сервера, nil если TLS не настроен
+func loadCertificate(cfg *Config) (*tls.Certificate, error) {
+	if cfg.TLS == nil {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+// liveState примененный конфиг и собранные по нему обработчик и сертификат
+type liveState struct {
+	cfg     *Config
+	handler http.Handler
+	cert    *tls.Certificate
+}
+
+// liveServer обработчик сервера, который можно перенастроить перезагрузкой конфига без разрыва соединений.
+// Без перезапуска применяются аутентификация, ограничения частоты запросов, логи, TLS сертификат
+// и shutdown_timeout, остальные настройки используются сервером и фоновыми службами с момента запуска
+type liveServer struct {
+	path      string
+	lookupEnv func(string) (string, bool)
+	logOutput io.Writer
+	storage   Storage
+	services  Services
+	// started конфиг, с которым запущен сервер
+	started *Config
+
+	// mu не дает перезагрузкам выполняться одновременно
+	mu    sync.Mutex
+	state atomic.Pointer[liveState]
+}
+
+// newLiveServer собирает обработчик по конфигу cfg, загруженному из path. При перезагрузке
+// конфиг читается из path с переменными окружения lookupEnv, а логи пишутся в logOutput
+func newLiveServer(path string, lookupEnv func(string) (string, bool), logOutput io.Writer, cfg *Config, storage Storage, services Services) (*liveServer, error) {
+	cert, err := loadCertificate(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := &liveServer{
+		path:      path,
+		lookupEnv: lookupEnv,
+		logOutput: logOutput,
+		storage:   storage,
+		services:  services,
+		started:   cfg,
+	}
+	s.state.Store(&liveState{cfg: cfg, handler: newHandler(cfg, storage, services), cert: cert})
+	return s, nil
+}
+
+// Config возвращает последний примененный конфиг
+func (s *liveServer) Config() *Config {
+	return s.state.Load().cfg
+}
+
+func (s *liveServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.state.Load().handler.ServeHTTP(w, r)
+}
+
+func (s *liveServer) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.state.Load().cert, nil
+}
+
+// Reload перечитывает конфиг и применяет его к новым запросам, начатые запросы завершаются со старым.
+// Если новый конфиг некорректен, возвращается ошибка и остается прежний
+func (s *liveServer) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cfg, err := LoadConfig(s.path, s.lookupEnv)
+	if err != nil {
+		return err
+	}
+	cert, err := loadCertificate(cfg)
+	if err != nil {
+		return err
+	}
+	if (cfg.TLS == nil) != (s.started.TLS == nil) {
+		// Включить или выключить TLS можно только перезапуском, до него работает прежний сертификат
+		cert = s.state.Load().cert
+	}
+	logger, err := cfg.Log.newLogger(s.logOutput)
+	if err != nil {
+		return err
+	}
+	// loggingHandler берет логгер по умолчанию при создании обработчика
+	slog.SetDefault(logger)
+	s.state.Store(&liveState{cfg: cfg, handler: newHandler(cfg, s.storage, s.services), cert: cert})
+	if changed := restartRequired(s.started, cfg); len(changed) > 0 {
+		logger.Warn("Config changes will be applied after restart", slog.Any("settings", changed))
+	}
+	return nil
+}
+
+// restartRequired возвращает настройки cfg, которые отличаются от конфига запуска started
+// и не могут быть применены без перезапуска
+func restartRequired(started, cfg *Config) []string {
+	settings := []struct {
+		name          string
+		before, after any
+	}{
+		{"server_address", started.Address, cfg.Address},
+		{"storage_path", started.StoragePath, cfg.StoragePath},
+		{"snapshot_every", started.SnapshotEvery, cfg.SnapshotEvery},
+		{"read_timeout", started.ReadTimeout, cfg.ReadTimeout},
+		{"write_timeout", started.WriteTimeout, cfg.WriteTimeout},
+		{"idle_timeout", started.IdleTimeout, cfg.IdleTimeout},
+		{"tls", started.TLS == nil, cfg.TLS == nil},
+		{"reminders", started.Reminders, cfg.Reminders},
+		{"webhooks", started.Webhooks, cfg.Webhooks},
+		{"stream", started.Stream, cfg.Stream},
+		{"history", started.History, cfg.History},
+	}
+	var changed []string
+	for _, setting := range settings {
+		if !reflect.DeepEqual(setting.before, setting.after) {
+			changed = append(changed, setting.name)
+		}
+	}
+	return changed
+}
+
+// httpServer создает сервер с таймаутами из конфига запуска
+func (s *liveServer) httpServer() *http.Server {
+	server := &http.Server{
+		Addr:         s.started.Address,
+		Handler:      s,
+		ReadTimeout:  s.started.ReadTimeout.or(defaultReadTimeout),
+		WriteTimeout: s.started.WriteTimeout.or(defaultWriteTimeout),
+		IdleTimeout:  s.started.IdleTimeout.or(defaultIdleTimeout),
+	}
+	if s.started.TLS != nil {
+		server.TLSConfig = &tls.Config{GetCertificate: s.getCertificate}
+	}
+	return server
+}
+
+// listenAndServe запускает сервер, созданный httpServer, с TLS, если он настроен
+func listenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
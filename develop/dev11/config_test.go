@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mapEnv возвращает lookupEnv по заданным переменным окружения
+func mapEnv(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+// writeConfig записывает конфиг в файл path
+func writeConfig(t *testing.T, path, data string) {
+	require.NoError(t, os.WriteFile(path, []byte(data), 0644))
+}
+
+// writeTestCertificate создает самоподписанный сертификат для host в директории dir
+func writeTestCertificate(t *testing.T, dir, host string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certFile, keyFile = filepath.Join(dir, host+".crt"), filepath.Join(dir, host+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0644))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		want    Config
+		wantErr string
+	}{
+		{
+			name: "file",
+			file: `{"server_address": "localhost:8089", "read_timeout": "5s", "shutdown_timeout": "1m"}`,
+			want: Config{Address: "localhost:8089", ReadTimeout: Duration(5 * time.Second), ShutdownTimeout: Duration(time.Minute)},
+		},
+		{
+			name: "environment overrides file",
+			file: `{"server_address": "localhost:8089", "storage_path": "data", "log": {"format": "text"}}`,
+			env: map[string]string{
+				"CALENDAR_SERVER_ADDRESS": ":9000",
+				"CALENDAR_STORAGE_PATH":   "",
+				"CALENDAR_SNAPSHOT_EVERY": "10",
+				"CALENDAR_WRITE_TIMEOUT":  "1m",
+				"CALENDAR_LOG_LEVEL":      "debug",
+				"CALENDAR_TLS_CERT_FILE":  "server.crt",
+				"CALENDAR_TLS_KEY_FILE":   "server.key",
+			},
+			want: Config{
+				Address:       ":9000",
+				SnapshotEvery: 10,
+				WriteTimeout:  Duration(time.Minute),
+				Log:           &LogConfig{Level: "debug", Format: "text"},
+				TLS:           &TLSConfig{CertFile: "server.crt", KeyFile: "server.key"},
+			},
+		},
+		{
+			name: "secret from environment enables auth",
+			file: `{}`,
+			env:  map[string]string{"CALENDAR_AUTH_HMAC_SECRET": "secret"},
+			want: Config{Auth: &AuthConfig{HMACSecret: "secret"}},
+		},
+		{"wrong json", `{"server_address": 8089}`, nil, Config{}, "parse config file"},
+		{"wrong duration", `{"idle_timeout": "soon"}`, nil, Config{}, "parse config file"},
+		{"negative timeout", `{"write_timeout": "-1s"}`, nil, Config{}, "write_timeout must not be negative"},
+		{"wrong log level", `{"log": {"level": "verbose"}}`, nil, Config{}, `wrong log level "verbose"`},
+		{"key without certificate", `{"tls": {"key_file": "server.key"}}`, nil, Config{}, "tls.cert_file and tls.key_file must be set together"},
+		{"negative rate limit", `{"rate_limit": {"write": {"rate": -1}}}`, nil, Config{}, "rate_limit.write.rate must be a non-negative number"},
+		{"negative history age", `{"history": {"max_age": "-1h"}}`, nil, Config{}, "history.max_age must not be negative"},
+		{"wrong integer in environment", `{}`, map[string]string{"CALENDAR_SNAPSHOT_EVERY": "often"}, Config{}, "CALENDAR_SNAPSHOT_EVERY"},
+		{"wrong duration in environment", `{}`, map[string]string{"CALENDAR_READ_TIMEOUT": "5"}, Config{}, "CALENDAR_READ_TIMEOUT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "conf.json")
+			writeConfig(t, path, tt.file)
+			cfg, err := LoadConfig(path, mapEnv(tt.env))
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, *cfg)
+		})
+	}
+
+	_, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json"), mapEnv(nil))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestLiveServerReload(t *testing.T) {
+	captureLogs(t)
+	path := filepath.Join(t.TempDir(), "conf.json")
+	writeConfig(t, path, `{"server_address": "localhost:8089"}`)
+	cfg, err := LoadConfig(path, mapEnv(nil))
+	require.NoError(t, err)
+	storage := NewMemoryStorage()
+	start := mustTime(t, "2024-03-04T10:00:00Z")
+	_, err = storage.Create(&Event{UserID: "34", Name: "standup", Start: start, End: start.Add(time.Hour)})
+	require.NoError(t, err)
+	var logs bytes.Buffer
+	live, err := newLiveServer(path, mapEnv(nil), &logs, cfg, storage, Services{})
+	require.NoError(t, err)
+
+	request := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/users/34/events", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := httptest.NewRecorder()
+		live.ServeHTTP(resp, req)
+		return resp.Code
+	}
+	require.Equal(t, http.StatusOK, request(""))
+
+	// Аутентификация и логи применяются сразу, адрес - после перезапуска
+	writeConfig(t, path, `{"server_address": ":9000", "shutdown_timeout": "1m", "auth": {"api_keys": [{"key": "key-34", "user_id": "34"}]}}`)
+	require.NoError(t, live.Reload())
+	assert.Equal(t, http.StatusUnauthorized, request(""))
+	assert.Equal(t, http.StatusOK, request("key-34"))
+	assert.Equal(t, Duration(time.Minute), live.Config().ShutdownTimeout)
+	assert.Contains(t, logs.String(), `"settings":["server_address"]`)
+	assert.Contains(t, logs.String(), `"msg":"Request processed"`)
+	assert.Equal(t, "localhost:8089", live.httpServer().Addr)
+
+	// Некорректный конфиг отклоняется, работает прежний
+	for _, data := range []string{`{"auth": `, `{"read_timeout": "-1s"}`, `{"tls": {"cert_file": "missing.crt", "key_file": "missing.key"}}`} {
+		writeConfig(t, path, data)
+		assert.Error(t, live.Reload())
+		assert.Equal(t, http.StatusUnauthorized, request(""))
+		assert.Equal(t, http.StatusOK, request("key-34"))
+		assert.Equal(t, ":9000", live.Config().Address)
+	}
+}
+
+func TestLiveServerCertificate(t *testing.T) {
+	captureLogs(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "conf.json")
+	certFile, keyFile := writeTestCertificate(t, dir, "old.example.com")
+	writeConfig(t, path, `{"tls": {"cert_file": "`+certFile+`", "key_file": "`+keyFile+`"}}`)
+	cfg, err := LoadConfig(path, mapEnv(nil))
+	require.NoError(t, err)
+	live, err := newLiveServer(path, mapEnv(nil), &bytes.Buffer{}, cfg, NewMemoryStorage(), Services{})
+	require.NoError(t, err)
+	server := live.httpServer()
+	require.NotNil(t, server.TLSConfig)
+
+	commonName := func() string {
+		cert, err := server.TLSConfig.GetCertificate(nil)
+		require.NoError(t, err)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		return leaf.Subject.CommonName
+	}
+	assert.Equal(t, "old.example.com", commonName())
+
+	// Новый сертификат используется без перезапуска сервера
+	certFile, keyFile = writeTestCertificate(t, dir, "new.example.com")
+	writeConfig(t, path, `{}`)
+	require.NoError(t, live.Reload())
+	assert.Equal(t, "old.example.com", commonName())
+	writeConfig(t, path, `{"tls": {"cert_file": "`+certFile+`", "key_file": "`+keyFile+`"}}`)
+	require.NoError(t, live.Reload())
+	assert.Equal(t, "new.example.com", commonName())
+}
+
+func TestHTTPServerTimeouts(t *testing.T) {
+	tests := []struct {
+		name                    string
+		cfg                     Config
+		read, write, idle, stop time.Duration
+	}{
+		{"defaults", Config{}, defaultReadTimeout, defaultWriteTimeout, defaultIdleTimeout, defaultShutdownTimeout},
+		{
+			"configured",
+			Config{ReadTimeout: Duration(time.Second), WriteTimeout: Duration(2 * time.Second), IdleTimeout: Duration(3 * time.Second), ShutdownTimeout: Duration(4 * time.Second)},
+			time.Second, 2 * time.Second, 3 * time.Second, 4 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			live, err := newLiveServer("", mapEnv(nil), &bytes.Buffer{}, &tt.cfg, NewMemoryStorage(), Services{})
+			require.NoError(t, err)
+			server := live.httpServer()
+			assert.Equal(t, tt.read, server.ReadTimeout)
+			assert.Equal(t, tt.write, server.WriteTimeout)
+			assert.Equal(t, tt.idle, server.IdleTimeout)
+			assert.Equal(t, tt.stop, live.Config().ShutdownTimeout.or(defaultShutdownTimeout))
+			assert.Nil(t, server.TLSConfig)
+		})
+	}
+}
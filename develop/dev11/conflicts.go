@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// conflictHorizon насколько вперед от начала серии проверяются пересечения ее повторений
+const conflictHorizon = 366 * 24 * time.Hour
+
+// WriteOption задает необязательный режим записи для методов изменения хранилища
+type WriteOption func(*writeOptions)
+
+type writeOptions struct {
+	// rejectConflicts учитывается только Create, Update и Put
+	rejectConflicts bool
+	actor           string
+	// expectVersion означает, что изменение разрешено только для версии события version
+	expectVersion bool
+	version       int64
+	precondition  bool
+	// keepAttendees учитывается только Update, UpdateOccurrence и Put
+	keepAttendees bool
+}
+
+func newWriteOptions(opts []WriteOption) writeOptions {
+	var o writeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// RejectConflicts запрещает запись события, пересекающегося с другими событиями организатора
+// или участников, не отказавшихся от приглашения. В этом случае возвращается *ConflictError
+func RejectConflicts() WriteOption {
+	return func(o *writeOptions) {
+		o.rejectConflicts = true
+	}
+}
+
+// ConflictError ошибка записи события, пересекающегося с существующими событиями организатора или участников
+type ConflictError struct {
+	// Conflicts пересекающиеся события или повторения серий
+	Conflicts []Event
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("Event conflicts with %d existing event(s)", len(e.Conflicts))
+}
+
+// busy проверяет, занимает ли событие время. Событие без длительности время не занимает
+func (e *Event) busy() bool {
+	return e.End.After(e.Start)
+}
+
+// lockWrite блокирует на запись шард пользователя userID. В режиме rejectConflicts проверка пересечений
+// читает календари участников и события, в которые они приглашены, поэтому остальные шарды блокируются
+// на чтение в порядке возрастания индекса, как в lockAll. Возвращает шард пользователя и функцию снятия блокировок
+func (s *MemoryStorage) lockWrite(userID string, o writeOptions) (*storageShard, func()) {
+	sh := s.shard(userID)
+	if !o.rejectConflicts {
+		sh.mu.Lock()
+		return sh, sh.mu.Unlock
+	}
+	for _, other := range s.shards {
+		if other == sh {
+			other.mu.Lock()
+		} else {
+			other.mu.RLock()
+		}
+	}
+	return sh, func() {
+		for _, other := range s.shards {
+			if other == sh {
+				other.mu.Unlock()
+			} else {
+				other.mu.RUnlock()
+			}
+		}
+	}
+}
+
+// source возвращает хранилище с календарем пользователя: черновик пакета /batch хранит только
+// календари пользователей пакета, остальные читаются из base
+func (s *MemoryStorage) source(userID string) *MemoryStorage {
+	if s.base != nil && !s.drafted[userID] {
+		return s.base
+	}
+	return s
+}
+
+// participants возвращает организатора и участников события, не отказавшихся от приглашения
+func (e *Event) participants() []string {
+	res := []string{e.UserID}
+	for _, a := range e.Attendees {
+		if a.Status != AttendeeDeclined {
+			res = append(res, a.UserID)
+		}
+	}
+	return res
+}
+
+// checkConflicts возвращает *ConflictError, если повторения event в пределах conflictHorizon пересекаются
+// с событиями организатора или участников, в том числе с событиями, в которые они приглашены.
+// Вызывается под блокировками lockWrite
+func (s *MemoryStorage) checkConflicts(event *Event) error {
+	var own []Event
+	for _, occ := range event.Occurrences(event.Start, event.Start.Add(conflictHorizon)) {
+		if occ.busy() {
+			own = append(own, occ)
+		}
+	}
+	if len(own) == 0 {
+		return nil
+	}
+	from, to := own[0].Start, own[0].End
+	for _, occ := range own[1:] {
+		if occ.Start.Before(from) {
+			from = occ.Start
+		}
+		if occ.End.After(to) {
+			to = occ.End
+		}
+	}
+	// Событие проверяется один раз, даже если в нем участвуют несколько участников event
+	checked := map[eventRef]bool{{userID: event.UserID, id: event.ID}: true}
+	var conflicts []Event
+	check := func(other Event) {
+		ref := eventRef{userID: other.UserID, id: other.ID}
+		if checked[ref] {
+			return
+		}
+		checked[ref] = true
+		for _, occ := range other.Occurrences(from, to) {
+			if !occ.busy() {
+				continue
+			}
+			for i := range own {
+				if occ.Start.Before(own[i].End) && own[i].Start.Before(occ.End) {
+					conflicts = append(conflicts, occ)
+					break
+				}
+			}
+		}
+	}
+	for _, userID := range event.participants() {
+		for _, other := range s.source(userID).shard(userID).events[userID] {
+			check(other)
+		}
+		refs := s.invitations.list(userID)
+		if s.base != nil {
+			refs = append(refs, s.base.invitations.list(userID)...)
+		}
+		for _, ref := range refs {
+			other, err := s.source(ref.userID).shard(ref.userID).get(ref.userID, ref.id)
+			if err != nil {
+				continue
+			}
+			if status, ok := other.attendee(userID); ok && status != AttendeeDeclined {
+				check(other)
+			}
+		}
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	sortEvents(conflicts)
+	return &ConflictError{Conflicts: conflicts}
+}
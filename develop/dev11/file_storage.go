@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+	// defaultSnapshotEvery - через сколько записей журнала по умолчанию делается снимок
+	defaultSnapshotEvery = 1000
+)
+
+// walRecord это одна запись журнала. Изменения одной записи применяются вместе
+type walRecord struct {
+	Changes []Change `json:"changes"`
+}
+
+// FileStorage хранит календари в памяти и сохраняет каждое изменение в журнал (write-ahead log) на диске.
+// Периодически состояние целиком записывается в снимок, после чего журнал очищается.
+// При старте загружается последний снимок и поверх него проигрывается журнал.
+// Снимок делает фоновая горутина, которая запускается при разрастании журнала.
+type FileStorage struct {
+	*MemoryStorage
+	dir string
+	// walMu защищает журнал и счетчики. Берется после блокировки шардов
+	walMu sync.Mutex
+	wal   *os.File
+	// Размер журнала после последней успешной записи
+	walSize int64
+	// Количество записей в журнале с момента последнего снимка
+	walRecords int
+	// Через сколько записей журнала делать снимок
+	snapshotEvery int
+	// Сигнал фоновой горутине, что пора делать снимок
+	snapshotCh chan struct{}
+	done       chan struct{}
+	wg         sync.WaitGroup
+}
+
+// NewFileStorage открывает (или создает) хранилище в директории dir и восстанавливает его состояние
+func NewFileStorage(dir string, snapshotEvery int) (*FileStorage, error) {
+	if snapshotEvery <= 0 {
+		snapshotEvery = defaultSnapshotEvery
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create storage dir: %w", err)
+	}
+	s := &FileStorage{
+		MemoryStorage: NewMemoryStorage(),
+		dir:           dir,
+		snapshotEvery: snapshotEvery,
+		snapshotCh:    make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := s.replayWAL(); err != nil {
+		return nil, err
+	}
+	s.MemoryStorage.journal = s.writeWAL
+	s.wg.Add(1)
+	go s.snapshotLoop()
+	return s, nil
+}
+
+// Close останавливает фоновые снимки и закрывает файл журнала
+func (s *FileStorage) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	s.walMu.Lock()
+	defer s.walMu.Unlock()
+	return s.wal.Close()
+}
+
+// snapshotLoop делает снимки по сигналу из writeWAL
+func (s *FileStorage) snapshotLoop() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.snapshotCh:
+			if err := s.writeSnapshot(); err != nil {
+				// Журнал по-прежнему содержит все изменения, поэтому можно продолжать работу
+				fmt.Fprintf(os.Stderr, "Error while writing snapshot: %v\n", err)
+			}
+		}
+	}
+}
+
+// loadSnapshot загружает последний снимок, если он есть
+func (s *FileStorage) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read snapshot: %w", err)
+	}
+	var events []Event
+	if err := json.Unmarshal(data, &events); err != nil {
+		return fmt.Errorf("parse snapshot: %w", err)
+	}
+	for _, event := range events {
+		s.apply(Change{Status: Created, Event: event})
+	}
+	return nil
+}
+
+// replayWAL проигрывает журнал поверх снимка и открывает журнал для дозаписи.
+// Недописанная последняя запись (например, после падения процесса) отбрасывается.
+func (s *FileStorage) replayWAL() error {
+	f, err := os.OpenFile(filepath.Join(s.dir, walFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("open wal: %w", err)
+	}
+	reader := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("read wal: %w", err)
+		}
+		var rec walRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			f.Close()
+			return fmt.Errorf("parse wal record at offset %d: %w", offset, err)
+		}
+		for _, c := range rec.Changes {
+			s.apply(c)
+		}
+		offset += int64(len(line))
+		s.walRecords++
+	}
+	// Отрезаем хвост без перевода строки и дописываем журнал с конца последней целой записи
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return fmt.Errorf("truncate wal: %w", err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return fmt.Errorf("seek wal: %w", err)
+	}
+	s.wal = f
+	s.walSize = offset
+	return nil
+}
+
+// writeWAL дописывает изменения в журнал. Если журнал разросся, просит фоновую горутину сделать снимок
+func (s *FileStorage) writeWAL(changes []Change) error {
+	s.walMu.Lock()
+	defer s.walMu.Unlock()
+	data, err := json.Marshal(walRecord{Changes: changes})
+	if err != nil {
+		return fmt.Errorf("marshal wal record: %w", err)
+	}
+	data = append(data, '\n')
+	if _, err := s.wal.Write(data); err != nil {
+		s.rollbackWAL()
+		return fmt.Errorf("write wal: %w", err)
+	}
+	if err := s.wal.Sync(); err != nil {
+		s.rollbackWAL()
+		return fmt.Errorf("sync wal: %w", err)
+	}
+	s.walSize += int64(len(data))
+	s.walRecords++
+	if s.walRecords >= s.snapshotEvery {
+		select {
+		case s.snapshotCh <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// rollbackWAL отрезает частично записанную запись, чтобы следующие записи не шли после мусора
+func (s *FileStorage) rollbackWAL() {
+	if err := s.wal.Truncate(s.walSize); err != nil {
+		fmt.Fprintf(os.Stderr, "Error while truncating wal: %v\n", err)
+		return
+	}
+	if _, err := s.wal.Seek(s.walSize, io.SeekStart); err != nil {
+		fmt.Fprintf(os.Stderr, "Error while seeking wal: %v\n", err)
+	}
+}
+
+// writeSnapshot атомарно заменяет снимок текущим состоянием и очищает журнал.
+// На время снимка блокируются все шарды, чтобы снимок и журнал не разошлись
+func (s *FileStorage) writeSnapshot() error {
+	s.lockAll()
+	defer s.unlockAll()
+	s.walMu.Lock()
+	defer s.walMu.Unlock()
+	data, err := json.Marshal(s.snapshot())
+	if err != nil {
+		return fmt.Errorf("marshal snapshot: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, snapshotFileName), data); err != nil {
+		return err
+	}
+	// Если процесс упадет до очистки журнала, повторное проигрывание записей поверх снимка
+	// даст то же состояние, так как каждая запись просто задает итоговое значение события
+	if err := s.wal.Truncate(0); err != nil {
+		return fmt.Errorf("truncate wal: %w", err)
+	}
+	if _, err := s.wal.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek wal: %w", err)
+	}
+	s.walSize = 0
+	s.walRecords = 0
+	return nil
+}
+
+// writeFileAtomic записывает данные во временный файл и переименовывает его в name
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", tmp, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("write %s: %w", tmp, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync %s: %w", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return fmt.Errorf("rename %s: %w", tmp, err)
+	}
+	return nil
+}
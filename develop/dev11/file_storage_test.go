@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStorageRestore(t *testing.T) {
+	tests := []struct {
+		name          string
+		snapshotEvery int
+	}{
+		{
+			name:          "Restore from wal only",
+			snapshotEvery: 100,
+		},
+		{
+			name:          "Restore from snapshot and wal",
+			snapshotEvery: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			date := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+
+			s, err := NewFileStorage(dir, tt.snapshotEvery)
+			require.NoError(t, err)
+			first, err := s.Create(&Event{UserID: "34", Name: "action", Start: date, End: date})
+			require.NoError(t, err)
+			second, err := s.Create(&Event{UserID: "34", Name: "action2", Start: date, End: date})
+			require.NoError(t, err)
+			_, err = s.Create(&Event{UserID: "34", Name: "action3", Start: date, End: date})
+			require.NoError(t, err)
+			_, err = s.Update(&Event{UserID: "34", ID: first.ID, Name: "renamed", Start: date, End: date})
+			require.NoError(t, err)
+			_, err = s.Delete(&Event{UserID: "34", ID: second.ID})
+			require.NoError(t, err)
+			require.NoError(t, s.Close())
+
+			restored, err := NewFileStorage(dir, tt.snapshotEvery)
+			require.NoError(t, err)
+			defer restored.Close()
+			events, err := restored.GetEventsPerDay("34", date)
+			require.NoError(t, err)
+			assert.Len(t, events, 2)
+			names := []string{events[0].Name, events[1].Name}
+			assert.ElementsMatch(t, []string{"renamed", "action3"}, names)
+		})
+	}
+}
+
+func TestFileStorageTornWALRecord(t *testing.T) {
+	dir := t.TempDir()
+	date := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+
+	s, err := NewFileStorage(dir, 100)
+	require.NoError(t, err)
+	_, err = s.Create(&Event{UserID: "34", Name: "action", Start: date, End: date})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// Имитируем падение процесса посреди записи
+	f, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"changes":[{"status":0,"ev`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	restored, err := NewFileStorage(dir, 100)
+	require.NoError(t, err)
+	_, err = restored.Create(&Event{UserID: "34", Name: "action2", Start: date, End: date})
+	require.NoError(t, err)
+	require.NoError(t, restored.Close())
+
+	restored, err = NewFileStorage(dir, 100)
+	require.NoError(t, err)
+	defer restored.Close()
+	events, err := restored.GetEventsPerDay("34", date)
+	require.NoError(t, err)
+	assert.Len(t, events, 2)
+}
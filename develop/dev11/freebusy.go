@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// BusyInterval занятый интервал [Start, End) в формате RFC 3339
+type BusyInterval struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// FreeBusyResult занятые интервалы одного пользователя, возвращается в /free_busy
+type FreeBusyResult struct {
+	UserID string         `json:"user_id"`
+	Busy   []BusyInterval `json:"busy"`
+}
+
+// busyIntervals объединяет пересекающиеся и смежные события в занятые интервалы, обрезанные по [from, to).
+// События без длительности время не занимают
+func busyIntervals(events []Event, from, to time.Time) [][2]time.Time {
+	var intervals [][2]time.Time
+	for _, e := range events {
+		if !e.busy() || !e.Overlaps(from, to) {
+			continue
+		}
+		start, end := e.Start, e.End
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		intervals = append(intervals, [2]time.Time{start, end})
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i][0].Before(intervals[j][0]) })
+	var res [][2]time.Time
+	for _, interval := range intervals {
+		if n := len(res); n > 0 && !interval[0].After(res[n-1][1]) {
+			if interval[1].After(res[n-1][1]) {
+				res[n-1][1] = interval[1]
+			}
+			continue
+		}
+		res = append(res, interval)
+	}
+	return res
+}
+
+// getFreeBusy возвращает занятые интервалы одного или нескольких пользователей (несколько параметров user_id)
+// в диапазоне from - to. Время выводится в часовом поясе timezone, у пользователя без событий интервалов нет
+func getFreeBusy(w http.ResponseWriter, r *http.Request, storage Storage) {
+	if r.Method != http.MethodGet {
+		writeErrorMessage(w, http.StatusMethodNotAllowed, "Wrong method")
+		return
+	}
+
+	query := r.URL.Query()
+	_, from, to, loc, err := ParseUserAndRange(query)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	userIDs := query["user_id"]
+	if len(userIDs) == 0 {
+		writeErrorMessage(w, http.StatusBadRequest, "empty parameters")
+		return
+	}
+	from, to, err = defaultRange(from, to, loc)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	res := make([]FreeBusyResult, len(userIDs))
+	for i, userID := range userIDs {
+		res[i] = FreeBusyResult{UserID: userID, Busy: []BusyInterval{}}
+		events, err := getEventsInRange(storage, userID, from, to)
+		if err != nil {
+			if err, ok := err.(*ValidationError); ok && err.NotFound {
+				continue
+			}
+			writeError(w, err)
+			return
+		}
+		for _, interval := range busyIntervals(events, from, to) {
+			res[i].Busy = append(res[i].Busy, BusyInterval{
+				Start: interval[0].In(loc).Format(time.RFC3339),
+				End:   interval[1].In(loc).Format(time.RFC3339),
+			})
+		}
+	}
+	marshalResponseAndWrite(w, http.StatusOK, Response{Result: res})
+}
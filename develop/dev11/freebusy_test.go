@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRejectConflicts(t *testing.T) {
+	at := func(value string) time.Time {
+		res, err := time.Parse(time.RFC3339, value)
+		require.NoError(t, err)
+		return res
+	}
+	s := NewMemoryStorage()
+	meeting, err := s.Create(&Event{UserID: "34", Name: "meeting", Start: at("2024-03-04T10:00:00Z"), End: at("2024-03-04T11:00:00Z")})
+	require.NoError(t, err)
+	_, err = s.Create(&Event{UserID: "34", Name: "standup", Start: at("2024-03-05T09:00:00Z"), End: at("2024-03-05T09:15:00Z"), RRule: "FREQ=WEEKLY"})
+	require.NoError(t, err)
+	_, err = s.Create(&Event{UserID: "34", Name: "reminder", Start: at("2024-03-06T12:00:00Z"), End: at("2024-03-06T12:00:00Z")})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		event     Event
+		conflicts []string
+	}{
+		{"overlapping event", Event{Start: at("2024-03-04T10:30:00Z"), End: at("2024-03-04T11:30:00Z")}, []string{"meeting"}},
+		{"adjacent event", Event{Start: at("2024-03-04T11:00:00Z"), End: at("2024-03-04T12:00:00Z")}, nil},
+		{"occurrence of series", Event{Start: at("2024-04-02T09:10:00Z"), End: at("2024-04-02T10:00:00Z")}, []string{"standup"}},
+		{"between occurrences", Event{Start: at("2024-04-02T09:15:00Z"), End: at("2024-04-02T10:00:00Z")}, nil},
+		{"event without duration", Event{Start: at("2024-03-04T10:30:00Z"), End: at("2024-03-04T10:30:00Z")}, nil},
+		{"over event without duration", Event{Start: at("2024-03-06T11:00:00Z"), End: at("2024-03-06T13:00:00Z")}, nil},
+		{"series over event", Event{Start: at("2024-02-26T10:00:00Z"), End: at("2024-02-26T10:30:00Z"), RRule: "FREQ=WEEKLY;COUNT=3"}, []string{"meeting"}},
+		{"all-day event", Event{Start: at("2024-03-05T00:00:00Z"), End: at("2024-03-06T00:00:00Z"), AllDay: true}, []string{"standup"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := tt.event
+			event.UserID = "34"
+			event.Name = "new"
+			_, err := s.Create(&event, RejectConflicts())
+			if tt.conflicts == nil {
+				require.NoError(t, err)
+				_, err = s.Delete(&event)
+				require.NoError(t, err)
+				return
+			}
+			var conflictErr *ConflictError
+			require.ErrorAs(t, err, &conflictErr)
+			var names []string
+			for _, e := range conflictErr.Conflicts {
+				names = append(names, e.Name)
+			}
+			assert.Equal(t, tt.conflicts, names)
+		})
+	}
+
+	// Событие не конфликтует само с собой при обновлении
+	meeting.Start = at("2024-03-04T10:30:00Z")
+	_, err = s.Update(meeting, RejectConflicts())
+	require.NoError(t, err)
+	meeting.Start = at("2024-03-05T09:00:00Z")
+	meeting.End = at("2024-03-05T10:00:00Z")
+	_, err = s.Update(meeting, RejectConflicts())
+	require.ErrorAs(t, err, new(*ConflictError))
+	// Без RejectConflicts пересечения разрешены
+	_, err = s.Update(meeting)
+	require.NoError(t, err)
+}
+
+func TestRejectConflictsAttendees(t *testing.T) {
+	at := func(value string) time.Time {
+		res, err := time.Parse(time.RFC3339, value)
+		require.NoError(t, err)
+		return res
+	}
+	s := NewMemoryStorage()
+	_, err := s.Create(&Event{UserID: "35", Name: "attendee busy", Start: at("2024-03-04T10:00:00Z"), End: at("2024-03-04T11:00:00Z")})
+	require.NoError(t, err)
+	invitation, err := s.Create(&Event{UserID: "36", Name: "invitation", Start: at("2024-03-04T14:00:00Z"), End: at("2024-03-04T15:00:00Z"),
+		Attendees: []Attendee{{UserID: "34"}}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		event     Event
+		conflicts []string
+	}{
+		{"attendee event", Event{Start: at("2024-03-04T10:30:00Z"), End: at("2024-03-04T11:30:00Z"), Attendees: []Attendee{{UserID: "35"}}}, []string{"attendee busy"}},
+		{"other user event", Event{Start: at("2024-03-04T10:30:00Z"), End: at("2024-03-04T11:30:00Z")}, nil},
+		{"organizer invitation", Event{Start: at("2024-03-04T14:30:00Z"), End: at("2024-03-04T15:30:00Z")}, []string{"invitation"}},
+		{"attendee invitation", Event{UserID: "35", Start: at("2024-03-04T14:30:00Z"), End: at("2024-03-04T15:30:00Z"), Attendees: []Attendee{{UserID: "34"}}}, []string{"invitation"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := tt.event
+			if event.UserID == "" {
+				event.UserID = "34"
+			}
+			event.Name = "new"
+			_, err := s.Create(&event, RejectConflicts())
+			if tt.conflicts == nil {
+				require.NoError(t, err)
+				_, err = s.Delete(&event)
+				require.NoError(t, err)
+				return
+			}
+			var conflictErr *ConflictError
+			require.ErrorAs(t, err, &conflictErr)
+			var names []string
+			for _, e := range conflictErr.Conflicts {
+				names = append(names, e.Name)
+			}
+			assert.Equal(t, tt.conflicts, names)
+		})
+	}
+
+	overlapping := func() *Event {
+		return &Event{UserID: "34", ID: "put", Name: "new", Start: at("2024-03-04T14:30:00Z"), End: at("2024-03-04T15:30:00Z")}
+	}
+	_, _, err = s.Put(overlapping(), RejectConflicts())
+	require.ErrorAs(t, err, new(*ConflictError))
+	_, err = s.Batch([]BatchOperation{{Action: BatchCreate, Event: overlapping(), Options: []WriteOption{RejectConflicts()}}})
+	require.ErrorAs(t, err, new(*ConflictError))
+
+	// Отклоненное приглашение время не занимает
+	_, err = s.Respond("36", invitation.ID, "34", AttendeeDeclined)
+	require.NoError(t, err)
+	_, _, err = s.Put(overlapping(), RejectConflicts())
+	require.NoError(t, err)
+}
+
+func TestRejectConflictsHandler(t *testing.T) {
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			handler := newHandler(&Config{}, backend.newStorage(t), Services{})
+			ts := httptest.NewServer(handler)
+			defer ts.Close()
+
+			_, err := createEventAndGetID(ts, handler, "user_id=34&start=2024-03-04T10:00:00Z&duration=1h&name=meeting")
+			require.NoError(t, err)
+			overlapping := "user_id=34&start=2024-03-04T10:30:00Z&duration=1h&name=other"
+
+			resp := makePostRequest(ts, handler, "/create_event/", overlapping+"&reject_conflicts=true")
+			require.Equal(t, http.StatusConflict, resp.Code)
+			var errResp ErrorResponse
+			require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &errResp))
+			require.Len(t, errResp.Conflicts, 1)
+			assert.Equal(t, "meeting", errResp.Conflicts[0].Name)
+
+			resp = makePostRequest(ts, handler, "/create_event/", overlapping+"&reject_conflicts=abc")
+			assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+			id, err := createEventAndGetID(ts, handler, overlapping)
+			require.NoError(t, err)
+			resp = makePostRequest(ts, handler, "/update_event/", overlapping+"&id="+id+"&reject_conflicts=1")
+			assert.Equal(t, http.StatusConflict, resp.Code)
+
+			resp = makeJSONRequest(handler, http.MethodPost, "/users/34/events?reject_conflicts=true", `{"name":"rest","start":"2024-03-04T09:30:00Z","duration":"1h"}`)
+			assert.Equal(t, http.StatusConflict, resp.Code)
+		})
+	}
+}
+
+func TestFreeBusy(t *testing.T) {
+	handler := getHandler()
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	for _, body := range []string{
+		"user_id=34&start=2024-03-04T10:00:00Z&duration=1h&name=a",
+		"user_id=34&start=2024-03-04T10:30:00Z&duration=1h&name=overlapping",
+		"user_id=34&start=2024-03-04T11:30:00Z&duration=30m&name=adjacent",
+		"user_id=34&start=2024-03-04T15:00:00Z&name=no_duration",
+		"user_id=34&start=2024-03-05T09:00:00Z&duration=1h&rrule=FREQ%3DDAILY%3BCOUNT%3D2&name=daily",
+		"user_id=34&start=2024-03-07T23:00:00Z&duration=2h&name=crosses_range_end",
+		"user_id=35&start=2024-03-04T12:00:00Z&duration=1h&name=b",
+	} {
+		_, err := createEventAndGetID(ts, handler, body)
+		require.NoError(t, err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/free_busy/?user_id=34&user_id=35&user_id=36&from=2024-03-04&to=2024-03-07", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	var result struct {
+		Result []FreeBusyResult `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &result))
+	assert.Equal(t, []FreeBusyResult{
+		{UserID: "34", Busy: []BusyInterval{
+			{Start: "2024-03-04T10:00:00Z", End: "2024-03-04T12:00:00Z"},
+			{Start: "2024-03-05T09:00:00Z", End: "2024-03-05T10:00:00Z"},
+			{Start: "2024-03-06T09:00:00Z", End: "2024-03-06T10:00:00Z"},
+			{Start: "2024-03-07T23:00:00Z", End: "2024-03-08T00:00:00Z"},
+		}},
+		{UserID: "35", Busy: []BusyInterval{{Start: "2024-03-04T12:00:00Z", End: "2024-03-04T13:00:00Z"}}},
+		{UserID: "36", Busy: []BusyInterval{}},
+	}, result.Result)
+
+	req = httptest.NewRequest(http.MethodGet, "/free_busy/?user_id=35&from=2024-03-04&to=2024-03-04&timezone=Europe/Moscow", nil)
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &result))
+	assert.Equal(t, []BusyInterval{{Start: "2024-03-04T15:00:00+03:00", End: "2024-03-04T16:00:00+03:00"}}, result.Result[0].Busy)
+
+	req = httptest.NewRequest(http.MethodGet, "/free_busy/?from=2024-03-04", nil)
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
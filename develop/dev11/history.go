@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// historyFileName файл истории изменений в директории хранилища
+	historyFileName = "history.log"
+	// defaultHistoryMaxVersions сколько последних версий события хранится по умолчанию
+	defaultHistoryMaxVersions = 100
+	// defaultHistoryMaxAge сколько хранятся изменения по умолчанию
+	defaultHistoryMaxAge = 90 * 24 * time.Hour
+	// historyCompactMin с какого количества удаленных записей файл истории переписывается
+	historyCompactMin = 1000
+)
+
+// HistoryConfig ограничения хранения истории изменений, нулевые значения заменяются значениями по умолчанию
+type HistoryConfig struct {
+	// MaxVersions сколько последних версий хранится для каждого события
+	MaxVersions int `json:"max_versions"`
+	// MaxAge сколько хранятся изменения, более старые версии нельзя восстановить и нет в журнале аудита
+	MaxAge Duration `json:"max_age"`
+}
+
+// validate проверяет ограничения хранения истории
+func (cfg *HistoryConfig) validate() error {
+	if cfg.MaxVersions < 0 {
+		return fmt.Errorf("history.max_versions must not be negative")
+	}
+	if cfg.MaxAge < 0 {
+		return fmt.Errorf("history.max_age must not be negative")
+	}
+	return nil
+}
+
+// AsActor задает автора изменения для истории и журнала аудита
+func AsActor(actor string) WriteOption {
+	return func(o *writeOptions) {
+		o.actor = actor
+	}
+}
+
+// requestActor возвращает автора изменений запроса: пользователя из токена, а без аутентификации -
+// владельца календаря userID, так как других сведений о клиенте нет
+func requestActor(r *http.Request, userID string) WriteOption {
+	if p := PrincipalFromContext(r.Context()); p != nil {
+		return AsActor(p.UserID)
+	}
+	return AsActor(userID)
+}
+
+// HistoryEntry версия события: одно его изменение с состоянием до и после
+type HistoryEntry struct {
+	// Version версия события Event.Version после изменения, для удаленного события - версия удаления
+	Version int64     `json:"version"`
+	UserID  string    `json:"user_id"`
+	EventID string    `json:"event_id"`
+	Status  Status    `json:"status"`
+	Actor   string    `json:"actor,omitempty"`
+	Time    time.Time `json:"time"`
+	// Before событие до изменения, nil для созданного события
+	Before *Event `json:"before,omitempty"`
+	// After событие после изменения, nil для удаленного события
+	After *Event `json:"after,omitempty"`
+}
+
+// normalizeVersion выводит Version из состояния события после изменения, так как в файлах истории
+// прежнего формата Version был номером записи
+func (entry *HistoryEntry) normalizeVersion() {
+	switch {
+	case entry.After != nil:
+		entry.Version = entry.After.Version
+	case entry.Before != nil:
+		entry.Version = entry.Before.Version + 1
+	}
+}
+
+type historyKey struct {
+	userID string
+	id     string
+}
+
+// historyRecord запись истории. expired означает, что запись удалена ограничениями хранения
+// и будет убрана из entries при сжатии
+type historyRecord struct {
+	HistoryEntry
+	expired bool
+}
+
+// History хранит изменения событий в пределах ограничений HistoryConfig. Если задан файл, изменения
+// дописываются в него и загружаются из него при старте, а удаленные ограничениями записи время от времени
+// вычищаются из файла. Безопасна для конкурентного использования
+type History struct {
+	maxVersions int
+	maxAge      time.Duration
+	now         func() time.Time
+
+	mu sync.RWMutex
+	// entries записи в порядке изменений
+	entries []*historyRecord
+	// versions хранимые версии события в порядке изменений
+	versions map[historyKey][]*historyRecord
+	// expired сколько записей entries удалено ограничениями хранения
+	expired int
+	// stale сколько записей файла удалено ограничениями хранения, для истории в памяти - сколько было бы удалено
+	stale int
+	path  string
+	file  *os.File
+}
+
+// NewHistory загружает историю из файла path с ограничениями хранения cfg.
+// Пустой path означает историю только в памяти
+func NewHistory(path string, cfg HistoryConfig) (*History, error) {
+	h := &History{
+		maxVersions: cfg.MaxVersions,
+		maxAge:      time.Duration(cfg.MaxAge),
+		now:         time.Now,
+		versions:    make(map[historyKey][]*historyRecord),
+		path:        path,
+	}
+	if h.maxVersions <= 0 {
+		h.maxVersions = defaultHistoryMaxVersions
+	}
+	if h.maxAge <= 0 {
+		h.maxAge = defaultHistoryMaxAge
+	}
+	if path == "" {
+		return h, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open history: %w", err)
+	}
+	reader := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("read history: %w", err)
+		}
+		var entry HistoryEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("parse history entry at offset %d: %w", offset, err)
+		}
+		entry.normalizeVersion()
+		h.add(entry)
+		offset += int64(len(line))
+	}
+	// Недописанная последняя запись отбрасывается, как в журнале хранилища
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("truncate history: %w", err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("seek history: %w", err)
+	}
+	h.file = f
+	h.expire(h.now())
+	if err := h.compact(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// Close закрывает файл истории
+func (h *History) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file == nil {
+		return nil
+	}
+	return h.file.Close()
+}
+
+// add добавляет запись, удаляя версии события сверх maxVersions. Если версия не больше последней
+// хранимой, событие создано заново после удаления (не через Revert): его прежние версии перестают
+// быть версиями события, но остаются в журнале аудита
+func (h *History) add(entry HistoryEntry) {
+	key := historyKey{userID: entry.UserID, id: entry.EventID}
+	versions := h.versions[key]
+	if n := len(versions); n > 0 && entry.Version <= versions[n-1].Version {
+		versions = nil
+	}
+	record := &historyRecord{HistoryEntry: entry}
+	versions = append(versions, record)
+	if len(versions) > h.maxVersions {
+		versions[0].expired = true
+		h.expired++
+		h.stale++
+		versions = versions[1:]
+	}
+	h.versions[key] = versions
+	h.entries = append(h.entries, record)
+}
+
+// expire удаляет записи старше maxAge на момент now. Записи добавляются по времени изменения,
+// поэтому устаревшие записи находятся в начале entries
+func (h *History) expire(now time.Time) {
+	deadline := now.Add(-h.maxAge)
+	n := 0
+	for ; n < len(h.entries) && h.entries[n].Time.Before(deadline); n++ {
+		record := h.entries[n]
+		if record.expired {
+			h.expired--
+			continue
+		}
+		h.stale++
+		key := historyKey{userID: record.UserID, id: record.EventID}
+		if versions := h.versions[key]; len(versions) > 0 && versions[0] == record {
+			if len(versions) == 1 {
+				delete(h.versions, key)
+			} else {
+				h.versions[key] = versions[1:]
+			}
+		}
+	}
+	h.entries = h.entries[n:]
+}
+
+// compact убирает удаленные записи из entries и переписывает файл истории, когда удаленных записей
+// в нем не меньше historyCompactMin и не меньше хранимых
+func (h *History) compact() error {
+	if h.stale < historyCompactMin || h.stale < len(h.entries)-h.expired {
+		return nil
+	}
+	entries := make([]*historyRecord, 0, len(h.entries)-h.expired)
+	var data []byte
+	for _, record := range h.entries {
+		if record.expired {
+			continue
+		}
+		entries = append(entries, record)
+		if h.file == nil {
+			continue
+		}
+		line, err := json.Marshal(record.HistoryEntry)
+		if err != nil {
+			return fmt.Errorf("marshal history entry: %w", err)
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if h.file != nil {
+		if err := writeFileAtomic(h.path, data); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("open history: %w", err)
+		}
+		h.file.Close()
+		h.file = f
+	}
+	h.entries = entries
+	h.expired = 0
+	h.stale = 0
+	return nil
+}
+
+// Record добавляет изменения хранилища в историю. Вызывается хранилищем после каждого изменения.
+// Ошибка записи в файл не отменяет изменение события, поэтому только выводится в лог
+func (h *History) Record(changes []Change) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, c := range changes {
+		entry := HistoryEntry{
+			Version: c.Event.Version,
+			UserID:  c.Event.UserID,
+			EventID: c.Event.ID,
+			Status:  c.Status,
+			Actor:   c.Actor,
+			Time:    c.Time,
+			Before:  c.Before,
+		}
+		if c.Status != Deleted {
+			after := c.Event
+			entry.After = &after
+		}
+		h.add(entry)
+		if h.file == nil {
+			continue
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error while serializing history entry", err)
+			continue
+		}
+		if _, err := h.file.Write(append(data, '\n')); err != nil {
+			fmt.Fprintf(os.Stderr, "Error while writing history of event %s: %v\n", c.Event.ID, err)
+		}
+	}
+	h.expire(h.now())
+	if err := h.compact(); err != nil {
+		// Удаленные записи остаются в файле и будут убраны при следующем сжатии
+		fmt.Fprintf(os.Stderr, "Error while compacting history: %v\n", err)
+	}
+}
+
+// EventHistory возвращает хранимые версии события, начиная с самой ранней
+func (h *History) EventHistory(userID, id string) ([]HistoryEntry, error) {
+	if userID == "" || id == "" {
+		return nil, &ValidationError{Message: "empty parameters"}
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	versions, ok := h.versions[historyKey{userID: userID, id: id}]
+	if !ok {
+		return nil, &ValidationError{Message: "Event history does not exist", NotFound: true}
+	}
+	res := make([]HistoryEntry, 0, len(versions))
+	for _, record := range versions {
+		res = append(res, record.HistoryEntry)
+	}
+	return res, nil
+}
+
+// Version возвращает версию version события
+func (h *History) Version(userID, id string, version int64) (HistoryEntry, error) {
+	versions, err := h.EventHistory(userID, id)
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	return findVersion(versions, version)
+}
+
+// findVersion ищет версию version среди версий события
+func findVersion(versions []HistoryEntry, version int64) (HistoryEntry, error) {
+	for _, entry := range versions {
+		if entry.Version == version {
+			return entry, nil
+		}
+	}
+	return HistoryEntry{}, &ValidationError{Message: "Version does not exist", NotFound: true}
+}
+
+// AuditLog возвращает изменения событий пользователя userID (пустой - всех пользователей)
+// в интервале [from, to). Нулевые from и to не ограничивают интервал
+func (h *History) AuditLog(userID string, from, to time.Time) []HistoryEntry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	res := []HistoryEntry{}
+	for _, record := range h.entries {
+		if record.expired || userID != "" && record.UserID != userID {
+			continue
+		}
+		if !from.IsZero() && record.Time.Before(from) || !to.IsZero() && !record.Time.Before(to) {
+			continue
+		}
+		res = append(res, record.HistoryEntry)
+	}
+	return res
+}
+
+// Revert восстанавливает событие в состоянии версии version. Если в этой версии событие было удалено,
+// оно удаляется. Восстановление записывается в историю как новая версия
+func (h *History) Revert(storage Storage, userID, id string, version int64, opts ...WriteOption) (*Event, Status, error) {
+	versions, err := h.EventHistory(userID, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	entry, err := findVersion(versions, version)
+	if err != nil {
+		return nil, 0, err
+	}
+	if entry.After == nil {
+		event, err := storage.Delete(&Event{UserID: userID, ID: id}, opts...)
+		return event, Deleted, err
+	}
+	event := *entry.After
+	// Удаленное событие создается заново и продолжает нумерацию версий, чтобы номера версий не повторялись
+	event.Version = versions[len(versions)-1].Version
+	return storage.Put(&event, opts...)
+}
+
+// HistoryResult версия события в ответе API
+type HistoryResult struct {
+	Version int64        `json:"version"`
+	UserID  string       `json:"user_id"`
+	EventID string       `json:"event_id"`
+	Status  Status       `json:"status"`
+	Actor   string       `json:"actor,omitempty"`
+	Time    string       `json:"time"`
+	Before  *EventResult `json:"before,omitempty"`
+	After   *EventResult `json:"after,omitempty"`
+}
+
+func newHistoryResults(entries []HistoryEntry) []HistoryResult {
+	res := make([]HistoryResult, 0, len(entries))
+	for _, entry := range entries {
+		r := HistoryResult{
+			Version: entry.Version,
+			UserID:  entry.UserID,
+			EventID: entry.EventID,
+			Status:  entry.Status,
+			Actor:   entry.Actor,
+			Time:    entry.Time.Format(time.RFC3339),
+		}
+		if entry.Before != nil {
+			before := newEventResult(*entry.Before)
+			r.Before = &before
+		}
+		if entry.After != nil {
+			after := newEventResult(*entry.After)
+			r.After = &after
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// getEventHistory возвращает версии события id пользователя user_id
+func getEventHistory(w http.ResponseWriter, r *http.Request, history *History) {
+	if r.Method != http.MethodGet {
+		writeErrorMessage(w, http.StatusMethodNotAllowed, "Wrong method")
+		return
+	}
+	query := r.URL.Query()
+	entries, err := history.EventHistory(query.Get("user_id"), query.Get("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	marshalResponseAndWrite(w, http.StatusOK, Response{Result: newHistoryResults(entries)})
+}
+
+// revertEvent восстанавливает событие id пользователя user_id в состоянии версии version
+func revertEvent(w http.ResponseWriter, r *http.Request, storage Storage, history *History) {
+	if !validatePostRequest(w, r) {
+		return
+	}
+	userID, id := r.PostForm.Get("user_id"), r.PostForm.Get("id")
+	version, err := strconv.ParseInt(r.PostForm.Get("version"), 10, 64)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, "version parse error")
+		return
+	}
+	event, status, err := history.Revert(storage, userID, id, version, requestActor(r, userID))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("ETag", eventETag(event.Version))
+	marshalResponseAndWrite(w, http.StatusOK, Response{Result: PostResult{
+		ID:      event.ID,
+		Status:  status,
+		Version: event.Version,
+	}})
+}
+
+// getAuditLog возвращает изменения событий пользователя user_id (без него - всех пользователей)
+// за период from - to. При включенной аутентификации доступен только администраторам
+func getAuditLog(w http.ResponseWriter, r *http.Request, history *History) {
+	if r.Method != http.MethodGet {
+		writeErrorMessage(w, http.StatusMethodNotAllowed, "Wrong method")
+		return
+	}
+	if p := PrincipalFromContext(r.Context()); p != nil && !p.IsAdmin() {
+		writeErrorMessage(w, http.StatusForbidden, "Audit log is available only to administrators")
+		return
+	}
+	userID, from, to, _, err := ParseUserAndRange(r.URL.Query())
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	marshalResponseAndWrite(w, http.StatusOK, Response{Result: newHistoryResults(history.AuditLog(userID, from, to))})
+}
+
+// startHistory открывает историю изменений в директории хранилища и подписывает ее на изменения
+func startHistory(cfg *Config, storage Storage) (*History, error) {
+	source, ok := storage.(interface {
+		OnChange(fn func(changes []Change))
+	})
+	if !ok {
+		return nil, fmt.Errorf("storage does not support history")
+	}
+	var path string
+	if cfg.StoragePath != "" {
+		path = filepath.Join(cfg.StoragePath, historyFileName)
+	}
+	var historyCfg HistoryConfig
+	if cfg.History != nil {
+		historyCfg = *cfg.History
+	}
+	history, err := NewHistory(path, historyCfg)
+	if err != nil {
+		return nil, err
+	}
+	source.OnChange(history.Record)
+	return history, nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), historyFileName)
+	s := NewMemoryStorage()
+	history, err := NewHistory(path, HistoryConfig{})
+	require.NoError(t, err)
+	s.OnChange(history.Record)
+
+	start := mustTime(t, "2024-03-04T10:00:00Z")
+	event, err := s.Create(&Event{UserID: "34", Name: "first", Start: start, End: start.Add(time.Hour)}, AsActor("34"))
+	require.NoError(t, err)
+	id := event.ID
+	_, err = s.Update(&Event{UserID: "34", ID: id, Name: "second", Start: start, End: start.Add(time.Hour)}, AsActor("root"))
+	require.NoError(t, err)
+	_, err = s.Delete(&Event{UserID: "34", ID: id})
+	require.NoError(t, err)
+
+	check := func(t *testing.T, entries []HistoryEntry) {
+		require.Len(t, entries, 3)
+		assert.Equal(t, []int64{1, 2, 3}, []int64{entries[0].Version, entries[1].Version, entries[2].Version})
+		assert.Equal(t, []Status{Created, Updated, Deleted}, []Status{entries[0].Status, entries[1].Status, entries[2].Status})
+		assert.Equal(t, []string{"34", "root", ""}, []string{entries[0].Actor, entries[1].Actor, entries[2].Actor})
+		assert.Nil(t, entries[0].Before)
+		assert.Equal(t, "first", entries[0].After.Name)
+		assert.Equal(t, "first", entries[1].Before.Name)
+		assert.Equal(t, "second", entries[1].After.Name)
+		assert.Equal(t, "second", entries[2].Before.Name)
+		assert.Nil(t, entries[2].After)
+		assert.False(t, entries[2].Time.IsZero())
+	}
+	entries, err := history.EventHistory("34", id)
+	require.NoError(t, err)
+	check(t, entries)
+	_, err = history.EventHistory("35", id)
+	assert.Error(t, err)
+
+	// История загружается из файла после перезапуска
+	require.NoError(t, history.Close())
+	history, err = NewHistory(path, HistoryConfig{})
+	require.NoError(t, err)
+	defer history.Close()
+	s = NewMemoryStorage()
+	s.OnChange(history.Record)
+	entries, err = history.EventHistory("34", id)
+	require.NoError(t, err)
+	check(t, entries)
+
+	// Восстановление удаленного события создает его заново и добавляет новую версию
+	restored, status, err := history.Revert(s, "34", id, 1, AsActor("34"))
+	require.NoError(t, err)
+	assert.Equal(t, Created, status)
+	assert.Equal(t, "first", restored.Name)
+	stored, err := s.Get("34", id)
+	require.NoError(t, err)
+	assert.Equal(t, "first", stored.Name)
+	_, status, err = history.Revert(s, "34", id, 3)
+	require.NoError(t, err)
+	assert.Equal(t, Deleted, status)
+	_, _, err = history.Revert(s, "34", id, 6)
+	assert.Error(t, err)
+
+	entries, err = history.EventHistory("34", id)
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+	assert.Equal(t, Created, entries[3].Status)
+	assert.Equal(t, int64(4), entries[3].Version)
+	assert.Equal(t, Deleted, entries[4].Status)
+}
+
+func TestHistoryHandlers(t *testing.T) {
+	storage := NewMemoryStorage()
+	history, err := NewHistory("", HistoryConfig{})
+	require.NoError(t, err)
+	storage.OnChange(history.Record)
+	handler := newHandler(&Config{}, storage, Services{History: history})
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	id, err := createEventAndGetID(ts, handler, "user_id=34&date=2024-03-04&name=first")
+	require.NoError(t, err)
+	resp := makePostRequest(ts, handler, "/update_event/", "user_id=34&date=2024-03-05&name=second&id="+id)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	getHistory := func() []HistoryResult {
+		req := httptest.NewRequest(http.MethodGet, "/event_history/?user_id=34&id="+id, nil)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+		var res struct {
+			Result []HistoryResult `json:"result"`
+		}
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &res))
+		return res.Result
+	}
+	versions := getHistory()
+	require.Len(t, versions, 2)
+	assert.Equal(t, "34", versions[0].Actor)
+	assert.Nil(t, versions[0].Before)
+	assert.Equal(t, "2024-03-04", versions[1].Before.Date)
+	assert.Equal(t, "2024-03-05", versions[1].After.Date)
+
+	resp = makePostRequest(ts, handler, "/revert_event/", "user_id=34&version=1&id="+id)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	events := getWeekEvents(t, handler, "user_id=34&date=2024-03-04")
+	require.Len(t, events, 1)
+	assert.Equal(t, "first", events[0].Name)
+	versions = getHistory()
+	require.Len(t, versions, 3)
+	assert.Equal(t, "second", versions[2].Before.Name)
+	assert.Equal(t, "first", versions[2].After.Name)
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"no version", "user_id=34&id=" + id},
+		{"unknown version", "user_id=34&version=10&id=" + id},
+		{"other user", "user_id=35&version=1&id=" + id},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := makePostRequest(ts, handler, "/revert_event/", tt.body)
+			assert.Equal(t, http.StatusBadRequest, resp.Code)
+		})
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	storage := NewMemoryStorage()
+	history, err := NewHistory("", HistoryConfig{})
+	require.NoError(t, err)
+	storage.OnChange(history.Record)
+	handler := newHandler(&Config{Auth: &AuthConfig{APIKeys: []APIKey{
+		{Key: "key-34", UserID: "34", Role: RoleUser},
+		{Key: "key-admin", UserID: "root", Role: RoleAdmin},
+	}}}, storage, Services{History: history})
+
+	resp := makeAuthRequest(handler, http.MethodPost, "/create_event/", "key-34", "date=2024-03-04&name=mine")
+	require.Equal(t, http.StatusOK, resp.Code)
+	resp = makeAuthRequest(handler, http.MethodPost, "/create_event/", "key-admin", "user_id=35&date=2024-03-04&name=theirs")
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	today := time.Now().UTC().Format("2006-01-02")
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1).Format("2006-01-02")
+	tests := []struct {
+		name   string
+		token  string
+		query  string
+		status int
+		actors []string
+	}{
+		{"all users", "key-admin", "", http.StatusOK, []string{"34", "root"}},
+		{"one user", "key-admin", "?user_id=35", http.StatusOK, []string{"root"}},
+		{"time range", "key-admin", "?from=" + today + "&to=" + today, http.StatusOK, []string{"34", "root"}},
+		{"empty time range", "key-admin", "?from=" + tomorrow, http.StatusOK, nil},
+		{"wrong time range", "key-admin", "?from=abc", http.StatusBadRequest, nil},
+		{"not admin", "key-34", "", http.StatusForbidden, nil},
+		{"not admin own calendar", "key-34", "?user_id=34", http.StatusForbidden, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := makeAuthRequest(handler, http.MethodGet, "/audit_log/"+tt.query, tt.token, "")
+			require.Equal(t, tt.status, resp.Code, resp.Body.String())
+			if tt.status != http.StatusOK {
+				return
+			}
+			var res struct {
+				Result []HistoryResult `json:"result"`
+			}
+			require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &res))
+			var actors []string
+			for _, entry := range res.Result {
+				actors = append(actors, entry.Actor)
+			}
+			assert.Equal(t, tt.actors, actors)
+		})
+	}
+}
+
+func TestHistoryVersions(t *testing.T) {
+	s := NewMemoryStorage()
+	start := mustTime(t, "2024-03-04T10:00:00Z")
+	// Событие создано до ведения истории, поэтому первая версия в истории - вторая версия события
+	event, err := s.Create(&Event{UserID: "34", Name: "first", Start: start, End: start.Add(time.Hour)})
+	require.NoError(t, err)
+	history, err := NewHistory("", HistoryConfig{MaxVersions: 3})
+	require.NoError(t, err)
+	s.OnChange(history.Record)
+	for _, name := range []string{"second", "third", "fourth", "fifth"} {
+		_, err = s.Update(&Event{UserID: "34", ID: event.ID, Name: name, Start: start, End: start.Add(time.Hour)})
+		require.NoError(t, err)
+	}
+
+	entries, err := history.EventHistory("34", event.ID)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, []int64{3, 4, 5}, []int64{entries[0].Version, entries[1].Version, entries[2].Version})
+	assert.Len(t, history.AuditLog("34", time.Time{}, time.Time{}), 3)
+	_, err = history.Version("34", event.ID, 2)
+	assert.Error(t, err)
+	entry, err := history.Version("34", event.ID, 4)
+	require.NoError(t, err)
+	assert.Equal(t, "fourth", entry.After.Name)
+	reverted, _, err := history.Revert(s, "34", event.ID, 3)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), reverted.Version)
+	assert.Equal(t, "third", reverted.Name)
+
+	// Событие, созданное заново после удаления, начинает историю версий заново
+	_, err = s.Delete(&Event{UserID: "34", ID: event.ID})
+	require.NoError(t, err)
+	_, _, err = s.Put(&Event{UserID: "34", ID: event.ID, Name: "again", Start: start, End: start.Add(time.Hour)})
+	require.NoError(t, err)
+	entries, err = history.EventHistory("34", event.ID)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, int64(1), entries[0].Version)
+	// Прежние версии остаются в журнале аудита в пределах max_versions
+	assert.Len(t, history.AuditLog("34", time.Time{}, time.Time{}), 4)
+
+	// Изменения старше max_age удаляются при следующей записи
+	later := time.Now().Add(2 * time.Hour)
+	history.maxAge = time.Hour
+	history.now = func() time.Time { return later }
+	history.Record([]Change{{Status: Created, Event: Event{UserID: "35", ID: "other", Version: 1}, Time: later}})
+	_, err = history.EventHistory("34", event.ID)
+	assert.Error(t, err)
+	assert.Empty(t, history.AuditLog("34", time.Time{}, time.Time{}))
+	entries, err = history.EventHistory("35", "other")
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestHistoryCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), historyFileName)
+	history, err := NewHistory(path, HistoryConfig{MaxVersions: 2})
+	require.NoError(t, err)
+	s := NewMemoryStorage()
+	s.OnChange(history.Record)
+	start := mustTime(t, "2024-03-04T10:00:00Z")
+	event, err := s.Create(&Event{UserID: "34", Name: "first", Start: start, End: start.Add(time.Hour)})
+	require.NoError(t, err)
+	for i := 0; i <= historyCompactMin; i++ {
+		event, err = s.Update(event)
+		require.NoError(t, err)
+	}
+	require.NoError(t, history.Close())
+
+	// Удаленные записи вычищены из файла, хранимые загружаются после перезапуска
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Less(t, strings.Count(string(data), "\n"), 10)
+	history, err = NewHistory(path, HistoryConfig{MaxVersions: 2})
+	require.NoError(t, err)
+	defer history.Close()
+	entries, err := history.EventHistory("34", event.ID)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, []int64{event.Version - 1, event.Version}, []int64{entries[0].Version, entries[1].Version})
+}
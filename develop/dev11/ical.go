@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	icalDateLayout      = "20060102"
+	icalDateTimeLayout  = "20060102T150405Z"
+	icalLocalTimeLayout = "20060102T150405"
+	// icalLineLimit максимальная длина строки в октетах без CRLF (RFC 5545, 3.1)
+	icalLineLimit = 75
+	// icalTimezoneYears на сколько лет после последнего события и текущего года выгружаются переходы VTIMEZONE
+	icalTimezoneYears = 10
+)
+
+// WriteICalendar записывает события в формате iCalendar (RFC 5545) как VCALENDAR с VEVENT на каждое событие.
+// UID берется из Event.ID. Серия выгружается одним VEVENT с RRULE и EXDATE, а каждое ее измененное
+// повторение - отдельным VEVENT с тем же UID и RECURRENCE-ID.
+// Время событий не в UTC выгружается местным с TZID, чтобы клиенты применяли правило серии в поясе события,
+// а для каждого пояса пишется VTIMEZONE. У дат событий на весь день TZID не бывает, поэтому их пояс
+// выгружается свойством X-WR-TIMEZONE
+func WriteICalendar(out io.Writer, events []Event, stamp time.Time) error {
+	w := &icalWriter{w: bufio.NewWriter(out)}
+	w.line("BEGIN", "VCALENDAR")
+	w.line("VERSION", "2.0")
+	w.line("PRODID", "-//WBL2//dev11 calendar//EN")
+	w.line("CALSCALE", "GREGORIAN")
+	// Пояса событий со временем и годы их событий
+	var zones []*time.Location
+	years := make(map[*time.Location][2]int)
+	for _, e := range events {
+		loc := e.Location()
+		if e.AllDay || isUTC(loc) {
+			continue
+		}
+		span, ok := years[loc]
+		if !ok {
+			zones = append(zones, loc)
+			span = [2]int{e.Start.In(loc).Year(), stamp.In(loc).Year()}
+		}
+		span[0] = min(span[0], e.Start.In(loc).Year())
+		span[1] = max(span[1], e.Start.In(loc).Year())
+		years[loc] = span
+	}
+	for _, loc := range zones {
+		w.timezone(loc, years[loc][0], years[loc][1]+icalTimezoneYears)
+	}
+	for _, e := range events {
+		w.event(e, stamp)
+		for _, o := range e.Overrides {
+			o.ID = e.ID
+			o.AllDay = e.AllDay
+			o.Timezone = e.Timezone
+			w.event(o, stamp)
+		}
+	}
+	w.line("END", "VCALENDAR")
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+// isUTC проверяет, что время в поясе loc не отличается от UTC и его можно выгружать без TZID
+func isUTC(loc *time.Location) bool {
+	return loc.String() == "UTC"
+}
+
+// timezone пишет VTIMEZONE пояса loc с его переходами с начала года from до конца года to.
+// Правила перехода не выводятся: каждый переход записывается отдельным STANDARD или DAYLIGHT,
+// первый задает смещение на начало года from
+func (w *icalWriter) timezone(loc *time.Location, from, to int) {
+	w.line("BEGIN", "VTIMEZONE")
+	w.line("TZID", loc.String())
+	t := time.Date(from, 1, 1, 0, 0, 0, 0, loc)
+	end := time.Date(to+1, 1, 1, 0, 0, 0, 0, loc)
+	_, offset := t.Zone()
+	w.observance(t, offset)
+	for {
+		_, next := t.ZoneBounds()
+		if next.IsZero() || !next.Before(end) {
+			break
+		}
+		_, offset = t.Zone()
+		w.observance(next, offset)
+		t = next
+	}
+	w.line("END", "VTIMEZONE")
+}
+
+// observance пишет STANDARD или DAYLIGHT для смещения, которое действует с onset. before - смещение до onset
+func (w *icalWriter) observance(onset time.Time, before int) {
+	kind := "STANDARD"
+	if onset.IsDST() {
+		kind = "DAYLIGHT"
+	}
+	name, offset := onset.Zone()
+	w.line("BEGIN", kind)
+	// DTSTART наступления смещения указывается местным временем по смещению до него
+	w.line("DTSTART", onset.In(time.FixedZone("", before)).Format(icalLocalTimeLayout))
+	w.line("TZOFFSETFROM", icalOffset(before))
+	w.line("TZOFFSETTO", icalOffset(offset))
+	w.line("TZNAME", escapeICalText(name))
+	w.line("END", kind)
+}
+
+// icalOffset форматирует смещение от UTC в секундах как UTC-OFFSET: +0300, -0330, +053728
+func icalOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+	res := fmt.Sprintf("%s%02d%02d", sign, offset/3600, offset/60%60)
+	if offset%60 != 0 {
+		res += fmt.Sprintf("%02d", offset%60)
+	}
+	return res
+}
+
+// event пишет VEVENT события: для серии с правилом и удаленными повторениями,
+// для измененного повторения - с RECURRENCE-ID
+func (w *icalWriter) event(e Event, stamp time.Time) {
+	loc := e.Location()
+	w.line("BEGIN", "VEVENT")
+	w.line("UID", escapeICalText(e.ID))
+	w.line("DTSTAMP", stamp.UTC().Format(icalDateTimeLayout))
+	w.time("DTSTART", e.Start, e.AllDay, loc)
+	w.time("DTEND", e.End, e.AllDay, loc)
+	if e.AllDay && !isUTC(loc) {
+		w.line("X-WR-TIMEZONE", loc.String())
+	}
+	if !e.RecurrenceID.IsZero() {
+		w.time("RECURRENCE-ID", e.RecurrenceID, e.AllDay, loc)
+	} else if e.RRule != "" {
+		w.line("RRULE", icalRRule(&e, loc))
+		if len(e.ExDates) > 0 {
+			exdates := make([]string, len(e.ExDates))
+			for i, t := range e.ExDates {
+				exdates[i] = icalTime(t, e.AllDay, loc)
+			}
+			w.line("EXDATE"+icalTimeParams(e.AllDay, loc), strings.Join(exdates, ","))
+		}
+	}
+	w.line("SUMMARY", escapeICalText(e.Name))
+	if e.Description != "" {
+		w.line("DESCRIPTION", escapeICalText(e.Description))
+	}
+	w.line("END", "VEVENT")
+}
+
+// icalRRule возвращает правило серии для RRULE. UNTIL должен быть того же типа, что и DTSTART
+// (RFC 5545, 3.3.10), поэтому у событий на весь день он выгружается датой в поясе loc, а у остальных - в UTC
+func icalRRule(e *Event, loc *time.Location) string {
+	rule, err := e.rule()
+	if err != nil || rule.Until.IsZero() {
+		return e.RRule
+	}
+	until := rule.Until.UTC().Format(icalDateTimeLayout)
+	if e.AllDay {
+		until = rule.Until.In(loc).Format(icalDateLayout)
+	}
+	parts := strings.Split(strings.TrimPrefix(e.RRule, "RRULE:"), ";")
+	for i, part := range parts {
+		if key, _, _ := strings.Cut(part, "="); strings.EqualFold(key, "UNTIL") {
+			parts[i] = "UNTIL=" + until
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// icalWriter пишет строки содержимого iCalendar, запоминая первую ошибку
+type icalWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+// time пишет свойство со временем в формате icalTime
+func (w *icalWriter) time(name string, t time.Time, allDay bool, loc *time.Location) {
+	w.line(name+icalTimeParams(allDay, loc), icalTime(t, allDay, loc))
+}
+
+// icalTimeParams возвращает параметры свойства со временем в формате icalTime
+func icalTimeParams(allDay bool, loc *time.Location) string {
+	switch {
+	case allDay:
+		return ";VALUE=DATE"
+	case !isUTC(loc):
+		return ";TZID=" + loc.String()
+	}
+	return ""
+}
+
+// icalTime форматирует время события в его часовом поясе loc: дату для событий на весь день,
+// местное время для остальных поясов, кроме UTC
+func icalTime(t time.Time, allDay bool, loc *time.Location) string {
+	switch {
+	case allDay:
+		return t.In(loc).Format(icalDateLayout)
+	case !isUTC(loc):
+		return t.In(loc).Format(icalLocalTimeLayout)
+	}
+	return t.UTC().Format(icalDateTimeLayout)
+}
+
+// line пишет свойство name:value, сворачивая строку длиннее 75 октетов (RFC 5545, 3.1).
+// Строка разрывается только между символами UTF-8, продолжение начинается с пробела
+func (w *icalWriter) line(name, value string) {
+	if w.err != nil {
+		return
+	}
+	content := name + ":" + value
+	limit := icalLineLimit
+	for len(content) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(content[cut]) {
+			cut--
+		}
+		if _, w.err = w.w.WriteString(content[:cut] + "\r\n "); w.err != nil {
+			return
+		}
+		content = content[cut:]
+		// Пробел в начале строки продолжения занимает один октет
+		limit = icalLineLimit - 1
+	}
+	_, w.err = w.w.WriteString(content + "\r\n")
+}
+
+var icalTextEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\;`,
+	",", `\,`,
+	"\r\n", `\n`,
+	"\n", `\n`,
+	"\r", `\n`,
+)
+
+// escapeICalText экранирует значение типа TEXT (RFC 5545, 3.3.11)
+func escapeICalText(value string) string {
+	return icalTextEscaper.Replace(value)
+}
+
+// icalProperty строка содержимого iCalendar: NAME;PARAM=VALUE:value
+type icalProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// icalComponent компонент VEVENT со свойствами в порядке следования
+type icalComponent struct {
+	Props []icalProperty
+}
+
+// get возвращает первое свойство с заданным именем
+func (c *icalComponent) get(name string) (icalProperty, bool) {
+	for _, p := range c.Props {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return icalProperty{}, false
+}
+
+// ParseICalendar разбирает VCALENDAR и возвращает его компоненты VEVENT.
+// Остальные компоненты (VTIMEZONE, VTODO, VALARM внутри VEVENT и т.д.) пропускаются.
+// Пояс календаря X-WR-TIMEZONE добавляется в VEVENT, у которых нет своего
+func ParseICalendar(r io.Reader) ([]icalComponent, error) {
+	lines, err := unfoldICalLines(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 || !strings.EqualFold(lines[0], "BEGIN:VCALENDAR") {
+		return nil, &ValidationError{Message: "not an iCalendar file"}
+	}
+	var res []icalComponent
+	var current *icalComponent
+	// Глубина вложенности компонентов внутри VEVENT, свойства которых не относятся к событию
+	nested := 0
+	ended := false
+	var timezone *icalProperty
+	for i, line := range lines[1:] {
+		prop, err := parseICalProperty(line)
+		if err != nil {
+			return nil, &ValidationError{Message: fmt.Sprintf("line %d: %v", i+2, err)}
+		}
+		switch {
+		case prop.Name == "BEGIN" && strings.EqualFold(prop.Value, "VEVENT") && current == nil:
+			current = &icalComponent{}
+		case prop.Name == "BEGIN" && current != nil:
+			nested++
+		case prop.Name == "END" && current != nil && nested > 0:
+			nested--
+		case prop.Name == "END" && current != nil:
+			res = append(res, *current)
+			current = nil
+		case prop.Name == "END" && strings.EqualFold(prop.Value, "VCALENDAR"):
+			ended = true
+		case current != nil && nested == 0:
+			current.Props = append(current.Props, prop)
+		case current == nil && prop.Name == "X-WR-TIMEZONE":
+			timezone = &prop
+		}
+	}
+	if current != nil || !ended {
+		return nil, &ValidationError{Message: "unexpected end of iCalendar file"}
+	}
+	if timezone != nil {
+		for i := range res {
+			if _, ok := res[i].get("X-WR-TIMEZONE"); !ok {
+				res[i].Props = append(res[i].Props, *timezone)
+			}
+		}
+	}
+	return res, nil
+}
+
+// unfoldICalLines читает строки содержимого, склеивая свернутые строки (RFC 5545, 3.1)
+func unfoldICalLines(r io.Reader) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// parseICalProperty разбирает строку NAME;PARAM=VALUE;PARAM="VALUE":value
+func parseICalProperty(line string) (icalProperty, error) {
+	prop := icalProperty{Params: make(map[string]string)}
+	inQuotes := false
+	colon := -1
+	for i, r := range line {
+		if r == '"' {
+			inQuotes = !inQuotes
+		}
+		if r == ':' && !inQuotes {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return prop, fmt.Errorf("missing ':' in %q", line)
+	}
+	prop.Value = line[colon+1:]
+	parts := strings.Split(line[:colon], ";")
+	prop.Name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		key, value, ok := strings.Cut(param, "=")
+		if !ok {
+			return prop, fmt.Errorf("wrong parameter %q", param)
+		}
+		prop.Params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+	}
+	return prop, nil
+}
+
+var icalTextUnescaper = strings.NewReplacer(
+	`\\`, `\`,
+	`\;`, ";",
+	`\,`, ",",
+	`\n`, "\n",
+	`\N`, "\n",
+)
+
+// unescapeICalText снимает экранирование значения типа TEXT
+func unescapeICalText(value string) string {
+	return icalTextUnescaper.Replace(value)
+}
+
+// parseICalDateTime разбирает значение свойства DATE или DATE-TIME с учетом параметров VALUE и TZID.
+// Время без часового пояса понимается в поясе defaultLoc
+func parseICalDateTime(prop icalProperty, defaultLoc *time.Location) (t time.Time, allDay bool, err error) {
+	loc := defaultLoc
+	if tzid := prop.Params["TZID"]; tzid != "" {
+		loc, err = LoadLocation(tzid)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("unknown TZID %q", tzid)
+		}
+	}
+	allDay = strings.EqualFold(prop.Params["VALUE"], "DATE") || len(prop.Value) == len(icalDateLayout)
+	t, err = parseICalTime(prop.Value, loc)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("wrong time %q", prop.Value)
+	}
+	return t, allDay, nil
+}
+
+// parseICalDuration разбирает длительность RFC 5545 вида P1W, P1D, PT1H30M, -PT15M
+func parseICalDuration(value string) (days int, d time.Duration, err error) {
+	rest := value
+	sign := 1
+	switch {
+	case strings.HasPrefix(rest, "-"):
+		sign = -1
+		rest = rest[1:]
+	case strings.HasPrefix(rest, "+"):
+		rest = rest[1:]
+	}
+	if !strings.HasPrefix(rest, "P") || len(rest) < 3 {
+		return 0, 0, fmt.Errorf("wrong duration %q", value)
+	}
+	rest = rest[1:]
+	inTime := false
+	for rest != "" {
+		if rest[0] == 'T' {
+			inTime = true
+			rest = rest[1:]
+			continue
+		}
+		i := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+		if i <= 0 {
+			return 0, 0, fmt.Errorf("wrong duration %q", value)
+		}
+		n, _ := strconv.Atoi(rest[:i])
+		switch unit := rest[i]; {
+		case unit == 'W' && !inTime:
+			days += 7 * n
+		case unit == 'D' && !inTime:
+			days += n
+		case unit == 'H' && inTime:
+			d += time.Duration(n) * time.Hour
+		case unit == 'M' && inTime:
+			d += time.Duration(n) * time.Minute
+		case unit == 'S' && inTime:
+			d += time.Duration(n) * time.Second
+		default:
+			return 0, 0, fmt.Errorf("wrong duration %q", value)
+		}
+		rest = rest[i+1:]
+	}
+	return sign * days, time.Duration(sign) * d, nil
+}
+
+// icalEvent событие, полученное из VEVENT
+type icalEvent struct {
+	UID string
+	// RecurrenceID не нулевой для измененного повторения серии
+	RecurrenceID time.Time
+	Event        Event
+}
+
+// toEvent переводит VEVENT в событие пользователя userID. Ошибки в полях возвращаются как *ValidationError
+func (c *icalComponent) toEvent(userID string) (*icalEvent, error) {
+	res := &icalEvent{Event: Event{UserID: userID}}
+	fieldError := func(name string, err error) error {
+		return &ValidationError{Message: fmt.Sprintf("%s: %v", name, err)}
+	}
+	uid, ok := c.get("UID")
+	if !ok || uid.Value == "" {
+		return res, &ValidationError{Message: "UID: empty value"}
+	}
+	res.UID = unescapeICalText(uid.Value)
+	if summary, ok := c.get("SUMMARY"); ok {
+		res.Event.Name = unescapeICalText(summary.Value)
+	}
+	if description, ok := c.get("DESCRIPTION"); ok {
+		res.Event.Description = unescapeICalText(description.Value)
+	}
+	dtstart, ok := c.get("DTSTART")
+	if !ok {
+		return res, &ValidationError{Message: "DTSTART: empty value"}
+	}
+	loc := time.UTC
+	if tzid := dtstart.Params["TZID"]; tzid != "" {
+		var err error
+		if loc, err = LoadLocation(tzid); err != nil {
+			return res, fieldError("DTSTART", fmt.Errorf("unknown TZID %q", tzid))
+		}
+	} else if tz, ok := c.get("X-WR-TIMEZONE"); ok {
+		// Пояс дат и времени без TZID, например событий на весь день
+		var err error
+		if loc, err = LoadLocation(tz.Value); err != nil {
+			return res, fieldError("X-WR-TIMEZONE", fmt.Errorf("unknown time zone %q", tz.Value))
+		}
+	}
+	res.Event.Timezone = loc.String()
+	var err error
+	res.Event.Start, res.Event.AllDay, err = parseICalDateTime(dtstart, loc)
+	if err != nil {
+		return res, fieldError("DTSTART", err)
+	}
+	if dtend, ok := c.get("DTEND"); ok {
+		if res.Event.End, _, err = parseICalDateTime(dtend, loc); err != nil {
+			return res, fieldError("DTEND", err)
+		}
+	} else if duration, ok := c.get("DURATION"); ok {
+		days, d, err := parseICalDuration(duration.Value)
+		if err != nil {
+			return res, fieldError("DURATION", err)
+		}
+		res.Event.End = res.Event.Start.AddDate(0, 0, days).Add(d)
+	} else if res.Event.AllDay {
+		res.Event.End = res.Event.Start.AddDate(0, 0, 1)
+	} else {
+		res.Event.End = res.Event.Start
+	}
+	if rrule, ok := c.get("RRULE"); ok {
+		res.Event.RRule = rrule.Value
+	}
+	for _, p := range c.Props {
+		if p.Name != "EXDATE" {
+			continue
+		}
+		for _, value := range strings.Split(p.Value, ",") {
+			p.Value = value
+			exdate, _, err := parseICalDateTime(p, loc)
+			if err != nil {
+				return res, fieldError("EXDATE", err)
+			}
+			res.Event.ExDates = append(res.Event.ExDates, exdate)
+		}
+	}
+	if recurrenceID, ok := c.get("RECURRENCE-ID"); ok {
+		if res.RecurrenceID, _, err = parseICalDateTime(recurrenceID, loc); err != nil {
+			return res, fieldError("RECURRENCE-ID", err)
+		}
+	}
+	return res, nil
+}
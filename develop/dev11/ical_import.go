@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"os"
+)
+
+// importNamespace пространство имен для получения ID события из UID импортируемого VEVENT
+var importNamespace = uuid.MustParse("6f1c3a52-2b8e-4c8e-9a0e-3d2f0c1b7e41")
+
+// Результаты импорта отдельного VEVENT
+const (
+	ImportCreated = "created"
+	ImportUpdated = "updated"
+	ImportSkipped = "skipped"
+)
+
+// ImportResult результат импорта одного VEVENT
+type ImportResult struct {
+	UID    string `json:"uid"`
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// importEventID возвращает ID события для UID. UID, выгруженные из этого календаря, уже являются ID,
+// для остальных ID получается детерминированно, поэтому повторный импорт обновляет те же события
+func importEventID(uid string) string {
+	if id, err := uuid.Parse(uid); err == nil {
+		return id.String()
+	}
+	return uuid.NewSHA1(importNamespace, []byte(uid)).String()
+}
+
+// ImportICalendar сохраняет события из VEVENT в календарь пользователя userID.
+// Ошибка в одном VEVENT не прерывает импорт, для каждого VEVENT возвращается свой результат.
+// Измененные повторения (VEVENT с RECURRENCE-ID) сохраняются вместе со своей серией из того же файла.
+// ATTENDEE не импортируются, поэтому участники и их ответы у обновляемых событий сохраняются.
+// opts передаются в Storage.Put каждого события
+func ImportICalendar(storage Storage, userID string, components []icalComponent, opts ...WriteOption) []ImportResult {
+	opts = append(opts[:len(opts):len(opts)], KeepAttendees())
+	results := make([]ImportResult, len(components))
+	events := make([]*icalEvent, len(components))
+	// UID -> индекс VEVENT серии или одиночного события
+	masters := make(map[string]int)
+	// UID -> индексы VEVENT измененных повторений
+	overrides := make(map[string][]int)
+	for i := range components {
+		e, err := components[i].toEvent(userID)
+		results[i].UID = e.UID
+		if err != nil {
+			results[i].Status, results[i].Reason = ImportSkipped, err.Error()
+			continue
+		}
+		events[i] = e
+		if !e.RecurrenceID.IsZero() {
+			overrides[e.UID] = append(overrides[e.UID], i)
+			continue
+		}
+		if _, ok := masters[e.UID]; ok {
+			results[i].Status, results[i].Reason = ImportSkipped, "duplicate UID"
+			events[i] = nil
+			continue
+		}
+		masters[e.UID] = i
+	}
+
+	for uid, idx := range overrides {
+		if _, ok := masters[uid]; !ok {
+			for _, i := range idx {
+				results[i].Status, results[i].Reason = ImportSkipped, "recurring event for RECURRENCE-ID not found in file"
+			}
+		}
+	}
+
+	for i, e := range events {
+		if e == nil || !e.RecurrenceID.IsZero() {
+			continue
+		}
+		master := e.Event
+		master.ID = importEventID(e.UID)
+		var attached []int
+		for _, j := range overrides[e.UID] {
+			override := events[j].Event
+			override.ID = master.ID
+			override.RecurrenceID = events[j].RecurrenceID
+			if override.Name == "" {
+				override.Name = master.Name
+			}
+			if master.RRule == "" {
+				results[j].Status, results[j].Reason = ImportSkipped, "event with this UID is not recurring"
+				continue
+			}
+			if err := override.validate(); err != nil {
+				results[j].Status, results[j].Reason = ImportSkipped, err.Error()
+				continue
+			}
+			master.Overrides = append(master.Overrides, override)
+			attached = append(attached, j)
+		}
+
+		var result ImportResult
+		stored, status, err := storage.Put(&master, opts...)
+		if err != nil {
+			result = ImportResult{Status: ImportSkipped, Reason: err.Error()}
+			if _, ok := err.(*ValidationError); !ok {
+				fmt.Fprintf(os.Stderr, "Internal error while importing event %s: %v\n", master.ID, err)
+				result.Reason = "storage error"
+			}
+		} else {
+			result = ImportResult{ID: stored.ID, Status: ImportUpdated}
+			if status == Created {
+				result.Status = ImportCreated
+			}
+		}
+		for _, j := range append([]int{i}, attached...) {
+			result.UID = results[j].UID
+			results[j] = result
+		}
+	}
+	return results
+}
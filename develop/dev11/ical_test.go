@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestWriteICalendar(t *testing.T) {
+	stamp := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	moscow, err := LoadLocation("Europe/Moscow")
+	require.NoError(t, err)
+	events := []Event{
+		{
+			ID:       "1",
+			Name:     "Встреча; обсуждение, план\nи итоги",
+			Start:    time.Date(2024, 3, 4, 14, 0, 0, 0, moscow),
+			End:      time.Date(2024, 3, 4, 15, 30, 0, 0, moscow),
+			Timezone: "Europe/Moscow",
+		},
+		{
+			ID:       "2",
+			Name:     "Праздник",
+			Start:    time.Date(2024, 3, 8, 0, 0, 0, 0, moscow),
+			End:      time.Date(2024, 3, 9, 0, 0, 0, 0, moscow),
+			AllDay:   true,
+			Timezone: "Europe/Moscow",
+		},
+		{
+			ID:      "3",
+			Name:    "standup",
+			Start:   time.Date(2024, 3, 5, 9, 0, 0, 0, time.UTC),
+			End:     time.Date(2024, 3, 5, 9, 15, 0, 0, time.UTC),
+			RRule:   "FREQ=DAILY;COUNT=5",
+			ExDates: []time.Time{time.Date(2024, 3, 6, 9, 0, 0, 0, time.UTC)},
+			Overrides: []Event{{
+				ID:           "3",
+				Name:         "standup late",
+				Start:        time.Date(2024, 3, 7, 10, 0, 0, 0, time.UTC),
+				End:          time.Date(2024, 3, 7, 10, 15, 0, 0, time.UTC),
+				RRule:        "FREQ=DAILY;COUNT=5",
+				RecurrenceID: time.Date(2024, 3, 7, 9, 0, 0, 0, time.UTC),
+			}},
+		},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteICalendar(&buf, events, stamp))
+	want := "BEGIN:VCALENDAR\r\n" +
+		"VERSION:2.0\r\n" +
+		"PRODID:-//WBL2//dev11 calendar//EN\r\n" +
+		"CALSCALE:GREGORIAN\r\n" +
+		"BEGIN:VTIMEZONE\r\n" +
+		"TZID:Europe/Moscow\r\n" +
+		"BEGIN:STANDARD\r\n" +
+		"DTSTART:20240101T000000\r\n" +
+		"TZOFFSETFROM:+0300\r\n" +
+		"TZOFFSETTO:+0300\r\n" +
+		"TZNAME:MSK\r\n" +
+		"END:STANDARD\r\n" +
+		"END:VTIMEZONE\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:1\r\n" +
+		"DTSTAMP:20240301T120000Z\r\n" +
+		"DTSTART;TZID=Europe/Moscow:20240304T140000\r\n" +
+		"DTEND;TZID=Europe/Moscow:20240304T153000\r\n" +
+		"SUMMARY:Встреча\\; обсуждение\\, план\\nи итоги\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:2\r\n" +
+		"DTSTAMP:20240301T120000Z\r\n" +
+		"DTSTART;VALUE=DATE:20240308\r\n" +
+		"DTEND;VALUE=DATE:20240309\r\n" +
+		"X-WR-TIMEZONE:Europe/Moscow\r\n" +
+		"SUMMARY:Праздник\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:3\r\n" +
+		"DTSTAMP:20240301T120000Z\r\n" +
+		"DTSTART:20240305T090000Z\r\n" +
+		"DTEND:20240305T091500Z\r\n" +
+		"RRULE:FREQ=DAILY;COUNT=5\r\n" +
+		"EXDATE:20240306T090000Z\r\n" +
+		"SUMMARY:standup\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:3\r\n" +
+		"DTSTAMP:20240301T120000Z\r\n" +
+		"DTSTART:20240307T100000Z\r\n" +
+		"DTEND:20240307T101500Z\r\n" +
+		"RECURRENCE-ID:20240307T090000Z\r\n" +
+		"SUMMARY:standup late\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+	assert.Equal(t, want, buf.String())
+}
+
+func TestWriteICalendarUntil(t *testing.T) {
+	berlin, err := LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	events := []Event{
+		{
+			ID:       "1",
+			Name:     "vacation",
+			Start:    time.Date(2024, 3, 28, 0, 0, 0, 0, berlin),
+			End:      time.Date(2024, 3, 29, 0, 0, 0, 0, berlin),
+			AllDay:   true,
+			Timezone: "Europe/Berlin",
+			RRule:    "FREQ=DAILY;UNTIL=20240402T215959Z",
+		},
+		{
+			ID:    "2",
+			Name:  "standup",
+			Start: time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC),
+			End:   time.Date(2024, 3, 4, 9, 15, 0, 0, time.UTC),
+			RRule: "FREQ=DAILY;UNTIL=20240308T090000;BYDAY=MO,TU,WE,TH,FR",
+		},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, WriteICalendar(&buf, events, time.Now()))
+	// UNTIL того же типа, что и DTSTART
+	assert.Contains(t, buf.String(), "RRULE:FREQ=DAILY;UNTIL=20240402\r\n")
+	assert.Contains(t, buf.String(), "RRULE:FREQ=DAILY;UNTIL=20240308T090000Z;BYDAY=MO,TU,WE,TH,FR\r\n")
+}
+
+func TestWriteICalendarFolding(t *testing.T) {
+	name := strings.Repeat("очень длинное название ", 10)
+	var buf bytes.Buffer
+	require.NoError(t, WriteICalendar(&buf, []Event{{ID: "1", Name: name}}, time.Now()))
+
+	var unfolded strings.Builder
+	for i, line := range strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n") {
+		assert.LessOrEqual(t, len(line), icalLineLimit, "line %d is too long", i)
+		assert.True(t, utf8.ValidString(line), "line %d splits utf-8 sequence", i)
+		if strings.HasPrefix(line, " ") {
+			unfolded.WriteString(line[1:])
+		} else {
+			unfolded.WriteString("\n" + line)
+		}
+	}
+	assert.Contains(t, unfolded.String(), "\nSUMMARY:"+name+"\n")
+}
+
+func TestExportICS(t *testing.T) {
+	type want struct {
+		statusCode int
+		events     int
+	}
+	tests := []struct {
+		name  string
+		query string
+		want  want
+	}{
+		{
+			name:  "Positive test with date range",
+			query: "user_id=34&from=2024-03-01&to=2024-03-31",
+			want:  want{statusCode: 200, events: 3},
+		},
+		{
+			name:  "Positive test with range across months",
+			query: "user_id=34&from=2024-03-30&to=2024-04-02",
+			want:  want{statusCode: 200, events: 1},
+		},
+		{
+			name:  "Negative test with empty user_id parameter",
+			query: "from=2024-03-01&to=2024-03-31",
+			want:  want{statusCode: 400},
+		},
+		{
+			name:  "Negative test with wrong range",
+			query: "user_id=34&from=2024-03-31&to=2024-03-01",
+			want:  want{statusCode: 400},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := getHandler()
+			ts := httptest.NewServer(handler)
+			defer ts.Close()
+
+			_, err := createEventAndGetID(ts, handler, "user_id=34&name=action&date=2024-03-04")
+			require.NoError(t, err)
+			_, err = createEventAndGetID(ts, handler, "user_id=34&name=trip&start=2024-03-31T20:00:00Z&end=2024-04-01T08:00:00Z")
+			require.NoError(t, err)
+			_, err = createEventAndGetID(ts, handler, "user_id=34&name=review&start=2024-03-10T10:00:00Z&rrule=FREQ%3DWEEKLY%3BCOUNT%3D2")
+			require.NoError(t, err)
+
+			request := httptest.NewRequest(http.MethodGet, ts.URL+"/export_ics/?"+tt.query, nil)
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, request)
+
+			require.Equal(t, tt.want.statusCode, resp.Code)
+			if tt.want.statusCode != 200 {
+				return
+			}
+			assert.Equal(t, "text/calendar; charset=utf-8", resp.Header().Get("content-type"))
+			body := resp.Body.String()
+			assert.True(t, strings.HasPrefix(body, "BEGIN:VCALENDAR\r\n"))
+			assert.Equal(t, tt.want.events, strings.Count(body, "BEGIN:VEVENT\r\n"))
+		})
+	}
+}
+
+const importFile = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"PRODID:-//Other//Calendar//EN\r\n" +
+	"BEGIN:VTIMEZONE\r\n" +
+	"TZID:Europe/Moscow\r\n" +
+	"BEGIN:STANDARD\r\n" +
+	"DTSTART:19700101T000000\r\n" +
+	"TZOFFSETFROM:+0300\r\n" +
+	"TZOFFSETTO:+0300\r\n" +
+	"END:STANDARD\r\n" +
+	"END:VTIMEZONE\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:meeting@other.example\r\n" +
+	"DTSTART;TZID=Europe/Moscow:20240304T140000\r\n" +
+	"DTEND;TZID=Europe/Moscow:20240304T153000\r\n" +
+	"SUMMARY:Встреча\\, план на \r\n" +
+	" неделю\r\n" +
+	"BEGIN:VALARM\r\n" +
+	"ACTION:DISPLAY\r\n" +
+	"TRIGGER:-PT15M\r\n" +
+	"END:VALARM\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:standup@other.example\r\n" +
+	"DTSTART:20240304T090000Z\r\n" +
+	"DURATION:PT15M\r\n" +
+	"RRULE:FREQ=DAILY;COUNT=5\r\n" +
+	"EXDATE:20240305T090000Z\r\n" +
+	"SUMMARY:standup\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:standup@other.example\r\n" +
+	"RECURRENCE-ID:20240306T090000Z\r\n" +
+	"DTSTART:20240306T180000Z\r\n" +
+	"DURATION:PT15M\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:broken@other.example\r\n" +
+	"SUMMARY:no start\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:weekly@other.example\r\n" +
+	"DTSTART:20240304T090000Z\r\n" +
+	"RRULE:FREQ=WEEKLY;BYHOUR=9\r\n" +
+	"SUMMARY:unsupported\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestImportICS(t *testing.T) {
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			handler := newHandler(&Config{}, backend.newStorage(t), Services{})
+
+			results := importICSFile(t, handler, importFile)
+			require.Len(t, results, 5)
+			assert.Equal(t, ImportCreated, results[0].Status)
+			assert.Equal(t, ImportCreated, results[1].Status)
+			assert.Equal(t, ImportCreated, results[2].Status)
+			assert.Equal(t, results[1].ID, results[2].ID)
+			assert.Equal(t, ImportSkipped, results[3].Status)
+			assert.Equal(t, "DTSTART: empty value", results[3].Reason)
+			assert.Equal(t, ImportSkipped, results[4].Status)
+			assert.Equal(t, "weekly@other.example", results[4].UID)
+
+			week := getWeekEvents(t, handler, "user_id=34&date=2024-03-04")
+			assert.ElementsMatch(t, []string{
+				"2024-03-04T14:00:00+03:00",
+				"2024-03-04T09:00:00Z",
+				"2024-03-06T18:00:00Z",
+				"2024-03-07T09:00:00Z",
+				"2024-03-08T09:00:00Z",
+			}, startTimes(week))
+			for _, e := range week {
+				if e.Timezone == "Europe/Moscow" {
+					assert.Equal(t, "Встреча, план на неделю", e.Name)
+					assert.Equal(t, "2024-03-04T15:30:00+03:00", e.End)
+				}
+			}
+
+			// Повторный импорт обновляет события, а не создает копии
+			again := importICSFile(t, handler, importFile)
+			assert.Equal(t, ImportUpdated, again[0].Status)
+			assert.Equal(t, results[0].ID, again[0].ID)
+			assert.Len(t, getWeekEvents(t, handler, "user_id=34&date=2024-03-04"), 5)
+		})
+	}
+}
+
+func TestImportExportedICS(t *testing.T) {
+	handler := getHandler()
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	id, err := createEventAndGetID(ts, handler, "user_id=34&name=action&start=2024-03-04T10:00:00Z&duration=1h")
+	require.NoError(t, err)
+	request := httptest.NewRequest(http.MethodGet, "/export_ics/?user_id=34&from=2024-03-01&to=2024-03-31", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, request)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	results := importICSFile(t, handler, resp.Body.String())
+	require.Len(t, results, 1)
+	assert.Equal(t, ImportResult{UID: id, ID: id, Status: ImportUpdated}, results[0])
+}
+
+func TestImportExportedRecurringICS(t *testing.T) {
+	handler := getHandler()
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	id, err := createEventAndGetID(ts, handler, "user_id=34&name=standup&start=2024-03-04T09:00:00Z&duration=15m&rrule=FREQ%3DDAILY%3BCOUNT%3D5")
+	require.NoError(t, err)
+	resp := makePostRequest(ts, handler, "/delete_event/", "user_id=34&id="+id+"&occurrence=2024-03-05T09:00:00Z")
+	require.Equal(t, http.StatusOK, resp.Code)
+	resp = makePostRequest(ts, handler, "/update_event/", "user_id=34&id="+id+"&name=standup late&start=2024-03-06T18:00:00Z&duration=15m&occurrence=2024-03-06T09:00:00Z")
+	require.Equal(t, http.StatusOK, resp.Code)
+	before := startTimes(getWeekEvents(t, handler, "user_id=34&date=2024-03-04"))
+
+	// Серия выгружается одним VEVENT с правилом и удаленным повторением, измененное повторение - отдельным
+	request := httptest.NewRequest(http.MethodGet, "/export_ics/?user_id=34&from=2024-03-01&to=2024-03-31", nil)
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, request)
+	require.Equal(t, http.StatusOK, resp.Code)
+	body := resp.Body.String()
+	assert.Equal(t, 2, strings.Count(body, "BEGIN:VEVENT\r\n"))
+	assert.Contains(t, body, "RRULE:FREQ=DAILY;COUNT=5\r\nEXDATE:20240305T090000Z\r\n")
+	assert.Contains(t, body, "RECURRENCE-ID:20240306T090000Z\r\n")
+
+	results := importICSFile(t, handler, body)
+	require.Len(t, results, 2)
+	for _, result := range results {
+		assert.Equal(t, ImportResult{UID: id, ID: id, Status: ImportUpdated}, result)
+	}
+	week := getWeekEvents(t, handler, "user_id=34&date=2024-03-04")
+	assert.ElementsMatch(t, before, startTimes(week))
+	assert.ElementsMatch(t, []string{
+		"2024-03-04T09:00:00Z",
+		"2024-03-06T18:00:00Z",
+		"2024-03-07T09:00:00Z",
+		"2024-03-08T09:00:00Z",
+	}, startTimes(week))
+}
+
+func TestImportExportedTimezoneICS(t *testing.T) {
+	handler := getHandler()
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	_, err := createEventAndGetID(ts, handler, "user_id=34&name=weekly&start=2024-03-20T10:00:00%2B01:00&duration=1h"+
+		"&timezone=Europe/Berlin&rrule=FREQ%3DWEEKLY%3BCOUNT%3D4")
+	require.NoError(t, err)
+	_, err = createEventAndGetID(ts, handler, "user_id=34&name=vacation&date=2024-03-28&timezone=Europe/Berlin"+
+		"&rrule=FREQ%3DDAILY%3BUNTIL%3D20240402T215959Z")
+	require.NoError(t, err)
+
+	request := httptest.NewRequest(http.MethodGet, "/export_ics/?user_id=34&from=2024-03-01&to=2024-04-30", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, request)
+	require.Equal(t, http.StatusOK, resp.Code)
+	body := resp.Body.String()
+	assert.Contains(t, body, "DTSTART;TZID=Europe/Berlin:20240320T100000\r\n")
+	assert.Contains(t, body, "BEGIN:DAYLIGHT\r\nDTSTART:20240331T020000\r\nTZOFFSETFROM:+0100\r\nTZOFFSETTO:+0200\r\nTZNAME:CEST\r\n")
+	assert.Contains(t, body, "X-WR-TIMEZONE:Europe/Berlin\r\n")
+
+	results := importICSFile(t, handler, body)
+	require.Len(t, results, 2)
+	for _, result := range results {
+		assert.Equal(t, ImportUpdated, result.Status)
+	}
+	// Повторения после перехода на летнее время начинаются в то же местное время
+	week := getWeekEvents(t, handler, "user_id=34&date=2024-04-01&timezone=Europe/Berlin")
+	var weekly []EventResult
+	for _, e := range week {
+		assert.Equal(t, "Europe/Berlin", e.Timezone)
+		if e.Name == "weekly" {
+			weekly = append(weekly, e)
+		}
+	}
+	require.Len(t, weekly, 1)
+	assert.Equal(t, "2024-04-03T10:00:00+02:00", weekly[0].Start)
+
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/events_for_day/?user_id=34&date=2024-04-02&timezone=Europe/Berlin", nil))
+	require.Equal(t, http.StatusOK, resp.Code)
+	var day struct {
+		Result []EventResult `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &day))
+	require.Len(t, day.Result, 1)
+	assert.Equal(t, "2024-04-02T00:00:00+02:00", day.Result[0].Start)
+}
+
+func TestImportExportedAttendeesICS(t *testing.T) {
+	handler := getHandler()
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	id, err := createEventAndGetID(ts, handler, "user_id=34&name=standup&start=2024-03-04T09:00:00Z&duration=15m"+
+		"&rrule=FREQ%3DDAILY%3BCOUNT%3D5&attendees=35")
+	require.NoError(t, err)
+	resp := makePostRequest(ts, handler, "/rsvp_event/", "user_id=35&organizer_id=34&id="+id+"&status=accepted")
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+
+	request := httptest.NewRequest(http.MethodGet, "/export_ics/?user_id=34&from=2024-03-01&to=2024-03-31", nil)
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, request)
+	require.Equal(t, http.StatusOK, resp.Code)
+	results := importICSFile(t, handler, resp.Body.String())
+	require.Len(t, results, 1)
+	assert.Equal(t, ImportUpdated, results[0].Status)
+
+	// Повторный импорт сохраняет участников и их ответы
+	resp = makeJSONRequest(handler, http.MethodGet, "/users/34/events/"+id, "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var got struct {
+		Result EventResult `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &got))
+	assert.Equal(t, "34", got.Result.Organizer)
+	assert.Equal(t, []Attendee{{"35", AttendeeAccepted}}, got.Result.Attendees)
+	assert.Len(t, getWeekEvents(t, handler, "user_id=35&date=2024-03-04"), 5)
+}
+
+func TestImportICSRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		body        string
+		statusCode  int
+	}{
+		{
+			name:        "Positive test with raw body",
+			path:        "/import_ics?user_id=34",
+			contentType: "text/calendar",
+			body:        importFile,
+			statusCode:  200,
+		},
+		{
+			name:        "Positive test with multipart form",
+			path:        "/import_ics/",
+			contentType: "multipart/form-data; boundary=xxx",
+			body: "--xxx\r\n" +
+				"Content-Disposition: form-data; name=\"user_id\"\r\n\r\n34\r\n" +
+				"--xxx\r\n" +
+				"Content-Disposition: form-data; name=\"file\"; filename=\"cal.ics\"\r\n" +
+				"Content-Type: text/calendar\r\n\r\n" + importFile + "\r\n" +
+				"--xxx--\r\n",
+			statusCode: 200,
+		},
+		{
+			name:        "Negative test with empty user_id parameter",
+			path:        "/import_ics",
+			contentType: "text/calendar",
+			body:        importFile,
+			statusCode:  400,
+		},
+		{
+			name:        "Negative test with not iCalendar body",
+			path:        "/import_ics?user_id=34",
+			contentType: "text/calendar",
+			body:        "hello",
+			statusCode:  400,
+		},
+		{
+			name:        "Negative test with truncated file",
+			path:        "/import_ics?user_id=34",
+			contentType: "text/calendar",
+			body:        "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:1\r\n",
+			statusCode:  400,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := getHandler()
+			request := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			request.Header.Set("Content-Type", tt.contentType)
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, request)
+			assert.Equal(t, tt.statusCode, resp.Code)
+		})
+	}
+}
+
+func importICSFile(t *testing.T, handler http.Handler, file string) []ImportResult {
+	request := httptest.NewRequest(http.MethodPost, "/import_ics?user_id=34", strings.NewReader(file))
+	request.Header.Set("Content-Type", "text/calendar")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, request)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var respOK struct {
+		Result []ImportResult `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &respOK))
+	return respOK.Result
+}
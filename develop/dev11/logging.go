@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// requestIDHeader заголовок с идентификатором запроса. Переданный клиентом идентификатор
+// сохраняется, иначе генерируется новый. Идентификатор возвращается в ответе
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength ограничение длины идентификатора запроса от клиента
+const maxRequestIDLength = 128
+
+// LogConfig настройки логов сервера
+type LogConfig struct {
+	// Level минимальный уровень: debug, info (по умолчанию), warn или error
+	Level string `json:"level"`
+	// Format формат записей: json (по умолчанию) или text
+	Format string `json:"format"`
+}
+
+// newLogger создает логгер по настройкам cfg, nil означает настройки по умолчанию
+func (cfg *LogConfig) newLogger(w io.Writer) (*slog.Logger, error) {
+	var level, format string
+	if cfg != nil {
+		level, format = cfg.Level, cfg.Format
+	}
+	var opts slog.HandlerOptions
+	if level != "" {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("wrong log level %q", level)
+		}
+		opts.Level = l
+	}
+	switch format {
+	case "", "json":
+		return slog.New(slog.NewJSONHandler(w, &opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, &opts)), nil
+	default:
+		return nil, fmt.Errorf("wrong log format %q", format)
+	}
+}
+
+// requestInfo сведения о запросе для записи в лог. Заполняются обработчиками по ходу запроса
+type requestInfo struct {
+	id     string
+	userID string
+	// route шаблон маршрута, к которому относится запрос
+	route string
+}
+
+type requestInfoKey struct{}
+
+func withRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// RequestIDFromContext возвращает идентификатор запроса или пустую строку вне loggingHandler
+func RequestIDFromContext(ctx context.Context) string {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+// setLogUser запоминает аутентифицированного пользователя для записи запроса в лог
+func setLogUser(ctx context.Context, userID string) {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		info.userID = userID
+	}
+}
+
+// setLogRoute запоминает шаблон маршрута запроса для лога и метрик
+func setLogRoute(ctx context.Context, route string) {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		info.route = route
+	}
+}
+
+// requestID возвращает идентификатор запроса от клиента, если он допустим, иначе новый
+func requestID(value string) string {
+	if value == "" || len(value) > maxRequestIDLength || strings.IndexFunc(value, func(r rune) bool {
+		return r <= ' ' || r > '~'
+	}) >= 0 {
+		return uuid.New().String()
+	}
+	return value
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLogs направляет slog.Default() в буфер до конца теста
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+// lastLogRecord возвращает последнюю запись лога
+func lastLogRecord(t *testing.T, buf *bytes.Buffer) map[string]any {
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var record map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &record))
+	buf.Reset()
+	return record
+}
+
+func TestLoggingHandler(t *testing.T) {
+	logs := captureLogs(t)
+	handler := newHandler(&Config{Auth: &AuthConfig{APIKeys: []APIKey{{Key: "key-34", UserID: "34"}}}}, NewMemoryStorage(), Services{})
+
+	tests := []struct {
+		name      string
+		requestID string
+		token     string
+		path      string
+		status    int
+		userID    string
+		keepID    bool
+	}{
+		{"propagated request id", "abc-123", "key-34", "/events_for_day/?date=2024-03-04", http.StatusBadRequest, "34", true},
+		{"generated request id", "", "key-34", "/users/34/events/1", http.StatusNotFound, "34", false},
+		{"invalid request id", "bad id", "key-34", "/events_for_day/?date=2024-03-04", http.StatusBadRequest, "34", false},
+		{"unauthenticated", "", "", "/events_for_day/?user_id=35&date=2024-03-04", http.StatusUnauthorized, "35", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			if tt.requestID != "" {
+				req.Header.Set("X-Request-ID", tt.requestID)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+			require.Equal(t, tt.status, resp.Code)
+
+			requestID := resp.Header().Get("X-Request-ID")
+			if tt.keepID {
+				assert.Equal(t, tt.requestID, requestID)
+			} else {
+				assert.Len(t, requestID, 36)
+			}
+			record := lastLogRecord(t, logs)
+			assert.Equal(t, "INFO", record["level"])
+			assert.Equal(t, requestID, record["request_id"])
+			assert.Equal(t, http.MethodGet, record["method"])
+			assert.Equal(t, "192.0.2.1:1234", record["remote_addr"])
+			assert.Equal(t, tt.userID, record["user_id"])
+			assert.Equal(t, float64(tt.status), record["status"])
+			assert.Equal(t, float64(resp.Body.Len()), record["bytes"])
+			assert.Contains(t, record, "latency_ms")
+		})
+	}
+}
+
+func TestLoggingHandlerRecoversPanic(t *testing.T) {
+	logs := captureLogs(t)
+	handler := loggingHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("something went wrong")
+	}), nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/events_for_day/", nil))
+	require.Equal(t, http.StatusInternalServerError, resp.Code)
+	var errResp ErrorResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &errResp))
+	assert.Equal(t, "Internal server error", errResp.Error)
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	require.Len(t, lines, 2)
+	var panicRecord map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &panicRecord))
+	assert.Equal(t, "ERROR", panicRecord["level"])
+	assert.Equal(t, "something went wrong", panicRecord["panic"])
+	assert.Contains(t, panicRecord["stack"], "TestLoggingHandlerRecoversPanic")
+	logs.Reset()
+	logs.WriteString(lines[1])
+	record := lastLogRecord(t, logs)
+	assert.Equal(t, "ERROR", record["level"])
+	assert.Equal(t, float64(http.StatusInternalServerError), record["status"])
+	assert.Equal(t, panicRecord["request_id"], record["request_id"])
+
+	// Если ответ уже начат, соединение разрывается
+	handler = loggingHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		panic("too late")
+	}), nil)
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+}
+
+func TestLogConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *LogConfig
+		output  string
+		wantErr bool
+	}{
+		{"default", nil, `"msg":"message"`, false},
+		{"text", &LogConfig{Format: "text"}, "msg=message", false},
+		{"debug level", &LogConfig{Level: "debug"}, `"level":"DEBUG"`, false},
+		{"warn level", &LogConfig{Level: "warn"}, "", false},
+		{"wrong level", &LogConfig{Level: "verbose"}, "", true},
+		{"wrong format", &LogConfig{Format: "xml"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := tt.cfg.newLogger(&buf)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			logger.Debug("message")
+			logger.Info("message")
+			if tt.output == "" {
+				assert.Empty(t, buf.String())
+			} else {
+				assert.Contains(t, buf.String(), tt.output)
+			}
+		})
+	}
+}
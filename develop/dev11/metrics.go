@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets границы корзин гистограммы длительности запросов в секундах
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// otherRoute метка маршрута запросов, не подошедших ни к одному маршруту
+const otherRoute = "other"
+
+type requestKey struct {
+	route string
+	code  int
+}
+
+type storageErrorKey struct {
+	operation string
+	kind      string
+}
+
+// histogram накопительная гистограмма в формате Prometheus
+type histogram struct {
+	// counts количество наблюдений не больше соответствующей границы latencyBuckets
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range latencyBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// Metrics собирает метрики сервера и отдает их в текстовом формате Prometheus. Безопасен для конкурентного использования
+type Metrics struct {
+	inFlight atomic.Int64
+
+	mu            sync.Mutex
+	requests      map[requestKey]*histogram
+	storageErrors map[storageErrorKey]uint64
+	// stats возвращает количество пользователей и событий хранилища, nil если хранилище их не считает
+	stats func() (users, events int)
+}
+
+// NewMetrics создает пустой набор метрик
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:      make(map[requestKey]*histogram),
+		storageErrors: make(map[storageErrorKey]uint64),
+	}
+}
+
+// observeRequest учитывает обработанный запрос
+func (m *Metrics) observeRequest(route string, code int, latency time.Duration) {
+	if route == "" {
+		route = otherRoute
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := requestKey{route: route, code: code}
+	h, ok := m.requests[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.requests[key] = h
+	}
+	h.observe(latency.Seconds())
+}
+
+// observeStorageError учитывает ошибку операции хранилища
+func (m *Metrics) observeStorageError(operation string, err error) {
+	if err == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.storageErrors[storageErrorKey{operation: operation, kind: storageErrorKind(err)}]++
+}
+
+// storageErrorKind возвращает вид ошибки хранилища для метки kind. Для пакета - вид ошибки операции
+func storageErrorKind(err error) string {
+	if batchErr, ok := err.(*BatchError); ok {
+		err = batchErr.Err
+	}
+	switch err := err.(type) {
+	case *ValidationError:
+		if err.NotFound {
+			return "not_found"
+		}
+		return "validation"
+	case *ConflictError:
+		return "conflict"
+	case *VersionMismatchError:
+		return "version_mismatch"
+	default:
+		return "internal"
+	}
+}
+
+// WriteTo записывает метрики в текстовом формате Prometheus
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	m.mu.Lock()
+	requests := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requests = append(requests, key)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].route != requests[j].route {
+			return requests[i].route < requests[j].route
+		}
+		return requests[i].code < requests[j].code
+	})
+
+	b.WriteString("# HELP calendar_http_requests_total Number of processed HTTP requests.\n")
+	b.WriteString("# TYPE calendar_http_requests_total counter\n")
+	for _, key := range requests {
+		fmt.Fprintf(&b, "calendar_http_requests_total{%s} %d\n", requestLabels(key), m.requests[key].count)
+	}
+	b.WriteString("# HELP calendar_http_request_duration_seconds Latency of processed HTTP requests.\n")
+	b.WriteString("# TYPE calendar_http_request_duration_seconds histogram\n")
+	for _, key := range requests {
+		h, labels := m.requests[key], requestLabels(key)
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(&b, "calendar_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, formatFloat(bound), h.counts[i])
+		}
+		fmt.Fprintf(&b, "calendar_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(&b, "calendar_http_request_duration_seconds_sum{%s} %s\n", labels, formatFloat(h.sum))
+		fmt.Fprintf(&b, "calendar_http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	storageErrors := make([]storageErrorKey, 0, len(m.storageErrors))
+	for key := range m.storageErrors {
+		storageErrors = append(storageErrors, key)
+	}
+	sort.Slice(storageErrors, func(i, j int) bool {
+		if storageErrors[i].operation != storageErrors[j].operation {
+			return storageErrors[i].operation < storageErrors[j].operation
+		}
+		return storageErrors[i].kind < storageErrors[j].kind
+	})
+	b.WriteString("# HELP calendar_storage_errors_total Number of failed storage operations.\n")
+	b.WriteString("# TYPE calendar_storage_errors_total counter\n")
+	for _, key := range storageErrors {
+		fmt.Fprintf(&b, "calendar_storage_errors_total{operation=\"%s\",kind=\"%s\"} %d\n",
+			escapeLabel(key.operation), escapeLabel(key.kind), m.storageErrors[key])
+	}
+	stats := m.stats
+	m.mu.Unlock()
+
+	b.WriteString("# HELP calendar_http_requests_in_flight Number of HTTP requests being processed.\n")
+	b.WriteString("# TYPE calendar_http_requests_in_flight gauge\n")
+	fmt.Fprintf(&b, "calendar_http_requests_in_flight %d\n", m.inFlight.Load())
+	if stats != nil {
+		users, events := stats()
+		b.WriteString("# HELP calendar_users Number of users with events.\n")
+		b.WriteString("# TYPE calendar_users gauge\n")
+		fmt.Fprintf(&b, "calendar_users %d\n", users)
+		b.WriteString("# HELP calendar_events Number of stored events, a recurring series is counted once.\n")
+		b.WriteString("# TYPE calendar_events gauge\n")
+		fmt.Fprintf(&b, "calendar_events %d\n", events)
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func requestLabels(key requestKey) string {
+	return fmt.Sprintf("route=\"%s\",code=\"%d\"", escapeLabel(key.route), key.code)
+}
+
+// escapeLabel экранирует значение метки по правилам текстового формата Prometheus
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// metricsHandler отдает метрики. При включенной аутентификации доступен только администраторам
+func metricsHandler(metrics *Metrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeErrorMessage(w, http.StatusMethodNotAllowed, "Wrong method")
+			return
+		}
+		if p := PrincipalFromContext(r.Context()); p != nil && !p.IsAdmin() {
+			writeErrorMessage(w, http.StatusForbidden, "Metrics are available only to administrators")
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.WriteTo(w)
+	})
+}
+
+// routeHandler определяет маршрут mux, к которому относится запрос, до его обработки next,
+// чтобы маршрут был известен и для запросов, отклоненных до mux (например, без токена)
+func routeHandler(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		setLogRoute(r.Context(), pattern)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Stats возвращает количество пользователей, у которых есть события, и количество событий
+func (s *MemoryStorage) Stats() (users, events int) {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for _, calendar := range sh.events {
+			if len(calendar) > 0 {
+				users++
+				events += len(calendar)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return users, events
+}
+
+// metricsStorage считает ошибки операций хранилища
+type metricsStorage struct {
+	Storage
+	metrics *Metrics
+}
+
+// instrument возвращает хранилище, ошибки операций которого учитываются в метриках.
+// Если хранилище умеет считать события, их количество также попадает в метрики
+func (m *Metrics) instrument(storage Storage) Storage {
+	if s, ok := storage.(interface{ Stats() (int, int) }); ok {
+		m.mu.Lock()
+		m.stats = s.Stats
+		m.mu.Unlock()
+	}
+	return &metricsStorage{Storage: storage, metrics: m}
+}
+
+func (s *metricsStorage) Create(event *Event, opts ...WriteOption) (*Event, error) {
+	res, err := s.Storage.Create(event, opts...)
+	s.metrics.observeStorageError("create", err)
+	return res, err
+}
+
+func (s *metricsStorage) Update(event *Event, opts ...WriteOption) (*Event, error) {
+	res, err := s.Storage.Update(event, opts...)
+	s.metrics.observeStorageError("update", err)
+	return res, err
+}
+
+func (s *metricsStorage) Delete(event *Event, opts ...WriteOption) (*Event, error) {
+	res, err := s.Storage.Delete(event, opts...)
+	s.metrics.observeStorageError("delete", err)
+	return res, err
+}
+
+func (s *metricsStorage) Get(userID, id string) (*Event, error) {
+	res, err := s.Storage.Get(userID, id)
+	s.metrics.observeStorageError("get", err)
+	return res, err
+}
+
+func (s *metricsStorage) Put(event *Event, opts ...WriteOption) (*Event, Status, error) {
+	res, status, err := s.Storage.Put(event, opts...)
+	s.metrics.observeStorageError("put", err)
+	return res, status, err
+}
+
+func (s *metricsStorage) UpdateOccurrence(event *Event, occurrence time.Time, scope RecurrenceScope, opts ...WriteOption) (*Event, error) {
+	res, err := s.Storage.UpdateOccurrence(event, occurrence, scope, opts...)
+	s.metrics.observeStorageError("update_occurrence", err)
+	return res, err
+}
+
+func (s *metricsStorage) DeleteOccurrence(event *Event, occurrence time.Time, scope RecurrenceScope, opts ...WriteOption) (*Event, error) {
+	res, err := s.Storage.DeleteOccurrence(event, occurrence, scope, opts...)
+	s.metrics.observeStorageError("delete_occurrence", err)
+	return res, err
+}
+
+func (s *metricsStorage) Respond(organizerID, id, attendeeID string, status AttendeeStatus, opts ...WriteOption) (*Event, error) {
+	res, err := s.Storage.Respond(organizerID, id, attendeeID, status, opts...)
+	s.metrics.observeStorageError("respond", err)
+	return res, err
+}
+
+func (s *metricsStorage) GetEventsPerDay(userID string, date time.Time) ([]Event, error) {
+	res, err := s.Storage.GetEventsPerDay(userID, date)
+	s.metrics.observeStorageError("events_per_day", err)
+	return res, err
+}
+
+func (s *metricsStorage) GetEventsPerWeek(userID string, startDate time.Time) ([]Event, error) {
+	res, err := s.Storage.GetEventsPerWeek(userID, startDate)
+	s.metrics.observeStorageError("events_per_week", err)
+	return res, err
+}
+
+func (s *metricsStorage) GetEventsPerMonth(userID string, year int, month time.Month, loc *time.Location) ([]Event, error) {
+	res, err := s.Storage.GetEventsPerMonth(userID, year, month, loc)
+	s.metrics.observeStorageError("events_per_month", err)
+	return res, err
+}
+
+func (s *metricsStorage) Search(userID, query string, from, to time.Time) ([]Event, error) {
+	res, err := s.Storage.Search(userID, query, from, to)
+	s.metrics.observeStorageError("search", err)
+	return res, err
+}
+
+func (s *metricsStorage) Batch(ops []BatchOperation) ([]Event, error) {
+	res, err := s.Storage.Batch(ops)
+	s.metrics.observeStorageError("batch", err)
+	return res, err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrapeMetrics запрашивает /metrics и возвращает ответ
+func scrapeMetrics(t *testing.T, ts *httptest.Server, token string) (int, string) {
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/metrics", nil)
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	storage := NewMemoryStorage()
+	handler := newHandler(&Config{}, storage, Services{Metrics: NewMetrics()})
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	_, err := createEventAndGetID(ts, handler, "user_id=34&date=2024-03-04&name=action")
+	require.NoError(t, err)
+	_, err = createEventAndGetID(ts, handler, "user_id=35&date=2024-03-04&name=action")
+	require.NoError(t, err)
+	requests := []string{
+		"/events_for_day/?user_id=34&date=2024-03-04",
+		"/events_for_day/?user_id=34&date=2024-03-04",
+		"/events_for_day/?user_id=34&date=wrong",
+		"/users/34/events/missing",
+		"/unknown",
+	}
+	for _, path := range requests {
+		resp, err := ts.Client().Get(ts.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	status, body := scrapeMetrics(t, ts, "")
+	require.Equal(t, http.StatusOK, status)
+	lines := []string{
+		"# TYPE calendar_http_requests_total counter",
+		`calendar_http_requests_total{route="/create_event/",code="200"} 2`,
+		`calendar_http_requests_total{route="/events_for_day/",code="200"} 2`,
+		`calendar_http_requests_total{route="/events_for_day/",code="400"} 1`,
+		`calendar_http_requests_total{route="/users/",code="404"} 1`,
+		`calendar_http_requests_total{route="other",code="404"} 1`,
+		"# TYPE calendar_http_request_duration_seconds histogram",
+		`calendar_http_request_duration_seconds_bucket{route="/events_for_day/",code="200",le="+Inf"} 2`,
+		`calendar_http_request_duration_seconds_count{route="/events_for_day/",code="200"} 2`,
+		// Запрос к /metrics еще выполняется
+		"calendar_http_requests_in_flight 1",
+		"calendar_users 2",
+		"calendar_events 2",
+		`calendar_storage_errors_total{operation="get",kind="not_found"} 1`,
+	}
+	for _, line := range lines {
+		assert.Contains(t, strings.Split(body, "\n"), line)
+	}
+	assert.Contains(t, body, `calendar_http_request_duration_seconds_bucket{route="/events_for_day/",code="200",le="0.005"}`)
+
+	// Сам запрос к /metrics учитывается после ответа
+	_, body = scrapeMetrics(t, ts, "")
+	assert.Contains(t, body, `calendar_http_requests_total{route="/metrics",code="200"} 1`)
+}
+
+func TestMetricsAccess(t *testing.T) {
+	auth := &AuthConfig{APIKeys: []APIKey{
+		{Key: "key-34", UserID: "34"},
+		{Key: "key-admin", UserID: "1", Role: RoleAdmin},
+	}}
+	ts := httptest.NewServer(newHandler(&Config{Auth: auth}, NewMemoryStorage(), Services{Metrics: NewMetrics()}))
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"without token", "", http.StatusUnauthorized},
+		{"user", "key-34", http.StatusForbidden},
+		{"admin", "key-admin", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, _ := scrapeMetrics(t, ts, tt.token)
+			assert.Equal(t, tt.status, status)
+		})
+	}
+	_, body := scrapeMetrics(t, ts, "key-admin")
+	assert.Contains(t, body, `calendar_http_requests_total{route="/metrics",code="401"} 1`)
+	assert.Contains(t, body, `calendar_http_requests_total{route="/metrics",code="403"} 1`)
+}
+
+func TestMetricsExposition(t *testing.T) {
+	m := NewMetrics()
+	m.observeRequest(`/path"with\quotes`, http.StatusOK, 30*time.Millisecond)
+	m.observeStorageError("update", &VersionMismatchError{Expected: 1, Current: 2})
+	m.observeStorageError("update", &ConflictError{})
+	m.observeStorageError("create", &ValidationError{Message: "wrong"})
+	m.observeStorageError("create", nil)
+
+	var b strings.Builder
+	_, err := m.WriteTo(&b)
+	require.NoError(t, err)
+	body := b.String()
+	assert.Contains(t, body, `calendar_http_requests_total{route="/path\"with\\quotes",code="200"} 1`)
+	assert.Contains(t, body, `calendar_http_request_duration_seconds_bucket{route="/path\"with\\quotes",code="200",le="0.025"} 0`)
+	assert.Contains(t, body, `calendar_http_request_duration_seconds_bucket{route="/path\"with\\quotes",code="200",le="0.05"} 1`)
+	assert.Contains(t, body, `calendar_http_request_duration_seconds_sum{route="/path\"with\\quotes",code="200"} 0.03`)
+	assert.Contains(t, body, `calendar_storage_errors_total{operation="create",kind="validation"} 1`)
+	assert.Contains(t, body, `calendar_storage_errors_total{operation="update",kind="conflict"} 1`)
+	assert.Contains(t, body, `calendar_storage_errors_total{operation="update",kind="version_mismatch"} 1`)
+	// Без хранилища количество событий не известно
+	assert.NotContains(t, body, "calendar_events")
+}
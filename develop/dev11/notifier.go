@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// webhookTimeout ограничение времени одного запроса к webhook
+const webhookTimeout = 10 * time.Second
+
+// Notifier доставляет напоминания
+type Notifier interface {
+	Notify(ctx context.Context, r Reminder) error
+}
+
+// ReminderConfig настройки напоминаний. Если в Config его нет, напоминания не отправляются
+type ReminderConfig struct {
+	// WebhookURL адрес, на который напоминания отправляются POST запросом в формате JSON
+	WebhookURL string `json:"webhook_url"`
+	// LogFile файл, в который напоминания дописываются строками JSON. "-" означает stdout
+	LogFile string `json:"log_file"`
+}
+
+// notifier создает Notifier по настройкам. Если не задано ни одного способа доставки, напоминания пишутся в stdout
+func (c *ReminderConfig) notifier() (Notifier, error) {
+	var notifiers multiNotifier
+	if c.WebhookURL != "" {
+		notifiers = append(notifiers, &WebhookNotifier{URL: c.WebhookURL})
+	}
+	switch c.LogFile {
+	case "":
+		if len(notifiers) == 0 {
+			notifiers = append(notifiers, NewLogNotifier(os.Stdout))
+		}
+	case "-":
+		notifiers = append(notifiers, NewLogNotifier(os.Stdout))
+	default:
+		f, err := os.OpenFile(c.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("open reminder log: %w", err)
+		}
+		notifiers = append(notifiers, NewLogNotifier(f))
+	}
+	if len(notifiers) == 1 {
+		return notifiers[0], nil
+	}
+	return notifiers, nil
+}
+
+// WebhookNotifier отправляет напоминание POST запросом с телом ReminderMessage
+type WebhookNotifier struct {
+	URL string
+	// Client HTTP клиент, nil означает клиент с таймаутом webhookTimeout
+	Client *http.Client
+}
+
+// Notify отправляет напоминание, ответ с кодом не 2xx считается ошибкой
+func (n *WebhookNotifier) Notify(ctx context.Context, r Reminder) error {
+	body, err := json.Marshal(r.Message())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: webhookTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// LogNotifier дописывает напоминания в w строками JSON
+type LogNotifier struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewLogNotifier возвращает LogNotifier, пишущий в w
+func NewLogNotifier(w io.Writer) *LogNotifier {
+	return &LogNotifier{w: w}
+}
+
+// Notify записывает напоминание одной строкой
+func (n *LogNotifier) Notify(_ context.Context, r Reminder) error {
+	line, err := json.Marshal(r.Message())
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, err = n.w.Write(append(line, '\n'))
+	return err
+}
+
+// multiNotifier доставляет напоминание всеми способами
+type multiNotifier []Notifier
+
+func (m multiNotifier) Notify(ctx context.Context, r Reminder) error {
+	var errs []error
+	for _, n := range m {
+		if err := n.Notify(ctx, r); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
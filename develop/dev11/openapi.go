@@ -0,0 +1,685 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiSchema схема значения в документе OpenAPI. Для параметров запроса по ней же проверяются значения
+type apiSchema struct {
+	Ref                  string                `json:"$ref,omitempty"`
+	Type                 string                `json:"type,omitempty"`
+	Format               string                `json:"format,omitempty"`
+	Description          string                `json:"description,omitempty"`
+	Enum                 []string              `json:"enum,omitempty"`
+	Minimum              *int                  `json:"minimum,omitempty"`
+	Maximum              *int                  `json:"maximum,omitempty"`
+	AnyOf                []*apiSchema          `json:"anyOf,omitempty"`
+	Items                *apiSchema            `json:"items,omitempty"`
+	Properties           map[string]*apiSchema `json:"properties,omitempty"`
+	AdditionalProperties *apiSchema            `json:"additionalProperties,omitempty"`
+	Required             []string              `json:"required,omitempty"`
+}
+
+// apiFormats форматы строковых параметров, которые проверяются при разборе запроса.
+// go-duration и timezone не входят в OpenAPI, но допускаются им как пользовательские форматы
+var apiFormats = map[string]struct {
+	name  string
+	check func(value string) error
+}{
+	"date": {"a date like 2006-01-02", func(value string) error {
+		_, err := time.Parse("2006-01-02", value)
+		return err
+	}},
+	"date-time": {"a date-time in RFC 3339 format", func(value string) error {
+		_, err := time.Parse(time.RFC3339, value)
+		return err
+	}},
+	"go-duration": {"a duration like 1h30m", func(value string) error {
+		_, err := time.ParseDuration(value)
+		return err
+	}},
+	"timezone": {"an IANA time zone", func(value string) error {
+		_, err := LoadLocation(value)
+		return err
+	}},
+}
+
+// expected описывает допустимые значения схемы для сообщения о нарушении
+func (s *apiSchema) expected() string {
+	if len(s.AnyOf) > 0 {
+		names := make([]string, len(s.AnyOf))
+		for i, alt := range s.AnyOf {
+			names[i] = alt.expected()
+		}
+		return strings.Join(names, " or ")
+	}
+	if len(s.Enum) > 0 {
+		return "one of " + strings.Join(s.Enum, ", ")
+	}
+	if format, ok := apiFormats[s.Format]; ok {
+		return format.name
+	}
+	switch s.Type {
+	case "integer":
+		return "an integer"
+	case "boolean":
+		return "a boolean"
+	default:
+		return "a string"
+	}
+}
+
+// check проверяет значение параметра и возвращает описание нарушения, пустое для допустимого значения
+func (s *apiSchema) check(value string) string {
+	if len(s.AnyOf) > 0 {
+		for _, alt := range s.AnyOf {
+			if alt.check(value) == "" {
+				return ""
+			}
+		}
+		return "must be " + s.expected()
+	}
+	if len(s.Enum) > 0 {
+		for _, allowed := range s.Enum {
+			if value == allowed {
+				return ""
+			}
+		}
+		return "must be " + s.expected()
+	}
+	switch s.Type {
+	case "integer":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return "must be " + s.expected()
+		}
+		if s.Minimum != nil && n < *s.Minimum {
+			return fmt.Sprintf("must be at least %d", *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			return fmt.Sprintf("must be at most %d", *s.Maximum)
+		}
+	case "boolean":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return "must be " + s.expected()
+		}
+	}
+	if format, ok := apiFormats[s.Format]; ok && format.check(value) != nil {
+		return "must be " + s.expected()
+	}
+	return ""
+}
+
+func intPtr(n int) *int {
+	return &n
+}
+
+var (
+	stringSchema   = apiSchema{Type: "string"}
+	booleanSchema  = apiSchema{Type: "boolean"}
+	dateSchema     = apiSchema{Type: "string", Format: "date"}
+	dateTimeSchema = apiSchema{Type: "string", Format: "date-time"}
+	timezoneSchema = apiSchema{Type: "string", Format: "timezone"}
+	durationSchema = apiSchema{Type: "string", Format: "go-duration"}
+	versionSchema  = apiSchema{Type: "integer", Minimum: intPtr(0)}
+	// eventTimeSchema время события: для событий на весь день допускается дата без времени
+	eventTimeSchema = apiSchema{AnyOf: []*apiSchema{&dateTimeSchema, &dateSchema}}
+)
+
+// apiParam параметр операции API
+type apiParam struct {
+	Name string
+	// In path для параметров пути. Остальные параметры передаются в query, а у операций с формой - в теле
+	In          string
+	Description string
+	Required    bool
+	Schema      apiSchema
+}
+
+// optional возвращает копию обязательного параметра, которую можно не передавать
+func (p apiParam) optional() apiParam {
+	p.Required = false
+	return p
+}
+
+var (
+	userIDParam   = apiParam{Name: "user_id", Description: "Пользователь календаря", Required: true, Schema: stringSchema}
+	eventIDParam  = apiParam{Name: "id", Description: "ID события", Required: true, Schema: stringSchema}
+	timezoneParam = apiParam{Name: "timezone", Description: "Часовой пояс из базы IANA, по умолчанию UTC", Schema: timezoneSchema}
+	fromParam     = apiParam{Name: "from", Description: "Первый день диапазона", Schema: dateSchema}
+	toParam       = apiParam{Name: "to", Description: "Последний день диапазона, включается в него", Schema: dateSchema}
+	versionParam  = apiParam{Name: "version", Description: "Ожидаемая версия события, вместо нее можно передать заголовок If-Match", Schema: versionSchema}
+	limitParam    = apiParam{Name: "limit", Description: "Количество результатов",
+		Schema: apiSchema{Type: "integer", Minimum: intPtr(1), Maximum: intPtr(pageMaxLimit)}}
+	occurrenceParam = apiParam{Name: "occurrence", Description: "Исходное начало изменяемого повторения серии", Schema: dateTimeSchema}
+	scopeParam      = apiParam{Name: "scope", Description: "Какие повторения серии изменить, по умолчанию this",
+		Schema: apiSchema{Type: "string", Enum: []string{string(ScopeThis), string(ScopeFollowing), string(ScopeAll)}}}
+	rejectConflictsParam = apiParam{Name: "reject_conflicts", Description: "Не записывать событие, пересекающееся с событиями организатора или участников",
+		Schema: booleanSchema}
+	// eventParams поля события в формате /create_event
+	eventParams = []apiParam{
+		{Name: "name", Description: "Название события", Required: true, Schema: stringSchema},
+		{Name: "description", Description: "Описание события", Schema: stringSchema},
+		{Name: "date", Description: "День события на весь день, если не задан start", Schema: dateSchema},
+		{Name: "start", Description: "Начало события, для события на весь день - дата", Schema: eventTimeSchema},
+		{Name: "end", Description: "Конец события, для события на весь день - дата, не включается", Schema: eventTimeSchema},
+		{Name: "duration", Description: "Длительность события вместо end, например 1h30m", Schema: durationSchema},
+		{Name: "all_day", Description: "Событие на весь день", Schema: booleanSchema},
+		{Name: "timezone", Description: "Часовой пояс события из базы IANA, по умолчанию UTC", Schema: timezoneSchema},
+		{Name: "rrule", Description: "Правило повторения RFC 5545, например FREQ=WEEKLY;BYDAY=MO,WE;COUNT=10", Schema: stringSchema},
+		{Name: "reminders", Description: "Смещения напоминаний до начала через запятую, например 15m,1d", Schema: stringSchema},
+		{Name: "attendees", Description: "Приглашенные пользователи через запятую. При изменении без параметра участники сохраняются, пустое значение удаляет их", Schema: stringSchema},
+	}
+)
+
+// params собирает список параметров операции из отдельных параметров и их списков
+func params(items ...any) []apiParam {
+	var res []apiParam
+	for _, item := range items {
+		switch item := item.(type) {
+		case apiParam:
+			res = append(res, item)
+		case []apiParam:
+			res = append(res, item...)
+		}
+	}
+	return res
+}
+
+// pathParam параметр пути REST API
+func pathParam(name, description string) apiParam {
+	return apiParam{Name: name, In: "path", Description: description, Required: true, Schema: stringSchema}
+}
+
+const formContentType = "application/x-www-form-urlencoded"
+
+// apiOperation операция API: метод и путь маршрута, его параметры и ответ
+type apiOperation struct {
+	Method string
+	// Path шаблон пути OpenAPI, например /users/{user_id}/events
+	Path    string
+	ID      string
+	Summary string
+	Params  []apiParam
+	// Form тип тела с параметрами, пустой - параметры передаются в query
+	Form string
+	// Body значение, по типу которого строится схема тела запроса типа BodyType (по умолчанию JSON)
+	Body     any
+	BodyType string
+	// Status код успешного ответа, по умолчанию 200
+	Status int
+	// Result значение, по типу которого строится схема успешного ответа, nil - ответ без тела.
+	// Без ContentType ответ - JSON {"result": ...}
+	Result      any
+	ContentType string
+}
+
+var (
+	createEventOperation = &apiOperation{
+		Method: http.MethodPost, Path: "/create_event/", ID: "createEvent", Summary: "Создать событие",
+		Params: params(userIDParam, eventParams, rejectConflictsParam),
+		Form:   formContentType, Result: PostResult{},
+	}
+	updateEventOperation = &apiOperation{
+		Method: http.MethodPost, Path: "/update_event/", ID: "updateEvent", Summary: "Изменить событие или повторение серии",
+		Params: params(userIDParam, eventIDParam, eventParams, occurrenceParam, scopeParam, rejectConflictsParam, versionParam),
+		Form:   formContentType, Result: PostResult{},
+	}
+	deleteEventOperation = &apiOperation{
+		Method: http.MethodPost, Path: "/delete_event/", ID: "deleteEvent", Summary: "Удалить событие или повторение серии",
+		Params: params(userIDParam, eventIDParam, occurrenceParam, scopeParam, versionParam),
+		Form:   formContentType, Result: PostResult{},
+	}
+	batchOperation = &apiOperation{
+		Method: http.MethodPost, Path: "/batch", ID: "batch", Summary: "Атомарно применить пакет операций create_event, update_event и delete_event",
+		Params: params(apiParam{Name: "user_id", Description: "Пользователь операций без user_id", Schema: stringSchema}),
+		Body:   []BatchRequestOperation{}, Result: []PostResult{},
+	}
+	rsvpEventOperation = &apiOperation{
+		Method: http.MethodPost, Path: "/rsvp_event/", ID: "rsvpEvent", Summary: "Ответить на приглашение",
+		Params: params(
+			apiParam{Name: "user_id", Description: "Приглашенный пользователь", Required: true, Schema: stringSchema},
+			apiParam{Name: "organizer_id", Description: "Организатор события", Required: true, Schema: stringSchema},
+			eventIDParam,
+			apiParam{Name: "status", Description: "Ответ на приглашение", Required: true, Schema: apiSchema{Type: "string",
+				Enum: []string{string(AttendeeAccepted), string(AttendeeDeclined), string(AttendeeTentative)}}},
+			versionParam,
+		),
+		Form: formContentType, Result: PostResult{},
+	}
+	eventsForDayOperation = &apiOperation{
+		Method: http.MethodGet, Path: "/events_for_day/", ID: "eventsForDay", Summary: "События дня",
+		Params: params(userIDParam, apiParam{Name: "date", Description: "День", Required: true, Schema: dateSchema}, timezoneParam),
+		Result: []EventResult{},
+	}
+	eventsForWeekOperation = &apiOperation{
+		Method: http.MethodGet, Path: "/events_for_week/", ID: "eventsForWeek", Summary: "События недели",
+		Params: params(userIDParam, apiParam{Name: "date", Description: "Первый день недели", Required: true, Schema: dateSchema}, timezoneParam),
+		Result: []EventResult{},
+	}
+	eventsForMonthOperation = &apiOperation{
+		Method: http.MethodGet, Path: "/events_for_month/", ID: "eventsForMonth", Summary: "События месяца",
+		Params: params(
+			userIDParam,
+			apiParam{Name: "year", Description: "Год", Required: true, Schema: apiSchema{Type: "integer", Minimum: intPtr(1), Maximum: intPtr(9999)}},
+			apiParam{Name: "month", Description: "Номер месяца", Required: true, Schema: apiSchema{Type: "integer", Minimum: intPtr(1), Maximum: intPtr(12)}},
+			timezoneParam,
+		),
+		Result: []EventResult{},
+	}
+	eventsOperation = &apiOperation{
+		Method: http.MethodGet, Path: "/events/", ID: "events", Summary: "События диапазона постранично",
+		Params: params(userIDParam, fromParam, toParam, timezoneParam, limitParam,
+			apiParam{Name: "cursor", Description: "Курсор next_cursor из предыдущей страницы", Schema: stringSchema}),
+		Result: EventsPage{},
+	}
+	searchEventsOperation = &apiOperation{
+		Method: http.MethodGet, Path: "/search_events/", ID: "searchEvents", Summary: "Поиск событий по словам",
+		Params: params(userIDParam, apiParam{Name: "q", Description: "Слова запроса", Required: true, Schema: stringSchema},
+			fromParam, toParam, timezoneParam, limitParam),
+		Result: []EventResult{},
+	}
+	freeBusyOperation = &apiOperation{
+		Method: http.MethodGet, Path: "/free_busy/", ID: "freeBusy", Summary: "Занятость пользователей",
+		Params: params(
+			apiParam{Name: "user_id", Description: "Пользователи, параметр повторяется для каждого", Required: true,
+				Schema: apiSchema{Type: "array", Items: &stringSchema}},
+			fromParam, toParam, timezoneParam,
+		),
+		Result: []FreeBusyResult{},
+	}
+	exportICSOperation = &apiOperation{
+		Method: http.MethodGet, Path: "/export_ics/", ID: "exportICS", Summary: "Выгрузить события в формате iCalendar",
+		Params:      params(userIDParam, fromParam, toParam, timezoneParam),
+		Result:      "",
+		ContentType: "text/calendar",
+	}
+	importICSOperation = &apiOperation{
+		Method: http.MethodPost, Path: "/import_ics", ID: "importICS", Summary: "Загрузить события из файла iCalendar",
+		Params: params(userIDParam, apiParam{Name: "file", Description: "Файл iCalendar", Schema: apiSchema{Type: "string", Format: "binary"}}),
+		Form:   "multipart/form-data", Body: "", BodyType: "text/calendar",
+		Result: []ImportResult{},
+	}
+	listEventsRESTOperation = &apiOperation{
+		Method: http.MethodGet, Path: "/users/{user_id}/events", ID: "listEvents", Summary: "События диапазона",
+		Params: params(pathParam("user_id", "Пользователь календаря"), fromParam, toParam, timezoneParam),
+		Result: []EventResult{},
+	}
+	createEventRESTOperation = &apiOperation{
+		Method: http.MethodPost, Path: "/users/{user_id}/events", ID: "createEventResource", Summary: "Создать событие",
+		Params: params(pathParam("user_id", "Пользователь календаря"), rejectConflictsParam),
+		Body:   EventRequest{}, Status: http.StatusCreated, Result: PostResult{},
+	}
+	getEventRESTOperation = &apiOperation{
+		Method: http.MethodGet, Path: "/users/{user_id}/events/{id}", ID: "getEvent", Summary: "Событие",
+		Params: params(pathParam("user_id", "Пользователь календаря"), pathParam("id", "ID события")),
+		Result: EventResult{},
+	}
+	replaceEventRESTOperation = &apiOperation{
+		Method: http.MethodPut, Path: "/users/{user_id}/events/{id}", ID: "replaceEvent", Summary: "Заменить событие или повторение серии",
+		Params: params(pathParam("user_id", "Пользователь календаря"), pathParam("id", "ID события"),
+			occurrenceParam, scopeParam, rejectConflictsParam, versionParam),
+		Body: EventRequest{}, Result: PostResult{},
+	}
+	patchEventRESTOperation = &apiOperation{
+		Method: http.MethodPatch, Path: "/users/{user_id}/events/{id}", ID: "patchEvent", Summary: "Изменить переданные поля события",
+		Params: params(pathParam("user_id", "Пользователь календаря"), pathParam("id", "ID события"),
+			rejectConflictsParam, versionParam),
+		Body: EventRequest{}, Result: PostResult{},
+	}
+	deleteEventRESTOperation = &apiOperation{
+		Method: http.MethodDelete, Path: "/users/{user_id}/events/{id}", ID: "deleteEventResource", Summary: "Удалить событие или повторение серии",
+		Params: params(pathParam("user_id", "Пользователь календаря"), pathParam("id", "ID события"),
+			occurrenceParam, scopeParam, versionParam),
+		Status: http.StatusNoContent,
+	}
+	listWebhooksOperation = &apiOperation{
+		Method: http.MethodGet, Path: "/webhooks/", ID: "listWebhooks", Summary: "Подписки на изменения событий",
+		Params: params(userIDParam.optional()),
+		Result: []WebhookSubscription{},
+	}
+	subscribeWebhookOperation = &apiOperation{
+		Method: http.MethodPost, Path: "/webhooks/", ID: "subscribeWebhook", Summary: "Подписаться на изменения событий",
+		Params: params(
+			apiParam{Name: "user_id", Description: "Пользователь, об изменениях событий которого сообщать, без него - все пользователи", Schema: stringSchema},
+			apiParam{Name: "url", Description: "Адрес http или https, на который отправляются изменения", Required: true, Schema: stringSchema},
+			apiParam{Name: "secret", Description: "Ключ подписи HMAC-SHA256 тела запроса", Schema: stringSchema},
+		),
+		Form: formContentType, Status: http.StatusCreated, Result: WebhookSubscription{},
+	}
+	deadLettersOperation = &apiOperation{
+		Method: http.MethodGet, Path: "/webhooks/dead_letters", ID: "deadLetters", Summary: "Недоставленные изменения",
+		Params: params(userIDParam.optional()),
+		Result: []DeadLetter{},
+	}
+	unsubscribeWebhookOperation = &apiOperation{
+		Method: http.MethodDelete, Path: "/webhooks/{id}", ID: "unsubscribeWebhook", Summary: "Удалить подписку",
+		Params: params(pathParam("id", "ID подписки"), userIDParam.optional()),
+		Status: http.StatusNoContent,
+	}
+	eventHistoryOperation = &apiOperation{
+		Method: http.MethodGet, Path: "/event_history/", ID: "eventHistory", Summary: "Версии события",
+		Params: params(userIDParam, eventIDParam),
+		Result: []HistoryResult{},
+	}
+	revertEventOperation = &apiOperation{
+		Method: http.MethodPost, Path: "/revert_event/", ID: "revertEvent", Summary: "Восстановить версию события",
+		Params: params(userIDParam, eventIDParam, apiParam{Name: "version", Description: "Версия события из его истории, та же, что в ETag",
+			Required: true, Schema: apiSchema{Type: "integer", Minimum: intPtr(1)}}),
+		Form: formContentType, Result: PostResult{},
+	}
+	auditLogOperation = &apiOperation{
+		Method: http.MethodGet, Path: "/audit_log/", ID: "auditLog", Summary: "Изменения событий, только для администраторов",
+		Params: params(apiParam{Name: "user_id", Description: "Пользователь, без него - все пользователи", Schema: stringSchema},
+			fromParam, toParam, timezoneParam),
+		Result: []HistoryResult{},
+	}
+	streamOperation = &apiOperation{
+		Method: http.MethodGet, Path: "/stream", ID: "stream", Summary: "Поток изменений событий в формате text/event-stream",
+		Params: params(userIDParam, apiParam{Name: "last_event_id", Description: "ID последнего полученного сообщения, вместо заголовка Last-Event-ID",
+			Schema: stringSchema}),
+		Result: "", ContentType: "text/event-stream",
+	}
+	metricsOperation = &apiOperation{
+		Method: http.MethodGet, Path: "/metrics", ID: "metrics", Summary: "Метрики в текстовом формате Prometheus, только для администраторов",
+		Result: "", ContentType: "text/plain",
+	}
+	openAPIOperation = &apiOperation{
+		Method: http.MethodGet, Path: "/openapi.json", ID: "openAPI", Summary: "Этот документ OpenAPI",
+		Result: map[string]any{}, ContentType: "application/json",
+	}
+)
+
+// validate проверяет значения параметров v по описанию операции. Нарушения отсортированы по параметру.
+// Параметры пути проверяет сам обработчик при разборе пути
+func (op *apiOperation) validate(v url.Values) []Violation {
+	var res []Violation
+	declared := make(map[string]bool)
+	for _, p := range op.Params {
+		if p.In == "path" {
+			continue
+		}
+		declared[p.Name] = true
+		var values []string
+		for _, value := range v[p.Name] {
+			if value != "" {
+				values = append(values, value)
+			}
+		}
+		switch {
+		case len(values) == 0:
+			if p.Required {
+				res = append(res, Violation{Parameter: p.Name, Message: "is required"})
+			}
+		case p.Schema.Type == "array":
+			for _, value := range values {
+				if msg := p.Schema.Items.check(value); msg != "" {
+					res = append(res, Violation{Parameter: p.Name, Message: msg})
+					break
+				}
+			}
+		case len(v[p.Name]) > 1:
+			res = append(res, Violation{Parameter: p.Name, Message: "must be passed once"})
+		default:
+			if msg := p.Schema.check(values[0]); msg != "" {
+				res = append(res, Violation{Parameter: p.Name, Message: msg})
+			}
+		}
+	}
+	for name := range v {
+		if !declared[name] {
+			res = append(res, Violation{Parameter: name, Message: "is not allowed"})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Parameter < res[j].Parameter
+	})
+	return res
+}
+
+// hasParams сообщает, описаны ли у операции параметры query или формы. Запросы операций без них
+// не проверяются: authHandler может подставить в query user_id, который такой операции не нужен
+func (op *apiOperation) hasParams() bool {
+	for _, p := range op.Params {
+		if p.In != "path" {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath сообщает, подходит ли путь из сегментов segments к шаблону пути операции
+func (op *apiOperation) matchPath(segments []string) bool {
+	template := strings.Split(strings.Trim(op.Path, "/"), "/")
+	if len(template) != len(segments) {
+		return false
+	}
+	for i, part := range template {
+		if !strings.HasPrefix(part, "{") && part != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// matchOperation возвращает операцию из ops для метода и пути запроса r или nil.
+// Шаблоны без параметров пути имеют приоритет, как /webhooks/dead_letters перед /webhooks/{id}
+func matchOperation(ops []*apiOperation, r *http.Request) *apiOperation {
+	segments := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	for _, literal := range []bool{true, false} {
+		for _, op := range ops {
+			if op.Method == r.Method && strings.Contains(op.Path, "{") != literal && op.matchPath(segments) {
+				return op
+			}
+		}
+	}
+	return nil
+}
+
+// validateRequest проверяет параметры запроса по описанию его операции из ops, прежде чем передать его next.
+// Запросы без описанной операции, например неподдерживаемым методом, передаются next без проверки
+func validateRequest(ops []*apiOperation, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := matchOperation(ops, r)
+		if op == nil || !op.hasParams() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		v := r.URL.Query()
+		if op.Form != "" {
+			if err := parseForm(w, r); err != nil {
+				writeErrorMessage(w, http.StatusBadRequest, "Failed to parse form")
+				return
+			}
+			v = r.Form
+		}
+		if violations := op.validate(v); len(violations) > 0 {
+			writeError(w, &ParamsError{Violations: violations})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiMux регистрирует обработчики вместе с описанием их операций, по которому строится /openapi.json
+type apiMux struct {
+	*http.ServeMux
+	operations []*apiOperation
+}
+
+// handle регистрирует обработчик маршрута pattern с операциями ops и возвращает его вместе с проверкой
+// параметров, чтобы тот же обработчик можно было зарегистрировать для второго варианта пути
+func (m *apiMux) handle(pattern string, handler http.Handler, ops ...*apiOperation) http.Handler {
+	m.operations = append(m.operations, ops...)
+	handler = validateRequest(ops, handler)
+	m.Handle(pattern, handler)
+	return handler
+}
+
+func (m *apiMux) handleFunc(pattern string, handler http.HandlerFunc, ops ...*apiOperation) http.Handler {
+	return m.handle(pattern, handler, ops...)
+}
+
+// apiComponents схемы типов для components/schemas документа по имени типа
+type apiComponents map[string]*apiSchema
+
+// schemaOf возвращает схему JSON представления значения v. Именованные структуры попадают в components,
+// их поля без omitempty и не указатели считаются обязательными
+func (c apiComponents) schemaOf(v any) *apiSchema {
+	return c.schema(reflect.TypeOf(v))
+}
+
+func (c apiComponents) schema(t reflect.Type) *apiSchema {
+	if t == reflect.TypeOf(time.Time{}) {
+		return &apiSchema{Type: "string", Format: "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return c.schema(t.Elem())
+	case reflect.String:
+		return &apiSchema{Type: "string"}
+	case reflect.Bool:
+		return &apiSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &apiSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &apiSchema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &apiSchema{Type: "array", Items: c.schema(t.Elem())}
+	case reflect.Map:
+		return &apiSchema{Type: "object", AdditionalProperties: c.schema(t.Elem())}
+	case reflect.Struct:
+		if _, ok := c[t.Name()]; !ok {
+			// Схема добавляется до обхода полей, чтобы рекурсивные типы ссылались на нее
+			s := &apiSchema{Type: "object", Properties: make(map[string]*apiSchema)}
+			c[t.Name()] = s
+			for i := 0; i < t.NumField(); i++ {
+				field := t.Field(i)
+				name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+				if !field.IsExported() || name == "-" {
+					continue
+				}
+				if name == "" {
+					name = field.Name
+				}
+				s.Properties[name] = c.schema(field.Type)
+				if !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Pointer {
+					s.Required = append(s.Required, name)
+				}
+			}
+		}
+		return &apiSchema{Ref: "#/components/schemas/" + t.Name()}
+	default:
+		return &apiSchema{}
+	}
+}
+
+// document возвращает описание операции в документе OpenAPI
+func (op *apiOperation) document(c apiComponents) map[string]any {
+	res := map[string]any{"operationId": op.ID, "summary": op.Summary}
+	var parameters []map[string]any
+	form := &apiSchema{Type: "object", Properties: make(map[string]*apiSchema)}
+	for _, p := range op.Params {
+		schema := p.Schema
+		if p.In != "path" && op.Form != "" {
+			schema.Description = p.Description
+			form.Properties[p.Name] = &schema
+			if p.Required {
+				form.Required = append(form.Required, p.Name)
+			}
+			continue
+		}
+		in := p.In
+		if in == "" {
+			in = "query"
+		}
+		parameters = append(parameters, map[string]any{
+			"name":        p.Name,
+			"in":          in,
+			"description": p.Description,
+			"required":    p.Required,
+			"schema":      &schema,
+		})
+	}
+	if len(parameters) > 0 {
+		res["parameters"] = parameters
+	}
+
+	content := make(map[string]any)
+	if op.Form != "" {
+		content[op.Form] = map[string]any{"schema": form}
+	}
+	if op.Body != nil {
+		bodyType := op.BodyType
+		if bodyType == "" {
+			bodyType = "application/json"
+		}
+		content[bodyType] = map[string]any{"schema": c.schemaOf(op.Body)}
+	}
+	if len(content) > 0 {
+		res["requestBody"] = map[string]any{"required": true, "content": content}
+	}
+
+	success := map[string]any{"description": "Успешный ответ"}
+	switch {
+	case op.Result == nil:
+	case op.ContentType == "":
+		success["content"] = map[string]any{"application/json": map[string]any{"schema": &apiSchema{
+			Type:       "object",
+			Properties: map[string]*apiSchema{"result": c.schemaOf(op.Result)},
+			Required:   []string{"result"},
+		}}}
+	default:
+		success["content"] = map[string]any{op.ContentType: map[string]any{"schema": c.schemaOf(op.Result)}}
+	}
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	res["responses"] = map[string]any{
+		strconv.Itoa(status): success,
+		"default": map[string]any{
+			"description": "Ошибка",
+			"content":     map[string]any{"application/json": map[string]any{"schema": c.schemaOf(ErrorResponse{})}},
+		},
+	}
+	return res
+}
+
+// openAPIDocument возвращает документ OpenAPI 3 с операциями ops
+func openAPIDocument(ops []*apiOperation) map[string]any {
+	components := make(apiComponents)
+	paths := make(map[string]map[string]any)
+	for _, op := range ops {
+		if paths[op.Path] == nil {
+			paths[op.Path] = make(map[string]any)
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = op.document(components)
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Calendar API",
+			"version": "1.0.0",
+		},
+		"paths":      paths,
+		"components": map[string]any{"schemas": components},
+	}
+}
+
+// getOpenAPI отдает документ OpenAPI с операциями, зарегистрированными в mux
+func getOpenAPI(w http.ResponseWriter, r *http.Request, mux *apiMux) {
+	if r.Method != http.MethodGet {
+		writeErrorMessage(w, http.StatusMethodNotAllowed, "Wrong method")
+		return
+	}
+	marshalResponseAndWrite(w, http.StatusOK, openAPIDocument(mux.operations))
+}
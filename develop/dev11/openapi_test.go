@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type openAPIDoc struct {
+	OpenAPI string `json:"openapi"`
+	Paths   map[string]map[string]struct {
+		OperationID string `json:"operationId"`
+	} `json:"paths"`
+	Components struct {
+		Schemas map[string]json.RawMessage `json:"schemas"`
+	} `json:"components"`
+}
+
+func getOpenAPIDoc(t *testing.T, handler http.Handler) openAPIDoc {
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	require.Equal(t, http.StatusOK, resp.Code)
+	var doc openAPIDoc
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &doc))
+	return doc
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	history, err := NewHistory("", HistoryConfig{})
+	require.NoError(t, err)
+	webhooks, err := NewWebhookDispatcher(WebhookConfig{}, "")
+	require.NoError(t, err)
+	defer webhooks.Close(context.Background())
+	stream := NewChangeStream(StreamConfig{})
+	defer stream.Close()
+	mux := newMux(NewMemoryStorage(), Services{Webhooks: webhooks, Stream: stream, History: history, Metrics: NewMetrics()})
+
+	doc := getOpenAPIDoc(t, mux)
+	assert.Equal(t, "3.0.3", doc.OpenAPI)
+	ids := make(map[string]bool)
+	// Каждая операция документа обслуживается зарегистрированным маршрутом
+	for path, methods := range doc.Paths {
+		for method, op := range methods {
+			assert.False(t, ids[op.OperationID], op.OperationID)
+			ids[op.OperationID] = true
+			req := httptest.NewRequest(strings.ToUpper(method), strings.NewReplacer("{user_id}", "34", "{id}", "1").Replace(path), nil)
+			_, pattern := mux.Handler(req)
+			assert.NotEmpty(t, pattern, path)
+		}
+	}
+	assert.Len(t, ids, 29)
+	for _, name := range []string{"EventResult", "EventRequest", "ErrorResponse", "Violation", "BatchRequestOperation"} {
+		assert.Contains(t, doc.Components.Schemas, name)
+	}
+
+	// Маршруты отключенных служб не описываются
+	doc = getOpenAPIDoc(t, getHandler())
+	assert.Contains(t, doc.Paths, "/create_event/")
+	assert.NotContains(t, doc.Paths, "/webhooks/")
+	assert.NotContains(t, doc.Paths, "/metrics")
+}
+
+func TestValidateRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		want   string
+	}{
+		{"unknown parameter", http.MethodGet, "/events_for_day/?user_id=34&date=2024-03-04&users=35", "", http.StatusBadRequest,
+			`[{"parameter": "users", "message": "is not allowed"}]`},
+		{"missing date", http.MethodGet, "/events_for_day/?user_id=34", "", http.StatusBadRequest,
+			`[{"parameter": "date", "message": "is required"}]`},
+		{"repeated parameter", http.MethodGet, "/events_for_week/?user_id=34&date=2024-03-04&date=2024-03-11", "", http.StatusBadRequest,
+			`[{"parameter": "date", "message": "must be passed once"}]`},
+		{"wrong month and timezone", http.MethodGet, "/events_for_month/?user_id=34&year=2024&month=13&timezone=Mars/Base", "", http.StatusBadRequest,
+			`[{"parameter": "month", "message": "must be at most 12"}, {"parameter": "timezone", "message": "must be an IANA time zone"}]`},
+		{"wrong form fields", http.MethodPost, "/create_event/", "user_id=34&name=action&start=04.03.2024&all_day=yes", http.StatusBadRequest,
+			`[{"parameter": "all_day", "message": "must be a boolean"},
+			  {"parameter": "start", "message": "must be a date-time in RFC 3339 format or a date like 2006-01-02"}]`},
+		{"missing name", http.MethodPost, "/create_event/", "user_id=34&date=2024-03-04", http.StatusBadRequest,
+			`[{"parameter": "name", "message": "is required"}]`},
+		{"wrong scope", http.MethodPost, "/delete_event/", "user_id=34&id=1&scope=some", http.StatusBadRequest,
+			`[{"parameter": "scope", "message": "must be one of this, following, all"}]`},
+		{"rest query", http.MethodPut, "/users/34/events/1?reject=true", `{}`, http.StatusBadRequest,
+			`[{"parameter": "reject", "message": "is not allowed"}]`},
+		{"occurrence in patch", http.MethodPatch, "/users/34/events/1?occurrence=2024-03-04T10:00:00Z", `{}`, http.StatusBadRequest,
+			`[{"parameter": "occurrence", "message": "is not allowed"}]`},
+		{"repeated users of free busy", http.MethodGet, "/free_busy/?user_id=34&user_id=35", "", http.StatusOK, ""},
+		{"wrong method", http.MethodGet, "/create_event/?users=35", "", http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.method == http.MethodPost {
+				req.Header.Set("content-type", "application/x-www-form-urlencoded")
+			}
+			resp := httptest.NewRecorder()
+			getHandler().ServeHTTP(resp, req)
+			require.Equal(t, tt.status, resp.Code, resp.Body.String())
+			if tt.want == "" {
+				return
+			}
+			var respErr ErrorResponse
+			require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &respErr))
+			assert.Equal(t, "Invalid request parameters", respErr.Error)
+			violations, err := json.Marshal(respErr.Violations)
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.want, string(violations))
+		})
+	}
+}
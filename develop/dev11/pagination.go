@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	pageDefaultLimit = 100
+	pageMaxLimit     = 1000
+)
+
+// EventsPage результат запроса /events: страница событий и курсор следующей страницы.
+// NextCursor пустой, если страница последняя
+type EventsPage struct {
+	Events     []EventResult `json:"events"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// pageCursor ключ сортировки последнего события страницы. Следующая страница начинается
+// с событий строго больше ключа, поэтому добавление и удаление событий между запросами
+// не приводит к пропускам и повторам уже существующих событий
+type pageCursor struct {
+	Start        time.Time `json:"s"`
+	ID           string    `json:"id"`
+	RecurrenceID time.Time `json:"r,omitempty"`
+}
+
+func newPageCursor(e *Event) *pageCursor {
+	return &pageCursor{Start: e.Start.UTC(), ID: e.ID, RecurrenceID: e.RecurrenceID.UTC()}
+}
+
+// before проверяет, идет ли событие e в порядке sortEvents раньше курсора или совпадает с ним
+func (c *pageCursor) before(e *Event) bool {
+	return compareEvents(e, &Event{Start: c.Start, ID: c.ID, RecurrenceID: c.RecurrenceID}) <= 0
+}
+
+// String возвращает курсор в непрозрачном для клиента виде
+func (c *pageCursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parsePageCursor(value string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("wrong cursor")
+	}
+	var c pageCursor
+	if err := json.Unmarshal(data, &c); err != nil || c.ID == "" || c.Start.IsZero() {
+		return nil, fmt.Errorf("wrong cursor")
+	}
+	return &c, nil
+}
+
+// ParsePage парсит размер страницы limit (по умолчанию pageDefaultLimit) и курсор cursor из ответа на предыдущий запрос
+func ParsePage(v url.Values) (limit int, cursor *pageCursor, err error) {
+	limit, err = parseLimit(v)
+	if err != nil {
+		return 0, nil, err
+	}
+	if value := v.Get("cursor"); value != "" {
+		cursor, err = parsePageCursor(value)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	return limit, cursor, nil
+}
+
+// parseLimit парсит количество результатов limit, по умолчанию pageDefaultLimit
+func parseLimit(v url.Values) (int, error) {
+	value := v.Get("limit")
+	if value == "" {
+		return pageDefaultLimit, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > pageMaxLimit {
+		return 0, fmt.Errorf("limit must be from 1 to %d", pageMaxLimit)
+	}
+	return limit, nil
+}
+
+// getEvents возвращает события пользователя в диапазоне from - to постранично, отсортированными по началу и ID
+func getEvents(w http.ResponseWriter, r *http.Request, storage Storage) {
+	if r.Method != http.MethodGet {
+		writeErrorMessage(w, http.StatusMethodNotAllowed, "Wrong method")
+		return
+	}
+
+	query := r.URL.Query()
+	userID, from, to, loc, err := ParseUserAndRange(query)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit, cursor, err := ParsePage(query)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	from, to, err = defaultRange(from, to, loc)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// События раньше курсора не попадут в страницу, поэтому их месяцы можно не запрашивать
+	scanFrom := from
+	if cursor != nil && cursor.Start.After(from) {
+		scanFrom = cursor.Start.In(loc)
+	}
+	var events []Event
+	if scanFrom.Before(to) {
+		events, err = getEventsInRange(storage, userID, scanFrom, to)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	sortEvents(events)
+
+	page := EventsPage{Events: []EventResult{}}
+	for i := range events {
+		if cursor != nil && cursor.before(&events[i]) {
+			continue
+		}
+		if len(page.Events) == limit {
+			page.NextCursor = newPageCursor(&events[i-1]).String()
+			break
+		}
+		page.Events = append(page.Events, newEventResult(events[i]))
+	}
+	marshalResponseAndWrite(w, http.StatusOK, Response{Result: page})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func getEventsPage(t *testing.T, handler http.Handler, query string) EventsPage {
+	req := httptest.NewRequest(http.MethodGet, "/events/?"+query, nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	var page struct {
+		Result EventsPage `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &page))
+	return page.Result
+}
+
+func TestEventsPagination(t *testing.T) {
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			handler := newHandler(&Config{}, backend.newStorage(t), Services{})
+			ts := httptest.NewServer(handler)
+			defer ts.Close()
+
+			for _, body := range []string{
+				"user_id=34&start=2024-03-05T10:00:00Z&duration=1h&name=b",
+				"user_id=34&start=2024-03-04T10:00:00Z&duration=1h&name=a",
+				"user_id=34&start=2024-03-04T09:00:00Z&duration=1h&rrule=FREQ%3DDAILY%3BCOUNT%3D3&name=daily",
+				"user_id=34&start=2024-04-01T10:00:00Z&duration=1h&name=c",
+				"user_id=34&start=2024-02-01T10:00:00Z&duration=1h&name=before_range",
+			} {
+				_, err := createEventAndGetID(ts, handler, body)
+				require.NoError(t, err)
+			}
+
+			query := url.Values{"user_id": {"34"}, "from": {"2024-03-01"}, "to": {"2024-04-30"}, "limit": {"2"}}
+			var names []string
+			var cursors []string
+			for {
+				page := getEventsPage(t, handler, query.Encode())
+				assert.LessOrEqual(t, len(page.Events), 2)
+				for _, e := range page.Events {
+					names = append(names, e.Name)
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				cursors = append(cursors, page.NextCursor)
+				query.Set("cursor", page.NextCursor)
+			}
+			assert.Equal(t, []string{"daily", "a", "daily", "b", "daily", "c"}, names)
+			require.Len(t, cursors, 2)
+
+			// События, добавленные до и после курсора, не сдвигают страницы:
+			// следующая страница продолжается с того же места
+			query.Set("cursor", cursors[0])
+			before := getEventsPage(t, handler, query.Encode())
+			_, err := createEventAndGetID(ts, handler, "user_id=34&start=2024-03-04T08:00:00Z&duration=1h&name=added_before")
+			require.NoError(t, err)
+			_, err = createEventAndGetID(ts, handler, "user_id=34&start=2024-03-06T08:00:00Z&duration=1h&name=added_after")
+			require.NoError(t, err)
+			after := getEventsPage(t, handler, query.Encode())
+			assert.Equal(t, before.Events, after.Events)
+
+			query.Del("cursor")
+			query.Set("limit", "100")
+			page := getEventsPage(t, handler, query.Encode())
+			assert.Empty(t, page.NextCursor)
+			assert.Len(t, page.Events, 8)
+		})
+	}
+}
+
+func TestEventsPaginationErrors(t *testing.T) {
+	handler := getHandler()
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	_, err := createEventAndGetID(ts, handler, "user_id=34&date=2024-03-04&name=a")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"wrong limit", "user_id=34&limit=abc"},
+		{"zero limit", "user_id=34&limit=0"},
+		{"too large limit", "user_id=34&limit=100000"},
+		{"wrong cursor", "user_id=34&cursor=abc"},
+		{"wrong from", "user_id=34&from=2024-13-01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/events/?"+tt.query, nil)
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+			assert.Equal(t, http.StatusBadRequest, resp.Code)
+		})
+	}
+}
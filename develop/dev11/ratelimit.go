@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval как часто удаляются корзины, которые успели наполниться
+const rateLimitSweepInterval = time.Minute
+
+// RateLimitConfig ограничения частоты запросов одного клиента. Клиент определяется по пользователю
+// из токена, а без аутентификации - по IP адресу: user_id запроса клиент может подставить любой
+type RateLimitConfig struct {
+	// Read ограничение запросов на чтение: GET, HEAD и OPTIONS
+	Read RateLimit `json:"read"`
+	// Write ограничение остальных запросов, изменяющих события
+	Write RateLimit `json:"write"`
+}
+
+// RateLimit параметры корзины токенов
+type RateLimit struct {
+	// Rate сколько запросов в секунду разрешено в среднем, 0 - без ограничения
+	Rate float64 `json:"rate"`
+	// Burst сколько запросов можно сделать подряд, по умолчанию округленный вверх Rate
+	Burst int `json:"burst"`
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// validate проверяет параметры ограничения name
+func (l RateLimit) validate(name string) error {
+	if l.Rate < 0 || math.IsInf(l.Rate, 0) || math.IsNaN(l.Rate) {
+		return fmt.Errorf("rate_limit.%s.rate must be a non-negative number", name)
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("rate_limit.%s.burst must not be negative", name)
+	}
+	return nil
+}
+
+// validate проверяет ограничения частоты запросов
+func (cfg *RateLimitConfig) validate() error {
+	if err := cfg.Read.validate("read"); err != nil {
+		return err
+	}
+	return cfg.Write.validate("write")
+}
+
+type bucketKey struct {
+	write  bool
+	client string
+}
+
+// bucket корзина токенов клиента: каждый запрос забирает токен, токены пополняются со скоростью Rate
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateDecision результат проверки запроса
+type rateDecision struct {
+	allowed   bool
+	limit     int
+	remaining int
+	// reset через сколько корзина наполнится полностью
+	reset time.Duration
+	// retryAfter через сколько появится токен для следующего запроса
+	retryAfter time.Duration
+}
+
+// RateLimiter ограничивает частоту запросов клиентов. Безопасен для конкурентного использования
+type RateLimiter struct {
+	cfg RateLimitConfig
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*bucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter создает ограничитель по настройкам cfg, now - источник времени, nil означает time.Now
+func NewRateLimiter(cfg RateLimitConfig, now func() time.Time) *RateLimiter {
+	if now == nil {
+		now = time.Now
+	}
+	return &RateLimiter{cfg: cfg, now: now, buckets: make(map[bucketKey]*bucket), lastSweep: now()}
+}
+
+// allow забирает токен из корзины клиента client для чтения или изменения
+func (l *RateLimiter) allow(client string, write bool) (rateDecision, bool) {
+	limit := l.cfg.Read
+	if write {
+		limit = l.cfg.Write
+	}
+	if limit.Rate == 0 {
+		return rateDecision{}, false
+	}
+	burst := limit.burst()
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+	key := bucketKey{write: write, client: client}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed.Seconds()*limit.Rate)
+		b.last = now
+	}
+	d := rateDecision{limit: int(burst)}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.allowed = true
+	} else {
+		d.retryAfter = secondsDuration((1 - b.tokens) / limit.Rate)
+	}
+	d.remaining = int(b.tokens)
+	d.reset = secondsDuration((burst - b.tokens) / limit.Rate)
+	return d, true
+}
+
+// sweep удаляет корзины, которые наполнились бы к моменту now: они не отличаются от новых
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		limit := l.cfg.Read
+		if key.write {
+			limit = l.cfg.Write
+		}
+		if b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= limit.burst() {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// size возвращает количество корзин
+func (l *RateLimiter) size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// ceilSeconds округляет длительность вверх до целых секунд для заголовков
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// rateLimitClient возвращает ключ клиента запроса для ограничения частоты
+func rateLimitClient(r *http.Request) string {
+	if p := PrincipalFromContext(r.Context()); p != nil {
+		return "user:" + p.UserID
+	}
+	// X-Forwarded-For не учитывается: клиент может подставить в него любой адрес
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// isWriteRequest сообщает, изменяет ли запрос события
+func isWriteRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	default:
+		return true
+	}
+}
+
+// rateLimitHandler отклоняет запросы клиента сверх ограничения с кодом 429. В ответах на ограниченные
+// запросы передаются заголовки X-RateLimit-Limit, X-RateLimit-Remaining и X-RateLimit-Reset (секунды до
+// наполнения корзины), а в ответе 429 - Retry-After
+func rateLimitHandler(limiter *RateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, limited := limiter.allow(rateLimitClient(r), isWriteRequest(r))
+		if !limited {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(d.limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(d.remaining))
+		w.Header().Set("X-RateLimit-Reset", ceilSeconds(d.reset))
+		if !d.allowed {
+			w.Header().Set("Retry-After", ceilSeconds(d.retryAfter))
+			writeErrorMessage(w, http.StatusTooManyRequests, "Too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	clock := newFakeClock(mustTime(t, "2024-03-04T10:00:00Z"))
+	limiter := NewRateLimiter(RateLimitConfig{
+		Read:  RateLimit{Rate: 1, Burst: 3},
+		Write: RateLimit{Rate: 0.5},
+	}, clock.Now)
+
+	tests := []struct {
+		name       string
+		advance    time.Duration
+		client     string
+		write      bool
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+	}{
+		{"first read", 0, "user:34", false, true, 2, 0},
+		{"second read", 0, "user:34", false, true, 1, 0},
+		{"third read", 0, "user:34", false, true, 0, 0},
+		{"read over burst", 0, "user:34", false, false, 0, time.Second},
+		{"other client", 0, "user:35", false, true, 2, 0},
+		{"write has own bucket", 0, "user:34", true, true, 0, 0},
+		{"write over burst", 0, "user:34", true, false, 0, 2 * time.Second},
+		{"partial refill", 500 * time.Millisecond, "user:34", false, false, 0, 500 * time.Millisecond},
+		{"refilled token", 500 * time.Millisecond, "user:34", false, true, 0, 0},
+		{"write refilled", time.Second, "user:34", true, true, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock.Advance(tt.advance)
+			d, limited := limiter.allow(tt.client, tt.write)
+			require.True(t, limited)
+			assert.Equal(t, tt.allowed, d.allowed)
+			assert.Equal(t, tt.remaining, d.remaining)
+			assert.Equal(t, tt.retryAfter, d.retryAfter)
+		})
+	}
+
+	_, limited := NewRateLimiter(RateLimitConfig{Write: RateLimit{Rate: 1}}, clock.Now).allow("user:34", false)
+	assert.False(t, limited)
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	clock := newFakeClock(mustTime(t, "2024-03-04T10:00:00Z"))
+	limiter := NewRateLimiter(RateLimitConfig{Read: RateLimit{Rate: 1, Burst: 100}}, clock.Now)
+	for _, client := range []string{"ip:192.0.2.1", "ip:192.0.2.2", "ip:192.0.2.3"} {
+		limiter.allow(client, false)
+	}
+	clock.Advance(50 * time.Second)
+	for i := 0; i < 20; i++ {
+		limiter.allow("ip:192.0.2.4", false)
+	}
+	require.Equal(t, 4, limiter.size())
+
+	// Через минуту корзины наполнились и удаляются, кроме недавно опустошенной
+	clock.Advance(rateLimitSweepInterval - 50*time.Second)
+	limiter.allow("ip:192.0.2.5", false)
+	assert.Equal(t, 2, limiter.size())
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	handler := newHandler(&Config{RateLimit: &RateLimitConfig{
+		Read:  RateLimit{Rate: 0.01, Burst: 2},
+		Write: RateLimit{Rate: 0.01, Burst: 1},
+	}}, NewMemoryStorage(), Services{})
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		remoteAddr string
+		status     int
+		remaining  string
+	}{
+		{"write", http.MethodPost, "/create_event/", "user_id=34&date=2024-03-04&name=action", "192.0.2.1:1234", http.StatusOK, "0"},
+		{"write over limit", http.MethodPost, "/create_event/", "user_id=34&date=2024-03-05&name=action", "192.0.2.1:1234", http.StatusTooManyRequests, "0"},
+		{"write from other address", http.MethodPost, "/create_event/", "user_id=34&date=2024-03-05&name=action", "192.0.2.2:1234", http.StatusOK, "0"},
+		{"read", http.MethodGet, "/events_for_day/?user_id=34&date=2024-03-04", "", "192.0.2.1:1234", http.StatusOK, "1"},
+		{"read by user from other address", http.MethodGet, "/users/34/events", "", "192.0.2.2:1234", http.StatusOK, "1"},
+		{"second read", http.MethodGet, "/events_for_day/?user_id=34&date=2024-03-04", "", "192.0.2.1:1234", http.StatusOK, "0"},
+		// Без аутентификации user_id запроса не меняет клиента, иначе ограничение обходилось бы подменой
+		{"read over limit as other user", http.MethodGet, "/events_for_day/?user_id=35&date=2024-03-04", "", "192.0.2.1:1234", http.StatusTooManyRequests, "0"},
+		{"rest read over limit as other user", http.MethodGet, "/users/35/events", "", "192.0.2.1:1234", http.StatusTooManyRequests, "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("content-type", "application/x-www-form-urlencoded")
+			req.RemoteAddr = tt.remoteAddr
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+			require.Equal(t, tt.status, resp.Code, resp.Body.String())
+			assert.Equal(t, tt.remaining, resp.Header().Get("X-RateLimit-Remaining"))
+			assert.NotEmpty(t, resp.Header().Get("X-RateLimit-Limit"))
+			assert.NotEmpty(t, resp.Header().Get("X-RateLimit-Reset"))
+			if tt.status == http.StatusTooManyRequests {
+				assert.Equal(t, "100", resp.Header().Get("Retry-After"))
+				assert.JSONEq(t, `{"error":"Too many requests"}`, resp.Body.String())
+			} else {
+				assert.Empty(t, resp.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+func TestRateLimitByPrincipal(t *testing.T) {
+	handler := newHandler(&Config{
+		Auth:      &AuthConfig{APIKeys: []APIKey{{Key: "key-34", UserID: "34"}, {Key: "key-35", UserID: "35"}}},
+		RateLimit: &RateLimitConfig{Read: RateLimit{Rate: 0.01, Burst: 1}},
+	}, NewMemoryStorage(), Services{})
+
+	tests := []struct {
+		name   string
+		token  string
+		path   string
+		status int
+	}{
+		{"first request", "key-34", "/users/34/events/1", http.StatusNotFound},
+		{"same user", "key-34", "/events_for_day/?date=2024-03-04", http.StatusTooManyRequests},
+		// Клиент определяется по токену, а не по адресу
+		{"other user", "key-35", "/users/35/events/1", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+			assert.Equal(t, tt.status, resp.Code)
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// RecurrenceScope задает, какие повторения серии затрагивает изменение
+type RecurrenceScope string
+
+const (
+	// ScopeAll изменение всей серии
+	ScopeAll RecurrenceScope = "all"
+	// ScopeThis изменение одного повторения
+	ScopeThis RecurrenceScope = "this"
+	// ScopeFollowing изменение повторения и всех следующих за ним
+	ScopeFollowing RecurrenceScope = "following"
+)
+
+// rule возвращает разобранное правило повторения события или nil, если событие не повторяется
+func (e *Event) rule() (*RecurrenceRule, error) {
+	if e.RRule == "" {
+		return nil, nil
+	}
+	return ParseRRule(e.RRule, e.Location())
+}
+
+// Occurrences возвращает повторения события, пересекающиеся с интервалом [from, to).
+// Для неповторяющегося события это само событие, если оно пересекается с интервалом
+func (e *Event) Occurrences(from, to time.Time) []Event {
+	rule, err := e.rule()
+	if err != nil || rule == nil {
+		if e.Overlaps(from, to) {
+			return []Event{*e}
+		}
+		return nil
+	}
+	var res []Event
+	rule.forEach(e.Start.In(e.Location()), to, func(t time.Time) bool {
+		if e.isException(t) {
+			return true
+		}
+		if occ := e.occurrence(t); occ.Overlaps(from, to) {
+			res = append(res, occ)
+		}
+		return true
+	})
+	for _, o := range e.Overrides {
+		if o.Overlaps(from, to) {
+			o.RRule = e.RRule
+			o.Version = e.Version
+			o.Attendees = e.Attendees
+			res = append(res, o)
+		}
+	}
+	return res
+}
+
+// occurrence возвращает повторение серии, начинающееся в t
+func (e *Event) occurrence(t time.Time) Event {
+	occ := *e
+	occ.Start = t
+	if e.AllDay {
+		occ.End = t.AddDate(0, 0, e.days())
+	} else {
+		occ.End = t.Add(e.End.Sub(e.Start))
+	}
+	occ.RecurrenceID = t
+	occ.ExDates = nil
+	occ.Overrides = nil
+	return occ
+}
+
+// days возвращает длительность события на весь день в днях. В поясах с переходом
+// на летнее время день длится 23 или 25 часов, поэтому длительность округляется
+func (e *Event) days() int {
+	return int(e.End.Sub(e.Start).Round(24*time.Hour) / (24 * time.Hour))
+}
+
+// isException проверяет, удалено или изменено ли повторение серии, начинающееся в t
+func (e *Event) isException(t time.Time) bool {
+	for _, ex := range e.ExDates {
+		if ex.Equal(t) {
+			return true
+		}
+	}
+	for _, o := range e.Overrides {
+		if o.RecurrenceID.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasOccurrence проверяет, есть ли у серии повторение с исходным началом t
+func (e *Event) hasOccurrence(rule *RecurrenceRule, t time.Time) bool {
+	for _, o := range e.Overrides {
+		if o.RecurrenceID.Equal(t) {
+			return true
+		}
+	}
+	found := false
+	rule.forEach(e.Start.In(e.Location()), t.Add(time.Nanosecond), func(occ time.Time) bool {
+		found = occ.Equal(t)
+		return !found
+	})
+	return found && !e.isException(t)
+}
+
+// countBefore возвращает количество повторений серии, начинающихся раньше t, включая удаленные
+func (e *Event) countBefore(rule *RecurrenceRule, t time.Time) int {
+	n := 0
+	rule.forEach(e.Start.In(e.Location()), t, func(time.Time) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// truncate возвращает серию, оканчивающуюся перед повторением occurrence
+func (e *Event) truncate(rule *RecurrenceRule, occurrence time.Time) Event {
+	truncated := *e
+	cut := *rule
+	if cut.Count > 0 {
+		cut.Count = e.countBefore(rule, occurrence)
+	} else {
+		cut.Until = occurrence.Add(-time.Second)
+	}
+	truncated.RRule = cut.String()
+	truncated.ExDates = nil
+	for _, ex := range e.ExDates {
+		if ex.Before(occurrence) {
+			truncated.ExDates = append(truncated.ExDates, ex)
+		}
+	}
+	truncated.Overrides = nil
+	for _, o := range e.Overrides {
+		if o.RecurrenceID.Before(occurrence) {
+			truncated.Overrides = append(truncated.Overrides, o)
+		}
+	}
+	return truncated
+}
+
+// UpdateOccurrence изменяет повторение серии event.ID с исходным началом occurrence.
+// ScopeThis изменяет только это повторение, ScopeFollowing разбивает серию на две:
+// старая заканчивается перед occurrence, а новая с параметрами event начинается с него.
+// Если у event не задано правило, новая серия продолжает правило старой.
+// Возвращается измененное повторение или новая серия
+func (s *MemoryStorage) UpdateOccurrence(event *Event, occurrence time.Time, scope RecurrenceScope, opts ...WriteOption) (*Event, error) {
+	if event.ID == "" || occurrence.IsZero() {
+		return nil, &ValidationError{Message: "empty parameters"}
+	}
+	if err := event.validate(); err != nil {
+		return nil, err
+	}
+	o := newWriteOptions(opts)
+	// Изменение серии с первого повторения проверяет пересечения в update
+	sh, unlock := s.lockWrite(event.UserID, o)
+	defer unlock()
+	master, rule, err := sh.getOccurrence(event.UserID, event.ID, occurrence)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.checkVersion(master.Version); err != nil {
+		return nil, err
+	}
+	switch scope {
+	case ScopeThis:
+		master.Version++
+		override := *event
+		override.RRule = ""
+		override.RecurrenceID = occurrence
+		override.ExDates = nil
+		override.Overrides = nil
+		override.Version = 0
+		// Участники общие для всей серии
+		override.Attendees = nil
+		master.Overrides = replaceOverride(master.Overrides, override)
+		if err := s.commit(sh, o, Change{Status: Updated, Event: master}); err != nil {
+			return nil, err
+		}
+		override.RRule = master.RRule
+		override.Version = master.Version
+		override.Attendees = master.Attendees
+		return &override, nil
+	case ScopeFollowing:
+		if occurrence.Equal(master.Start) {
+			// Изменяется вся серия: без правила update превратил бы ее в одно событие и потерял исключения
+			if event.RRule == "" {
+				event.RRule = master.RRule
+			}
+			return s.update(sh, event, o)
+		}
+		series := *event
+		series.ID = uuid.New().String()
+		series.ExDates = nil
+		series.Overrides = nil
+		series.Version = 1
+		// Участники, которые остались в новой серии, сохраняют свои ответы
+		requested := series.Attendees
+		if o.keepAttendees {
+			requested = master.Attendees
+		}
+		series.Attendees, err = mergeAttendees(series.UserID, requested, master.Attendees)
+		if err != nil {
+			return nil, err
+		}
+		if series.RRule == "" {
+			rest := *rule
+			if rest.Count > 0 {
+				rest.Count -= master.countBefore(rule, occurrence)
+			}
+			series.RRule = rest.String()
+		}
+		if err := series.validate(); err != nil {
+			return nil, err
+		}
+		truncated := master.truncate(rule, occurrence)
+		truncated.Version++
+		err := s.commit(sh, o, Change{Status: Updated, Event: truncated}, Change{Status: Created, Event: series})
+		if err != nil {
+			return nil, err
+		}
+		return &series, nil
+	default:
+		return nil, &ValidationError{Message: "wrong scope"}
+	}
+}
+
+// DeleteOccurrence удаляет повторение серии event.ID с исходным началом occurrence (ScopeThis)
+// или его вместе со всеми следующими (ScopeFollowing)
+func (s *MemoryStorage) DeleteOccurrence(event *Event, occurrence time.Time, scope RecurrenceScope, opts ...WriteOption) (*Event, error) {
+	if event.ID == "" || event.UserID == "" || occurrence.IsZero() {
+		return nil, &ValidationError{Message: "empty parameters"}
+	}
+	sh := s.shard(event.UserID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	master, rule, err := sh.getOccurrence(event.UserID, event.ID, occurrence)
+	if err != nil {
+		return nil, err
+	}
+	o := newWriteOptions(opts)
+	if err := o.checkVersion(master.Version); err != nil {
+		return nil, err
+	}
+	master.Version++
+	switch scope {
+	case ScopeThis:
+		master.Overrides = removeOverride(master.Overrides, occurrence)
+		master.ExDates = append(append([]time.Time(nil), master.ExDates...), occurrence)
+		if err := s.commit(sh, o, Change{Status: Updated, Event: master}); err != nil {
+			return nil, err
+		}
+	case ScopeFollowing:
+		change := Change{Status: Updated, Event: master.truncate(rule, occurrence)}
+		if occurrence.Equal(master.Start) {
+			change = Change{Status: Deleted, Event: master}
+		}
+		if err := s.commit(sh, o, change); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, &ValidationError{Message: "wrong scope"}
+	}
+	event.Version = master.Version
+	return event, nil
+}
+
+// getOccurrence возвращает серию и ее правило, проверяя, что у серии есть повторение occurrence
+func (s *storageShard) getOccurrence(userID, id string, occurrence time.Time) (Event, *RecurrenceRule, error) {
+	master, err := s.get(userID, id)
+	if err != nil {
+		return Event{}, nil, err
+	}
+	rule, err := master.rule()
+	if err != nil || rule == nil {
+		return Event{}, nil, &ValidationError{Message: "Event is not recurring"}
+	}
+	if !master.hasOccurrence(rule, occurrence) {
+		return Event{}, nil, &ValidationError{Message: "Occurrence does not exist", NotFound: true}
+	}
+	return master, rule, nil
+}
+
+// replaceOverride возвращает копию списка измененных повторений с добавленным или замененным override
+func replaceOverride(overrides []Event, override Event) []Event {
+	res := removeOverride(overrides, override.RecurrenceID)
+	return append(res, override)
+}
+
+// removeOverride возвращает копию списка измененных повторений без повторения occurrence
+func removeOverride(overrides []Event, occurrence time.Time) []Event {
+	var res []Event
+	for _, o := range overrides {
+		if !o.RecurrenceID.Equal(occurrence) {
+			res = append(res, o)
+		}
+	}
+	return res
+}
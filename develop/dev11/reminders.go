@@ -0,0 +1,544 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxReminders сколько напоминаний можно задать одному событию
+	maxReminders = 10
+	// reminderLookahead насколько вперед планировщик ищет следующее напоминание. Не дольше этого он спит
+	reminderLookahead = time.Hour
+	// reminderStateFileName файл состояния планировщика в директории хранилища
+	reminderStateFileName = "reminders.json"
+	// reminderGrace насколько может опоздать напоминание о событии, которое уже началось.
+	// Более старые напоминания (например, пропущенные, пока сервер не работал) не отправляются
+	reminderGrace = time.Minute
+	// reminderRetry через сколько планировщик повторяет отправку напоминания после ошибки
+	reminderRetry = 30 * time.Second
+	// reminderHorizon насколько вперед ищется следующее напоминание о серии. Если его нет,
+	// поиск повторяется, когда время дойдет до этой границы
+	reminderHorizon = 366 * 24 * time.Hour
+)
+
+// ParseReminders разбирает список смещений напоминаний до начала события через запятую:
+// длительности в формате time.ParseDuration (15m, 1h30m) или целые дни (1d)
+func ParseReminders(value string) ([]time.Duration, error) {
+	var res []time.Duration
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var offset time.Duration
+		if days, ok := strings.CutSuffix(part, "d"); ok {
+			n, err := strconv.Atoi(days)
+			if err != nil {
+				return nil, fmt.Errorf("wrong reminder %q", part)
+			}
+			offset = time.Duration(n) * 24 * time.Hour
+		} else {
+			var err error
+			offset, err = time.ParseDuration(part)
+			if err != nil {
+				return nil, fmt.Errorf("wrong reminder %q", part)
+			}
+		}
+		res = append(res, offset)
+	}
+	return res, nil
+}
+
+// FormatReminder возвращает смещение напоминания в формате ParseReminders
+func FormatReminder(offset time.Duration) string {
+	if offset != 0 && offset%(24*time.Hour) == 0 {
+		return strconv.Itoa(int(offset/(24*time.Hour))) + "d"
+	}
+	return offset.String()
+}
+
+// normalizeReminders проверяет смещения напоминаний и возвращает их отсортированными без повторов
+func normalizeReminders(reminders []time.Duration) ([]time.Duration, error) {
+	if len(reminders) == 0 {
+		return nil, nil
+	}
+	if len(reminders) > maxReminders {
+		return nil, fmt.Errorf("too many reminders, max %d", maxReminders)
+	}
+	res := append([]time.Duration(nil), reminders...)
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	n := 0
+	for i, offset := range res {
+		if offset < 0 {
+			return nil, fmt.Errorf("reminder must not be after event start")
+		}
+		if i == 0 || offset != res[n-1] {
+			res[n] = offset
+			n++
+		}
+	}
+	return res[:n], nil
+}
+
+// Reminder напоминание о повторении события
+type Reminder struct {
+	// FireAt время отправки напоминания: начало события минус Offset
+	FireAt time.Time
+	Offset time.Duration
+	// Event событие или повторение серии, о котором напоминание
+	Event Event
+}
+
+// ReminderSource источник напоминаний для планировщика
+type ReminderSource interface {
+	// DueReminders возвращает напоминания со временем отправки в интервале (from, to]
+	DueReminders(from, to time.Time) []Reminder
+	// NextReminder возвращает время, до которого после after нет напоминаний: время ближайшего напоминания
+	// или границу, до которой оно искалось. false, если напоминаний больше нет
+	NextReminder(after time.Time) (time.Time, bool)
+}
+
+// DueReminders возвращает напоминания всех пользователей со временем отправки в интервале (from, to]
+func (s *MemoryStorage) DueReminders(from, to time.Time) []Reminder {
+	res, ok := s.reminders.due(from, to)
+	if !ok {
+		res = nil
+		s.forEachEvent(func(event *Event) {
+			res = append(res, event.dueReminders(from, to)...)
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].FireAt.Before(res[j].FireAt) })
+	return res
+}
+
+// NextReminder возвращает время ближайшего напоминания всех пользователей после after
+// или границу, до которой оно искалось
+func (s *MemoryStorage) NextReminder(after time.Time) (time.Time, bool) {
+	if next, ok, indexed := s.reminders.next(after); indexed {
+		return next, ok
+	}
+	var res time.Time
+	s.forEachEvent(func(event *Event) {
+		if next, ok := event.nextReminder(after); ok && (res.IsZero() || next.Before(res)) {
+			res = next
+		}
+	})
+	return res, !res.IsZero()
+}
+
+// forEachEvent вызывает fn для каждого события хранилища, блокируя шарды на чтение по одному
+func (s *MemoryStorage) forEachEvent(fn func(event *Event)) {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for _, calendar := range sh.events {
+			for i := range calendar {
+				event := calendar[i]
+				fn(&event)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+}
+
+// reminderIndex очередь событий с напоминаниями по времени ближайшего напоминания после base.
+// Планировщик запрашивает напоминания с неубывающим началом интервала, очередь сдвигается вместе с ним,
+// поэтому повторения разворачиваются только у событий, напоминания которых наступили.
+// Как и invitations, обновляется под блокировкой шарда организатора и хранит копии событий
+type reminderIndex struct {
+	mu    sync.Mutex
+	base  time.Time
+	queue reminderQueue
+	items map[eventRef]*reminderItem
+}
+
+// reminderItem событие в очереди напоминаний
+type reminderItem struct {
+	event Event
+	// next время ближайшего напоминания после base или граница, до которой его искали
+	next  time.Time
+	index int
+}
+
+// reminderQueue куча событий по времени ближайшего напоминания для container/heap
+type reminderQueue []*reminderItem
+
+func (q reminderQueue) Len() int {
+	return len(q)
+}
+
+func (q reminderQueue) Less(i, j int) bool {
+	return q[i].next.Before(q[j].next)
+}
+
+func (q reminderQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *reminderQueue) Push(x any) {
+	item := x.(*reminderItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *reminderQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return item
+}
+
+// update переносит в очередь изменение события
+func (idx *reminderIndex) update(c Change) {
+	ref := eventRef{userID: c.Event.UserID, id: c.Event.ID}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if item, ok := idx.items[ref]; ok {
+		heap.Remove(&idx.queue, item.index)
+		delete(idx.items, ref)
+	}
+	if c.Status != Deleted {
+		idx.push(c.Event)
+	}
+}
+
+// push добавляет событие в очередь, если у него есть напоминания после base
+func (idx *reminderIndex) push(event Event) {
+	next, ok := event.nextReminder(idx.base)
+	if !ok {
+		return
+	}
+	if idx.items == nil {
+		idx.items = make(map[eventRef]*reminderItem)
+	}
+	item := &reminderItem{event: event, next: next}
+	heap.Push(&idx.queue, item)
+	idx.items[eventRef{userID: event.UserID, id: event.ID}] = item
+}
+
+// advance сдвигает base к from: события, напоминания которых наступили, переставляются на следующее
+func (idx *reminderIndex) advance(from time.Time) {
+	if !from.After(idx.base) {
+		return
+	}
+	idx.base = from
+	for len(idx.queue) > 0 && !idx.queue[0].next.After(from) {
+		item := heap.Pop(&idx.queue).(*reminderItem)
+		delete(idx.items, eventRef{userID: item.event.UserID, id: item.event.ID})
+		idx.push(item.event)
+	}
+}
+
+// due возвращает напоминания со временем отправки в интервале (from, to].
+// false, если from раньше начала очереди и она не знает о таких напоминаниях
+func (idx *reminderIndex) due(from, to time.Time) ([]Reminder, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if from.Before(idx.base) {
+		return nil, false
+	}
+	idx.advance(from)
+	var items []*reminderItem
+	for len(idx.queue) > 0 && !idx.queue[0].next.After(to) {
+		items = append(items, heap.Pop(&idx.queue).(*reminderItem))
+	}
+	var res []Reminder
+	for _, item := range items {
+		res = append(res, item.event.dueReminders(from, to)...)
+		heap.Push(&idx.queue, item)
+	}
+	return res, true
+}
+
+// next возвращает время ближайшего напоминания после after и есть ли оно.
+// indexed false, если after раньше начала очереди
+func (idx *reminderIndex) next(after time.Time) (next time.Time, ok bool, indexed bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if after.Before(idx.base) {
+		return time.Time{}, false, false
+	}
+	idx.advance(after)
+	if len(idx.queue) == 0 {
+		return time.Time{}, false, true
+	}
+	return idx.queue[0].next, true, true
+}
+
+// nextReminder возвращает время ближайшего напоминания о повторениях события после after.
+// Повторения перебираются не дальше reminderHorizon после after: если напоминание не найдено,
+// а серия может продолжаться, возвращается граница поиска, от которой его нужно искать снова
+func (e *Event) nextReminder(after time.Time) (time.Time, bool) {
+	var next time.Time
+	consider := func(start time.Time, reminders []time.Duration) {
+		for _, offset := range reminders {
+			if fireAt := start.Add(-offset); fireAt.After(after) && (next.IsZero() || fireAt.Before(next)) {
+				next = fireAt
+			}
+		}
+	}
+	for _, o := range e.Overrides {
+		consider(o.Start, o.Reminders)
+	}
+	rule, err := e.rule()
+	if err != nil || rule == nil {
+		consider(e.Start, e.Reminders)
+		return next, !next.IsZero()
+	}
+	if len(e.Reminders) == 0 {
+		return next, !next.IsZero()
+	}
+	// Смещения отсортированы, у более поздних повторений напоминания не раньше start - maxOffset
+	maxOffset := e.Reminders[len(e.Reminders)-1]
+	limit := after.Add(maxOffset + reminderHorizon)
+	count := 0
+	rule.forEach(e.Start.In(e.Location()), limit, func(t time.Time) bool {
+		count++
+		if !next.IsZero() && !t.Add(-maxOffset).Before(next) {
+			return false
+		}
+		if !e.isException(t) {
+			consider(t, e.Reminders)
+		}
+		return true
+	})
+	if !next.IsZero() {
+		return next, true
+	}
+	if rule.Count > 0 && count >= rule.Count || !rule.Until.IsZero() && rule.Until.Before(limit) {
+		return time.Time{}, false
+	}
+	return limit, true
+}
+
+// dueReminders возвращает напоминания о повторениях события со временем отправки в интервале (from, to]
+func (e *Event) dueReminders(from, to time.Time) []Reminder {
+	maxOffset := time.Duration(-1)
+	for _, offset := range e.Reminders {
+		maxOffset = max(maxOffset, offset)
+	}
+	for _, o := range e.Overrides {
+		for _, offset := range o.Reminders {
+			maxOffset = max(maxOffset, offset)
+		}
+	}
+	if maxOffset < 0 {
+		return nil
+	}
+	var res []Reminder
+	for _, occ := range e.Occurrences(from, to.Add(maxOffset+time.Nanosecond)) {
+		for _, offset := range occ.Reminders {
+			fireAt := occ.Start.Add(-offset)
+			if fireAt.After(from) && !fireAt.After(to) {
+				res = append(res, Reminder{FireAt: fireAt, Offset: offset, Event: occ})
+			}
+		}
+	}
+	return res
+}
+
+// Clock источник времени планировщика, в тестах подменяется
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// reminderState состояние планировщика, сохраняемое между перезапусками
+type reminderState struct {
+	// Watermark все напоминания со временем отправки не позже него уже обработаны
+	Watermark time.Time `json:"watermark"`
+}
+
+// Scheduler отправляет напоминания о событиях через Notifier в момент их наступления.
+// Время, до которого напоминания обработаны, сохраняется только после их отправки, поэтому
+// доставка не реже одного раза: напоминание, которое не удалось отправить, отправляется повторно
+// через reminderRetry, а после такой ошибки или перезапуска во время отправки напоминание может прийти дважды
+type Scheduler struct {
+	source    ReminderSource
+	notifier  Notifier
+	clock     Clock
+	statePath string
+	watermark time.Time
+	wake      chan struct{}
+}
+
+// NewScheduler создает планировщик. Состояние хранится в файле statePath, если он пустой -
+// только в памяти, и напоминания, пропущенные до запуска, не отправляются. clock nil означает системное время
+func NewScheduler(source ReminderSource, notifier Notifier, clock Clock, statePath string) (*Scheduler, error) {
+	if clock == nil {
+		clock = realClock{}
+	}
+	s := &Scheduler{
+		source:    source,
+		notifier:  notifier,
+		clock:     clock,
+		statePath: statePath,
+		watermark: clock.Now(),
+		wake:      make(chan struct{}, 1),
+	}
+	if statePath == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read reminder state: %w", err)
+	}
+	var state reminderState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("parse reminder state: %w", err)
+	}
+	s.watermark = state.Watermark
+	return s, nil
+}
+
+// Wake будит планировщик, чтобы он пересчитал время следующего напоминания.
+// Вызывается при изменении событий, не блокируется
+func (s *Scheduler) Wake() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run отправляет напоминания, пока не отменен ctx
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		now := s.clock.Now()
+		if now.After(s.watermark) {
+			s.fire(ctx, now)
+		}
+		wait := reminderLookahead
+		if next, ok := s.source.NextReminder(s.watermark); ok {
+			if next.After(now) {
+				wait = min(wait, next.Sub(now))
+			} else {
+				// Напоминание не отправлено из-за ошибки
+				wait = reminderRetry
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-s.clock.After(wait):
+		}
+	}
+}
+
+// fire отправляет напоминания со временем отправки от последнего запуска до now.
+// При ошибке отправки watermark остается перед неотправленным напоминанием
+func (s *Scheduler) fire(ctx context.Context, now time.Time) {
+	watermark := now
+	for _, r := range s.source.DueReminders(s.watermark, now) {
+		if now.After(r.Event.Start) && now.Sub(r.FireAt) > reminderGrace {
+			continue
+		}
+		if err := s.notifier.Notify(ctx, r); err != nil {
+			fmt.Fprintf(os.Stderr, "Error while sending reminder for event %s: %v\n", r.Event.ID, err)
+			watermark = r.FireAt.Add(-time.Nanosecond)
+			break
+		}
+	}
+	if !watermark.After(s.watermark) {
+		return
+	}
+	s.watermark = watermark
+	if err := s.saveState(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error while saving reminder state:", err)
+	}
+}
+
+func (s *Scheduler) saveState() error {
+	if s.statePath == "" {
+		return nil
+	}
+	data, err := json.Marshal(reminderState{Watermark: s.watermark})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.statePath, data)
+}
+
+// ReminderMessage формат уведомления о напоминании
+type ReminderMessage struct {
+	UserID string      `json:"user_id"`
+	FireAt string      `json:"fire_at"`
+	Offset string      `json:"offset"`
+	Event  EventResult `json:"event"`
+}
+
+// Message возвращает напоминание в формате уведомления
+func (r *Reminder) Message() ReminderMessage {
+	return ReminderMessage{
+		UserID: r.Event.UserID,
+		FireAt: r.FireAt.In(r.Event.Location()).Format(time.RFC3339),
+		Offset: FormatReminder(r.Offset),
+		Event:  newEventResult(r.Event),
+	}
+}
+
+// startScheduler запускает планировщик напоминаний, если он настроен в cfg. Планировщик будится
+// при каждом изменении событий и останавливается во время server.Shutdown. Возвращает канал,
+// который закрывается после остановки планировщика
+func startScheduler(cfg *Config, storage Storage, server *http.Server) (<-chan struct{}, error) {
+	done := make(chan struct{})
+	if cfg.Reminders == nil {
+		close(done)
+		return done, nil
+	}
+	source, ok := storage.(interface {
+		ReminderSource
+		OnChange(fn func(changes []Change))
+	})
+	if !ok {
+		return nil, fmt.Errorf("storage does not support reminders")
+	}
+	notifier, err := cfg.Reminders.notifier()
+	if err != nil {
+		return nil, err
+	}
+	var statePath string
+	if cfg.StoragePath != "" {
+		statePath = filepath.Join(cfg.StoragePath, reminderStateFileName)
+	}
+	scheduler, err := NewScheduler(source, notifier, nil, statePath)
+	if err != nil {
+		return nil, err
+	}
+	source.OnChange(func([]Change) { scheduler.Wake() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server.RegisterOnShutdown(cancel)
+	go func() {
+		defer close(done)
+		scheduler.Run(ctx)
+	}()
+	return done, nil
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock время, которое двигается только вызовом Advance
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+	// waiting получает сигнал каждый раз, когда кто-то начинает ждать
+	waiting chan struct{}
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, waiting: make(chan struct{}, 100)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+	} else {
+		c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	}
+	c.waiting <- struct{}{}
+	return ch
+}
+
+// Advance сдвигает время и будит ожидающих
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	var rest []fakeWaiter
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			rest = append(rest, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = rest
+}
+
+// waitIdle ждет, пока планировщик не начнет ждать следующего напоминания
+func (c *fakeClock) waitIdle(t *testing.T) {
+	select {
+	case <-c.waiting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduler is not waiting")
+	}
+}
+
+// chanNotifier передает напоминания в канал
+type chanNotifier chan Reminder
+
+func (n chanNotifier) Notify(_ context.Context, r Reminder) error {
+	n <- r
+	return nil
+}
+
+func (n chanNotifier) expect(t *testing.T, name string, fireAt string) {
+	select {
+	case r := <-n:
+		assert.Equal(t, name, r.Event.Name)
+		assert.Equal(t, fireAt, r.FireAt.UTC().Format(time.RFC3339))
+	case <-time.After(5 * time.Second):
+		t.Fatalf("reminder for %s is not sent", name)
+	}
+}
+
+func (n chanNotifier) expectNone(t *testing.T) {
+	select {
+	case r := <-n:
+		t.Fatalf("unexpected reminder for %s at %s", r.Event.Name, r.FireAt)
+	default:
+	}
+}
+
+func mustTime(t *testing.T, value string) time.Time {
+	res, err := time.Parse(time.RFC3339, value)
+	require.NoError(t, err)
+	return res
+}
+
+func TestParseReminders(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []time.Duration
+		err   bool
+	}{
+		{"15m", []time.Duration{15 * time.Minute}, false},
+		{"1d, 15m,1h30m", []time.Duration{24 * time.Hour, 15 * time.Minute, 90 * time.Minute}, false},
+		{"", nil, false},
+		{"abc", nil, true},
+		{"xd", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseReminders(tt.value)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+	assert.Equal(t, "1d", FormatReminder(24*time.Hour))
+	assert.Equal(t, "15m0s", FormatReminder(15*time.Minute))
+
+	// Напоминания сортируются без повторов, напоминание после начала события - ошибка
+	e := Event{UserID: "34", Name: "a", Start: mustTime(t, "2024-03-04T10:00:00Z"), Reminders: []time.Duration{time.Hour, 0, time.Hour}}
+	e.End = e.Start
+	require.NoError(t, e.validate())
+	assert.Equal(t, []time.Duration{0, time.Hour}, e.Reminders)
+	e.Reminders = []time.Duration{-time.Minute}
+	assert.Error(t, e.validate())
+}
+
+func TestDueReminders(t *testing.T) {
+	s := NewMemoryStorage()
+	_, err := s.Create(&Event{UserID: "34", Name: "meeting", Start: mustTime(t, "2024-03-04T10:00:00Z"),
+		End: mustTime(t, "2024-03-04T11:00:00Z"), Reminders: []time.Duration{15 * time.Minute, 24 * time.Hour}})
+	require.NoError(t, err)
+	_, err = s.Create(&Event{UserID: "35", Name: "daily", Start: mustTime(t, "2024-03-04T09:00:00Z"),
+		End: mustTime(t, "2024-03-04T09:00:00Z"), RRule: "FREQ=DAILY", Reminders: []time.Duration{time.Hour}})
+	require.NoError(t, err)
+	_, err = s.Create(&Event{UserID: "35", Name: "no reminders", Start: mustTime(t, "2024-03-04T09:00:00Z"),
+		End: mustTime(t, "2024-03-04T09:00:00Z")})
+	require.NoError(t, err)
+
+	due := s.DueReminders(mustTime(t, "2024-03-03T10:00:00Z"), mustTime(t, "2024-03-05T08:00:00Z"))
+	var got []string
+	for _, r := range due {
+		got = append(got, r.Event.Name+" "+r.FireAt.Format(time.RFC3339))
+	}
+	// Интервал не включает начало
+	assert.Equal(t, []string{
+		"daily 2024-03-04T08:00:00Z",
+		"meeting 2024-03-04T09:45:00Z",
+		"daily 2024-03-05T08:00:00Z",
+	}, got)
+}
+
+func TestReminderIndex(t *testing.T) {
+	s := NewMemoryStorage()
+	meeting, err := s.Create(&Event{UserID: "34", Name: "meeting", Start: mustTime(t, "2024-03-04T10:00:00Z"),
+		End: mustTime(t, "2024-03-04T11:00:00Z"), Reminders: []time.Duration{15 * time.Minute}})
+	require.NoError(t, err)
+	yearly, err := s.Create(&Event{UserID: "35", Name: "yearly", Start: mustTime(t, "2020-03-04T09:00:00Z"),
+		End: mustTime(t, "2020-03-04T09:00:00Z"), RRule: "FREQ=YEARLY;INTERVAL=2", Reminders: []time.Duration{time.Hour}})
+	require.NoError(t, err)
+	_, err = s.Create(&Event{UserID: "35", Name: "ended", Start: mustTime(t, "2020-03-04T09:00:00Z"),
+		End: mustTime(t, "2020-03-04T09:00:00Z"), RRule: "FREQ=DAILY;COUNT=3", Reminders: []time.Duration{time.Hour}})
+	require.NoError(t, err)
+
+	names := func(due []Reminder) []string {
+		var res []string
+		for _, r := range due {
+			res = append(res, r.Event.Name+" "+r.FireAt.Format(time.RFC3339))
+		}
+		return res
+	}
+	next := func(after string) string {
+		res, ok := s.NextReminder(mustTime(t, after))
+		if !ok {
+			return ""
+		}
+		return res.Format(time.RFC3339)
+	}
+
+	assert.Equal(t, "2024-03-04T08:00:00Z", next("2024-03-01T00:00:00Z"))
+	assert.Equal(t, []string{"yearly 2024-03-04T08:00:00Z", "meeting 2024-03-04T09:45:00Z"},
+		names(s.DueReminders(mustTime(t, "2024-03-01T00:00:00Z"), mustTime(t, "2024-03-05T00:00:00Z"))))
+	// Изменение события переносится в очередь
+	meeting.Start = mustTime(t, "2024-03-06T10:00:00Z")
+	meeting.End = mustTime(t, "2024-03-06T11:00:00Z")
+	_, err = s.Update(meeting)
+	require.NoError(t, err)
+	assert.Equal(t, "2024-03-06T09:45:00Z", next("2024-03-05T00:00:00Z"))
+
+	// Следующее повторение серии дальше reminderHorizon ищется снова от границы поиска
+	assert.Equal(t, "2025-03-06T01:00:00Z", next("2024-03-07T00:00:00Z"))
+	assert.Empty(t, s.DueReminders(mustTime(t, "2024-03-07T00:00:00Z"), mustTime(t, "2025-03-06T01:00:00Z")))
+	assert.Equal(t, "2026-03-04T08:00:00Z", next("2025-03-06T01:00:00Z"))
+
+	_, err = s.Delete(meeting)
+	require.NoError(t, err)
+	_, err = s.Delete(yearly)
+	require.NoError(t, err)
+	assert.Equal(t, "", next("2025-03-06T01:00:00Z"))
+	assert.Empty(t, s.DueReminders(mustTime(t, "2025-03-06T01:00:00Z"), mustTime(t, "2030-01-01T00:00:00Z")))
+
+	// Интервал раньше начала очереди читается из календарей
+	assert.Equal(t, []string{"ended 2020-03-04T08:00:00Z"},
+		names(s.DueReminders(mustTime(t, "2020-03-04T00:00:00Z"), mustTime(t, "2020-03-04T12:00:00Z"))))
+	assert.Equal(t, "2020-03-05T08:00:00Z", next("2020-03-04T12:00:00Z"))
+}
+
+// failingNotifier не отправляет первые failures напоминаний
+type failingNotifier struct {
+	chanNotifier
+	failures int
+}
+
+func (n *failingNotifier) Notify(ctx context.Context, r Reminder) error {
+	if n.failures > 0 {
+		n.failures--
+		return errors.New("unavailable")
+	}
+	return n.chanNotifier.Notify(ctx, r)
+}
+
+func TestSchedulerRetriesFailedReminders(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "reminders.json")
+	clock := newFakeClock(mustTime(t, "2024-03-04T09:00:00Z"))
+	s := NewMemoryStorage()
+	_, err := s.Create(&Event{UserID: "34", Name: "meeting", Start: mustTime(t, "2024-03-04T10:00:00Z"),
+		End: mustTime(t, "2024-03-04T11:00:00Z"), Reminders: []time.Duration{0, 30 * time.Minute}})
+	require.NoError(t, err)
+	notifier := &failingNotifier{chanNotifier: make(chanNotifier, 10), failures: 2}
+	scheduler, err := NewScheduler(s, notifier, clock, statePath)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scheduler.Run(ctx)
+	}()
+	clock.waitIdle(t)
+
+	clock.Advance(30 * time.Minute)
+	clock.waitIdle(t)
+	notifier.expectNone(t)
+	// Сохраненное состояние не пропускает неотправленное напоминание
+	restarted, err := NewScheduler(s, notifier, clock, statePath)
+	require.NoError(t, err)
+	assert.True(t, restarted.watermark.Before(mustTime(t, "2024-03-04T09:30:00Z")))
+
+	clock.Advance(reminderRetry)
+	clock.waitIdle(t)
+	notifier.expectNone(t)
+	clock.Advance(reminderRetry)
+	notifier.expect(t, "meeting", "2024-03-04T09:30:00Z")
+	clock.waitIdle(t)
+	notifier.expectNone(t)
+
+	clock.Advance(29 * time.Minute)
+	notifier.expect(t, "meeting", "2024-03-04T10:00:00Z")
+	cancel()
+	<-done
+}
+
+func TestScheduler(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "reminders.json")
+	clock := newFakeClock(mustTime(t, "2024-03-04T09:00:00Z"))
+	s := NewMemoryStorage()
+	notifier := make(chanNotifier, 10)
+
+	start := func() (context.CancelFunc, chan struct{}) {
+		scheduler, err := NewScheduler(s, notifier, clock, statePath)
+		require.NoError(t, err)
+		s.OnChange(func([]Change) { scheduler.Wake() })
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			scheduler.Run(ctx)
+		}()
+		clock.waitIdle(t)
+		return cancel, done
+	}
+	cancel, done := start()
+
+	_, err := s.Create(&Event{UserID: "34", Name: "meeting", Start: mustTime(t, "2024-03-04T10:00:00Z"),
+		End: mustTime(t, "2024-03-04T11:00:00Z"), Reminders: []time.Duration{0, 15 * time.Minute, 30 * time.Minute}})
+	require.NoError(t, err)
+	// Планировщик пересчитывает следующее напоминание после изменения событий
+	clock.waitIdle(t)
+
+	clock.Advance(29 * time.Minute)
+	notifier.expectNone(t)
+
+	clock.Advance(time.Minute)
+	notifier.expect(t, "meeting", "2024-03-04T09:30:00Z")
+	clock.waitIdle(t)
+	notifier.expectNone(t)
+
+	// Остановка и перезапуск не отправляют напоминание повторно
+	cancel()
+	<-done
+	cancel, done = start()
+	notifier.expectNone(t)
+
+	// Пропущенное напоминание о еще не начавшемся событии отправляется после перезапуска
+	cancel()
+	<-done
+	clock.Advance(20 * time.Minute)
+	cancel, done = start()
+	notifier.expect(t, "meeting", "2024-03-04T09:45:00Z")
+	notifier.expectNone(t)
+
+	clock.Advance(10 * time.Minute)
+	notifier.expect(t, "meeting", "2024-03-04T10:00:00Z")
+	cancel()
+	<-done
+}
+
+func TestSchedulerSkipsStaleReminders(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "reminders.json")
+	clock := newFakeClock(mustTime(t, "2024-03-04T09:00:00Z"))
+	s := NewMemoryStorage()
+	notifier := make(chanNotifier, 10)
+	scheduler, err := NewScheduler(s, notifier, clock, statePath)
+	require.NoError(t, err)
+	require.NoError(t, scheduler.saveState())
+
+	_, err = s.Create(&Event{UserID: "34", Name: "meeting", Start: mustTime(t, "2024-03-04T10:00:00Z"),
+		End: mustTime(t, "2024-03-04T11:00:00Z"), Reminders: []time.Duration{15 * time.Minute}})
+	require.NoError(t, err)
+	_, err = s.Create(&Event{UserID: "34", Name: "later", Start: mustTime(t, "2024-03-04T13:00:00Z"),
+		End: mustTime(t, "2024-03-04T14:00:00Z"), Reminders: []time.Duration{3 * time.Hour}})
+	require.NoError(t, err)
+
+	// Сервер не работал до 12:00: напоминание о начавшемся событии уже не нужно
+	clock.Advance(3 * time.Hour)
+	scheduler, err = NewScheduler(s, notifier, clock, statePath)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go scheduler.Run(ctx)
+	notifier.expect(t, "later", "2024-03-04T10:00:00Z")
+	clock.waitIdle(t)
+	notifier.expectNone(t)
+}
+
+func TestLogNotifier(t *testing.T) {
+	var buf bytes.Buffer
+	n := NewLogNotifier(&buf)
+	r := Reminder{FireAt: mustTime(t, "2024-03-04T09:45:00Z"), Offset: 15 * time.Minute, Event: Event{
+		UserID: "34", ID: "1", Name: "meeting", Start: mustTime(t, "2024-03-04T10:00:00Z"),
+		End: mustTime(t, "2024-03-04T11:00:00Z"), Timezone: "Europe/Moscow"}}
+	require.NoError(t, n.Notify(context.Background(), r))
+	require.NoError(t, n.Notify(context.Background(), r))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	var msg ReminderMessage
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &msg))
+	assert.Equal(t, "34", msg.UserID)
+	assert.Equal(t, "2024-03-04T12:45:00+03:00", msg.FireAt)
+	assert.Equal(t, "15m0s", msg.Offset)
+	assert.Equal(t, "meeting", msg.Event.Name)
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	received := make(chan ReminderMessage, 1)
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var msg ReminderMessage
+		if err := json.Unmarshal(body, &msg); err == nil && r.Method == http.MethodPost {
+			received <- msg
+		}
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	n := &WebhookNotifier{URL: ts.URL}
+	r := Reminder{FireAt: mustTime(t, "2024-03-04T09:00:00Z"), Offset: time.Hour, Event: Event{
+		UserID: "34", ID: "1", Name: "meeting", Start: mustTime(t, "2024-03-04T10:00:00Z"), End: mustTime(t, "2024-03-04T10:00:00Z")}}
+	require.NoError(t, n.Notify(context.Background(), r))
+	msg := <-received
+	assert.Equal(t, "meeting", msg.Event.Name)
+	assert.Equal(t, "1h0m0s", msg.Offset)
+
+	status = http.StatusInternalServerError
+	assert.Error(t, n.Notify(context.Background(), r))
+}
+
+func TestEventReminders(t *testing.T) {
+	handler := getHandler()
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	_, err := createEventAndGetID(ts, handler, "user_id=34&start=2024-03-04T10:00:00Z&duration=1h&name=meeting&reminders=1d,15m")
+	require.NoError(t, err)
+	events := getWeekEvents(t, handler, "user_id=34&date=2024-03-04")
+	require.Len(t, events, 1)
+	assert.Equal(t, []string{"15m0s", "1d"}, events[0].Reminders)
+
+	resp := makePostRequest(ts, handler, "/create_event/", "user_id=34&start=2024-03-04T10:00:00Z&name=a&reminders=abc")
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	resp = makePostRequest(ts, handler, "/create_event/", "user_id=34&start=2024-03-04T10:00:00Z&name=a&reminders=-5m")
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	resp = makeJSONRequest(handler, http.MethodPost, "/users/35/events", `{"name":"rest","start":"2024-03-04T10:00:00Z","reminders":["30m"]}`)
+	require.Equal(t, http.StatusCreated, resp.Code)
+	location := resp.Header().Get("Location")
+	// PATCH без reminders сохраняет их
+	resp = makeJSONRequest(handler, http.MethodPatch, location, `{"name":"renamed"}`)
+	require.Equal(t, http.StatusOK, resp.Code)
+	resp = makeJSONRequest(handler, http.MethodGet, location, "")
+	var got struct {
+		Result EventResult `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &got))
+	assert.Equal(t, []string{"30m0s"}, got.Result.Reminders)
+}
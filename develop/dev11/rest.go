@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EventRequest тело запроса JSON API создания и изменения события.
+// Поля имеют тот же смысл и формат, что и параметры /create_event, незаданные поля равны nil
+type EventRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	Date        *string `json:"date"`
+	Start       *string `json:"start"`
+	End         *string `json:"end"`
+	Duration    *string `json:"duration"`
+	AllDay      *bool   `json:"all_day"`
+	Timezone    *string `json:"timezone"`
+	RRule       *string `json:"rrule"`
+	// Reminders смещения напоминаний, пустой список удаляет напоминания
+	Reminders *[]string `json:"reminders"`
+	// Attendees приглашенные пользователи, пустой список удаляет всех участников, а без списка участники сохраняются
+	Attendees *[]string `json:"attendees"`
+}
+
+// apply записывает заданные поля запроса в параметры v в формате /create_event
+func (req *EventRequest) apply(v url.Values) {
+	set := func(key string, value *string) {
+		if value != nil {
+			v.Set(key, *value)
+		}
+	}
+	set("name", req.Name)
+	set("description", req.Description)
+	set("date", req.Date)
+	set("timezone", req.Timezone)
+	set("rrule", req.RRule)
+	if req.Date != nil && req.Start == nil {
+		v.Del("start")
+		v.Del("end")
+	}
+	set("start", req.Start)
+	if req.End != nil || req.Duration != nil {
+		v.Del("end")
+		v.Del("duration")
+	}
+	set("end", req.End)
+	set("duration", req.Duration)
+	if req.AllDay != nil {
+		v.Set("all_day", strconv.FormatBool(*req.AllDay))
+	}
+	if req.Reminders != nil {
+		v.Set("reminders", strings.Join(*req.Reminders, ","))
+	}
+	if req.Attendees != nil {
+		v.Set("attendees", strings.Join(*req.Attendees, ","))
+	}
+}
+
+// eventValues возвращает параметры в формате /create_event, описывающие событие
+func eventValues(e *Event) url.Values {
+	loc := e.Location()
+	v := url.Values{}
+	v.Set("user_id", e.UserID)
+	v.Set("id", e.ID)
+	v.Set("name", e.Name)
+	if e.Description != "" {
+		v.Set("description", e.Description)
+	}
+	v.Set("start", e.Start.In(loc).Format(time.RFC3339))
+	v.Set("end", e.End.In(loc).Format(time.RFC3339))
+	v.Set("all_day", strconv.FormatBool(e.AllDay))
+	v.Set("timezone", loc.String())
+	if e.RRule != "" {
+		v.Set("rrule", e.RRule)
+	}
+	if len(e.Reminders) > 0 {
+		reminders := make([]string, len(e.Reminders))
+		for i, offset := range e.Reminders {
+			reminders[i] = FormatReminder(offset)
+		}
+		v.Set("reminders", strings.Join(reminders, ","))
+	}
+	if len(e.Attendees) > 0 {
+		v.Set("attendees", formatAttendees(e.Attendees))
+	}
+	return v
+}
+
+// restHandler обрабатывает ресурсный JSON API:
+// GET/POST /users/{user_id}/events и GET/PUT/PATCH/DELETE /users/{user_id}/events/{id}.
+// Использует то же хранилище и те же правила разбора параметров, что и form-encoded методы
+func restHandler(storage Storage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, id, ok := parseRESTPath(r.URL)
+		if !ok {
+			writeErrorMessage(w, http.StatusNotFound, "Not found")
+			return
+		}
+		if id == "" {
+			switch r.Method {
+			case http.MethodGet:
+				listEventsREST(w, r, storage, userID)
+			case http.MethodPost:
+				createEventREST(w, r, storage, userID)
+			default:
+				w.Header().Set("Allow", "GET, POST")
+				writeErrorMessage(w, http.StatusMethodNotAllowed, "Wrong method")
+			}
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			getEventREST(w, storage, userID, id)
+		case http.MethodPut:
+			replaceEventREST(w, r, storage, userID, id)
+		case http.MethodPatch:
+			patchEventREST(w, r, storage, userID, id)
+		case http.MethodDelete:
+			deleteEventREST(w, r, storage, userID, id)
+		default:
+			w.Header().Set("Allow", "GET, PUT, PATCH, DELETE")
+			writeErrorMessage(w, http.StatusMethodNotAllowed, "Wrong method")
+		}
+	})
+}
+
+// parseRESTPath разбирает путь /users/{user_id}/events[/{id}]
+func parseRESTPath(u *url.URL) (userID, id string, ok bool) {
+	parts := strings.Split(strings.Trim(u.EscapedPath(), "/"), "/")
+	if len(parts) < 3 || len(parts) > 4 || parts[0] != "users" || parts[2] != "events" {
+		return "", "", false
+	}
+	userID, err := url.PathUnescape(parts[1])
+	if err != nil || userID == "" {
+		return "", "", false
+	}
+	if len(parts) == 4 {
+		id, err = url.PathUnescape(parts[3])
+		if err != nil || id == "" {
+			return "", "", false
+		}
+	}
+	return userID, id, true
+}
+
+// eventLocation возвращает путь ресурса события для заголовка Location
+func eventLocation(userID, id string) string {
+	return "/users/" + url.PathEscape(userID) + "/events/" + url.PathEscape(id)
+}
+
+// decodeEventRequest читает JSON тело запроса, неизвестные поля считаются ошибкой
+func decodeEventRequest(w http.ResponseWriter, r *http.Request) (*EventRequest, bool) {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	var req EventRequest
+	if err := decoder.Decode(&req); err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, "Failed to parse JSON body: "+err.Error())
+		return nil, false
+	}
+	return &req, true
+}
+
+// writeRESTError как writeError, но отвечает 404 на отсутствующие пользователя и событие
+func writeRESTError(w http.ResponseWriter, err error) {
+	if err, ok := err.(*ValidationError); ok && err.NotFound {
+		writeErrorMessage(w, http.StatusNotFound, err.Message)
+		return
+	}
+	writeError(w, err)
+}
+
+func listEventsREST(w http.ResponseWriter, r *http.Request, storage Storage, userID string) {
+	query := r.URL.Query()
+	query.Set("user_id", userID)
+	_, from, to, loc, err := ParseUserAndRange(query)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	from, to, err = defaultRange(from, to, loc)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	events, err := getEventsInRange(storage, userID, from, to)
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+	sortEvents(events)
+	writeEventsResponse(w, events)
+}
+
+func createEventREST(w http.ResponseWriter, r *http.Request, storage Storage, userID string) {
+	req, ok := decodeEventRequest(w, r)
+	if !ok {
+		return
+	}
+	values := url.Values{}
+	req.apply(values)
+	values.Set("user_id", userID)
+	event, err := ParseEvent(values)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts, err := ParseWriteOptions(r.URL.Query())
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	event, err = storage.Create(event, append(opts, requestActor(r, userID))...)
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+	w.Header().Set("Location", eventLocation(userID, event.ID))
+	w.Header().Set("ETag", eventETag(event.Version))
+	marshalResponseAndWrite(w, http.StatusCreated, Response{Result: PostResult{
+		ID:      event.ID,
+		Status:  Created,
+		Version: event.Version,
+	}})
+}
+
+func getEventREST(w http.ResponseWriter, storage Storage, userID, id string) {
+	event, err := storage.Get(userID, id)
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+	w.Header().Set("ETag", eventETag(event.Version))
+	marshalResponseAndWrite(w, http.StatusOK, Response{Result: newEventResult(*event)})
+}
+
+// replaceEventREST заменяет событие целиком (PUT). Повторение серии задается query-параметрами occurrence и scope
+func replaceEventREST(w http.ResponseWriter, r *http.Request, storage Storage, userID, id string) {
+	req, ok := decodeEventRequest(w, r)
+	if !ok {
+		return
+	}
+	values := url.Values{}
+	req.apply(values)
+	values.Set("user_id", userID)
+	values.Set("id", id)
+	updateEventREST(w, r, storage, values)
+}
+
+// patchEventREST изменяет только переданные поля события (PATCH). Повторения серии изменяются только через PUT
+func patchEventREST(w http.ResponseWriter, r *http.Request, storage Storage, userID, id string) {
+	req, ok := decodeEventRequest(w, r)
+	if !ok {
+		return
+	}
+	stored, err := storage.Get(userID, id)
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+	values := eventValues(stored)
+	moved := req.Start != nil && req.End == nil && req.Duration == nil
+	if moved {
+		values.Del("end")
+	}
+	req.apply(values)
+	if moved {
+		// При переносе начала событие сохраняет длительность, а событие на весь день - число дней
+		if event, err := ParseEvent(values); err == nil && event.AllDay && stored.AllDay {
+			values.Set("end", event.Start.AddDate(0, 0, stored.days()).In(event.Location()).Format(time.RFC3339))
+		} else {
+			values.Set("duration", stored.End.Sub(stored.Start).String())
+		}
+	}
+	// Поля объединены с прочитанной версией, поэтому изменение между чтением и записью отклоняется
+	updateEventREST(w, r, storage, values, IfVersion(stored.Version))
+}
+
+// updateEventREST записывает событие с полями values в формате /update_event.
+// defaults задают ожидаемую версию, если ее не передал клиент
+func updateEventREST(w http.ResponseWriter, r *http.Request, storage Storage, values url.Values, defaults ...WriteOption) {
+	event, err := ParseEvent(values)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	occurrence, scope, err := ParseOccurrence(r.URL.Query())
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts, err := ParseWriteOptions(r.URL.Query())
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeOpts, err := ParseExpectedVersion(r, r.URL.Query())
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(writeOpts) == 0 {
+		writeOpts = defaults
+	}
+	writeOpts = append(writeOpts, requestActor(r, event.UserID))
+	writeOpts = append(writeOpts, parseKeepAttendees(values)...)
+	if occurrence.IsZero() {
+		event, err = storage.Update(event, append(opts, writeOpts...)...)
+	} else if len(opts) > 0 {
+		writeErrorMessage(w, http.StatusBadRequest, "reject_conflicts is not supported for occurrence")
+		return
+	} else {
+		event, err = storage.UpdateOccurrence(event, occurrence, scope, writeOpts...)
+	}
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+	w.Header().Set("ETag", eventETag(event.Version))
+	marshalResponseAndWrite(w, http.StatusOK, Response{Result: PostResult{
+		ID:      event.ID,
+		Status:  Updated,
+		Version: event.Version,
+	}})
+}
+
+func deleteEventREST(w http.ResponseWriter, r *http.Request, storage Storage, userID, id string) {
+	occurrence, scope, err := ParseOccurrence(r.URL.Query())
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeOpts, err := ParseExpectedVersion(r, r.URL.Query())
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeOpts = append(writeOpts, requestActor(r, userID))
+	event := &Event{UserID: userID, ID: id}
+	if occurrence.IsZero() {
+		_, err = storage.Delete(event, writeOpts...)
+	} else {
+		_, err = storage.DeleteOccurrence(event, occurrence, scope, writeOpts...)
+	}
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRESTEvents(t *testing.T) {
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			handler := newHandler(&Config{}, backend.newStorage(t), Services{})
+
+			resp := makeJSONRequest(handler, http.MethodPost, "/users/34/events", `{"name":"meeting","start":"2024-03-04T14:00:00+03:00","duration":"1h30m","timezone":"Europe/Moscow"}`)
+			require.Equal(t, http.StatusCreated, resp.Code)
+			var created struct {
+				Result PostResult `json:"result"`
+			}
+			require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &created))
+			location := "/users/34/events/" + created.Result.ID
+			assert.Equal(t, location, resp.Header().Get("Location"))
+
+			// Событие из JSON API видно через form-encoded методы
+			week := getWeekEvents(t, handler, "user_id=34&date=2024-03-04")
+			require.Len(t, week, 1)
+			assert.Equal(t, "meeting", week[0].Name)
+
+			resp = makeJSONRequest(handler, http.MethodPatch, location, `{"name":"planning","start":"2024-03-05T10:00:00+03:00"}`)
+			require.Equal(t, http.StatusOK, resp.Code)
+
+			resp = makeJSONRequest(handler, http.MethodGet, location, "")
+			require.Equal(t, http.StatusOK, resp.Code)
+			var got struct {
+				Result EventResult `json:"result"`
+			}
+			require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &got))
+			assert.Equal(t, "planning", got.Result.Name)
+			assert.Equal(t, "2024-03-05T10:00:00+03:00", got.Result.Start)
+			assert.Equal(t, "2024-03-05T11:30:00+03:00", got.Result.End)
+
+			resp = makeJSONRequest(handler, http.MethodPut, location, `{"name":"holiday","date":"2024-03-08"}`)
+			require.Equal(t, http.StatusOK, resp.Code)
+
+			resp = makeJSONRequest(handler, http.MethodGet, "/users/34/events?from=2024-03-01&to=2024-03-31", "")
+			require.Equal(t, http.StatusOK, resp.Code)
+			var list struct {
+				Result []EventResult `json:"result"`
+			}
+			require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &list))
+			require.Len(t, list.Result, 1)
+			assert.True(t, list.Result[0].AllDay)
+
+			resp = makeJSONRequest(handler, http.MethodDelete, location, "")
+			require.Equal(t, http.StatusNoContent, resp.Code)
+			assert.Empty(t, resp.Body.String())
+
+			resp = makeJSONRequest(handler, http.MethodGet, location, "")
+			assert.Equal(t, http.StatusNotFound, resp.Code)
+		})
+	}
+}
+
+func TestRESTErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		statusCode int
+	}{
+		{
+			name:       "Unknown event",
+			method:     http.MethodGet,
+			path:       "/users/34/events/unknown",
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:       "Unknown user",
+			method:     http.MethodDelete,
+			path:       "/users/35/events/unknown",
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:       "Unknown path",
+			method:     http.MethodGet,
+			path:       "/users/34/tasks",
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:       "Unknown field",
+			method:     http.MethodPost,
+			path:       "/users/34/events",
+			body:       `{"name":"meeting","date":"2024-03-04","color":"red"}`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Wrong field type",
+			method:     http.MethodPost,
+			path:       "/users/34/events",
+			body:       `{"name":"meeting","date":"2024-03-04","all_day":"yes"}`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Empty name",
+			method:     http.MethodPost,
+			path:       "/users/34/events",
+			body:       `{"date":"2024-03-04"}`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Wrong start",
+			method:     http.MethodPost,
+			path:       "/users/34/events",
+			body:       `{"name":"meeting","start":"tomorrow"}`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Wrong method",
+			method:     http.MethodDelete,
+			path:       "/users/34/events",
+			statusCode: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := getHandler()
+			resp := makeJSONRequest(handler, http.MethodPost, "/users/34/events", `{"name":"action","date":"2024-03-04"}`)
+			require.Equal(t, http.StatusCreated, resp.Code)
+
+			resp = makeJSONRequest(handler, tt.method, tt.path, tt.body)
+			assert.Equal(t, tt.statusCode, resp.Code)
+			var respErr ErrorResponse
+			require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &respErr))
+			assert.NotEmpty(t, respErr.Error)
+		})
+	}
+}
+
+func makeJSONRequest(handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, request)
+	return resp
+}
+
+// racingStorage изменяет событие сразу после первого чтения, как параллельный запрос
+type racingStorage struct {
+	Storage
+	raced bool
+}
+
+func (s *racingStorage) Get(userID, id string) (*Event, error) {
+	event, err := s.Storage.Get(userID, id)
+	if err == nil && !s.raced {
+		s.raced = true
+		concurrent := *event
+		concurrent.Name = "concurrent"
+		if _, err := s.Storage.Update(&concurrent); err != nil {
+			return nil, err
+		}
+	}
+	return event, err
+}
+
+func TestRESTPatchRace(t *testing.T) {
+	storage := &racingStorage{Storage: NewMemoryStorage()}
+	handler := newHandler(&Config{}, storage, Services{})
+	resp := makeJSONRequest(handler, http.MethodPost, "/users/34/events", `{"name":"meeting","start":"2024-03-04T14:00:00Z","duration":"1h"}`)
+	require.Equal(t, http.StatusCreated, resp.Code)
+	location := resp.Header().Get("Location")
+
+	// Запись между чтением и изменением PATCH не затирается устаревшими полями
+	resp = makeJSONRequest(handler, http.MethodPatch, location, `{"start":"2024-03-05T14:00:00Z"}`)
+	require.Equal(t, http.StatusConflict, resp.Code, resp.Body.String())
+	resp = makeJSONRequest(handler, http.MethodGet, location, "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var got struct {
+		Result EventResult `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &got))
+	assert.Equal(t, "concurrent", got.Result.Name)
+	assert.Equal(t, "2024-03-04T14:00:00Z", got.Result.Start)
+	assert.Equal(t, `"2"`, resp.Header().Get("ETag"))
+}
+
+func TestRESTSeriesOccurrence(t *testing.T) {
+	handler := getHandler()
+	resp := makeJSONRequest(handler, http.MethodPost, "/users/34/events",
+		`{"name":"standup","start":"2024-03-04T10:00:00+03:00","duration":"15m","timezone":"Europe/Moscow","rrule":"FREQ=DAILY;COUNT=3"}`)
+	require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+	location := resp.Header().Get("Location")
+
+	// У самой серии нет повторения
+	resp = makeJSONRequest(handler, http.MethodGet, location, "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var master struct {
+		Result map[string]any `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &master))
+	assert.Equal(t, "FREQ=DAILY;COUNT=3", master.Result["rrule"])
+	assert.NotContains(t, master.Result, "occurrence")
+
+	resp = makeJSONRequest(handler, http.MethodGet, "/users/34/events?from=2024-03-05&to=2024-03-05", "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var list struct {
+		Result []EventResult `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &list))
+	require.Len(t, list.Result, 1)
+	assert.Equal(t, "2024-03-05T10:00:00+03:00", list.Result[0].Occurrence)
+}
+
+func TestRESTPatchAllDayStart(t *testing.T) {
+	handler := getHandler()
+	resp := makeJSONRequest(handler, http.MethodPost, "/users/34/events",
+		`{"name":"trip","start":"2024-03-29","end":"2024-03-31","all_day":true,"timezone":"Europe/Berlin"}`)
+	require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+	location := resp.Header().Get("Location")
+
+	// Перенос через переход на летнее время сохраняет число дней, а не часов
+	resp = makeJSONRequest(handler, http.MethodPatch, location, `{"start":"2024-03-30"}`)
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	resp = makeJSONRequest(handler, http.MethodGet, location, "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var got struct {
+		Result EventResult `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &got))
+	assert.Equal(t, "2024-03-30T00:00:00+01:00", got.Result.Start)
+	assert.Equal(t, "2024-04-01T00:00:00+02:00", got.Result.End)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Frequency соответствует частоте повторения FREQ из RFC 5545
+type Frequency string
+
+const (
+	// Daily повторение каждый день
+	Daily Frequency = "DAILY"
+	// Weekly повторение каждую неделю
+	Weekly Frequency = "WEEKLY"
+	// Monthly повторение каждый месяц
+	Monthly Frequency = "MONTHLY"
+	// Yearly повторение каждый год
+	Yearly Frequency = "YEARLY"
+)
+
+var weekdayCodes = map[string]time.Weekday{
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+	"SU": time.Sunday,
+}
+
+// WeekdayNum элемент BYDAY: день недели и, для MONTHLY, его номер в месяце (1 - первый, -1 - последний, 0 - все)
+type WeekdayNum struct {
+	Ordinal int
+	Day     time.Weekday
+}
+
+func (w WeekdayNum) String() string {
+	code := strings.ToUpper(w.Day.String()[:2])
+	if w.Ordinal != 0 {
+		return strconv.Itoa(w.Ordinal) + code
+	}
+	return code
+}
+
+// RecurrenceRule правило повторения события, подмножество RRULE из RFC 5545:
+// FREQ, INTERVAL, COUNT, UNTIL и BYDAY
+type RecurrenceRule struct {
+	Freq     Frequency
+	Interval int
+	// Count ограничивает количество повторений, 0 - без ограничения
+	Count int
+	// Until время последнего возможного повторения включительно, нулевое - без ограничения
+	Until time.Time
+	ByDay []WeekdayNum
+}
+
+// ParseRRule разбирает правило вида FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE;COUNT=10 (префикс RRULE: допускается).
+// UNTIL без часового пояса (20240331 или 20240331T090000) понимается в часовом поясе loc
+func ParseRRule(value string, loc *time.Location) (*RecurrenceRule, error) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "RRULE:")
+	rule := &RecurrenceRule{Interval: 1}
+	for _, part := range strings.Split(value, ";") {
+		if part == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("wrong rrule part %q", part)
+		}
+		var err error
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			rule.Freq = Frequency(strings.ToUpper(val))
+			switch rule.Freq {
+			case Daily, Weekly, Monthly, Yearly:
+			default:
+				return nil, fmt.Errorf("unsupported rrule FREQ %q", val)
+			}
+		case "INTERVAL":
+			rule.Interval, err = strconv.Atoi(val)
+			if err != nil || rule.Interval < 1 {
+				return nil, fmt.Errorf("wrong rrule INTERVAL %q", val)
+			}
+		case "COUNT":
+			rule.Count, err = strconv.Atoi(val)
+			if err != nil || rule.Count < 1 {
+				return nil, fmt.Errorf("wrong rrule COUNT %q", val)
+			}
+		case "UNTIL":
+			rule.Until, err = parseICalTime(val, loc)
+			if err != nil {
+				return nil, fmt.Errorf("wrong rrule UNTIL %q", val)
+			}
+			if len(val) == len("20060102") {
+				// Дата без времени включает весь день
+				rule.Until = rule.Until.AddDate(0, 0, 1).Add(-time.Second)
+			}
+		case "BYDAY":
+			for _, day := range strings.Split(val, ",") {
+				wd, err := parseWeekdayNum(day)
+				if err != nil {
+					return nil, err
+				}
+				rule.ByDay = append(rule.ByDay, wd)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported rrule part %q", key)
+		}
+	}
+	if rule.Freq == "" {
+		return nil, fmt.Errorf("rrule FREQ is required")
+	}
+	if rule.Count != 0 && !rule.Until.IsZero() {
+		return nil, fmt.Errorf("rrule COUNT and UNTIL can't be used together")
+	}
+	for _, wd := range rule.ByDay {
+		if wd.Ordinal != 0 && rule.Freq != Monthly {
+			return nil, fmt.Errorf("rrule BYDAY with ordinal is supported only for MONTHLY")
+		}
+	}
+	if rule.Freq == Yearly && len(rule.ByDay) > 0 {
+		return nil, fmt.Errorf("rrule BYDAY is not supported for YEARLY")
+	}
+	return rule, nil
+}
+
+func parseWeekdayNum(value string) (WeekdayNum, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if len(value) < 2 {
+		return WeekdayNum{}, fmt.Errorf("wrong rrule BYDAY %q", value)
+	}
+	day, ok := weekdayCodes[value[len(value)-2:]]
+	if !ok {
+		return WeekdayNum{}, fmt.Errorf("wrong rrule BYDAY %q", value)
+	}
+	res := WeekdayNum{Day: day}
+	if ordinal := value[:len(value)-2]; ordinal != "" {
+		n, err := strconv.Atoi(ordinal)
+		if err != nil || n == 0 || n < -5 || n > 5 {
+			return WeekdayNum{}, fmt.Errorf("wrong rrule BYDAY %q", value)
+		}
+		res.Ordinal = n
+	}
+	return res, nil
+}
+
+// parseICalTime разбирает время в базовом формате RFC 5545: 20060102, 20060102T150405 или 20060102T150405Z
+func parseICalTime(value string, loc *time.Location) (time.Time, error) {
+	switch {
+	case strings.HasSuffix(value, "Z"):
+		return time.Parse("20060102T150405Z", value)
+	case strings.Contains(value, "T"):
+		return time.ParseInLocation("20060102T150405", value, loc)
+	default:
+		return time.ParseInLocation("20060102", value, loc)
+	}
+}
+
+// String возвращает правило в формате RRULE без префикса
+func (r *RecurrenceRule) String() string {
+	parts := []string{"FREQ=" + string(r.Freq)}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, len(r.ByDay))
+		for i, wd := range r.ByDay {
+			days[i] = wd.String()
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	return strings.Join(parts, ";")
+}
+
+// forEach вызывает fn для начала каждого повторения серии с первым событием в start в порядке возрастания,
+// пока fn возвращает true. Повторения, начинающиеся не раньше limit, не перебираются.
+// Время повторений вычисляется в часовом поясе start, поэтому при переходе на летнее время
+// событие остается в то же местное время
+func (r *RecurrenceRule) forEach(start, limit time.Time, fn func(t time.Time) bool) {
+	if !r.Until.IsZero() && r.Until.Before(limit) {
+		limit = r.Until.Add(time.Nanosecond)
+	}
+	count := 0
+	for period := 0; ; period++ {
+		periodStart, candidates := r.period(start, period)
+		if !periodStart.Before(limit) {
+			return
+		}
+		for _, t := range candidates {
+			if t.Before(start) {
+				continue
+			}
+			if !t.Before(limit) {
+				return
+			}
+			count++
+			if !fn(t) {
+				return
+			}
+			if r.Count > 0 && count >= r.Count {
+				return
+			}
+		}
+	}
+}
+
+// period возвращает начало n-го периода повторения и отсортированные начала повторений внутри него
+func (r *RecurrenceRule) period(start time.Time, n int) (time.Time, []time.Time) {
+	loc := start.Location()
+	y, m, d := start.Date()
+	hh, mm, ss := start.Clock()
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, hh, mm, ss, start.Nanosecond(), loc)
+	}
+	step := n * r.Interval
+	var periodStart time.Time
+	var res []time.Time
+	switch r.Freq {
+	case Daily:
+		periodStart = time.Date(y, m, d+step, 0, 0, 0, 0, loc)
+		if r.matchesDay(periodStart.Weekday()) {
+			res = append(res, at(y, m, d+step))
+		}
+	case Weekly:
+		// Недели начинаются с понедельника (WKST=MO)
+		offset := (int(start.Weekday()) + 6) % 7
+		periodStart = time.Date(y, m, d-offset+7*step, 0, 0, 0, 0, loc)
+		if len(r.ByDay) == 0 {
+			res = append(res, at(y, m, d+7*step))
+			break
+		}
+		for _, wd := range r.ByDay {
+			res = append(res, at(y, m, d-offset+7*step+(int(wd.Day)+6)%7))
+		}
+	case Monthly:
+		periodStart = time.Date(y, m+time.Month(step), 1, 0, 0, 0, 0, loc)
+		py, pm, _ := periodStart.Date()
+		if len(r.ByDay) == 0 {
+			// Повторения в несуществующие дни (например, 31 февраля) пропускаются
+			if t := at(py, pm, d); t.Month() == pm {
+				res = append(res, t)
+			}
+			break
+		}
+		for _, wd := range r.ByDay {
+			res = append(res, monthWeekdays(py, pm, wd, at)...)
+		}
+	case Yearly:
+		periodStart = time.Date(y+step, 1, 1, 0, 0, 0, 0, loc)
+		if t := at(y+step, m, d); t.Month() == m {
+			res = append(res, t)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Before(res[j]) })
+	return periodStart, dedupTimes(res)
+}
+
+// matchesDay проверяет ограничение BYDAY для ежедневных повторений
+func (r *RecurrenceRule) matchesDay(day time.Weekday) bool {
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	for _, wd := range r.ByDay {
+		if wd.Day == day {
+			return true
+		}
+	}
+	return false
+}
+
+// monthWeekdays возвращает дни месяца, подходящие под элемент BYDAY
+func monthWeekdays(y int, m time.Month, wd WeekdayNum, at func(int, time.Month, int) time.Time) []time.Time {
+	daysInMonth := time.Date(y, m+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	var days []int
+	for d := 1; d <= daysInMonth; d++ {
+		if time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Weekday() == wd.Day {
+			days = append(days, d)
+		}
+	}
+	switch {
+	case wd.Ordinal > 0 && wd.Ordinal <= len(days):
+		days = days[wd.Ordinal-1 : wd.Ordinal]
+	case wd.Ordinal < 0 && -wd.Ordinal <= len(days):
+		days = days[len(days)+wd.Ordinal : len(days)+wd.Ordinal+1]
+	case wd.Ordinal != 0:
+		days = nil
+	}
+	res := make([]time.Time, len(days))
+	for i, d := range days {
+		res[i] = at(y, m, d)
+	}
+	return res
+}
+
+func dedupTimes(times []time.Time) []time.Time {
+	if len(times) < 2 {
+		return times
+	}
+	res := times[:1]
+	for _, t := range times[1:] {
+		if !t.Equal(res[len(res)-1]) {
+			res = append(res, t)
+		}
+	}
+	return res
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseRRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rrule   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "Daily rule",
+			rrule: "FREQ=DAILY",
+			want:  "FREQ=DAILY",
+		},
+		{
+			name:  "Weekly rule with prefix, interval and days",
+			rrule: "RRULE:freq=weekly;INTERVAL=2;BYDAY=MO,WE;COUNT=10",
+			want:  "FREQ=WEEKLY;INTERVAL=2;COUNT=10;BYDAY=MO,WE",
+		},
+		{
+			name:  "Monthly rule with ordinal day and until date",
+			rrule: "FREQ=MONTHLY;BYDAY=-1FR;UNTIL=20241231",
+			want:  "FREQ=MONTHLY;UNTIL=20241231T235959Z;BYDAY=-1FR",
+		},
+		{
+			name:    "Without FREQ",
+			rrule:   "COUNT=3",
+			wantErr: true,
+		},
+		{
+			name:    "With COUNT and UNTIL",
+			rrule:   "FREQ=DAILY;COUNT=3;UNTIL=20241231T000000Z",
+			wantErr: true,
+		},
+		{
+			name:    "With unsupported part",
+			rrule:   "FREQ=DAILY;BYHOUR=10",
+			wantErr: true,
+		},
+		{
+			name:    "With ordinal day for weekly rule",
+			rrule:   "FREQ=WEEKLY;BYDAY=1MO",
+			wantErr: true,
+		},
+		{
+			name:    "With wrong interval",
+			rrule:   "FREQ=DAILY;INTERVAL=0",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := ParseRRule(tt.rrule, time.UTC)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, rule.String())
+		})
+	}
+}
+
+func TestEventOccurrences(t *testing.T) {
+	moscow, err := LoadLocation("Europe/Moscow")
+	require.NoError(t, err)
+	berlin, err := LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		event Event
+		from  time.Time
+		to    time.Time
+		want  []string
+	}{
+		{
+			name: "Daily with count",
+			event: Event{
+				Start: time.Date(2024, 3, 4, 10, 0, 0, 0, moscow),
+				End:   time.Date(2024, 3, 4, 10, 15, 0, 0, moscow),
+				RRule: "FREQ=DAILY;COUNT=3", Timezone: "Europe/Moscow",
+			},
+			from: time.Date(2024, 3, 1, 0, 0, 0, 0, moscow),
+			to:   time.Date(2024, 4, 1, 0, 0, 0, 0, moscow),
+			want: []string{"2024-03-04T10:00:00+03:00", "2024-03-05T10:00:00+03:00", "2024-03-06T10:00:00+03:00"},
+		},
+		{
+			name: "Weekly on weekdays in range",
+			event: Event{
+				Start: time.Date(2024, 3, 6, 9, 0, 0, 0, time.UTC),
+				End:   time.Date(2024, 3, 6, 9, 0, 0, 0, time.UTC),
+				RRule: "FREQ=WEEKLY;BYDAY=MO,WE",
+			},
+			from: time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC),
+			to:   time.Date(2024, 3, 18, 0, 0, 0, 0, time.UTC),
+			want: []string{"2024-03-06T09:00:00Z", "2024-03-11T09:00:00Z", "2024-03-13T09:00:00Z"},
+		},
+		{
+			name: "Every second week with until",
+			event: Event{
+				Start: time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC),
+				End:   time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC),
+				RRule: "FREQ=WEEKLY;INTERVAL=2;UNTIL=20240401T090000Z",
+			},
+			from: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			to:   time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			want: []string{"2024-03-04T09:00:00Z", "2024-03-18T09:00:00Z", "2024-04-01T09:00:00Z"},
+		},
+		{
+			name: "Monthly on the last friday",
+			event: Event{
+				Start: time.Date(2024, 1, 26, 15, 0, 0, 0, time.UTC),
+				End:   time.Date(2024, 1, 26, 16, 0, 0, 0, time.UTC),
+				RRule: "FREQ=MONTHLY;BYDAY=-1FR;COUNT=3",
+			},
+			from: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			to:   time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			want: []string{"2024-01-26T15:00:00Z", "2024-02-23T15:00:00Z", "2024-03-29T15:00:00Z"},
+		},
+		{
+			name: "Monthly on the 31st skips short months",
+			event: Event{
+				Start: time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC),
+				End:   time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC),
+				RRule: "FREQ=MONTHLY;COUNT=3",
+			},
+			from: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			to:   time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			want: []string{"2024-01-31T12:00:00Z", "2024-03-31T12:00:00Z", "2024-05-31T12:00:00Z"},
+		},
+		{
+			name: "Yearly on leap day",
+			event: Event{
+				Start: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC),
+				End:   time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+				RRule: "FREQ=YEARLY", AllDay: true,
+			},
+			from: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			to:   time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+			want: []string{"2024-02-29T00:00:00Z", "2028-02-29T00:00:00Z"},
+		},
+		{
+			name: "Daily keeps local time across DST change",
+			event: Event{
+				Start: time.Date(2024, 3, 30, 9, 0, 0, 0, berlin),
+				End:   time.Date(2024, 3, 30, 9, 30, 0, 0, berlin),
+				RRule: "FREQ=DAILY;COUNT=2", Timezone: "Europe/Berlin",
+			},
+			from: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+			to:   time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+			want: []string{"2024-03-30T09:00:00+01:00", "2024-03-31T09:00:00+02:00"},
+		},
+		{
+			name: "With deleted and moved occurrences",
+			event: Event{
+				Start:   time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC),
+				End:     time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC),
+				RRule:   "FREQ=DAILY;COUNT=4",
+				ExDates: []time.Time{time.Date(2024, 3, 5, 9, 0, 0, 0, time.UTC)},
+				Overrides: []Event{{
+					Start:        time.Date(2024, 3, 6, 18, 0, 0, 0, time.UTC),
+					End:          time.Date(2024, 3, 6, 18, 0, 0, 0, time.UTC),
+					RecurrenceID: time.Date(2024, 3, 6, 9, 0, 0, 0, time.UTC),
+				}},
+			},
+			from: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+			to:   time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+			want: []string{"2024-03-04T09:00:00Z", "2024-03-07T09:00:00Z", "2024-03-06T18:00:00Z"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, occ := range tt.event.Occurrences(tt.from, tt.to) {
+				got = append(got, occ.Start.Format(time.RFC3339))
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Веса слов события при поиске: совпадение в названии важнее совпадения в описании
+const (
+	searchNameWeight        = 2
+	searchDescriptionWeight = 1
+)
+
+// tokenize разбивает текст на слова из букв и цифр в нижнем регистре. Буква ё заменяется на е,
+// чтобы поиск не зависел от того, как написано слово
+func tokenize(text string) []string {
+	text = strings.ReplaceAll(strings.ToLower(text), "ё", "е")
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// searchTerms возвращает слова события с весами. Учитываются название, описание и измененные повторения серии
+func searchTerms(e *Event) map[string]int {
+	terms := make(map[string]int)
+	add := func(text string, weight int) {
+		for _, token := range tokenize(text) {
+			if terms[token] < weight {
+				terms[token] = weight
+			}
+		}
+	}
+	add(e.Name, searchNameWeight)
+	add(e.Description, searchDescriptionWeight)
+	for _, o := range e.Overrides {
+		add(o.Name, searchNameWeight)
+		add(o.Description, searchDescriptionWeight)
+	}
+	return terms
+}
+
+// searchUsers возвращает пользователей, которые ищут событие: организатора и не отказавшихся участников
+func searchUsers(e *Event) []string {
+	users := []string{e.UserID}
+	for _, a := range e.Attendees {
+		if a.Status != AttendeeDeclined {
+			users = append(users, a.UserID)
+		}
+	}
+	return users
+}
+
+// searchIndex обратный индекс для поиска: пользователь -> слово -> события с весом слова.
+// Как и invitations, обновляется под блокировкой шарда организатора
+type searchIndex struct {
+	mu    sync.RWMutex
+	terms map[string]map[string]map[eventRef]int
+}
+
+// update переносит в индекс изменение события с before на c.Event
+func (idx *searchIndex) update(c Change, before *Event) {
+	ref := eventRef{userID: c.Event.UserID, id: c.Event.ID}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if before != nil {
+		terms := searchTerms(before)
+		for _, userID := range searchUsers(before) {
+			for token := range terms {
+				delete(idx.terms[userID][token], ref)
+				if len(idx.terms[userID][token]) == 0 {
+					delete(idx.terms[userID], token)
+				}
+			}
+			if len(idx.terms[userID]) == 0 {
+				delete(idx.terms, userID)
+			}
+		}
+	}
+	if c.Status == Deleted {
+		return
+	}
+	if idx.terms == nil {
+		idx.terms = make(map[string]map[string]map[eventRef]int)
+	}
+	terms := searchTerms(&c.Event)
+	for _, userID := range searchUsers(&c.Event) {
+		if idx.terms[userID] == nil {
+			idx.terms[userID] = make(map[string]map[eventRef]int)
+		}
+		for token, weight := range terms {
+			if idx.terms[userID][token] == nil {
+				idx.terms[userID][token] = make(map[eventRef]int)
+			}
+			idx.terms[userID][token][ref] = weight
+		}
+	}
+}
+
+// search возвращает события пользователя userID, в которых есть слова, начинающиеся с каждого из tokens,
+// и их релевантность. Полное совпадение слова весит вдвое больше совпадения по префиксу
+func (idx *searchIndex) search(userID string, tokens []string) map[eventRef]int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	var res map[eventRef]int
+	for _, query := range tokens {
+		// Для каждого слова запроса берется лучшее совпадение в событии
+		best := make(map[eventRef]int)
+		for token, refs := range idx.terms[userID] {
+			if !strings.HasPrefix(token, query) {
+				continue
+			}
+			for ref, weight := range refs {
+				if token == query {
+					weight *= 2
+				}
+				if best[ref] < weight {
+					best[ref] = weight
+				}
+			}
+		}
+		if res == nil {
+			res = best
+			continue
+		}
+		for ref, score := range res {
+			if weight, ok := best[ref]; ok {
+				res[ref] = score + weight
+			} else {
+				delete(res, ref)
+			}
+		}
+	}
+	return res
+}
+
+// Search ищет события пользователя userID и события, в которые он приглашен, по словам запроса query
+// в названии и описании. Слова запроса ищутся по префиксу без учета регистра, в событии должны быть все слова.
+// Если задан диапазон [from, to) (любая граница может быть нулевой), возвращаются только события, пересекающиеся
+// с ним, а для серий - первое такое повторение. Результат отсортирован по релевантности, затем по началу
+func (s *MemoryStorage) Search(userID, query string, from, to time.Time) ([]Event, error) {
+	if userID == "" || query == "" {
+		return nil, &ValidationError{Message: "empty parameters"}
+	}
+	tokens := tokenize(query)
+	if len(tokens) == 0 {
+		return nil, &ValidationError{Message: "query must contain letters or digits"}
+	}
+	filter := !from.IsZero() || !to.IsZero()
+	if filter && to.IsZero() {
+		to = from.Add(rangeMaxDuration)
+	}
+
+	type result struct {
+		event Event
+		score int
+	}
+	var results []result
+	// Шарды организаторов блокируются по очереди после чтения индекса
+	for ref, score := range s.searchIndex.search(userID, tokens) {
+		sh := s.shard(ref.userID)
+		sh.mu.RLock()
+		event, err := sh.get(ref.userID, ref.id)
+		sh.mu.RUnlock()
+		if err != nil {
+			// Событие удалено после чтения индекса
+			continue
+		}
+		if status, ok := event.attendee(userID); ok && status == AttendeeDeclined {
+			continue
+		}
+		if filter {
+			occurrences := event.Occurrences(from, to)
+			if len(occurrences) == 0 {
+				continue
+			}
+			sortEvents(occurrences)
+			event = occurrences[0]
+		}
+		results = append(results, result{event: event, score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return compareEvents(&results[i].event, &results[j].event) < 0
+	})
+	res := make([]Event, len(results))
+	for i, r := range results {
+		res[i] = r.event
+	}
+	return res, nil
+}
+
+// searchEvents ищет события пользователя user_id по словам запроса q. Необязательные from и to (включительно)
+// в формате 2019-09-09 в часовом поясе timezone ограничивают даты событий, limit - количество результатов
+func searchEvents(w http.ResponseWriter, r *http.Request, storage Storage) {
+	if r.Method != http.MethodGet {
+		writeErrorMessage(w, http.StatusMethodNotAllowed, "Wrong method")
+		return
+	}
+	query := r.URL.Query()
+	userID, from, to, _, err := ParseUserAndRange(query)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit, err := parseLimit(query)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	events, err := storage.Search(userID, query.Get("q"), from, to)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	res := make([]EventResult, len(events))
+	for i, e := range events {
+		res[i] = newEventResult(e)
+	}
+	marshalResponseAndWrite(w, http.StatusOK, Response{Result: res})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Встреча с командой", []string{"встреча", "с", "командой"}},
+		{"ЁЛКА, ёлка!", []string{"елка", "елка"}},
+		{"Sprint-12 review", []string{"sprint", "12", "review"}},
+		{" ... ", []string{}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tokenize(tt.text), tt.text)
+	}
+}
+
+// searchIDs возвращает идентификаторы найденных событий в порядке результата
+func searchIDs(t *testing.T, s Storage, userID, query string, from, to time.Time) []string {
+	events, err := s.Search(userID, query, from, to)
+	require.NoError(t, err)
+	ids := []string{}
+	for _, e := range events {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func TestSearch(t *testing.T) {
+	s := NewMemoryStorage()
+	start := mustTime(t, "2024-03-04T10:00:00Z")
+	create := func(event Event) string {
+		event.UserID = "34"
+		event.End = event.Start.Add(time.Hour)
+		created, err := s.Create(&event)
+		require.NoError(t, err)
+		return created.ID
+	}
+	planning := create(Event{Name: "Планирование спринта", Start: start.AddDate(0, 0, 2)})
+	review := create(Event{Name: "Обзор", Description: "Итоги спринта и планирование", Start: start})
+	standup := create(Event{Name: "Ежедневная встреча", Start: start, RRule: "FREQ=WEEKLY;COUNT=10"})
+	yolka := create(Event{Name: "Ёлка в офисе", Start: start.AddDate(0, 0, 1)})
+
+	tests := []struct {
+		name     string
+		query    string
+		from, to time.Time
+		want     []string
+	}{
+		{"prefix", "план", time.Time{}, time.Time{}, []string{planning, review}},
+		{"case insensitive", "ПЛАНИРОВАНИЕ", time.Time{}, time.Time{}, []string{planning, review}},
+		// Название весит больше описания, при равной релевантности раньше идет более раннее событие
+		{"exact word", "спринта", time.Time{}, time.Time{}, []string{planning, review}},
+		{"all words", "спринт итог", time.Time{}, time.Time{}, []string{review}},
+		{"yo", "елка", time.Time{}, time.Time{}, []string{yolka}},
+		{"no match", "отпуск", time.Time{}, time.Time{}, []string{}},
+		{"from", "план", start.AddDate(0, 0, 1), time.Time{}, []string{planning}},
+		{"to", "план", time.Time{}, start.AddDate(0, 0, 1), []string{review}},
+		{"series in range", "встреча", start.AddDate(0, 0, 20), start.AddDate(0, 0, 30), []string{standup}},
+		{"series out of range", "встреча", start.AddDate(1, 0, 0), start.AddDate(1, 1, 0), []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, searchIDs(t, s, "34", tt.query, tt.from, tt.to))
+		})
+	}
+
+	// Для серии возвращается первое повторение в диапазоне
+	events, err := s.Search("34", "встреча", start.AddDate(0, 0, 20), time.Time{})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, start.AddDate(0, 0, 21), events[0].Start)
+
+	_, err = s.Search("34", "!!!", time.Time{}, time.Time{})
+	assert.Error(t, err)
+	_, err = s.Search("34", "", time.Time{}, time.Time{})
+	assert.Error(t, err)
+}
+
+func TestSearchIndexUpdates(t *testing.T) {
+	s := NewMemoryStorage()
+	start := mustTime(t, "2024-03-04T10:00:00Z")
+	event, err := s.Create(&Event{UserID: "34", Name: "Встреча", Start: start, End: start.Add(time.Hour), RRule: "FREQ=DAILY;COUNT=3", Attendees: ParseAttendees("35")})
+	require.NoError(t, err)
+	id := event.ID
+	assert.Equal(t, []string{id}, searchIDs(t, s, "35", "встр", time.Time{}, time.Time{}))
+
+	_, err = s.Update(&Event{UserID: "34", ID: id, Name: "Совещание", Start: start, End: start.Add(time.Hour), RRule: "FREQ=DAILY;COUNT=3", Attendees: ParseAttendees("35")})
+	require.NoError(t, err)
+	assert.Empty(t, searchIDs(t, s, "34", "встреча", time.Time{}, time.Time{}))
+	assert.Equal(t, []string{id}, searchIDs(t, s, "34", "совещ", time.Time{}, time.Time{}))
+
+	// Измененное повторение ищется по своему названию
+	day := start.AddDate(0, 0, 1)
+	_, err = s.UpdateOccurrence(&Event{UserID: "34", ID: id, Name: "Презентация", Start: day, End: day.Add(time.Hour)}, day, ScopeThis)
+	require.NoError(t, err)
+	assert.Equal(t, []string{id}, searchIDs(t, s, "35", "презентация", time.Time{}, time.Time{}))
+
+	// Отказавшийся участник не находит событие
+	_, err = s.Respond("34", id, "35", AttendeeDeclined)
+	require.NoError(t, err)
+	assert.Empty(t, searchIDs(t, s, "35", "совещ", time.Time{}, time.Time{}))
+
+	_, err = s.Delete(&Event{UserID: "34", ID: id})
+	require.NoError(t, err)
+	assert.Empty(t, searchIDs(t, s, "34", "совещ", time.Time{}, time.Time{}))
+	assert.Empty(t, s.searchIndex.terms)
+}
+
+func TestSearchPersistence(t *testing.T) {
+	dir := t.TempDir()
+	start := mustTime(t, "2024-03-04T10:00:00Z")
+	s, err := NewFileStorage(dir, 2)
+	require.NoError(t, err)
+	first, err := s.Create(&Event{UserID: "34", Name: "Первая встреча", Start: start, End: start.Add(time.Hour)})
+	require.NoError(t, err)
+	_, err = s.Update(&Event{UserID: "34", ID: first.ID, Name: "Первое совещание", Start: start, End: start.Add(time.Hour)})
+	require.NoError(t, err)
+	// Второе событие попадает в журнал после снимка
+	second, err := s.Create(&Event{UserID: "34", Name: "Второе совещание", Start: start.Add(time.Hour), End: start.Add(2 * time.Hour)})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	restored, err := NewFileStorage(dir, 2)
+	require.NoError(t, err)
+	defer restored.Close()
+	assert.Equal(t, []string{first.ID, second.ID}, searchIDs(t, restored, "34", "совещание", time.Time{}, time.Time{}))
+	assert.Empty(t, searchIDs(t, restored, "34", "встреча", time.Time{}, time.Time{}))
+}
+
+func TestSearchHandler(t *testing.T) {
+	handler := getHandler()
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	first, err := createEventAndGetID(ts, handler, "user_id=34&date=2024-03-04&name=Встреча&description=Обсуждение бюджета")
+	require.NoError(t, err)
+	second, err := createEventAndGetID(ts, handler, "user_id=34&date=2024-03-05&name=Бюджет на год")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		want   []string
+	}{
+		{"ranked", "/search_events/?user_id=34&q=бюдж", http.StatusOK, []string{second, first}},
+		{"date range", "/search_events/?user_id=34&q=бюдж&from=2024-03-04&to=2024-03-04", http.StatusOK, []string{first}},
+		{"limit", "/search_events/?user_id=34&q=бюдж&limit=1", http.StatusOK, []string{second}},
+		{"other user", "/search_events/?user_id=35&q=бюдж", http.StatusOK, []string{}},
+		{"no query", "/search_events/?user_id=34", http.StatusBadRequest, nil},
+		{"wrong date", "/search_events/?user_id=34&q=бюдж&from=04.03.2024", http.StatusBadRequest, nil},
+		{"wrong limit", "/search_events/?user_id=34&q=бюдж&limit=0", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+			require.Equal(t, tt.status, resp.Code, resp.Body.String())
+			if tt.status != http.StatusOK {
+				return
+			}
+			var res struct {
+				Result []EventResult `json:"result"`
+			}
+			require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &res))
+			ids := []string{}
+			for _, e := range res.Result {
+				ids = append(ids, e.ID)
+			}
+			assert.Equal(t, tt.want, ids)
+		})
+	}
+
+	resp := makePostRequest(ts, handler, "/search_events/", "user_id=34&q=бюдж")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// shardCount количество независимо блокируемых частей MemoryStorage
+const shardCount = 32
+
+// Event это внутреннее представление события
+type Event struct {
+	UserID string `json:"user_id"`
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	// Description описание события
+	Description string `json:"description,omitempty"`
+	// Start и End задают интервал события [Start, End). Для события без длительности End == Start
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// AllDay означает, что событие занимает целые дни: Start и End - полночь в часовом поясе события
+	AllDay bool `json:"all_day"`
+	// Timezone название часового пояса события из базы IANA, например Europe/Moscow
+	Timezone string `json:"timezone"`
+	// RRule правило повторения в формате RFC 5545, пустое для неповторяющегося события
+	RRule string `json:"rrule,omitempty"`
+	// Reminders за сколько до начала события (и каждого повторения серии) отправлять напоминания
+	Reminders []time.Duration `json:"reminders,omitempty"`
+	// ExDates исходные начала удаленных повторений серии
+	ExDates []time.Time `json:"exdates,omitempty"`
+	// Overrides измененные повторения серии
+	Overrides []Event `json:"overrides,omitempty"`
+	// RecurrenceID исходное начало повторения, если событие является повторением серии
+	RecurrenceID time.Time `json:"recurrence_id"`
+	// Version увеличивается при каждом изменении события, начиная с 1 при создании.
+	// Для повторений серии это версия серии
+	Version int64 `json:"version"`
+	// Attendees приглашенные пользователи, UserID - организатор. Для повторений серии это участники серии
+	Attendees []Attendee `json:"attendees,omitempty"`
+}
+
+// Location возвращает часовой пояс события
+func (e *Event) Location() *time.Location {
+	loc, err := LoadLocation(e.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// Overlaps проверяет, пересекается ли событие с интервалом [from, to).
+// Событие без длительности попадает в интервал, если его начало лежит внутри интервала
+func (e *Event) Overlaps(from, to time.Time) bool {
+	if !e.Start.Before(to) {
+		return false
+	}
+	if e.End.Equal(e.Start) {
+		return !e.Start.Before(from)
+	}
+	return e.End.After(from)
+}
+
+// validate проверяет поля события, обязательные для создания и обновления
+func (e *Event) validate() error {
+	if e.UserID == "" || e.Name == "" || e.Start.IsZero() {
+		return &ValidationError{Message: "empty parameters"}
+	}
+	if e.End.Before(e.Start) {
+		return &ValidationError{Message: "end is before start"}
+	}
+	if e.AllDay && !e.End.After(e.Start) {
+		return &ValidationError{Message: "all-day event must last at least one day"}
+	}
+	rule, err := e.rule()
+	if err != nil {
+		return &ValidationError{Message: err.Error()}
+	}
+	if rule != nil {
+		e.RRule = rule.String()
+	}
+	e.Reminders, err = normalizeReminders(e.Reminders)
+	if err != nil {
+		return &ValidationError{Message: err.Error()}
+	}
+	return nil
+}
+
+var locations sync.Map
+
+// LoadLocation как time.LoadLocation, но кеширует загруженные часовые пояса. Пустое имя означает UTC
+func LoadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// UserCalendar хранит события одного пользователя
+type UserCalendar map[string]Event
+
+// Storage описывает хранилище календарей, с которым работают обработчики
+type Storage interface {
+	// Create создает новое событие
+	Create(event *Event, opts ...WriteOption) (*Event, error)
+	// Update обновляет существующее событие
+	Update(event *Event, opts ...WriteOption) (*Event, error)
+	// Delete удаляет существующее событие
+	Delete(event *Event, opts ...WriteOption) (*Event, error)
+	// Get возвращает событие (для серии - вместе с исключениями)
+	Get(userID, id string) (*Event, error)
+	// Put создает событие с заданным ID или заменяет существующее целиком, включая исключения серии
+	Put(event *Event, opts ...WriteOption) (*Event, Status, error)
+	// UpdateOccurrence изменяет одно повторение серии или повторения начиная с заданного
+	UpdateOccurrence(event *Event, occurrence time.Time, scope RecurrenceScope, opts ...WriteOption) (*Event, error)
+	// DeleteOccurrence удаляет одно повторение серии или повторения начиная с заданного
+	DeleteOccurrence(event *Event, occurrence time.Time, scope RecurrenceScope, opts ...WriteOption) (*Event, error)
+	// Respond записывает ответ участника на приглашение в событие другого пользователя
+	Respond(organizerID, id, attendeeID string, status AttendeeStatus, opts ...WriteOption) (*Event, error)
+	// GetEventsPerDay возвращает события, пересекающиеся с днем date (в часовом поясе date).
+	// Здесь и далее в результат входят события, в которые пользователь приглашен
+	GetEventsPerDay(userID string, date time.Time) ([]Event, error)
+	// GetEventsPerWeek возвращает события, пересекающиеся с неделей от startDate (в часовом поясе startDate)
+	GetEventsPerWeek(userID string, startDate time.Time) ([]Event, error)
+	// GetEventsPerMonth возвращает события, пересекающиеся с заданным месяцем в часовом поясе loc
+	GetEventsPerMonth(userID string, year int, month time.Month, loc *time.Location) ([]Event, error)
+	// Search ищет события пользователя по словам в названии и описании в необязательном диапазоне [from, to)
+	Search(userID, query string, from, to time.Time) ([]Event, error)
+	// Batch применяет операции создания, изменения и удаления атомарно: либо все, либо ни одной
+	Batch(ops []BatchOperation) ([]Event, error)
+}
+
+// Change описывает одно изменение события в хранилище
+type Change struct {
+	Status Status `json:"status"`
+	Event  Event  `json:"event"`
+	// Actor кто сделал изменение, пустой если неизвестно
+	Actor string `json:"actor,omitempty"`
+	// Time время изменения
+	Time time.Time `json:"time"`
+	// Before событие до изменения, nil для созданного события. В журнал не пишется
+	Before *Event `json:"-"`
+}
+
+// storageShard хранит календари части пользователей под своей блокировкой
+type storageShard struct {
+	mu sync.RWMutex
+	// user -> event ID -> event
+	events map[string]UserCalendar
+}
+
+// MemoryStorage хранит календари в памяти. Пользователи распределены по шардам,
+// поэтому запросы разных пользователей блокируют друг друга только при попадании в один шард.
+// Безопасен для конкурентного использования.
+type MemoryStorage struct {
+	shards [shardCount]*storageShard
+	// journal вызывается перед применением изменений под блокировкой шарда,
+	// nil если изменения никуда не пишутся
+	journal func(changes []Change) error
+	// listeners вызываются после применения изменений под блокировкой шарда
+	listenersMu sync.RWMutex
+	listeners   []func(changes []Change)
+	// invitations события, в которые приглашены пользователи
+	invitations invitations
+	// searchIndex слова событий для поиска
+	searchIndex searchIndex
+	// reminders очередь событий по времени ближайшего напоминания
+	reminders reminderIndex
+	// base хранилище, черновиком пакета /batch которого является это хранилище, nil для самого хранилища.
+	// Календари пользователей не из пакета drafted проверка пересечений читает из base
+	base    *MemoryStorage
+	drafted map[string]bool
+}
+
+// NewMemoryStorage возвращает новое хранилище в памяти
+func NewMemoryStorage() *MemoryStorage {
+	s := &MemoryStorage{}
+	for i := range s.shards {
+		s.shards[i] = &storageShard{events: make(map[string]UserCalendar)}
+	}
+	return s
+}
+
+// shard возвращает шард, в котором хранится календарь пользователя
+func (s *MemoryStorage) shard(userID string) *storageShard {
+	return s.shards[shardIndex(userID)]
+}
+
+// shardIndex возвращает индекс шарда, в котором хранится календарь пользователя
+func shardIndex(userID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return int(h.Sum32() % shardCount)
+}
+
+// lockAll блокирует все шарды на чтение, чтобы получить согласованный срез всего хранилища.
+// Шарды всегда блокируются в порядке возрастания индекса
+func (s *MemoryStorage) lockAll() {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+	}
+}
+
+// unlockAll снимает блокировки, взятые lockAll
+func (s *MemoryStorage) unlockAll() {
+	for _, sh := range s.shards {
+		sh.mu.RUnlock()
+	}
+}
+
+// commit записывает изменения в журнал (если он есть) и применяет их. Изменения дополняются
+// автором из o, временем и состоянием события до изменения. Вызывается с заблокированным на запись шардом sh
+func (s *MemoryStorage) commit(sh *storageShard, o writeOptions, changes ...Change) error {
+	now := time.Now().UTC()
+	for i := range changes {
+		changes[i].Actor = o.actor
+		changes[i].Time = now
+		if before, err := sh.get(changes[i].Event.UserID, changes[i].Event.ID); err == nil {
+			changes[i].Before = &before
+		}
+	}
+	return s.write(changes)
+}
+
+// write записывает изменения в журнал одной записью и применяет их к шардам и индексам.
+// Вызывается с заблокированными на запись шардами всех изменений
+func (s *MemoryStorage) write(changes []Change) error {
+	if s.journal != nil {
+		if err := s.journal(changes); err != nil {
+			return err
+		}
+	}
+	for _, c := range changes {
+		s.invitations.update(c, c.Before)
+		s.searchIndex.update(c, c.Before)
+		s.reminders.update(c)
+		s.shard(c.Event.UserID).apply(c)
+	}
+	s.listenersMu.RLock()
+	defer s.listenersMu.RUnlock()
+	for _, fn := range s.listeners {
+		fn(changes)
+	}
+	return nil
+}
+
+// OnChange добавляет обработчик, который вызывается после каждого изменения событий.
+// Обработчик вызывается под блокировкой шарда, поэтому не должен блокироваться и обращаться к хранилищу
+func (s *MemoryStorage) OnChange(fn func(changes []Change)) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// apply применяет изменение без записи в журнал
+func (s *MemoryStorage) apply(c Change) {
+	sh := s.shard(c.Event.UserID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	var before *Event
+	if stored, err := sh.get(c.Event.UserID, c.Event.ID); err == nil {
+		before = &stored
+	}
+	s.invitations.update(c, before)
+	s.searchIndex.update(c, before)
+	s.reminders.update(c)
+	sh.apply(c)
+}
+
+// apply применяет одно изменение к календарям шарда
+func (s *storageShard) apply(c Change) {
+	switch c.Status {
+	case Created, Updated:
+		calendar, ok := s.events[c.Event.UserID]
+		if !ok {
+			calendar = make(UserCalendar)
+			s.events[c.Event.UserID] = calendar
+		}
+		calendar[c.Event.ID] = c.Event
+	case Deleted:
+		calendar, ok := s.events[c.Event.UserID]
+		if !ok {
+			return
+		}
+		delete(calendar, c.Event.ID)
+	}
+}
+
+// Create создает новое событие
+func (s *MemoryStorage) Create(event *Event, opts ...WriteOption) (*Event, error) {
+	if err := event.validate(); err != nil {
+		return nil, err
+	}
+	attendees, err := mergeAttendees(event.UserID, event.Attendees, nil)
+	if err != nil {
+		return nil, err
+	}
+	event.ID = uuid.New().String()
+	event.ExDates = nil
+	event.Overrides = nil
+	event.RecurrenceID = time.Time{}
+	event.Version = 1
+	event.Attendees = attendees
+	o := newWriteOptions(opts)
+	sh, unlock := s.lockWrite(event.UserID, o)
+	defer unlock()
+	if o.rejectConflicts {
+		if err := s.checkConflicts(event); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.commit(sh, o, Change{Status: Created, Event: *event}); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// Update обновляет существующее событие
+func (s *MemoryStorage) Update(event *Event, opts ...WriteOption) (*Event, error) {
+	if event.ID == "" {
+		return nil, &ValidationError{Message: "empty parameters"}
+	}
+	if err := event.validate(); err != nil {
+		return nil, err
+	}
+	o := newWriteOptions(opts)
+	sh, unlock := s.lockWrite(event.UserID, o)
+	defer unlock()
+	return s.update(sh, event, o)
+}
+
+// update заменяет событие целиком. Для серии сохраняются удаленные и измененные повторения.
+// Вызывается под блокировками lockWrite
+func (s *MemoryStorage) update(sh *storageShard, event *Event, o writeOptions) (*Event, error) {
+	stored, err := sh.get(event.UserID, event.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.checkVersion(stored.Version); err != nil {
+		return nil, err
+	}
+	requested := event.Attendees
+	if o.keepAttendees {
+		requested = stored.Attendees
+	}
+	attendees, err := mergeAttendees(event.UserID, requested, stored.Attendees)
+	if err != nil {
+		return nil, err
+	}
+	event.ExDates = nil
+	event.Overrides = nil
+	event.RecurrenceID = time.Time{}
+	event.Version = stored.Version + 1
+	event.Attendees = attendees
+	if event.RRule != "" {
+		event.ExDates = stored.ExDates
+		event.Overrides = stored.Overrides
+	}
+	if o.rejectConflicts {
+		if err := s.checkConflicts(event); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.commit(sh, o, Change{Status: Updated, Event: *event}); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// Delete удаляет существующее событие. Возвращает удаленное событие со следующей версией
+func (s *MemoryStorage) Delete(event *Event, opts ...WriteOption) (*Event, error) {
+	if event.ID == "" || event.UserID == "" {
+		return nil, &ValidationError{Message: "empty parameters"}
+	}
+	sh := s.shard(event.UserID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	stored, err := sh.get(event.UserID, event.ID)
+	if err != nil {
+		return nil, err
+	}
+	o := newWriteOptions(opts)
+	if err := o.checkVersion(stored.Version); err != nil {
+		return nil, err
+	}
+	stored.Version++
+	if err := s.commit(sh, o, Change{Status: Deleted, Event: stored}); err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// Get возвращает событие (для серии - вместе с исключениями)
+func (s *MemoryStorage) Get(userID, id string) (*Event, error) {
+	if userID == "" || id == "" {
+		return nil, &ValidationError{Message: "empty parameters"}
+	}
+	sh := s.shard(userID)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	event, err := sh.get(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// Put создает событие с заданным ID или заменяет существующее целиком, включая исключения серии.
+// Созданное событие продолжает нумерацию версий с event.Version, например восстановленное из истории.
+// Возвращает Created или Updated в зависимости от того, было ли событие
+func (s *MemoryStorage) Put(event *Event, opts ...WriteOption) (*Event, Status, error) {
+	if event.ID == "" {
+		return nil, 0, &ValidationError{Message: "empty parameters"}
+	}
+	if err := event.validate(); err != nil {
+		return nil, 0, err
+	}
+	event.RecurrenceID = time.Time{}
+	o := newWriteOptions(opts)
+	sh, unlock := s.lockWrite(event.UserID, o)
+	defer unlock()
+	status := Updated
+	stored, err := sh.get(event.UserID, event.ID)
+	if err != nil {
+		status = Created
+	}
+	version := stored.Version
+	if status == Created {
+		version = event.Version
+	}
+	if err := o.checkVersion(stored.Version); err != nil {
+		return nil, 0, err
+	}
+	requested := event.Attendees
+	if o.keepAttendees {
+		requested = stored.Attendees
+	}
+	attendees, err := mergeAttendees(event.UserID, requested, stored.Attendees)
+	if err != nil {
+		return nil, 0, err
+	}
+	event.Version = version + 1
+	event.Attendees = attendees
+	if o.rejectConflicts {
+		if err := s.checkConflicts(event); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := s.commit(sh, o, Change{Status: status, Event: *event}); err != nil {
+		return nil, 0, err
+	}
+	return event, status, nil
+}
+
+// get возвращает событие пользователя с заданным id
+func (s *storageShard) get(userID, id string) (Event, error) {
+	calendar, ok := s.events[userID]
+	if !ok {
+		return Event{}, &ValidationError{Message: "UserID does not exist", NotFound: true}
+	}
+	event, ok := calendar[id]
+	if !ok {
+		return Event{}, &ValidationError{Message: "Event does not exist", NotFound: true}
+	}
+	return event, nil
+}
+
+// GetEventsPerDay возвращает события, пересекающиеся с днем date (в часовом поясе date)
+func (s *MemoryStorage) GetEventsPerDay(userID string, date time.Time) ([]Event, error) {
+	if userID == "" || date.IsZero() {
+		return nil, &ValidationError{Message: "empty parameters"}
+	}
+	from := startOfDay(date)
+	return s.eventsInRange(userID, from, from.AddDate(0, 0, 1))
+}
+
+// GetEventsPerWeek возвращает события, пересекающиеся с неделей от startDate (в часовом поясе startDate)
+func (s *MemoryStorage) GetEventsPerWeek(userID string, startDate time.Time) ([]Event, error) {
+	if userID == "" || startDate.IsZero() {
+		return nil, &ValidationError{Message: "empty parameters"}
+	}
+	from := startOfDay(startDate)
+	return s.eventsInRange(userID, from, from.AddDate(0, 0, 7))
+}
+
+// GetEventsPerMonth возвращает события, пересекающиеся с заданным месяцем в часовом поясе loc
+func (s *MemoryStorage) GetEventsPerMonth(userID string, year int, month time.Month, loc *time.Location) ([]Event, error) {
+	if userID == "" || year == 0 || month == 0 {
+		return nil, &ValidationError{Message: "empty parameters"}
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	from := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	return s.eventsInRange(userID, from, from.AddDate(0, 1, 0))
+}
+
+// eventsInRange возвращает события и повторения серий пользователя, пересекающиеся с интервалом [from, to),
+// включая события других пользователей, в которые он приглашен и от которых не отказался
+func (s *MemoryStorage) eventsInRange(userID string, from, to time.Time) ([]Event, error) {
+	var res []Event
+	sh := s.shard(userID)
+	sh.mu.RLock()
+	calendar, ok := sh.events[userID]
+	for _, event := range calendar {
+		res = append(res, event.Occurrences(from, to)...)
+	}
+	sh.mu.RUnlock()
+	// Шарды организаторов блокируются по очереди после освобождения шарда пользователя
+	invited := s.invitedEvents(userID)
+	if !ok && len(invited) == 0 {
+		return nil, &ValidationError{Message: "UserID does not exist", NotFound: true}
+	}
+	for _, event := range invited {
+		res = append(res, event.Occurrences(from, to)...)
+	}
+	return res, nil
+}
+
+// startOfDay возвращает полночь дня t в часовом поясе t
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// snapshot возвращает копию всех хранимых событий. Вызывается под lockAll
+func (s *MemoryStorage) snapshot() []Event {
+	var res []Event
+	for _, sh := range s.shards {
+		for _, calendar := range sh.events {
+			for _, event := range calendar {
+				res = append(res, event)
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStorageConcurrentAccess(t *testing.T) {
+	const (
+		users      = 8
+		goroutines = 16
+		iterations = 50
+	)
+	date := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			s := backend.newStorage(t)
+
+			var wg sync.WaitGroup
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					userID := fmt.Sprint(g % users)
+					for i := 0; i < iterations; i++ {
+						event, err := s.Create(&Event{UserID: userID, Name: "action", Start: date, End: date})
+						if !assert.NoError(t, err) {
+							return
+						}
+						_, err = s.Update(&Event{UserID: userID, ID: event.ID, Name: "action2", Start: date, End: date})
+						assert.NoError(t, err)
+						_, err = s.GetEventsPerDay(userID, date)
+						assert.NoError(t, err)
+						_, err = s.GetEventsPerWeek(userID, date)
+						assert.NoError(t, err)
+						_, err = s.GetEventsPerMonth(userID, date.Year(), date.Month(), time.UTC)
+						assert.NoError(t, err)
+						if i%2 == 0 {
+							_, err = s.Delete(&Event{UserID: userID, ID: event.ID})
+							assert.NoError(t, err)
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+
+			total := 0
+			for u := 0; u < users; u++ {
+				events, err := s.GetEventsPerDay(fmt.Sprint(u), date)
+				require.NoError(t, err)
+				total += len(events)
+			}
+			assert.Equal(t, goroutines*iterations/2, total)
+		})
+	}
+}
+
+func TestHandlerConcurrentCreate(t *testing.T) {
+	const requests = 200
+
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			handler := newHandler(&Config{}, backend.newStorage(t), Services{})
+			ts := httptest.NewServer(handler)
+			defer ts.Close()
+
+			var wg sync.WaitGroup
+			for i := 0; i < requests; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					body := fmt.Sprintf("user_id=%d&name=action&date=2024-03-04", i%4)
+					resp := makePostRequest(ts, handler, "/create_event/", body)
+					assert.Equal(t, http.StatusOK, resp.Code)
+				}(i)
+			}
+			wg.Wait()
+
+			total := 0
+			for u := 0; u < 4; u++ {
+				request := httptest.NewRequest(http.MethodGet, fmt.Sprintf("%s/events_for_day/?user_id=%d&date=2024-03-04", ts.URL, u), nil)
+				resp := httptest.NewRecorder()
+				handler.ServeHTTP(resp, request)
+				require.Equal(t, http.StatusOK, resp.Code)
+				total += countResults(t, resp)
+			}
+			assert.Equal(t, requests, total)
+		})
+	}
+}
+
+// countResults возвращает количество событий в успешном ответе API поиска
+func countResults(t *testing.T, resp *httptest.ResponseRecorder) int {
+	var respOK Response
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &respOK))
+	return len(respOK.Result.([]interface{}))
+}
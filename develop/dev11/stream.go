@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultStreamLogSize сколько последних изменений хранится для возобновления потока по Last-Event-ID
+	defaultStreamLogSize = 1000
+	// defaultStreamHeartbeat как часто в поток отправляется комментарий, чтобы прокси не закрывали соединение
+	defaultStreamHeartbeat = 15 * time.Second
+)
+
+// StreamConfig настройки потока изменений /stream
+type StreamConfig struct {
+	// LogSize сколько последних изменений хранится для возобновления потока
+	LogSize int `json:"log_size"`
+	// Heartbeat интервал отправки комментариев в поток
+	Heartbeat Duration `json:"heartbeat"`
+}
+
+// streamEntry изменение события в журнале потока
+type streamEntry struct {
+	seq    uint64
+	change Change
+}
+
+// ChangeStream рассылает изменения событий открытым потокам /stream. Последние изменения
+// хранятся в ограниченном журнале, по которому клиент может продолжить поток после переподключения.
+// Идентификатор изменения состоит из времени запуска журнала и порядкового номера, поэтому
+// идентификаторы, выданные до перезапуска сервера, распознаются как устаревшие
+type ChangeStream struct {
+	epoch     string
+	size      int
+	heartbeat time.Duration
+
+	mu          sync.Mutex
+	seq         uint64
+	entries     []streamEntry
+	subscribers map[chan struct{}]struct{}
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewChangeStream создает поток изменений с настройками cfg, незаданные настройки берутся по умолчанию
+func NewChangeStream(cfg StreamConfig) *ChangeStream {
+	s := &ChangeStream{
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		size:        cfg.LogSize,
+		heartbeat:   time.Duration(cfg.Heartbeat),
+		subscribers: make(map[chan struct{}]struct{}),
+		done:        make(chan struct{}),
+	}
+	if s.size <= 0 {
+		s.size = defaultStreamLogSize
+	}
+	if s.heartbeat <= 0 {
+		s.heartbeat = defaultStreamHeartbeat
+	}
+	return s
+}
+
+// Publish добавляет изменения в журнал и будит открытые потоки. Вызывается хранилищем, не блокируется
+func (s *ChangeStream) Publish(changes []Change) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range changes {
+		s.seq++
+		s.entries = append(s.entries, streamEntry{seq: s.seq, change: c})
+	}
+	if len(s.entries) > s.size {
+		s.entries = s.entries[len(s.entries)-s.size:]
+	}
+	for ch := range s.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close отключает все открытые потоки. Вызывается при остановке сервера, иначе
+// server.Shutdown ждал бы завершения бесконечных запросов
+func (s *ChangeStream) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+func (s *ChangeStream) subscribe() chan struct{} {
+	ch := make(chan struct{}, 1)
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+	return ch
+}
+
+func (s *ChangeStream) unsubscribe(ch chan struct{}) {
+	s.mu.Lock()
+	delete(s.subscribers, ch)
+	s.mu.Unlock()
+}
+
+// eventID возвращает идентификатор изменения для поля id потока
+func (s *ChangeStream) eventID(seq uint64) string {
+	return s.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// position возвращает номер последнего изменения, полученного клиентом с идентификатором lastEventID.
+// ok false, если продолжить поток нельзя: изменения уже вытеснены из журнала или идентификатор
+// выдан до перезапуска сервера
+func (s *ChangeStream) position(lastEventID string) (seq uint64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if lastEventID == "" {
+		return s.seq, true
+	}
+	epoch, value, found := strings.Cut(lastEventID, "-")
+	if !found || epoch != s.epoch {
+		return s.seq, false
+	}
+	seq, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || seq > s.seq {
+		return s.seq, false
+	}
+	// Изменения после seq должны еще быть в журнале
+	if seq < s.seq && (len(s.entries) == 0 || s.entries[0].seq > seq+1) {
+		return s.seq, false
+	}
+	return seq, true
+}
+
+// since возвращает изменения событий пользователя userID (включая события, в которые он приглашен) с номерами больше seq и номер последнего изменения журнала
+func (s *ChangeStream) since(userID string, seq uint64) ([]streamEntry, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []streamEntry
+	i := sort.Search(len(s.entries), func(i int) bool { return s.entries[i].seq > seq })
+	for _, e := range s.entries[i:] {
+		if e.change.concerns(userID) {
+			res = append(res, e)
+		}
+	}
+	return res, s.seq
+}
+
+// StreamMessage данные сообщения потока об изменении события
+type StreamMessage struct {
+	Status Status      `json:"status"`
+	Event  EventResult `json:"event"`
+}
+
+// streamEventNames типы сообщений потока для статусов изменений
+var streamEventNames = map[Status]string{
+	Created: "created",
+	Updated: "updated",
+	Deleted: "deleted",
+}
+
+// streamHandler отдает изменения событий пользователя user_id в формате text/event-stream.
+// Если клиент передал Last-Event-ID, сначала отправляются пропущенные изменения из журнала. Если их
+// там уже нет, отправляется сообщение reset, после которого клиент должен заново загрузить события
+func streamHandler(stream *ChangeStream) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeErrorMessage(w, http.StatusMethodNotAllowed, "Wrong method")
+			return
+		}
+		userID := r.URL.Query().Get("user_id")
+		if userID == "" {
+			writeErrorMessage(w, http.StatusBadRequest, "user_id is required")
+			return
+		}
+		lastEventID := r.Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			// EventSource не позволяет задать заголовок при первом подключении
+			lastEventID = r.URL.Query().Get("last_event_id")
+		}
+
+		// Подписываемся до чтения журнала, чтобы не пропустить изменения между ними
+		wake := stream.subscribe()
+		defer stream.unsubscribe(wake)
+		seq, ok := stream.position(lastEventID)
+
+		rc := http.NewResponseController(w)
+		// Поток открыт дольше write_timeout сервера, поэтому ограничение для него снимается
+		rc.SetWriteDeadline(time.Time{})
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		if !ok {
+			fmt.Fprintf(w, "id: %s\nevent: reset\ndata: {}\n\n", stream.eventID(seq))
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		heartbeat := time.NewTicker(stream.heartbeat)
+		defer heartbeat.Stop()
+		for {
+			var entries []streamEntry
+			entries, seq = stream.since(userID, seq)
+			for _, e := range entries {
+				data, err := json.Marshal(StreamMessage{Status: e.change.Status, Event: newEventResult(e.change.Event)})
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "Error while serializing stream message", err)
+					continue
+				}
+				fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", stream.eventID(e.seq), streamEventNames[e.change.Status], data)
+			}
+			if len(entries) > 0 {
+				if err := rc.Flush(); err != nil {
+					return
+				}
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-stream.done:
+				return
+			case <-wake:
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+				if err := rc.Flush(); err != nil {
+					return
+				}
+			}
+		}
+	})
+}
+
+// startStream создает поток изменений и подписывает его на изменения хранилища
+func startStream(cfg *Config, storage Storage) (*ChangeStream, error) {
+	source, ok := storage.(interface {
+		OnChange(fn func(changes []Change))
+	})
+	if !ok {
+		return nil, fmt.Errorf("storage does not support change stream")
+	}
+	var streamCfg StreamConfig
+	if cfg.Stream != nil {
+		streamCfg = *cfg.Stream
+	}
+	stream := NewChangeStream(streamCfg)
+	source.OnChange(stream.Publish)
+	return stream, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseMessage сообщение потока text/event-stream
+type sseMessage struct {
+	id    string
+	event string
+	data  string
+	// comment текст комментария, если сообщение - комментарий
+	comment string
+}
+
+// sseClient читает сообщения потока /stream
+type sseClient struct {
+	resp     *http.Response
+	messages chan sseMessage
+}
+
+func openStream(t *testing.T, url, lastEventID string) *sseClient {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	c := &sseClient{resp: resp, messages: make(chan sseMessage, 100)}
+	go func() {
+		defer close(c.messages)
+		scanner := bufio.NewScanner(resp.Body)
+		var msg sseMessage
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				c.messages <- msg
+				msg = sseMessage{}
+			case strings.HasPrefix(line, ":"):
+				msg.comment = strings.TrimSpace(line[1:])
+			default:
+				field, value, _ := strings.Cut(line, ": ")
+				switch field {
+				case "id":
+					msg.id = value
+				case "event":
+					msg.event = value
+				case "data":
+					msg.data = value
+				}
+			}
+		}
+	}()
+	t.Cleanup(func() { resp.Body.Close() })
+	return c
+}
+
+func (c *sseClient) next(t *testing.T) sseMessage {
+	select {
+	case msg, ok := <-c.messages:
+		require.True(t, ok, "stream is closed")
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message in stream")
+		return sseMessage{}
+	}
+}
+
+func (c *sseClient) expect(t *testing.T, event, name string) sseMessage {
+	msg := c.next(t)
+	require.Equal(t, event, msg.event)
+	var data StreamMessage
+	require.NoError(t, json.Unmarshal([]byte(msg.data), &data))
+	assert.Equal(t, name, data.Event.Name)
+	assert.NotEmpty(t, msg.id)
+	return msg
+}
+
+func newStreamServer(t *testing.T, cfg StreamConfig) (*httptest.Server, http.Handler, *ChangeStream) {
+	storage := NewMemoryStorage()
+	stream := NewChangeStream(cfg)
+	storage.OnChange(stream.Publish)
+	handler := newHandler(&Config{}, storage, Services{Stream: stream})
+	ts := httptest.NewServer(handler)
+	t.Cleanup(func() {
+		stream.Close()
+		ts.Close()
+	})
+	return ts, handler, stream
+}
+
+func TestStream(t *testing.T) {
+	ts, handler, _ := newStreamServer(t, StreamConfig{})
+	stream := openStream(t, ts.URL+"/stream?user_id=34", "")
+
+	id, err := createEventAndGetID(ts, handler, "user_id=34&date=2024-03-04&name=action")
+	require.NoError(t, err)
+	_, err = createEventAndGetID(ts, handler, "user_id=35&date=2024-03-04&name=other")
+	require.NoError(t, err)
+	resp := makePostRequest(ts, handler, "/update_event/", "user_id=34&date=2024-03-05&name=renamed&id="+id)
+	require.Equal(t, http.StatusOK, resp.Code)
+	resp = makePostRequest(ts, handler, "/delete_event/", "user_id=34&id="+id)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	created := stream.expect(t, "created", "action")
+	stream.expect(t, "updated", "renamed")
+	deleted := stream.expect(t, "deleted", "renamed")
+
+	// После переподключения приходят изменения, пропущенные клиентом
+	resumed := openStream(t, ts.URL+"/stream?user_id=34", created.id)
+	resumed.expect(t, "updated", "renamed")
+	assert.Equal(t, deleted.id, resumed.expect(t, "deleted", "renamed").id)
+
+	_, err = createEventAndGetID(ts, handler, "user_id=34&date=2024-03-04&name=new")
+	require.NoError(t, err)
+	stream.expect(t, "created", "new")
+	resumed.expect(t, "created", "new")
+
+	req := httptest.NewRequest(http.MethodGet, "/stream", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestStreamReset(t *testing.T) {
+	ts, handler, _ := newStreamServer(t, StreamConfig{LogSize: 2})
+	first, err := createEventAndGetID(ts, handler, "user_id=34&date=2024-03-04&name=first")
+	require.NoError(t, err)
+	stream := openStream(t, ts.URL+"/stream?user_id=34", "")
+	resp := makePostRequest(ts, handler, "/update_event/", "user_id=34&date=2024-03-05&name=second&id="+first)
+	require.Equal(t, http.StatusOK, resp.Code)
+	old := stream.expect(t, "updated", "second")
+	for _, name := range []string{"third", "fourth", "fifth"} {
+		_, err := createEventAndGetID(ts, handler, "user_id=34&date=2024-03-04&name="+name)
+		require.NoError(t, err)
+		stream.expect(t, "created", name)
+	}
+
+	tests := []struct {
+		name        string
+		lastEventID string
+	}{
+		{"evicted from log", old.id},
+		{"issued before restart", "abc-1"},
+		{"from future", strings.Split(old.id, "-")[0] + "-100"},
+		{"wrong", "wrong"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resumed := openStream(t, ts.URL+"/stream?user_id=34", tt.lastEventID)
+			reset := resumed.next(t)
+			assert.Equal(t, "reset", reset.event)
+			_, err := createEventAndGetID(ts, handler, "user_id=34&date=2024-03-04&name="+tt.name)
+			require.NoError(t, err)
+			resumed.expect(t, "created", tt.name)
+			stream.expect(t, "created", tt.name)
+		})
+	}
+}
+
+func TestStreamHeartbeatAndClose(t *testing.T) {
+	ts, _, changeStream := newStreamServer(t, StreamConfig{Heartbeat: Duration(10 * time.Millisecond)})
+	stream := openStream(t, ts.URL+"/stream?user_id=34", "")
+	assert.Equal(t, "heartbeat", stream.next(t).comment)
+
+	changeStream.Close()
+	require.Eventually(t, func() bool {
+		for {
+			select {
+			case _, ok := <-stream.messages:
+				if !ok {
+					return true
+				}
+			default:
+				return false
+			}
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -5,14 +5,21 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"github.com/google/uuid"
+	"io"
+	"log/slog"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"sort"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
+	// Встраиваем базу часовых поясов, чтобы сервер не зависел от ее наличия в системе
+	_ "time/tzdata"
 )
 
 /*
@@ -53,6 +60,63 @@ Web-сервер должен запускаться на порту указа
 // Config содержит описание конфигурационного файла сервера
 type Config struct {
 	Address string `json:"server_address"`
+	// StoragePath директория файлового хранилища, если пустая - события хранятся только в памяти
+	StoragePath string `json:"storage_path"`
+	// SnapshotEvery через сколько записей журнала делать снимок файлового хранилища
+	SnapshotEvery int `json:"snapshot_every"`
+	// Auth настройки аутентификации, если не заданы - запросы принимаются без токена
+	Auth *AuthConfig `json:"auth"`
+	// Reminders настройки отправки напоминаний, если не заданы - напоминания не отправляются
+	Reminders *ReminderConfig `json:"reminders"`
+	// Webhooks настройки доставки изменений событий подписчикам, если не заданы - подписки недоступны
+	Webhooks *WebhookConfig `json:"webhooks"`
+	// Stream настройки потока изменений /stream, если не заданы - используются настройки по умолчанию
+	Stream *StreamConfig `json:"stream"`
+	// History ограничения хранения истории изменений, если не заданы - используются ограничения по умолчанию
+	History *HistoryConfig `json:"history"`
+	// Log настройки логов, если не заданы - JSON с уровнем info
+	Log *LogConfig `json:"log"`
+	// ReadTimeout, WriteTimeout и IdleTimeout таймауты соединений сервера, нулевые - значения по умолчанию
+	ReadTimeout  Duration `json:"read_timeout"`
+	WriteTimeout Duration `json:"write_timeout"`
+	IdleTimeout  Duration `json:"idle_timeout"`
+	// ShutdownTimeout сколько ждать завершения запросов при остановке сервера, после чего соединения закрываются
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// TLS сертификат сервера, если не задан - сервер принимает HTTP без шифрования
+	TLS *TLSConfig `json:"tls"`
+	// RateLimit ограничения частоты запросов клиентов, если не заданы - запросы не ограничиваются.
+	// При перезагрузке конфига учет запросов начинается заново
+	RateLimit *RateLimitConfig `json:"rate_limit"`
+}
+
+// Duration длительность в конфиге, задается строкой в формате time.ParseDuration, например "1m30s"
+type Duration time.Duration
+
+// UnmarshalJSON разбирает длительность из строки
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string like \"1m30s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON записывает длительность строкой
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Services фоновые службы сервера, к которым обращаются обработчики. Незаданная служба отключена
+type Services struct {
+	Webhooks *WebhookDispatcher
+	Stream   *ChangeStream
+	History  *History
+	Metrics  *Metrics
 }
 
 // Status соответствует статусу события
@@ -71,13 +135,32 @@ const (
 type PostResult struct {
 	ID     string `json:"id"`
 	Status Status `json:"status"`
+	// Version версия события после изменения, она же возвращается в заголовке ETag
+	Version int64 `json:"version"`
 }
 
 // EventResult возвращается в API поиска событий
 type EventResult struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
-	Date string `json:"date"`
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Date дата начала события в его часовом поясе
+	Date     string `json:"date"`
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	AllDay   bool   `json:"all_day"`
+	Timezone string `json:"timezone"`
+	RRule    string `json:"rrule,omitempty"`
+	// Occurrence исходное начало повторения серии, по нему можно изменить или удалить одно повторение
+	Occurrence string `json:"occurrence,omitempty"`
+	// Reminders смещения напоминаний до начала события, например 15m или 1d
+	Reminders []string `json:"reminders,omitempty"`
+	// Version версия события, для повторения - версия серии
+	Version int64 `json:"version"`
+	// Organizer пользователь, в календаре которого хранится событие с участниками
+	Organizer string `json:"organizer,omitempty"`
+	// Attendees участники события и их ответы на приглашение
+	Attendees []Attendee `json:"attendees,omitempty"`
 }
 
 // Response это формат ответа API модификации событий
@@ -88,209 +171,252 @@ type Response struct {
 // ErrorResponse это формат ошибочного ответа API
 type ErrorResponse struct {
 	Error string `json:"error"`
+	// Conflicts события, с которыми пересекается записываемое событие в режиме reject_conflicts
+	Conflicts []EventResult `json:"conflicts,omitempty"`
+	// Operation номер операции пакета /batch (с нуля), из-за которой не применен весь пакет
+	Operation *int `json:"operation,omitempty"`
+	// Violations параметры запроса, не соответствующие документу /openapi.json
+	Violations []Violation `json:"violations,omitempty"`
+}
+
+// Violation нарушение описания параметра запроса
+type Violation struct {
+	Parameter string `json:"parameter"`
+	Message   string `json:"message"`
 }
 
 // ValidationError структура для ошибки валидации параметров
 type ValidationError struct {
 	Message string
+	// NotFound означает, что запрошенного пользователя или события нет
+	NotFound bool
 }
 
 func (e *ValidationError) Error() string {
 	return e.Message
 }
 
-// ParseEvent разбирает переданные параметры event и возвращает ссылку на Event, date - строка в формате 2019-09-09
+// ParamsError ошибка параметров запроса, не соответствующих их описанию в /openapi.json
+type ParamsError struct {
+	Violations []Violation
+}
+
+func (e *ParamsError) Error() string {
+	return "Invalid request parameters"
+}
+
+// ParseEvent разбирает переданные параметры event и возвращает ссылку на Event.
+// start и end - время в формате RFC 3339, вместо end можно передать duration (например 1h30m).
+// Для события на весь день (all_day=true) start и end можно передать датами в формате 2019-09-09, end не включается.
+// timezone - часовой пояс события из базы IANA, по умолчанию UTC.
+// Для совместимости date в формате 2019-09-09 без start задает событие на весь день.
+// rrule - правило повторения в формате RFC 5545, например FREQ=WEEKLY;BYDAY=MO,WE;COUNT=10.
+// reminders - смещения напоминаний до начала события через запятую, например 15m,1d.
+// attendees - приглашенные пользователи через запятую, например 35,36. description - описание события
 func ParseEvent(v url.Values) (*Event, error) {
-	event := Event{}
+	event := Event{
+		UserID:      v.Get("user_id"),
+		ID:          v.Get("id"),
+		Name:        v.Get("name"),
+		Description: v.Get("description"),
+		Timezone:    v.Get("timezone"),
+		RRule:       v.Get("rrule"),
+	}
 	var err error
-	for key, value := range v {
-		switch key {
-		case "user_id":
-			event.UserID = value[0]
-		case "id":
-			event.ID = value[0]
-		case "name":
-			event.Name = value[0]
-		case "date":
-			event.Date, err = time.Parse("2006-01-02", value[0])
-			if err != nil {
-				return nil, fmt.Errorf("date parse error: %w", err)
-			}
+	if value := v.Get("all_day"); value != "" {
+		event.AllDay, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("all_day parse error: %w", err)
 		}
 	}
-	return &event, nil
-}
-
-// ParseUserAndDate парсит id пользователя и дату события из query
-func ParseUserAndDate(v url.Values) (userID string, date time.Time, err error) {
-	for key, value := range v {
-		switch key {
-		case "user_id":
-			userID = value[0]
-		case "date":
-			date, err = time.Parse("2006-01-02", value[0])
-			if err != nil {
-				return "", time.Time{}, fmt.Errorf("date parse error: %w", err)
-			}
+	if value := v.Get("reminders"); value != "" {
+		event.Reminders, err = ParseReminders(value)
+		if err != nil {
+			return nil, err
 		}
 	}
-	return
-}
-
-// ParseUserAndMonth парсит id пользователя и год и месяц события из query
-func ParseUserAndMonth(v url.Values) (userID string, year int, month time.Month, err error) {
-	for key, value := range v {
-		switch key {
-		case "user_id":
-			userID = value[0]
-		case "year":
-			year, err = strconv.Atoi(value[0])
-			if err != nil {
-				return "", 0, 0, fmt.Errorf("year parse error: %w", err)
-			}
-		case "month":
-			monthNum, err := strconv.Atoi(value[0])
-			if err != nil {
-				return "", 0, 0, fmt.Errorf("month parse error: %w", err)
-			}
-			if monthNum < 1 || monthNum > 12 {
-				return "", 0, 0, fmt.Errorf("month parse error")
-			}
-			month = time.Month(monthNum)
+	if value := v.Get("attendees"); value != "" {
+		event.Attendees = ParseAttendees(value)
+	}
+	date, start, end, duration := v.Get("date"), v.Get("start"), v.Get("end"), v.Get("duration")
+	loc, err := LoadLocation(event.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("timezone parse error: %w", err)
+	}
+	event.Timezone = loc.String()
+	if start == "" && date != "" {
+		start = date
+		event.AllDay = true
+	}
+	if start == "" {
+		return &event, nil
+	}
+	event.Start, err = parseEventTime(start, loc, event.AllDay)
+	if err != nil {
+		return nil, fmt.Errorf("start parse error: %w", err)
+	}
+	switch {
+	case end != "":
+		event.End, err = parseEventTime(end, loc, event.AllDay)
+		if err != nil {
+			return nil, fmt.Errorf("end parse error: %w", err)
 		}
+	case duration != "":
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			return nil, fmt.Errorf("duration parse error: %w", err)
+		}
+		event.End = event.Start.Add(d)
+	case event.AllDay:
+		event.End = event.Start.AddDate(0, 0, 1)
+	default:
+		event.End = event.Start
 	}
-	return
-}
-
-// Event это внутреннее представление события
-type Event struct {
-	UserID string
-	ID     string
-	Name   string
-	Date   time.Time
-}
-
-// UserCalendar хранит события одного пользователя
-type UserCalendar map[string]Event
-
-// Storage хранит календари в памяти
-type Storage struct {
-	// user -> event ID -> event
-	events map[string]UserCalendar
+	return &event, nil
 }
 
-// NewStorage возвращает новый storage
-func NewStorage() *Storage {
-	return &Storage{events: make(map[string]UserCalendar)}
+// ParseWriteOptions парсит необязательный режим записи: reject_conflicts=true запрещает
+// создавать и изменять события, пересекающиеся с событиями организатора или участников
+func ParseWriteOptions(v url.Values) ([]WriteOption, error) {
+	var opts []WriteOption
+	if value := v.Get("reject_conflicts"); value != "" {
+		reject, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("reject_conflicts parse error: %w", err)
+		}
+		if reject {
+			opts = append(opts, RejectConflicts())
+		}
+	}
+	return opts, nil
 }
 
-// Create создает новое событие
-func (s *Storage) Create(event *Event) (*Event, error) {
-	if event.UserID == "" || event.Name == "" || event.Date.IsZero() {
-		return nil, &ValidationError{Message: "empty parameters"}
+// ParseOccurrence парсит повторение серии, к которому относится изменение: occurrence - исходное начало
+// повторения в формате RFC 3339, scope - this (по умолчанию), following или all.
+// Нулевое время означает изменение всей серии
+func ParseOccurrence(v url.Values) (occurrence time.Time, scope RecurrenceScope, err error) {
+	scope = RecurrenceScope(v.Get("scope"))
+	switch scope {
+	case "":
+		scope = ScopeThis
+	case ScopeAll, ScopeThis, ScopeFollowing:
+	default:
+		return time.Time{}, "", fmt.Errorf("scope parse error: unknown scope %q", scope)
+	}
+	value := v.Get("occurrence")
+	if value == "" || scope == ScopeAll {
+		return time.Time{}, ScopeAll, nil
 	}
-	event.ID = uuid.New().String()
-	calendar, ok := s.events[event.UserID]
-	if !ok {
-		calendar = make(map[string]Event)
-		s.events[event.UserID] = calendar
+	occurrence, err = time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("occurrence parse error: %w", err)
 	}
-	calendar[event.ID] = *event
-	return event, nil
+	return occurrence, scope, nil
 }
 
-// Update обновляет существующее событие
-func (s *Storage) Update(event *Event) (*Event, error) {
-	if event.ID == "" || event.UserID == "" || event.Name == "" || event.Date.IsZero() {
-		return nil, &ValidationError{Message: "empty parameters"}
+// parseEventTime разбирает время события в формате RFC 3339 и переводит его в часовой пояс loc.
+// Для событий на весь день допускается дата без времени, а результат округляется до полуночи
+func parseEventTime(value string, loc *time.Location, allDay bool) (time.Time, error) {
+	if allDay {
+		if t, err := time.ParseInLocation("2006-01-02", value, loc); err == nil {
+			return t, nil
+		}
 	}
-	calendar, ok := s.events[event.UserID]
-	if !ok {
-		return nil, &ValidationError{Message: "UserID does not exist"}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, err
 	}
-	_, ok = calendar[event.ID]
-	if !ok {
-		return nil, &ValidationError{Message: "Event does not exist"}
+	t = t.In(loc)
+	if allDay {
+		t = startOfDay(t)
 	}
-	calendar[event.ID] = *event
-	return event, nil
+	return t, nil
 }
 
-// Delete удаляет существующее событие
-func (s *Storage) Delete(event *Event) (*Event, error) {
-	if event.ID == "" || event.UserID == "" {
-		return nil, &ValidationError{Message: "empty parameters"}
-	}
-	calendar, ok := s.events[event.UserID]
-	if !ok {
-		return nil, &ValidationError{Message: "UserID does not exist"}
-	}
-	_, ok = calendar[event.ID]
-	if !ok {
-		return nil, &ValidationError{Message: "Event does not exist"}
+// parseLocation возвращает часовой пояс запроса из параметра timezone, по умолчанию UTC
+func parseLocation(v url.Values) (*time.Location, error) {
+	loc, err := LoadLocation(v.Get("timezone"))
+	if err != nil {
+		return nil, fmt.Errorf("timezone parse error: %w", err)
 	}
-	delete(calendar, event.ID)
-	return event, nil
+	return loc, nil
 }
 
-// GetEventsPerDay возвращает события в заданный день
-func (s *Storage) GetEventsPerDay(userID string, date time.Time) ([]Event, error) {
-	if userID == "" || date.IsZero() {
-		return nil, &ValidationError{Message: "empty parameters"}
+// ParseUserAndDate парсит id пользователя и обязательную дату события из query.
+// Дата возвращается в часовом поясе из параметра timezone (по умолчанию UTC)
+func ParseUserAndDate(v url.Values) (userID string, date time.Time, err error) {
+	loc, err := parseLocation(v)
+	if err != nil {
+		return "", time.Time{}, err
 	}
-	var res []Event
-	calendar, ok := s.events[userID]
-	if !ok {
-		return nil, &ValidationError{Message: "UserID does not exist"}
+	value := v.Get("date")
+	if value == "" {
+		return "", time.Time{}, fmt.Errorf("date is required")
 	}
-	for _, event := range calendar {
-		if event.Date == date {
-			res = append(res, event)
-		}
+	date, err = time.ParseInLocation("2006-01-02", value, loc)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("date parse error: %w", err)
 	}
-	return res, nil
+	return v.Get("user_id"), date, nil
 }
 
-// GetEventsPerWeek возвращает события в заданную неделю
-func (s *Storage) GetEventsPerWeek(userID string, startDate time.Time) ([]Event, error) {
-	if userID == "" || startDate.IsZero() {
-		return nil, &ValidationError{Message: "empty parameters"}
+// ParseUserAndMonth парсит id пользователя, обязательные год и месяц события и часовой пояс запроса из query
+func ParseUserAndMonth(v url.Values) (userID string, year int, month time.Month, loc *time.Location, err error) {
+	loc, err = parseLocation(v)
+	if err != nil {
+		return "", 0, 0, nil, err
 	}
-	var res []Event
-	calendar, ok := s.events[userID]
-	if !ok {
-		return nil, &ValidationError{Message: "UserID does not exist"}
-	}
-	endDate := startDate.Add(time.Hour * 24 * 7)
-	for _, event := range calendar {
-		if (!event.Date.Before(startDate)) && (event.Date.Before(endDate)) {
-			res = append(res, event)
+	for _, key := range []string{"year", "month"} {
+		if v.Get(key) == "" {
+			return "", 0, 0, nil, fmt.Errorf("%s is required", key)
 		}
 	}
-	return res, nil
+	year, err = strconv.Atoi(v.Get("year"))
+	if err != nil {
+		return "", 0, 0, nil, fmt.Errorf("year parse error: %w", err)
+	}
+	monthNum, err := strconv.Atoi(v.Get("month"))
+	if err != nil {
+		return "", 0, 0, nil, fmt.Errorf("month parse error: %w", err)
+	}
+	if monthNum < 1 || monthNum > 12 {
+		return "", 0, 0, nil, fmt.Errorf("month parse error")
+	}
+	return v.Get("user_id"), year, time.Month(monthNum), loc, nil
 }
 
-// GetEventsPerMonth возвращает события в заданный месяц
-func (s *Storage) GetEventsPerMonth(userID string, year int, month time.Month) ([]Event, error) {
-	if userID == "" || year == 0 || month == 0 {
-		return nil, &ValidationError{Message: "empty parameters"}
+// ParseUserAndRange парсит id пользователя и необязательный диапазон дат from и to (включительно)
+// в формате 2019-09-09 в часовом поясе timezone. Возвращается полуинтервал [from, to).
+// Незаданная граница остается нулевой
+func ParseUserAndRange(v url.Values) (userID string, from, to time.Time, loc *time.Location, err error) {
+	loc, err = parseLocation(v)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, nil, err
 	}
-	var res []Event
-	calendar, ok := s.events[userID]
-	if !ok {
-		return nil, &ValidationError{Message: "UserID does not exist"}
+	if value := v.Get("from"); value != "" {
+		from, err = time.ParseInLocation("2006-01-02", value, loc)
+		if err != nil {
+			return "", time.Time{}, time.Time{}, nil, fmt.Errorf("from parse error: %w", err)
+		}
 	}
-	for _, event := range calendar {
-		if event.Date.Year() == year && event.Date.Month() == month {
-			res = append(res, event)
+	if value := v.Get("to"); value != "" {
+		to, err = time.ParseInLocation("2006-01-02", value, loc)
+		if err != nil {
+			return "", time.Time{}, time.Time{}, nil, fmt.Errorf("to parse error: %w", err)
 		}
+		to = to.AddDate(0, 0, 1)
 	}
-	return res, nil
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return "", time.Time{}, time.Time{}, nil, fmt.Errorf("from must not be after to")
+	}
+	return v.Get("user_id"), from, to, loc, nil
 }
 
 type loggingResponseWriter struct {
 	w          http.ResponseWriter
 	statusCode int
+	// bytes размер записанного тела ответа
+	bytes int64
 }
 
 func (l *loggingResponseWriter) Header() http.Header {
@@ -298,7 +424,12 @@ func (l *loggingResponseWriter) Header() http.Header {
 }
 
 func (l *loggingResponseWriter) Write(bytes []byte) (int, error) {
-	return l.w.Write(bytes)
+	if l.statusCode == 0 {
+		l.statusCode = http.StatusOK
+	}
+	n, err := l.w.Write(bytes)
+	l.bytes += int64(n)
+	return n, err
 }
 
 func (l *loggingResponseWriter) WriteHeader(statusCode int) {
@@ -306,15 +437,85 @@ func (l *loggingResponseWriter) WriteHeader(statusCode int) {
 	l.w.WriteHeader(statusCode)
 }
 
-func loggingHandler(next http.Handler) http.Handler {
+// Unwrap нужен http.ResponseController, чтобы потоковые обработчики могли сбрасывать буфер
+func (l *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return l.w
+}
+
+// loggingHandler пишет каждый обработанный запрос в slog.Default() и возвращает клиенту идентификатор
+// запроса в X-Request-ID. Паника в обработчике записывается в лог со стеком, а клиент получает 500
+func loggingHandler(next http.Handler, metrics *Metrics) http.Handler {
+	logger := slog.Default()
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		if metrics != nil {
+			metrics.inFlight.Add(1)
+		}
+		info := &requestInfo{id: requestID(r.Header.Get(requestIDHeader))}
+		w.Header().Set(requestIDHeader, info.id)
 		nextW := &loggingResponseWriter{w: w}
+		r = r.WithContext(withRequestInfo(r.Context(), info))
+		defer func() {
+			p := recover()
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			headerWritten := nextW.statusCode != 0
+			if p != nil {
+				logger.LogAttrs(r.Context(), slog.LevelError, "Panic while processing request",
+					slog.String("request_id", info.id),
+					slog.Any("panic", p),
+					slog.String("stack", string(debug.Stack())))
+				if !headerWritten {
+					writeErrorMessage(nextW, http.StatusInternalServerError, "Internal server error")
+				}
+			}
+			level := slog.LevelInfo
+			if nextW.statusCode >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+			logger.LogAttrs(r.Context(), level, "Request processed",
+				slog.String("request_id", info.id),
+				slog.String("method", r.Method),
+				slog.String("url", r.URL.String()),
+				slog.String("route", info.route),
+				slog.String("remote_addr", r.RemoteAddr),
+				slog.String("user_id", logUserID(r, info)),
+				slog.Int("status", nextW.statusCode),
+				slog.Int64("bytes", nextW.bytes),
+				slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000))
+			if metrics != nil {
+				metrics.inFlight.Add(-1)
+				statusCode := nextW.statusCode
+				if statusCode == 0 {
+					// Обработчик ничего не записал, net/http ответит 200
+					statusCode = http.StatusOK
+				}
+				metrics.observeRequest(info.route, statusCode, time.Since(start))
+			}
+			if p != nil && headerWritten {
+				// Ответ уже начат, корректно завершить его нельзя, поэтому разрываем соединение
+				panic(http.ErrAbortHandler)
+			}
+		}()
 		next.ServeHTTP(nextW, r)
-		fmt.Fprintf(os.Stdout, "Request %s %s processed in %v, code %d\n", r.Method, r.URL.String(), time.Since(start), nextW.statusCode)
 	})
 }
 
+// logUserID возвращает пользователя запроса для лога: из токена, а без аутентификации - из user_id запроса
+func logUserID(r *http.Request, info *requestInfo) string {
+	if info.userID != "" {
+		return info.userID
+	}
+	if userID, _, ok := parseRESTPath(r.URL); ok {
+		return userID
+	}
+	if r.Form != nil {
+		return r.Form.Get("user_id")
+	}
+	return r.URL.Query().Get("user_id")
+}
+
 func validatePostRequest(w http.ResponseWriter, r *http.Request) bool {
 	if r.Method != http.MethodPost {
 		writeErrorMessage(w, http.StatusMethodNotAllowed, "Wrong method")
@@ -329,7 +530,7 @@ func validatePostRequest(w http.ResponseWriter, r *http.Request) bool {
 	return true
 }
 
-func createEvent(w http.ResponseWriter, r *http.Request, storage *Storage) {
+func createEvent(w http.ResponseWriter, r *http.Request, storage Storage) {
 	if !validatePostRequest(w, r) {
 		return
 	}
@@ -338,19 +539,26 @@ func createEvent(w http.ResponseWriter, r *http.Request, storage *Storage) {
 		writeErrorMessage(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	event, err = storage.Create(event)
+	opts, err := ParseWriteOptions(r.Form)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	event, err = storage.Create(event, append(opts, requestActor(r, event.UserID))...)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
+	w.Header().Set("ETag", eventETag(event.Version))
 	response := Response{Result: PostResult{
-		ID:     event.ID,
-		Status: Created,
+		ID:      event.ID,
+		Status:  Created,
+		Version: event.Version,
 	}}
 	marshalResponseAndWrite(w, http.StatusOK, response)
 }
 
-func updateEvent(w http.ResponseWriter, r *http.Request, storage *Storage) {
+func updateEvent(w http.ResponseWriter, r *http.Request, storage Storage) {
 	if !validatePostRequest(w, r) {
 		return
 	}
@@ -359,19 +567,45 @@ func updateEvent(w http.ResponseWriter, r *http.Request, storage *Storage) {
 		writeErrorMessage(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	event, err = storage.Update(event)
+	occurrence, scope, err := ParseOccurrence(r.PostForm)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts, err := ParseWriteOptions(r.Form)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeOpts, err := ParseExpectedVersion(r, r.PostForm)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeOpts = append(writeOpts, requestActor(r, event.UserID))
+	writeOpts = append(writeOpts, parseKeepAttendees(r.PostForm)...)
+	if occurrence.IsZero() {
+		event, err = storage.Update(event, append(opts, writeOpts...)...)
+	} else if len(opts) > 0 {
+		writeErrorMessage(w, http.StatusBadRequest, "reject_conflicts is not supported for occurrence")
+		return
+	} else {
+		event, err = storage.UpdateOccurrence(event, occurrence, scope, writeOpts...)
+	}
 	if err != nil {
 		writeError(w, err)
 		return
 	}
+	w.Header().Set("ETag", eventETag(event.Version))
 	response := Response{Result: PostResult{
-		ID:     event.ID,
-		Status: Updated,
+		ID:      event.ID,
+		Status:  Updated,
+		Version: event.Version,
 	}}
 	marshalResponseAndWrite(w, http.StatusOK, response)
 }
 
-func deleteEvent(w http.ResponseWriter, r *http.Request, storage *Storage) {
+func deleteEvent(w http.ResponseWriter, r *http.Request, storage Storage) {
 	if !validatePostRequest(w, r) {
 		return
 	}
@@ -380,19 +614,35 @@ func deleteEvent(w http.ResponseWriter, r *http.Request, storage *Storage) {
 		writeErrorMessage(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	event, err = storage.Delete(event)
+	occurrence, scope, err := ParseOccurrence(r.PostForm)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeOpts, err := ParseExpectedVersion(r, r.PostForm)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeOpts = append(writeOpts, requestActor(r, event.UserID))
+	if occurrence.IsZero() {
+		event, err = storage.Delete(event, writeOpts...)
+	} else {
+		event, err = storage.DeleteOccurrence(event, occurrence, scope, writeOpts...)
+	}
 	if err != nil {
 		writeError(w, err)
 		return
 	}
 	response := Response{Result: PostResult{
-		ID:     event.ID,
-		Status: Deleted,
+		ID:      event.ID,
+		Status:  Deleted,
+		Version: event.Version,
 	}}
 	marshalResponseAndWrite(w, http.StatusOK, response)
 }
 
-func getEventsPerDay(w http.ResponseWriter, r *http.Request, storage *Storage) {
+func getEventsPerDay(w http.ResponseWriter, r *http.Request, storage Storage) {
 	if r.Method != http.MethodGet {
 		writeErrorMessage(w, http.StatusMethodNotAllowed, "Wrong method")
 		return
@@ -411,7 +661,7 @@ func getEventsPerDay(w http.ResponseWriter, r *http.Request, storage *Storage) {
 	writeEventsResponse(w, events)
 }
 
-func getEventsPerWeek(w http.ResponseWriter, r *http.Request, storage *Storage) {
+func getEventsPerWeek(w http.ResponseWriter, r *http.Request, storage Storage) {
 	if r.Method != http.MethodGet {
 		writeErrorMessage(w, http.StatusMethodNotAllowed, "Wrong method")
 		return
@@ -430,18 +680,18 @@ func getEventsPerWeek(w http.ResponseWriter, r *http.Request, storage *Storage)
 	writeEventsResponse(w, events)
 }
 
-func getEventsPerMonth(w http.ResponseWriter, r *http.Request, storage *Storage) {
+func getEventsPerMonth(w http.ResponseWriter, r *http.Request, storage Storage) {
 	if r.Method != http.MethodGet {
 		writeErrorMessage(w, http.StatusMethodNotAllowed, "Wrong method")
 		return
 	}
 
-	userID, year, month, err := ParseUserAndMonth(r.URL.Query())
+	userID, year, month, loc, err := ParseUserAndMonth(r.URL.Query())
 	if err != nil {
 		writeErrorMessage(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	events, err := storage.GetEventsPerMonth(userID, year, month)
+	events, err := storage.GetEventsPerMonth(userID, year, month, loc)
 	if err != nil {
 		writeError(w, err)
 		return
@@ -449,19 +699,219 @@ func getEventsPerMonth(w http.ResponseWriter, r *http.Request, storage *Storage)
 	writeEventsResponse(w, events)
 }
 
+// exportICS отдает события пользователя в формате iCalendar для подписки из календарных клиентов.
+// По умолчанию выгружаются события за rangeDefaultMonths месяцев до и после текущего месяца
+func exportICS(w http.ResponseWriter, r *http.Request, storage Storage) {
+	if r.Method != http.MethodGet {
+		writeErrorMessage(w, http.StatusMethodNotAllowed, "Wrong method")
+		return
+	}
+
+	userID, from, to, loc, err := ParseUserAndRange(r.URL.Query())
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	from, to, err = defaultRange(from, to, loc)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	events, err := getEventsInRange(storage, userID, from, to)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	sortEvents(events)
+	events, err = exportedEvents(storage, events)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("content-type", "text/calendar; charset=utf-8")
+	w.Header().Set("content-disposition", `inline; filename="calendar.ics"`)
+	w.WriteHeader(http.StatusOK)
+	if err := WriteICalendar(w, events, time.Now()); err != nil {
+		fmt.Fprintln(os.Stderr, "Error while writing calendar", err)
+	}
+}
+
+// exportedEvents заменяет повторения из диапазона их сериями целиком, чтобы выгрузить каждую серию
+// один раз вместе с правилом, удаленными и измененными повторениями. Порядок событий сохраняется
+func exportedEvents(storage Storage, occurrences []Event) ([]Event, error) {
+	type key struct {
+		userID string
+		id     string
+	}
+	seen := make(map[key]bool)
+	var res []Event
+	for _, e := range occurrences {
+		k := key{userID: e.UserID, id: e.ID}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if e.RRule == "" {
+			res = append(res, e)
+			continue
+		}
+		// Серия приглашения хранится в календаре организатора e.UserID
+		master, err := storage.Get(e.UserID, e.ID)
+		if err != nil {
+			if err, ok := err.(*ValidationError); ok && err.NotFound {
+				// Серию удалили после чтения диапазона
+				continue
+			}
+			return nil, err
+		}
+		res = append(res, *master)
+	}
+	return res, nil
+}
+
+// importICS загружает события из файла iCalendar в календарь пользователя. Файл передается
+// полем file формы multipart/form-data или телом запроса, user_id - в форме или в query
+func importICS(w http.ResponseWriter, r *http.Request, storage Storage) {
+	r.Body = http.MaxBytesReader(w, r.Body, importMaxSize)
+	if !validatePostRequest(w, r) {
+		return
+	}
+	var body io.Reader = r.Body
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("content-type")); mediaType == "multipart/form-data" {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			writeErrorMessage(w, http.StatusBadRequest, "Failed to read file")
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+	userID := r.FormValue("user_id")
+	if userID == "" {
+		writeErrorMessage(w, http.StatusBadRequest, "empty parameters")
+		return
+	}
+	components, err := ParseICalendar(body)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	response := Response{Result: ImportICalendar(storage, userID, components, requestActor(r, userID))}
+	marshalResponseAndWrite(w, http.StatusOK, response)
+}
+
+const (
+	importMaxSize      = 10 << 20
+	rangeDefaultMonths = 12
+	rangeMaxDuration   = 5 * 366 * 24 * time.Hour
+)
+
+// defaultRange заполняет незаданные границы диапазона: по умолчанию берется
+// rangeDefaultMonths месяцев до и после текущего месяца. Слишком большой диапазон считается ошибкой
+func defaultRange(from, to time.Time, loc *time.Location) (time.Time, time.Time, error) {
+	now := time.Now().In(loc)
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+	if from.IsZero() {
+		from = thisMonth.AddDate(0, -rangeDefaultMonths, 0)
+	}
+	if to.IsZero() {
+		to = thisMonth.AddDate(0, rangeDefaultMonths+1, 0)
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must not be after to")
+	}
+	if to.Sub(from) > rangeMaxDuration {
+		return time.Time{}, time.Time{}, fmt.Errorf("date range is too large")
+	}
+	return from, to, nil
+}
+
+// sortEvents сортирует события по началу, затем по ID
+func sortEvents(events []Event) {
+	sort.Slice(events, func(i, j int) bool {
+		return compareEvents(&events[i], &events[j]) < 0
+	})
+}
+
+// compareEvents сравнивает события по началу, ID и исходному началу повторения
+func compareEvents(a, b *Event) int {
+	switch {
+	case !a.Start.Equal(b.Start):
+		return a.Start.Compare(b.Start)
+	case a.ID != b.ID:
+		return strings.Compare(a.ID, b.ID)
+	default:
+		return a.RecurrenceID.Compare(b.RecurrenceID)
+	}
+}
+
+// getEventsInRange собирает события в [from, to) из помесячных запросов к хранилищу, как в /events_for_month.
+// Событие, пересекающее границу месяцев, возвращается один раз
+func getEventsInRange(storage Storage, userID string, from, to time.Time) ([]Event, error) {
+	type key struct {
+		id           string
+		recurrenceID time.Time
+	}
+	seen := make(map[key]bool)
+	var res []Event
+	loc := from.Location()
+	for month := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, loc); month.Before(to); month = month.AddDate(0, 1, 0) {
+		events, err := storage.GetEventsPerMonth(userID, month.Year(), month.Month(), loc)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range events {
+			k := key{id: e.ID, recurrenceID: e.RecurrenceID.UTC()}
+			if seen[k] || !e.Overlaps(from, to) {
+				continue
+			}
+			seen[k] = true
+			res = append(res, e)
+		}
+	}
+	return res, nil
+}
+
 func writeEventsResponse(w http.ResponseWriter, events []Event) {
 	respEvents := make([]EventResult, len(events))
 	for i, e := range events {
-		respEvents[i] = EventResult{
-			ID:   e.ID,
-			Name: e.Name,
-			Date: e.Date.Format("2006-01-02"),
-		}
+		respEvents[i] = newEventResult(e)
 	}
 	response := Response{Result: respEvents}
 	marshalResponseAndWrite(w, http.StatusOK, response)
 }
 
+// newEventResult переводит событие в формат ответа API, время выводится в часовом поясе события
+func newEventResult(e Event) EventResult {
+	loc := e.Location()
+	res := EventResult{
+		ID:          e.ID,
+		Name:        e.Name,
+		Description: e.Description,
+		Date:        e.Start.In(loc).Format("2006-01-02"),
+		Start:       e.Start.In(loc).Format(time.RFC3339),
+		End:         e.End.In(loc).Format(time.RFC3339),
+		AllDay:      e.AllDay,
+		Timezone:    loc.String(),
+		Version:     e.Version,
+	}
+	if e.RRule != "" {
+		res.RRule = e.RRule
+	}
+	// У самой серии повторения нет, только у ее повторений
+	if !e.RecurrenceID.IsZero() {
+		res.Occurrence = e.RecurrenceID.In(loc).Format(time.RFC3339)
+	}
+	for _, offset := range e.Reminders {
+		res.Reminders = append(res.Reminders, FormatReminder(offset))
+	}
+	if len(e.Attendees) > 0 {
+		res.Organizer = e.UserID
+		res.Attendees = e.Attendees
+	}
+	return res
+}
+
 func marshalResponseAndWrite(w http.ResponseWriter, status int, response any) {
 	respJSON, err := json.Marshal(response)
 	if err != nil {
@@ -475,11 +925,38 @@ func marshalResponseAndWrite(w http.ResponseWriter, status int, response any) {
 }
 
 func writeError(w http.ResponseWriter, err error) {
-	if err, ok := err.(*ValidationError); ok {
-		writeErrorMessage(w, http.StatusBadRequest, err.Message)
-	} else {
+	var resp ErrorResponse
+	if batchErr, ok := err.(*BatchError); ok {
+		resp.Operation = &batchErr.Index
+		err = batchErr.Err
+	}
+	switch err := err.(type) {
+	case *ValidationError:
+		resp.Error = err.Message
+		marshalResponseAndWrite(w, http.StatusBadRequest, resp)
+	case *ParamsError:
+		resp.Error = err.Error()
+		resp.Violations = err.Violations
+		marshalResponseAndWrite(w, http.StatusBadRequest, resp)
+	case *ConflictError:
+		resp.Error = err.Error()
+		resp.Conflicts = make([]EventResult, len(err.Conflicts))
+		for i, e := range err.Conflicts {
+			resp.Conflicts[i] = newEventResult(e)
+		}
+		marshalResponseAndWrite(w, http.StatusConflict, resp)
+	case *VersionMismatchError:
+		w.Header().Set("ETag", eventETag(err.Current))
+		resp.Error = err.Error()
+		if err.Precondition {
+			marshalResponseAndWrite(w, http.StatusPreconditionFailed, resp)
+		} else {
+			marshalResponseAndWrite(w, http.StatusConflict, resp)
+		}
+	default:
 		fmt.Fprintf(os.Stderr, "Internal error while processing request: %v\n", err)
-		writeErrorMessage(w, http.StatusServiceUnavailable, "Service unavailable")
+		resp.Error = "Service unavailable"
+		marshalResponseAndWrite(w, http.StatusServiceUnavailable, resp)
 	}
 }
 
@@ -497,67 +974,228 @@ func writeErrorMessage(w http.ResponseWriter, statusCode int, message string) {
 }
 
 func getHandler() http.Handler {
-	storage := NewStorage()
+	return newHandler(&Config{}, NewMemoryStorage(), Services{})
+}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/create_event/", func(w http.ResponseWriter, r *http.Request) {
+// newHandler собирает обработчик сервера: маршруты, ограничение частоты запросов и аутентификацию,
+// если они настроены в cfg, логирование и метрики, если они включены в services
+func newHandler(cfg *Config, storage Storage, services Services) http.Handler {
+	if services.Metrics != nil {
+		storage = services.Metrics.instrument(storage)
+	}
+	mux := newMux(storage, services)
+	var handler http.Handler = mux
+	if cfg.RateLimit != nil {
+		// Ограничение после аутентификации, чтобы учитывать запросы по пользователю из токена
+		handler = rateLimitHandler(NewRateLimiter(*cfg.RateLimit, nil), handler)
+	}
+	if cfg.Auth != nil {
+		handler = authHandler(cfg.Auth, handler)
+	}
+	return loggingHandler(routeHandler(mux, handler), services.Metrics)
+}
+
+// newMux регистрирует маршруты API вместе с их описанием, которое отдается в /openapi.json.
+// Параметры запросов проверяются по этому описанию до вызова обработчиков
+func newMux(storage Storage, services Services) *http.ServeMux {
+	mux := &apiMux{ServeMux: http.NewServeMux()}
+	mux.handleFunc("/create_event/", func(w http.ResponseWriter, r *http.Request) {
 		createEvent(w, r, storage)
-	})
-	mux.HandleFunc("/update_event/", func(w http.ResponseWriter, r *http.Request) {
+	}, createEventOperation)
+	mux.handleFunc("/update_event/", func(w http.ResponseWriter, r *http.Request) {
 		updateEvent(w, r, storage)
-	})
-	mux.HandleFunc("/delete_event/", func(w http.ResponseWriter, r *http.Request) {
+	}, updateEventOperation)
+	mux.handleFunc("/delete_event/", func(w http.ResponseWriter, r *http.Request) {
 		deleteEvent(w, r, storage)
-	})
-	mux.HandleFunc("/events_for_day/", func(w http.ResponseWriter, r *http.Request) {
+	}, deleteEventOperation)
+	mux.handleFunc("/batch", func(w http.ResponseWriter, r *http.Request) {
+		batchEvents(w, r, storage)
+	}, batchOperation)
+	mux.handleFunc("/rsvp_event/", func(w http.ResponseWriter, r *http.Request) {
+		rsvpEvent(w, r, storage)
+	}, rsvpEventOperation)
+	mux.handleFunc("/events_for_day/", func(w http.ResponseWriter, r *http.Request) {
 		getEventsPerDay(w, r, storage)
-	})
-	mux.HandleFunc("/events_for_week/", func(w http.ResponseWriter, r *http.Request) {
+	}, eventsForDayOperation)
+	mux.handleFunc("/events_for_week/", func(w http.ResponseWriter, r *http.Request) {
 		getEventsPerWeek(w, r, storage)
-	})
-	mux.HandleFunc("/events_for_month/", func(w http.ResponseWriter, r *http.Request) {
+	}, eventsForWeekOperation)
+	mux.handleFunc("/events_for_month/", func(w http.ResponseWriter, r *http.Request) {
 		getEventsPerMonth(w, r, storage)
-	})
-	return loggingHandler(mux)
+	}, eventsForMonthOperation)
+	mux.handleFunc("/events/", func(w http.ResponseWriter, r *http.Request) {
+		getEvents(w, r, storage)
+	}, eventsOperation)
+	mux.handleFunc("/search_events/", func(w http.ResponseWriter, r *http.Request) {
+		searchEvents(w, r, storage)
+	}, searchEventsOperation)
+	mux.handleFunc("/free_busy/", func(w http.ResponseWriter, r *http.Request) {
+		getFreeBusy(w, r, storage)
+	}, freeBusyOperation)
+	mux.handleFunc("/export_ics/", func(w http.ResponseWriter, r *http.Request) {
+		exportICS(w, r, storage)
+	}, exportICSOperation)
+	// Для POST нельзя полагаться на редирект с пути без слэша, поэтому регистрируем оба
+	importHandler := mux.handleFunc("/import_ics", func(w http.ResponseWriter, r *http.Request) {
+		importICS(w, r, storage)
+	}, importICSOperation)
+	mux.Handle("/import_ics/", importHandler)
+	mux.handle("/users/", restHandler(storage), listEventsRESTOperation, createEventRESTOperation,
+		getEventRESTOperation, replaceEventRESTOperation, patchEventRESTOperation, deleteEventRESTOperation)
+	if services.Webhooks != nil {
+		mux.handle("/webhooks/", webhooksHandler(services.Webhooks), listWebhooksOperation, subscribeWebhookOperation,
+			deadLettersOperation, unsubscribeWebhookOperation)
+	}
+	if services.History != nil {
+		mux.handleFunc("/event_history/", func(w http.ResponseWriter, r *http.Request) {
+			getEventHistory(w, r, services.History)
+		}, eventHistoryOperation)
+		mux.handleFunc("/revert_event/", func(w http.ResponseWriter, r *http.Request) {
+			revertEvent(w, r, storage, services.History)
+		}, revertEventOperation)
+		mux.handleFunc("/audit_log/", func(w http.ResponseWriter, r *http.Request) {
+			getAuditLog(w, r, services.History)
+		}, auditLogOperation)
+	}
+	if services.Stream != nil {
+		streamHandler := mux.handle("/stream", streamHandler(services.Stream), streamOperation)
+		mux.Handle("/stream/", streamHandler)
+	}
+	if services.Metrics != nil {
+		mux.handle("/metrics", metricsHandler(services.Metrics), metricsOperation)
+	}
+	mux.handleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		getOpenAPI(w, r, mux)
+	}, openAPIOperation)
+	return mux.ServeMux
 }
 
 func main() {
 	// Определяем название конфиг файла
 	configName := flag.String("c", "conf.json", "name of config file")
+	// Выпуск токена для пользователя вместо запуска сервера
+	tokenUser := flag.String("token", "", "print token signed with auth.hmac_secret for user and exit")
+	tokenRole := flag.String("role", string(RoleUser), "role of issued token: user or admin")
+	tokenTTL := flag.Duration("ttl", 24*time.Hour, "lifetime of issued token, 0 - unlimited")
 	flag.Parse()
 
-	confData, err := os.ReadFile(*configName)
+	cfg, err := LoadConfig(*configName, os.LookupEnv)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error while reading config file: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error while loading config: %v\n", err)
 		os.Exit(1)
 	}
 
-	var cfg Config
-	err = json.Unmarshal(confData, &cfg)
+	if *tokenUser != "" {
+		if cfg.Auth == nil || cfg.Auth.HMACSecret == "" {
+			fmt.Fprintln(os.Stderr, "auth.hmac_secret is not set in config file or CALENDAR_AUTH_HMAC_SECRET")
+			os.Exit(1)
+		}
+		principal := Principal{UserID: *tokenUser, Role: Role(*tokenRole)}
+		if *tokenTTL > 0 {
+			principal.ExpiresAt = time.Now().Add(*tokenTTL).Unix()
+		}
+		token, err := SignToken(cfg.Auth.HMACSecret, principal)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error while signing token: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stdout, token)
+		return
+	}
+
+	logger, err := cfg.Log.newLogger(os.Stdout)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error while parsing config file: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error while configuring logs: %v\n", err)
 		os.Exit(1)
 	}
+	slog.SetDefault(logger)
 
-	handler := getHandler()
-	server := &http.Server{
-		Addr:    cfg.Address,
-		Handler: handler,
+	var storage Storage
+	if cfg.StoragePath == "" {
+		storage = NewMemoryStorage()
+	} else {
+		fileStorage, err := NewFileStorage(cfg.StoragePath, cfg.SnapshotEvery)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error while opening storage: %v\n", err)
+			os.Exit(1)
+		}
+		defer fileStorage.Close()
+		storage = fileStorage
+	}
+
+	webhooks, err := startWebhooks(cfg, storage)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while starting webhooks: %v\n", err)
+		os.Exit(1)
+	}
+	history, err := startHistory(cfg, storage)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while opening history: %v\n", err)
+		os.Exit(1)
+	}
+	defer history.Close()
+	stream, err := startStream(cfg, storage)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while starting change stream: %v\n", err)
+		os.Exit(1)
+	}
+	services := Services{Webhooks: webhooks, Stream: stream, History: history, Metrics: NewMetrics()}
+	live, err := newLiveServer(*configName, os.LookupEnv, os.Stdout, cfg, storage, services)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while configuring server: %v\n", err)
+		os.Exit(1)
+	}
+	server := live.httpServer()
+	// Потоки /stream не завершаются сами, без этого server.Shutdown ждал бы их бесконечно
+	server.RegisterOnShutdown(stream.Close)
+	schedulerDone, err := startScheduler(cfg, storage, server)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while starting reminder scheduler: %v\n", err)
+		os.Exit(1)
 	}
 
 	//Обрабатываем сигналы для корректного завершения
 	signalCtx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 	defer cancel()
+	// По SIGHUP перечитываем конфиг, при ошибке продолжаем работать с прежним
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
 	go func() {
+		for range hangup {
+			if er := live.Reload(); er != nil {
+				slog.Error("Config was not reloaded, previous config is kept", slog.String("error", er.Error()))
+				continue
+			}
+			slog.Info("Reloaded config", slog.String("path", *configName))
+		}
+	}()
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
 		<-signalCtx.Done()
-		if er := server.Shutdown(context.Background()); er != nil {
+		signal.Stop(hangup)
+		ctx, cancelShutdown := context.WithTimeout(context.Background(), live.Config().ShutdownTimeout.or(defaultShutdownTimeout))
+		defer cancelShutdown()
+		if er := server.Shutdown(ctx); er != nil {
 			fmt.Fprintln(os.Stderr, "Failed to shutdown server: ", er)
+			// Запросы не завершились за shutdown_timeout, закрываем соединения
+			server.Close()
 		}
 	}()
 
-	fmt.Fprintln(os.Stdout, "Started server")
-	if er := server.ListenAndServe(); er != http.ErrServerClosed {
+	logger.Info("Started server", slog.String("address", cfg.Address), slog.Bool("tls", cfg.TLS != nil))
+	if er := listenAndServe(server); er != http.ErrServerClosed {
 		fmt.Fprintln(os.Stderr, "HTTP server ListenAndServe: ", er)
+		// Сервер не запустился, останавливаем фоновые задачи, зарегистрированные на Shutdown
+		cancel()
+	}
+	<-shutdownDone
+	<-schedulerDone
+	if webhooks != nil {
+		// Обработчики завершены, новых изменений не будет
+		if er := webhooks.Close(context.Background()); er != nil {
+			fmt.Fprintln(os.Stderr, "Failed to stop webhooks: ", er)
+		}
 	}
 	fmt.Fprintln(os.Stdout, "Stopped server")
 }
@@ -8,6 +8,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 )
 
@@ -42,27 +43,31 @@ func TestCreateEvent(t *testing.T) {
 		},
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			handler := getHandler()
-			ts := httptest.NewServer(handler)
-			defer ts.Close()
-
-			resp := makePostRequest(ts, handler, "/create_event/", tt.body)
-
-			assert.Equal(t, tt.want.statusCode, resp.Code)
-			respBody, err := io.ReadAll(resp.Body)
-			require.NoError(t, err)
-			if tt.want.statusCode == 200 {
-				var respOK Response
-				err := json.Unmarshal(respBody, &respOK)
-				require.NoError(t, err)
-				result := respOK.Result.(map[string]interface{})
-				require.EqualValues(t, Created, result["status"])
-			} else {
-				var respErr ErrorResponse
-				err := json.Unmarshal(respBody, &respErr)
-				require.NoError(t, err)
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					handler := newHandler(&Config{}, backend.newStorage(t), Services{})
+					ts := httptest.NewServer(handler)
+					defer ts.Close()
+
+					resp := makePostRequest(ts, handler, "/create_event/", tt.body)
+
+					assert.Equal(t, tt.want.statusCode, resp.Code)
+					respBody, err := io.ReadAll(resp.Body)
+					require.NoError(t, err)
+					if tt.want.statusCode == 200 {
+						var respOK Response
+						err := json.Unmarshal(respBody, &respOK)
+						require.NoError(t, err)
+						result := respOK.Result.(map[string]interface{})
+						require.EqualValues(t, Created, result["status"])
+					} else {
+						var respErr ErrorResponse
+						err := json.Unmarshal(respBody, &respErr)
+						require.NoError(t, err)
+					}
+				})
 			}
 		})
 	}
@@ -117,35 +122,39 @@ func TestUpdateEvent(t *testing.T) {
 		},
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			handler := getHandler()
-			ts := httptest.NewServer(handler)
-			defer ts.Close()
-
-			id, err := createEventAndGetID(ts, handler, "user_id=34&name=action&date=2024-03-04")
-			require.NoError(t, err)
-
-			body := tt.body
-			if !tt.doNotAddID {
-				body = body + "&id=" + id
-			}
-
-			resp := makePostRequest(ts, handler, "/update_event/", body)
-
-			assert.Equal(t, tt.want.statusCode, resp.Code)
-			respBody, err := io.ReadAll(resp.Body)
-			require.NoError(t, err)
-			if tt.want.statusCode == 200 {
-				var respOK Response
-				err := json.Unmarshal(respBody, &respOK)
-				require.NoError(t, err)
-				result := respOK.Result.(map[string]interface{})
-				require.EqualValues(t, Updated, result["status"])
-			} else {
-				var respErr ErrorResponse
-				err := json.Unmarshal(respBody, &respErr)
-				require.NoError(t, err)
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					handler := newHandler(&Config{}, backend.newStorage(t), Services{})
+					ts := httptest.NewServer(handler)
+					defer ts.Close()
+
+					id, err := createEventAndGetID(ts, handler, "user_id=34&name=action&date=2024-03-04")
+					require.NoError(t, err)
+
+					body := tt.body
+					if !tt.doNotAddID {
+						body = body + "&id=" + id
+					}
+
+					resp := makePostRequest(ts, handler, "/update_event/", body)
+
+					assert.Equal(t, tt.want.statusCode, resp.Code)
+					respBody, err := io.ReadAll(resp.Body)
+					require.NoError(t, err)
+					if tt.want.statusCode == 200 {
+						var respOK Response
+						err := json.Unmarshal(respBody, &respOK)
+						require.NoError(t, err)
+						result := respOK.Result.(map[string]interface{})
+						require.EqualValues(t, Updated, result["status"])
+					} else {
+						var respErr ErrorResponse
+						err := json.Unmarshal(respBody, &respErr)
+						require.NoError(t, err)
+					}
+				})
 			}
 		})
 	}
@@ -190,35 +199,39 @@ func TestDeleteEvent(t *testing.T) {
 		},
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			handler := getHandler()
-			ts := httptest.NewServer(handler)
-			defer ts.Close()
-
-			id, err := createEventAndGetID(ts, handler, "user_id=34&name=action&date=2024-03-04")
-			require.NoError(t, err)
-
-			body := tt.body
-			if !tt.doNotAddID {
-				body = body + "&id=" + id
-			}
-
-			resp := makePostRequest(ts, handler, "/delete_event/", body)
-
-			assert.Equal(t, tt.want.statusCode, resp.Code)
-			respBody, err := io.ReadAll(resp.Body)
-			require.NoError(t, err)
-			if tt.want.statusCode == 200 {
-				var respOK Response
-				err := json.Unmarshal(respBody, &respOK)
-				require.NoError(t, err)
-				result := respOK.Result.(map[string]interface{})
-				require.EqualValues(t, Deleted, result["status"])
-			} else {
-				var respErr ErrorResponse
-				err := json.Unmarshal(respBody, &respErr)
-				require.NoError(t, err)
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					handler := newHandler(&Config{}, backend.newStorage(t), Services{})
+					ts := httptest.NewServer(handler)
+					defer ts.Close()
+
+					id, err := createEventAndGetID(ts, handler, "user_id=34&name=action&date=2024-03-04")
+					require.NoError(t, err)
+
+					body := tt.body
+					if !tt.doNotAddID {
+						body = body + "&id=" + id
+					}
+
+					resp := makePostRequest(ts, handler, "/delete_event/", body)
+
+					assert.Equal(t, tt.want.statusCode, resp.Code)
+					respBody, err := io.ReadAll(resp.Body)
+					require.NoError(t, err)
+					if tt.want.statusCode == 200 {
+						var respOK Response
+						err := json.Unmarshal(respBody, &respOK)
+						require.NoError(t, err)
+						result := respOK.Result.(map[string]interface{})
+						require.EqualValues(t, Deleted, result["status"])
+					} else {
+						var respErr ErrorResponse
+						err := json.Unmarshal(respBody, &respErr)
+						require.NoError(t, err)
+					}
+				})
 			}
 		})
 	}
@@ -256,36 +269,40 @@ func TestGetEventPerDay(t *testing.T) {
 		},
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			handler := getHandler()
-			ts := httptest.NewServer(handler)
-			defer ts.Close()
-
-			_, err := createEventAndGetID(ts, handler, "user_id=34&name=action&date=2024-03-04")
-			require.NoError(t, err)
-			_, err = createEventAndGetID(ts, handler, "user_id=34&name=action2&date=2024-03-04")
-			require.NoError(t, err)
-			_, err = createEventAndGetID(ts, handler, "user_id=34&name=action3&date=2024-03-03")
-			require.NoError(t, err)
-
-			request := httptest.NewRequest(http.MethodGet, ts.URL+"/events_for_day/?"+tt.query, nil)
-			resp := httptest.NewRecorder()
-			handler.ServeHTTP(resp, request)
-
-			assert.Equal(t, tt.want.statusCode, resp.Code)
-			respBody, err := io.ReadAll(resp.Body)
-			require.NoError(t, err)
-			if tt.want.statusCode == 200 {
-				var respOK Response
-				err := json.Unmarshal(respBody, &respOK)
-				require.NoError(t, err)
-				result := respOK.Result.([]interface{})
-				require.EqualValues(t, tt.want.lenRes, len(result))
-			} else {
-				var respErr ErrorResponse
-				err := json.Unmarshal(respBody, &respErr)
-				require.NoError(t, err)
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					handler := newHandler(&Config{}, backend.newStorage(t), Services{})
+					ts := httptest.NewServer(handler)
+					defer ts.Close()
+
+					_, err := createEventAndGetID(ts, handler, "user_id=34&name=action&date=2024-03-04")
+					require.NoError(t, err)
+					_, err = createEventAndGetID(ts, handler, "user_id=34&name=action2&date=2024-03-04")
+					require.NoError(t, err)
+					_, err = createEventAndGetID(ts, handler, "user_id=34&name=action3&date=2024-03-03")
+					require.NoError(t, err)
+
+					request := httptest.NewRequest(http.MethodGet, ts.URL+"/events_for_day/?"+tt.query, nil)
+					resp := httptest.NewRecorder()
+					handler.ServeHTTP(resp, request)
+
+					assert.Equal(t, tt.want.statusCode, resp.Code)
+					respBody, err := io.ReadAll(resp.Body)
+					require.NoError(t, err)
+					if tt.want.statusCode == 200 {
+						var respOK Response
+						err := json.Unmarshal(respBody, &respOK)
+						require.NoError(t, err)
+						result := respOK.Result.([]interface{})
+						require.EqualValues(t, tt.want.lenRes, len(result))
+					} else {
+						var respErr ErrorResponse
+						err := json.Unmarshal(respBody, &respErr)
+						require.NoError(t, err)
+					}
+				})
 			}
 		})
 	}
@@ -323,36 +340,40 @@ func TestGetEventPerWeek(t *testing.T) {
 		},
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			handler := getHandler()
-			ts := httptest.NewServer(handler)
-			defer ts.Close()
-
-			_, err := createEventAndGetID(ts, handler, "user_id=34&name=action&date=2024-03-04")
-			require.NoError(t, err)
-			_, err = createEventAndGetID(ts, handler, "user_id=34&name=action2&date=2024-03-10")
-			require.NoError(t, err)
-			_, err = createEventAndGetID(ts, handler, "user_id=34&name=action3&date=2024-03-11")
-			require.NoError(t, err)
-
-			request := httptest.NewRequest(http.MethodGet, ts.URL+"/events_for_week/?"+tt.query, nil)
-			resp := httptest.NewRecorder()
-			handler.ServeHTTP(resp, request)
-
-			assert.Equal(t, tt.want.statusCode, resp.Code)
-			respBody, err := io.ReadAll(resp.Body)
-			require.NoError(t, err)
-			if tt.want.statusCode == 200 {
-				var respOK Response
-				err := json.Unmarshal(respBody, &respOK)
-				require.NoError(t, err)
-				result := respOK.Result.([]interface{})
-				require.EqualValues(t, tt.want.lenRes, len(result))
-			} else {
-				var respErr ErrorResponse
-				err := json.Unmarshal(respBody, &respErr)
-				require.NoError(t, err)
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					handler := newHandler(&Config{}, backend.newStorage(t), Services{})
+					ts := httptest.NewServer(handler)
+					defer ts.Close()
+
+					_, err := createEventAndGetID(ts, handler, "user_id=34&name=action&date=2024-03-04")
+					require.NoError(t, err)
+					_, err = createEventAndGetID(ts, handler, "user_id=34&name=action2&date=2024-03-10")
+					require.NoError(t, err)
+					_, err = createEventAndGetID(ts, handler, "user_id=34&name=action3&date=2024-03-11")
+					require.NoError(t, err)
+
+					request := httptest.NewRequest(http.MethodGet, ts.URL+"/events_for_week/?"+tt.query, nil)
+					resp := httptest.NewRecorder()
+					handler.ServeHTTP(resp, request)
+
+					assert.Equal(t, tt.want.statusCode, resp.Code)
+					respBody, err := io.ReadAll(resp.Body)
+					require.NoError(t, err)
+					if tt.want.statusCode == 200 {
+						var respOK Response
+						err := json.Unmarshal(respBody, &respOK)
+						require.NoError(t, err)
+						result := respOK.Result.([]interface{})
+						require.EqualValues(t, tt.want.lenRes, len(result))
+					} else {
+						var respErr ErrorResponse
+						err := json.Unmarshal(respBody, &respErr)
+						require.NoError(t, err)
+					}
+				})
 			}
 		})
 	}
@@ -395,43 +416,70 @@ func TestGetEventPerMonth(t *testing.T) {
 		},
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			handler := getHandler()
-			ts := httptest.NewServer(handler)
-			defer ts.Close()
-
-			_, err := createEventAndGetID(ts, handler, "user_id=34&name=action&date=2024-03-01")
-			require.NoError(t, err)
-			_, err = createEventAndGetID(ts, handler, "user_id=34&name=action2&date=2024-03-31")
-			require.NoError(t, err)
-			_, err = createEventAndGetID(ts, handler, "user_id=34&name=action3&date=2024-04-11")
-			require.NoError(t, err)
-			_, err = createEventAndGetID(ts, handler, "user_id=34&name=action3&date=2023-03-11")
-			require.NoError(t, err)
-
-			request := httptest.NewRequest(http.MethodGet, ts.URL+"/events_for_month/?"+tt.query, nil)
-			resp := httptest.NewRecorder()
-			handler.ServeHTTP(resp, request)
-
-			assert.Equal(t, tt.want.statusCode, resp.Code)
-			respBody, err := io.ReadAll(resp.Body)
-			require.NoError(t, err)
-			if tt.want.statusCode == 200 {
-				var respOK Response
-				err := json.Unmarshal(respBody, &respOK)
-				require.NoError(t, err)
-				result := respOK.Result.([]interface{})
-				require.EqualValues(t, tt.want.lenRes, len(result))
-			} else {
-				var respErr ErrorResponse
-				err := json.Unmarshal(respBody, &respErr)
-				require.NoError(t, err)
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					handler := newHandler(&Config{}, backend.newStorage(t), Services{})
+					ts := httptest.NewServer(handler)
+					defer ts.Close()
+
+					_, err := createEventAndGetID(ts, handler, "user_id=34&name=action&date=2024-03-01")
+					require.NoError(t, err)
+					_, err = createEventAndGetID(ts, handler, "user_id=34&name=action2&date=2024-03-31")
+					require.NoError(t, err)
+					_, err = createEventAndGetID(ts, handler, "user_id=34&name=action3&date=2024-04-11")
+					require.NoError(t, err)
+					_, err = createEventAndGetID(ts, handler, "user_id=34&name=action3&date=2023-03-11")
+					require.NoError(t, err)
+
+					request := httptest.NewRequest(http.MethodGet, ts.URL+"/events_for_month/?"+tt.query, nil)
+					resp := httptest.NewRecorder()
+					handler.ServeHTTP(resp, request)
+
+					assert.Equal(t, tt.want.statusCode, resp.Code)
+					respBody, err := io.ReadAll(resp.Body)
+					require.NoError(t, err)
+					if tt.want.statusCode == 200 {
+						var respOK Response
+						err := json.Unmarshal(respBody, &respOK)
+						require.NoError(t, err)
+						result := respOK.Result.([]interface{})
+						require.EqualValues(t, tt.want.lenRes, len(result))
+					} else {
+						var respErr ErrorResponse
+						err := json.Unmarshal(respBody, &respErr)
+						require.NoError(t, err)
+					}
+				})
 			}
 		})
 	}
 }
 
+// storageBackends содержит все реализации Storage, на которых прогоняются тесты обработчиков
+var storageBackends = []struct {
+	name       string
+	newStorage func(t *testing.T) Storage
+}{
+	{
+		name: "Memory storage",
+		newStorage: func(t *testing.T) Storage {
+			return NewMemoryStorage()
+		},
+	},
+	{
+		name: "File storage",
+		newStorage: func(t *testing.T) Storage {
+			// Маленький интервал снимков, чтобы в тестах работали и журнал, и снимки
+			s, err := NewFileStorage(t.TempDir(), 2)
+			require.NoError(t, err)
+			t.Cleanup(func() { s.Close() })
+			return s
+		},
+	},
+}
+
 func createEventAndGetID(ts *httptest.Server, handler http.Handler, body string) (string, error) {
 	resp := makePostRequest(ts, handler, "/create_event/", body)
 	respBody, err := io.ReadAll(resp.Body)
@@ -454,3 +502,245 @@ func makePostRequest(ts *httptest.Server, handler http.Handler, path string, bod
 	handler.ServeHTTP(resp, request)
 	return resp
 }
+
+func TestTimedEvents(t *testing.T) {
+	type want struct {
+		statusCode int
+		lenRes     int
+	}
+	tests := []struct {
+		name  string
+		event string
+		query string
+		want  want
+	}{
+		{
+			name:  "Positive test with start and end",
+			event: "user_id=34&name=meeting&start=2024-03-04T14:00:00%2B03:00&end=2024-03-04T15:30:00%2B03:00&timezone=Europe/Moscow",
+			query: "user_id=34&date=2024-03-04",
+			want:  want{statusCode: 200, lenRes: 1},
+		},
+		{
+			name:  "Positive test with duration",
+			event: "user_id=34&name=meeting&start=2024-03-04T14:00:00Z&duration=90m",
+			query: "user_id=34&date=2024-03-04",
+			want:  want{statusCode: 200, lenRes: 1},
+		},
+		{
+			name:  "Positive test with event crossing midnight",
+			event: "user_id=34&name=party&start=2024-03-03T23:00:00Z&end=2024-03-04T01:00:00Z",
+			query: "user_id=34&date=2024-03-04",
+			want:  want{statusCode: 200, lenRes: 1},
+		},
+		{
+			name:  "Positive test with caller timezone",
+			event: "user_id=34&name=call&start=2024-03-03T22:00:00Z&duration=30m",
+			query: "user_id=34&date=2024-03-04&timezone=Europe/Moscow",
+			want:  want{statusCode: 200, lenRes: 1},
+		},
+		{
+			name:  "Positive test with event outside of caller day",
+			event: "user_id=34&name=call&start=2024-03-04T22:00:00Z&duration=30m",
+			query: "user_id=34&date=2024-03-04&timezone=Europe/Moscow",
+			want:  want{statusCode: 200, lenRes: 0},
+		},
+		{
+			name:  "Positive test with all-day event in event timezone",
+			event: "user_id=34&name=holiday&start=2024-03-04&all_day=true&timezone=Asia/Tokyo",
+			query: "user_id=34&date=2024-03-04",
+			want:  want{statusCode: 200, lenRes: 1},
+		},
+		{
+			name:  "Negative test with end before start",
+			event: "user_id=34&name=meeting&start=2024-03-04T14:00:00Z&end=2024-03-04T13:00:00Z",
+			want:  want{statusCode: 400},
+		},
+		{
+			name:  "Negative test with wrong timezone",
+			event: "user_id=34&name=meeting&start=2024-03-04T14:00:00Z&timezone=Mars/Olympus",
+			want:  want{statusCode: 400},
+		},
+		{
+			name:  "Negative test with wrong start",
+			event: "user_id=34&name=meeting&start=2024-03-04 14:00",
+			want:  want{statusCode: 400},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := getHandler()
+			ts := httptest.NewServer(handler)
+			defer ts.Close()
+
+			resp := makePostRequest(ts, handler, "/create_event/", tt.event)
+			if tt.want.statusCode != 200 {
+				assert.Equal(t, tt.want.statusCode, resp.Code)
+				return
+			}
+			require.Equal(t, http.StatusOK, resp.Code)
+
+			request := httptest.NewRequest(http.MethodGet, ts.URL+"/events_for_day/?"+tt.query, nil)
+			resp = httptest.NewRecorder()
+			handler.ServeHTTP(resp, request)
+			require.Equal(t, http.StatusOK, resp.Code)
+			assert.Equal(t, tt.want.lenRes, countResults(t, resp))
+		})
+	}
+}
+
+func TestEventResultFields(t *testing.T) {
+	handler := getHandler()
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	id, err := createEventAndGetID(ts, handler, "user_id=34&name=meeting&start=2024-03-04T11:00:00Z&end=2024-03-04T12:30:00Z&timezone=Europe/Moscow")
+	require.NoError(t, err)
+
+	request := httptest.NewRequest(http.MethodGet, ts.URL+"/events_for_day/?user_id=34&date=2024-03-04", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, request)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	var respOK struct {
+		Result []EventResult `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &respOK))
+	require.Len(t, respOK.Result, 1)
+	assert.Equal(t, EventResult{
+		ID:       id,
+		Name:     "meeting",
+		Date:     "2024-03-04",
+		Start:    "2024-03-04T14:00:00+03:00",
+		End:      "2024-03-04T15:30:00+03:00",
+		Timezone: "Europe/Moscow",
+		Version:  1,
+	}, respOK.Result[0])
+}
+
+func TestRecurringEvents(t *testing.T) {
+	for _, backend := range storageBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			handler := newHandler(&Config{}, backend.newStorage(t), Services{})
+			ts := httptest.NewServer(handler)
+			defer ts.Close()
+
+			id, err := createEventAndGetID(ts, handler, "user_id=34&name=standup&start=2024-03-04T09:00:00Z&duration=15m&rrule=FREQ%3DDAILY%3BCOUNT%3D5")
+			require.NoError(t, err)
+			week := getWeekEvents(t, handler, "user_id=34&date=2024-03-04")
+			require.Len(t, week, 5)
+			assert.Equal(t, "FREQ=DAILY;COUNT=5", week[0].RRule)
+
+			// Удаляем одно повторение
+			resp := makePostRequest(ts, handler, "/delete_event/", "user_id=34&id="+id+"&occurrence=2024-03-05T09:00:00Z")
+			require.Equal(t, http.StatusOK, resp.Code)
+			assert.Len(t, getWeekEvents(t, handler, "user_id=34&date=2024-03-04"), 4)
+
+			// Повторно удалить то же повторение нельзя
+			resp = makePostRequest(ts, handler, "/delete_event/", "user_id=34&id="+id+"&occurrence=2024-03-05T09:00:00Z")
+			require.Equal(t, http.StatusBadRequest, resp.Code)
+
+			// Переносим одно повторение на вечер
+			resp = makePostRequest(ts, handler, "/update_event/", "user_id=34&id="+id+"&name=standup&start=2024-03-06T18:00:00Z&occurrence=2024-03-06T09:00:00Z")
+			require.Equal(t, http.StatusOK, resp.Code)
+			week = getWeekEvents(t, handler, "user_id=34&date=2024-03-04")
+			require.Len(t, week, 4)
+			assert.Contains(t, startTimes(week), "2024-03-06T18:00:00Z")
+
+			// Переименовываем это и следующие повторения
+			resp = makePostRequest(ts, handler, "/update_event/", "user_id=34&id="+id+"&name=sync&start=2024-03-07T10:00:00Z&duration=30m&occurrence=2024-03-07T09:00:00Z&scope=following")
+			require.Equal(t, http.StatusOK, resp.Code)
+			week = getWeekEvents(t, handler, "user_id=34&date=2024-03-04")
+			assert.ElementsMatch(t, []string{
+				"2024-03-04T09:00:00Z",
+				"2024-03-06T18:00:00Z",
+				"2024-03-07T10:00:00Z",
+				"2024-03-08T10:00:00Z",
+			}, startTimes(week))
+
+			// Удаляем первую серию начиная со второго повторения
+			resp = makePostRequest(ts, handler, "/delete_event/", "user_id=34&id="+id+"&occurrence=2024-03-06T09:00:00Z&scope=following")
+			require.Equal(t, http.StatusOK, resp.Code)
+			week = getWeekEvents(t, handler, "user_id=34&date=2024-03-04")
+			assert.ElementsMatch(t, []string{
+				"2024-03-04T09:00:00Z",
+				"2024-03-07T10:00:00Z",
+				"2024-03-08T10:00:00Z",
+			}, startTimes(week))
+		})
+	}
+}
+
+func TestUpdateFirstOccurrenceFollowing(t *testing.T) {
+	handler := getHandler()
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	id, err := createEventAndGetID(ts, handler, "user_id=34&name=standup&start=2024-03-04T09:00:00Z&duration=15m&rrule=FREQ%3DDAILY%3BCOUNT%3D5")
+	require.NoError(t, err)
+	resp := makePostRequest(ts, handler, "/delete_event/", "user_id=34&id="+id+"&occurrence=2024-03-06T09:00:00Z")
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	// Изменение с первого повторения без rrule сохраняет правило и удаленные повторения серии
+	resp = makePostRequest(ts, handler, "/update_event/", "user_id=34&id="+id+"&name=sync&start=2024-03-04T09:00:00Z&duration=15m&occurrence=2024-03-04T09:00:00Z&scope=following")
+	require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+	week := getWeekEvents(t, handler, "user_id=34&date=2024-03-04")
+	require.Len(t, week, 4)
+	for _, e := range week {
+		assert.Equal(t, "sync", e.Name)
+		assert.Equal(t, "FREQ=DAILY;COUNT=5", e.RRule)
+	}
+	assert.NotContains(t, startTimes(week), "2024-03-06T09:00:00Z")
+}
+
+func getWeekEvents(t *testing.T, handler http.Handler, query string) []EventResult {
+	request := httptest.NewRequest(http.MethodGet, "/events_for_week/?"+query, nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, request)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var respOK struct {
+		Result []EventResult `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &respOK))
+	return respOK.Result
+}
+
+func startTimes(events []EventResult) []string {
+	res := make([]string, len(events))
+	for i, e := range events {
+		res[i] = e.Start
+	}
+	return res
+}
+
+func TestParseRequiredDate(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		month bool
+		err   string
+	}{
+		{"date", "user_id=34&date=2024-03-04", false, ""},
+		{"missing date", "user_id=34", false, "date is required"},
+		{"empty date", "user_id=34&date=", false, "date is required"},
+		{"month", "user_id=34&year=2024&month=3", true, ""},
+		{"missing year", "user_id=34&month=3", true, "year is required"},
+		{"missing month", "user_id=34&year=2024", true, "month is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := url.ParseQuery(tt.query)
+			require.NoError(t, err)
+			if tt.month {
+				_, _, _, _, err = ParseUserAndMonth(v)
+			} else {
+				_, _, err = ParseUserAndDate(v)
+			}
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.err)
+			}
+		})
+	}
+}
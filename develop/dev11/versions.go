@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// IfVersion разрешает изменение или удаление события, только если его текущая версия равна version.
+// Иначе возвращается *VersionMismatchError
+func IfVersion(version int64) WriteOption {
+	return func(o *writeOptions) {
+		o.expectVersion = true
+		o.version = version
+	}
+}
+
+// IfMatch как IfVersion, но ожидаемая версия передана предусловием запроса (заголовком If-Match),
+// поэтому несовпадение версии означает 412 Precondition Failed, а не 409 Conflict
+func IfMatch(version int64) WriteOption {
+	return func(o *writeOptions) {
+		IfVersion(version)(o)
+		o.precondition = true
+	}
+}
+
+// VersionMismatchError ошибка изменения события, версия которого отличается от ожидаемой клиентом
+type VersionMismatchError struct {
+	Expected int64
+	// Current текущая версия события
+	Current int64
+	// Precondition означает, что ожидаемая версия передана в If-Match
+	Precondition bool
+}
+
+func (e *VersionMismatchError) Error() string {
+	return fmt.Sprintf("Event version is %d, expected %d", e.Current, e.Expected)
+}
+
+// checkVersion возвращает *VersionMismatchError, если задана ожидаемая версия и она не равна current
+func (o writeOptions) checkVersion(current int64) error {
+	if o.expectVersion && o.version != current {
+		return &VersionMismatchError{Expected: o.version, Current: current, Precondition: o.precondition}
+	}
+	return nil
+}
+
+// ParseExpectedVersion парсит версию события, которую клиент ожидает изменить: заголовок If-Match
+// со значением ETag события или параметр version. If-Match: * означает любую версию
+func ParseExpectedVersion(r *http.Request, v url.Values) ([]WriteOption, error) {
+	if value := strings.TrimSpace(r.Header.Get("If-Match")); value != "" {
+		if value == "*" {
+			return nil, nil
+		}
+		version, err := parseETag(value)
+		if err != nil {
+			return nil, err
+		}
+		return []WriteOption{IfMatch(version)}, nil
+	}
+	return parseVersion(v)
+}
+
+// parseVersion парсит ожидаемую версию события из параметра version
+func parseVersion(v url.Values) ([]WriteOption, error) {
+	if value := v.Get("version"); value != "" {
+		version, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || version < 0 {
+			return nil, fmt.Errorf("version parse error")
+		}
+		return []WriteOption{IfVersion(version)}, nil
+	}
+	return nil, nil
+}
+
+// eventETag возвращает ETag версии события
+func eventETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// parseETag возвращает версию события из ETag. Слабые ETag не поддерживаются:
+// If-Match требует точного совпадения представления
+func parseETag(value string) (int64, error) {
+	unquoted, err := strconv.Unquote(value)
+	if err != nil || strings.HasPrefix(value, "W/") {
+		return 0, fmt.Errorf("If-Match must be a single ETag of event")
+	}
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("If-Match must be a single ETag of event")
+	}
+	return version, nil
+}
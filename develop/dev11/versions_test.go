@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventVersions(t *testing.T) {
+	s := NewMemoryStorage()
+	start := mustTime(t, "2024-03-04T10:00:00Z")
+	event, err := s.Create(&Event{UserID: "34", Name: "standup", Start: start, End: start.Add(time.Hour), RRule: "FREQ=DAILY"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), event.Version)
+	id := event.ID
+
+	updated, err := s.Update(&Event{UserID: "34", ID: id, Name: "daily", Start: start, End: start.Add(time.Hour), RRule: "FREQ=DAILY"}, IfVersion(1))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), updated.Version)
+
+	_, err = s.Update(&Event{UserID: "34", ID: id, Name: "stale", Start: start, End: start.Add(time.Hour)}, IfVersion(1))
+	var mismatch *VersionMismatchError
+	require.ErrorAs(t, err, &mismatch)
+	assert.Equal(t, int64(2), mismatch.Current)
+	assert.False(t, mismatch.Precondition)
+	_, err = s.Delete(&Event{UserID: "34", ID: id}, IfMatch(1))
+	require.ErrorAs(t, err, &mismatch)
+	assert.True(t, mismatch.Precondition)
+
+	// Изменение повторения увеличивает версию серии
+	occurrence := start.AddDate(0, 0, 1)
+	override, err := s.UpdateOccurrence(&Event{UserID: "34", ID: id, Name: "moved", Start: occurrence.Add(time.Hour), End: occurrence.Add(2 * time.Hour)}, occurrence, ScopeThis, IfVersion(2))
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), override.Version)
+	_, err = s.DeleteOccurrence(&Event{UserID: "34", ID: id}, start.AddDate(0, 0, 2), ScopeThis, IfVersion(2))
+	require.ErrorAs(t, err, &mismatch)
+	deleted, err := s.DeleteOccurrence(&Event{UserID: "34", ID: id}, start.AddDate(0, 0, 2), ScopeThis, IfVersion(3))
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), deleted.Version)
+	stored, err := s.Get("34", id)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), stored.Version)
+	occurrences := stored.Occurrences(occurrence, occurrence.AddDate(0, 0, 1))
+	require.Len(t, occurrences, 1)
+	assert.Equal(t, int64(4), occurrences[0].Version)
+
+	deleted, err = s.Delete(&Event{UserID: "34", ID: id}, IfVersion(4))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), deleted.Version)
+}
+
+func TestVersionHandlers(t *testing.T) {
+	handler := getHandler()
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	id, err := createEventAndGetID(ts, handler, "user_id=34&date=2024-03-04&name=action")
+	require.NoError(t, err)
+	update := "user_id=34&date=2024-03-05&name=renamed&id=" + id
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		ifMatch string
+		status  int
+		etag    string
+	}{
+		{"current version", http.MethodPost, "/update_event/", update + "&version=1", "", http.StatusOK, `"2"`},
+		{"stale version", http.MethodPost, "/update_event/", update + "&version=1", "", http.StatusConflict, `"2"`},
+		{"wrong version", http.MethodPost, "/update_event/", update + "&version=abc", "", http.StatusBadRequest, ""},
+		{"stale If-Match", http.MethodPost, "/update_event/", update, `"1"`, http.StatusPreconditionFailed, `"2"`},
+		{"If-Match overrides version", http.MethodPost, "/update_event/", update + "&version=1", `"2"`, http.StatusOK, `"3"`},
+		{"weak If-Match", http.MethodPost, "/update_event/", update, `W/"3"`, http.StatusBadRequest, ""},
+		{"without version", http.MethodPost, "/update_event/", update, "", http.StatusOK, `"4"`},
+		{"REST get", http.MethodGet, "/users/34/events/" + id, "", "", http.StatusOK, `"4"`},
+		{"REST stale If-Match", http.MethodPatch, "/users/34/events/" + id, `{"name":"rest"}`, `"3"`, http.StatusPreconditionFailed, `"4"`},
+		{"REST If-Match", http.MethodPatch, "/users/34/events/" + id, `{"name":"rest"}`, `"4"`, http.StatusOK, `"5"`},
+		{"stale delete", http.MethodPost, "/delete_event/", "user_id=34&version=4&id=" + id, "", http.StatusConflict, `"5"`},
+		{"REST stale delete", http.MethodDelete, "/users/34/events/" + id, "", `"4"`, http.StatusPreconditionFailed, `"5"`},
+		{"delete any version", http.MethodPost, "/delete_event/", "user_id=34&id=" + id, "*", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if strings.HasPrefix(tt.path, "/users/") {
+				req.Header.Set("content-type", "application/json")
+			} else {
+				req.Header.Set("content-type", "application/x-www-form-urlencoded")
+			}
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+			require.Equal(t, tt.status, resp.Code, resp.Body.String())
+			assert.Equal(t, tt.etag, resp.Header().Get("ETag"))
+			if tt.status == http.StatusOK && tt.etag != "" && tt.method != http.MethodGet {
+				var res struct {
+					Result PostResult `json:"result"`
+				}
+				require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &res))
+				assert.Equal(t, tt.etag, eventETag(res.Result.Version))
+			}
+		})
+	}
+}
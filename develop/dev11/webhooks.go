@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhooksFileName        = "webhooks.json"
+	defaultWebhookWorkers   = 4
+	defaultWebhookAttempts  = 6
+	defaultWebhookBackoff   = time.Second
+	defaultWebhookMaxWait   = 5 * time.Minute
+	defaultWebhookTimeout   = 10 * time.Second
+	defaultWebhookPending   = 1000
+	maxWebhookDeadLetters   = 1000
+	webhookSignatureHeader  = "X-Webhook-Signature"
+	webhookDeliveryIDHeader = "X-Webhook-ID"
+)
+
+// WebhookConfig настройки доставки webhook. Незаданные поля принимают значения по умолчанию
+type WebhookConfig struct {
+	// Workers количество одновременных доставок
+	Workers int `json:"workers"`
+	// MaxAttempts после стольких неудачных попыток доставка попадает в список недоставленных
+	MaxAttempts int `json:"max_attempts"`
+	// InitialBackoff пауза перед второй попыткой, дальше она удваивается до MaxBackoff
+	InitialBackoff Duration `json:"initial_backoff"`
+	MaxBackoff     Duration `json:"max_backoff"`
+	// Timeout ограничение времени одного запроса
+	Timeout Duration `json:"timeout"`
+	// MaxPending сколько недоставленных изменений одной подписки может ждать в очереди и повторах.
+	// Изменения сверх этого сразу попадают в список недоставленных
+	MaxPending int `json:"max_pending"`
+}
+
+// WebhookSubscription подписка на изменения событий
+type WebhookSubscription struct {
+	ID string `json:"id"`
+	// UserID пользователь, об изменениях событий которого (и событий, в которые он приглашен) сообщать,
+	// пустой - все пользователи
+	UserID string `json:"user_id,omitempty"`
+	URL    string `json:"url"`
+	// Secret ключ подписи HMAC-SHA256 тела запроса. Возвращается только при создании подписки
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookPayload тело запроса webhook
+type WebhookPayload struct {
+	// ID доставки, одинаковый для всех попыток, по нему получатель может отбросить повтор
+	ID             string      `json:"id"`
+	SubscriptionID string      `json:"subscription_id"`
+	UserID         string      `json:"user_id"`
+	Status         Status      `json:"status"`
+	Event          EventResult `json:"event"`
+	Timestamp      string      `json:"timestamp"`
+}
+
+// DeadLetter доставка, для которой исчерпаны попытки
+type DeadLetter struct {
+	// UserID владелец подписки, пустой у подписки на всех пользователей. Payload.UserID - организатор события
+	UserID    string         `json:"user_id,omitempty"`
+	Payload   WebhookPayload `json:"payload"`
+	URL       string         `json:"url"`
+	Attempts  int            `json:"attempts"`
+	LastError string         `json:"last_error"`
+	FailedAt  time.Time      `json:"failed_at"`
+}
+
+// webhookDelivery одна доставка изменения одной подписке
+type webhookDelivery struct {
+	subscription WebhookSubscription
+	payload      WebhookPayload
+	body         []byte
+	attempts     int
+}
+
+// WebhookDispatcher хранит подписки и асинхронно доставляет им изменения событий.
+// Неудачные доставки повторяются с экспоненциально растущей паузой, после MaxAttempts
+// попыток попадают в список недоставленных. Очередь каждой подписки ограничена MaxPending,
+// поэтому медленный получатель не занимает память без ограничения. Доставки, не завершенные к Close, теряются
+type WebhookDispatcher struct {
+	cfg    WebhookConfig
+	client *http.Client
+	// path файл, в котором сохраняются подписки, пустой - подписки хранятся только в памяти
+	path string
+
+	mu            sync.Mutex
+	cond          *sync.Cond
+	subscriptions map[string]WebhookSubscription
+	queue         []*webhookDelivery
+	retries       map[*time.Timer]struct{}
+	// pending количество незавершенных доставок подписки: в очереди, в отправке и в ожидании повтора
+	pending map[string]int
+	// overflowed подписки, о переполнении очереди которых уже сообщено в лог
+	overflowed  map[string]bool
+	deadLetters []DeadLetter
+	closed      bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewWebhookDispatcher создает диспетчер и запускает доставку. Подписки загружаются из файла path, если он задан
+func NewWebhookDispatcher(cfg WebhookConfig, path string) (*WebhookDispatcher, error) {
+	if cfg.Workers <= 0 {
+		cfg.Workers = defaultWebhookWorkers
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultWebhookAttempts
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = Duration(defaultWebhookBackoff)
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = Duration(defaultWebhookMaxWait)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = Duration(defaultWebhookTimeout)
+	}
+	if cfg.MaxPending <= 0 {
+		cfg.MaxPending = defaultWebhookPending
+	}
+	d := &WebhookDispatcher{
+		cfg:           cfg,
+		client:        &http.Client{Timeout: time.Duration(cfg.Timeout)},
+		path:          path,
+		subscriptions: make(map[string]WebhookSubscription),
+		retries:       make(map[*time.Timer]struct{}),
+		pending:       make(map[string]int),
+		overflowed:    make(map[string]bool),
+	}
+	d.cond = sync.NewCond(&d.mu)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("read webhooks: %w", err)
+		}
+		if err == nil {
+			var subscriptions []WebhookSubscription
+			if err := json.Unmarshal(data, &subscriptions); err != nil {
+				return nil, fmt.Errorf("parse webhooks: %w", err)
+			}
+			for _, sub := range subscriptions {
+				d.subscriptions[sub.ID] = sub
+			}
+		}
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for i := 0; i < cfg.Workers; i++ {
+		d.wg.Add(1)
+		go d.worker()
+	}
+	return d, nil
+}
+
+// Subscribe добавляет подписку. Пустой секрет генерируется
+func (d *WebhookDispatcher) Subscribe(sub WebhookSubscription) (WebhookSubscription, error) {
+	u, err := url.Parse(sub.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return WebhookSubscription{}, &ValidationError{Message: "url must be absolute http or https URL"}
+	}
+	if sub.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return WebhookSubscription{}, err
+		}
+		sub.Secret = hex.EncodeToString(secret)
+	}
+	sub.ID = uuid.New().String()
+	sub.CreatedAt = time.Now().UTC()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.subscriptions[sub.ID] = sub
+	if err := d.save(); err != nil {
+		delete(d.subscriptions, sub.ID)
+		return WebhookSubscription{}, err
+	}
+	return sub, nil
+}
+
+// Unsubscribe удаляет подписку пользователя userID (пустой userID - любую)
+func (d *WebhookDispatcher) Unsubscribe(userID, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sub, ok := d.subscriptions[id]
+	if !ok || (userID != "" && sub.UserID != userID) {
+		return &ValidationError{Message: "Subscription does not exist", NotFound: true}
+	}
+	delete(d.subscriptions, id)
+	if err := d.save(); err != nil {
+		d.subscriptions[id] = sub
+		return err
+	}
+	return nil
+}
+
+// Subscriptions возвращает подписки пользователя userID (пустой userID - все) без секретов
+func (d *WebhookDispatcher) Subscriptions(userID string) []WebhookSubscription {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res := []WebhookSubscription{}
+	for _, sub := range d.subscriptions {
+		if userID == "" || sub.UserID == userID {
+			sub.Secret = ""
+			res = append(res, sub)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].CreatedAt.Before(res[j].CreatedAt) })
+	return res
+}
+
+// DeadLetters возвращает недоставленные изменения по подпискам пользователя userID (пустой userID - все)
+func (d *WebhookDispatcher) DeadLetters(userID string) []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res := []DeadLetter{}
+	for _, dl := range d.deadLetters {
+		if userID == "" || dl.UserID == userID {
+			res = append(res, dl)
+		}
+	}
+	return res
+}
+
+// save записывает подписки в файл. Вызывается под d.mu
+func (d *WebhookDispatcher) save() error {
+	if d.path == "" {
+		return nil
+	}
+	subscriptions := make([]WebhookSubscription, 0, len(d.subscriptions))
+	for _, sub := range d.subscriptions {
+		subscriptions = append(subscriptions, sub)
+	}
+	data, err := json.Marshal(subscriptions)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(d.path, data)
+}
+
+// Publish ставит изменения в очередь доставки подписчикам. Не блокируется,
+// поэтому подходит для вызова из MemoryStorage.OnChange
+func (d *WebhookDispatcher) Publish(changes []Change) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, c := range changes {
+		for _, sub := range d.subscriptions {
+			if sub.UserID != "" && !c.concerns(sub.UserID) {
+				continue
+			}
+			payload := WebhookPayload{
+				ID:             uuid.New().String(),
+				SubscriptionID: sub.ID,
+				UserID:         c.Event.UserID,
+				Status:         c.Status,
+				Event:          newEventResult(c.Event),
+				Timestamp:      now,
+			}
+			body, err := json.Marshal(payload)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error while serializing webhook payload", err)
+				continue
+			}
+			delivery := &webhookDelivery{subscription: sub, payload: payload, body: body}
+			if d.pending[sub.ID] >= d.cfg.MaxPending {
+				if !d.overflowed[sub.ID] {
+					d.overflowed[sub.ID] = true
+					fmt.Fprintf(os.Stderr, "Webhook queue of subscription %s is full, changes go to dead letters\n", sub.ID)
+				}
+				d.addDeadLetter(delivery, "delivery queue is full")
+				continue
+			}
+			d.pending[sub.ID]++
+			d.queue = append(d.queue, delivery)
+		}
+	}
+	d.cond.Broadcast()
+}
+
+// Close прекращает доставку и ждет завершения текущих запросов или отмены ctx
+func (d *WebhookDispatcher) Close(ctx context.Context) error {
+	d.mu.Lock()
+	d.closed = true
+	for timer := range d.retries {
+		timer.Stop()
+	}
+	d.retries = nil
+	d.queue = nil
+	d.cond.Broadcast()
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		d.cancel()
+		return nil
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (d *WebhookDispatcher) worker() {
+	defer d.wg.Done()
+	for {
+		d.mu.Lock()
+		for len(d.queue) == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		if d.closed {
+			d.mu.Unlock()
+			return
+		}
+		delivery := d.queue[0]
+		d.queue[0] = nil
+		d.queue = d.queue[1:]
+		d.mu.Unlock()
+
+		delivery.attempts++
+		err := d.send(delivery)
+		if err != nil {
+			d.retry(delivery, err)
+		} else {
+			d.mu.Lock()
+			d.done(delivery)
+			d.mu.Unlock()
+		}
+	}
+}
+
+// send делает одну попытку доставки, ответ с кодом не 2xx считается ошибкой
+func (d *WebhookDispatcher) send(delivery *webhookDelivery) error {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, delivery.subscription.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set(webhookDeliveryIDHeader, delivery.payload.ID)
+	req.Header.Set(webhookSignatureHeader, SignWebhook(delivery.subscription.Secret, delivery.body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// retry планирует повтор доставки или переносит ее в список недоставленных
+func (d *WebhookDispatcher) retry(delivery *webhookDelivery, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	if delivery.attempts >= d.cfg.MaxAttempts {
+		d.addDeadLetter(delivery, err.Error())
+		d.done(delivery)
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(d.backoff(delivery.attempts), func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.closed {
+			return
+		}
+		delete(d.retries, timer)
+		d.queue = append(d.queue, delivery)
+		d.cond.Signal()
+	})
+	d.retries[timer] = struct{}{}
+}
+
+// addDeadLetter добавляет доставку в список недоставленных. Вызывается под d.mu
+func (d *WebhookDispatcher) addDeadLetter(delivery *webhookDelivery, lastError string) {
+	d.deadLetters = append(d.deadLetters, DeadLetter{
+		UserID:    delivery.subscription.UserID,
+		Payload:   delivery.payload,
+		URL:       delivery.subscription.URL,
+		Attempts:  delivery.attempts,
+		LastError: lastError,
+		FailedAt:  time.Now().UTC(),
+	})
+	if len(d.deadLetters) > maxWebhookDeadLetters {
+		d.deadLetters = d.deadLetters[len(d.deadLetters)-maxWebhookDeadLetters:]
+	}
+}
+
+// done освобождает место доставки в очереди подписки. Вызывается под d.mu
+func (d *WebhookDispatcher) done(delivery *webhookDelivery) {
+	id := delivery.subscription.ID
+	d.pending[id]--
+	if d.pending[id] <= 0 {
+		// О следующем переполнении сообщается снова только после того, как очередь разобрана
+		delete(d.pending, id)
+		delete(d.overflowed, id)
+	}
+}
+
+// backoff возвращает паузу перед попыткой attempts+1
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	wait := time.Duration(d.cfg.InitialBackoff)
+	for i := 1; i < attempts && wait < time.Duration(d.cfg.MaxBackoff); i++ {
+		wait *= 2
+	}
+	return min(wait, time.Duration(d.cfg.MaxBackoff))
+}
+
+// SignWebhook возвращает значение заголовка X-Webhook-Signature: sha256=hex(HMAC-SHA256(secret, body))
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// startWebhooks создает диспетчер webhook, если он настроен в cfg, и подписывает его на изменения хранилища
+func startWebhooks(cfg *Config, storage Storage) (*WebhookDispatcher, error) {
+	if cfg.Webhooks == nil {
+		return nil, nil
+	}
+	source, ok := storage.(interface {
+		OnChange(fn func(changes []Change))
+	})
+	if !ok {
+		return nil, fmt.Errorf("storage does not support webhooks")
+	}
+	var path string
+	if cfg.StoragePath != "" {
+		path = filepath.Join(cfg.StoragePath, webhooksFileName)
+	}
+	dispatcher, err := NewWebhookDispatcher(*cfg.Webhooks, path)
+	if err != nil {
+		return nil, err
+	}
+	source.OnChange(dispatcher.Publish)
+	return dispatcher, nil
+}
+
+// webhooksHandler обрабатывает управление подписками:
+// GET /webhooks/ - подписки пользователя user_id, POST /webhooks/ (url, user_id, secret) - новая подписка,
+// DELETE /webhooks/{id} - удаление подписки, GET /webhooks/dead_letters - недоставленные изменения
+func webhooksHandler(dispatcher *WebhookDispatcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhooks"), "/")
+		userID := r.URL.Query().Get("user_id")
+		switch {
+		case id == "" && r.Method == http.MethodGet:
+			marshalResponseAndWrite(w, http.StatusOK, Response{Result: dispatcher.Subscriptions(userID)})
+		case id == "" && r.Method == http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				writeErrorMessage(w, http.StatusBadRequest, "Failed to parse form")
+				return
+			}
+			sub, err := dispatcher.Subscribe(WebhookSubscription{
+				UserID: r.Form.Get("user_id"),
+				URL:    r.Form.Get("url"),
+				Secret: r.Form.Get("secret"),
+			})
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			marshalResponseAndWrite(w, http.StatusCreated, Response{Result: sub})
+		case id == "dead_letters" && r.Method == http.MethodGet:
+			marshalResponseAndWrite(w, http.StatusOK, Response{Result: dispatcher.DeadLetters(userID)})
+		case id != "" && id != "dead_letters" && r.Method == http.MethodDelete:
+			if err := dispatcher.Unsubscribe(userID, id); err != nil {
+				writeRESTError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeErrorMessage(w, http.StatusMethodNotAllowed, "Wrong method")
+		}
+	})
+}
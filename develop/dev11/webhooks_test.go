@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookReceiver принимает webhook и проверяет подпись
+type webhookReceiver struct {
+	*httptest.Server
+	payloads chan WebhookPayload
+	// fail сколько первых запросов отклонить с кодом 500, -1 - отклонять все
+	fail     atomic.Int64
+	requests atomic.Int64
+}
+
+func newWebhookReceiver(t *testing.T, secret string) *webhookReceiver {
+	rcv := &webhookReceiver{payloads: make(chan WebhookPayload, 100)}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rcv.requests.Add(1)
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, SignWebhook(secret, body), r.Header.Get("X-Webhook-Signature"))
+		if fail := rcv.fail.Load(); fail != 0 {
+			rcv.fail.Add(-1)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var payload WebhookPayload
+		require.NoError(t, json.Unmarshal(body, &payload))
+		assert.Equal(t, payload.ID, r.Header.Get("X-Webhook-ID"))
+		rcv.payloads <- payload
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+func (rcv *webhookReceiver) expect(t *testing.T, status Status, name string) WebhookPayload {
+	select {
+	case p := <-rcv.payloads:
+		assert.Equal(t, status, p.Status)
+		assert.Equal(t, name, p.Event.Name)
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatalf("webhook for %s is not delivered", name)
+		return WebhookPayload{}
+	}
+}
+
+func newTestDispatcher(t *testing.T, storage *MemoryStorage, path string) *WebhookDispatcher {
+	d, err := NewWebhookDispatcher(WebhookConfig{
+		MaxAttempts:    3,
+		InitialBackoff: Duration(time.Millisecond),
+		MaxBackoff:     Duration(10 * time.Millisecond),
+	}, path)
+	require.NoError(t, err)
+	storage.OnChange(d.Publish)
+	t.Cleanup(func() { d.Close(context.Background()) })
+	return d
+}
+
+func subscribe(t *testing.T, handler http.Handler, form url.Values) WebhookSubscription {
+	req := httptest.NewRequest(http.MethodPost, "/webhooks/", strings.NewReader(form.Encode()))
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+	var res struct {
+		Result WebhookSubscription `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &res))
+	return res.Result
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	storage := NewMemoryStorage()
+	dispatcher := newTestDispatcher(t, storage, "")
+	handler := newHandler(&Config{}, storage, Services{Webhooks: dispatcher})
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	rcv := newWebhookReceiver(t, "secret")
+	sub := subscribe(t, handler, url.Values{"url": {rcv.URL}, "user_id": {"34"}, "secret": {"secret"}})
+	assert.Equal(t, "secret", sub.Secret)
+
+	id, err := createEventAndGetID(ts, handler, "user_id=34&date=2024-03-04&name=action")
+	require.NoError(t, err)
+	created := rcv.expect(t, Created, "action")
+	assert.Equal(t, id, created.Event.ID)
+	assert.Equal(t, "34", created.UserID)
+	assert.Equal(t, sub.ID, created.SubscriptionID)
+
+	resp := makePostRequest(ts, handler, "/update_event/", "user_id=34&date=2024-03-05&name=renamed&id="+id)
+	require.Equal(t, http.StatusOK, resp.Code)
+	updated := rcv.expect(t, Updated, "renamed")
+	assert.Equal(t, "2024-03-05", updated.Event.Date)
+
+	resp = makePostRequest(ts, handler, "/delete_event/", "user_id=34&id="+id)
+	require.Equal(t, http.StatusOK, resp.Code)
+	rcv.expect(t, Deleted, "renamed")
+
+	// Изменения событий других пользователей подписке не доставляются
+	_, err = createEventAndGetID(ts, handler, "user_id=35&date=2024-03-04&name=other")
+	require.NoError(t, err)
+	_, err = createEventAndGetID(ts, handler, "user_id=34&date=2024-03-04&name=own")
+	require.NoError(t, err)
+	rcv.expect(t, Created, "own")
+}
+
+func TestWebhookRetries(t *testing.T) {
+	storage := NewMemoryStorage()
+	dispatcher := newTestDispatcher(t, storage, "")
+	handler := newHandler(&Config{}, storage, Services{Webhooks: dispatcher})
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	flaky := newWebhookReceiver(t, "flaky")
+	flaky.fail.Store(2)
+	subscribe(t, handler, url.Values{"url": {flaky.URL}, "secret": {"flaky"}})
+	broken := newWebhookReceiver(t, "broken")
+	broken.fail.Store(-1)
+	subscribe(t, handler, url.Values{"url": {broken.URL}, "user_id": {"34"}, "secret": {"broken"}})
+
+	_, err := createEventAndGetID(ts, handler, "user_id=34&date=2024-03-04&name=action")
+	require.NoError(t, err)
+
+	// Третья попытка успешна
+	flaky.expect(t, Created, "action")
+	assert.Equal(t, int64(3), flaky.requests.Load())
+
+	// После трех неудачных попыток доставка попадает в список недоставленных
+	var deadLetters []DeadLetter
+	require.Eventually(t, func() bool {
+		deadLetters = getDeadLetters(t, handler, "34")
+		return len(deadLetters) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Len(t, deadLetters, 1)
+	assert.Equal(t, "34", deadLetters[0].UserID)
+	assert.Equal(t, broken.URL, deadLetters[0].URL)
+	assert.Equal(t, 3, deadLetters[0].Attempts)
+	assert.Equal(t, "action", deadLetters[0].Payload.Event.Name)
+	assert.Contains(t, deadLetters[0].LastError, "500")
+	assert.Equal(t, int64(3), broken.requests.Load())
+}
+
+func getDeadLetters(t *testing.T, handler http.Handler, userID string) []DeadLetter {
+	req := httptest.NewRequest(http.MethodGet, "/webhooks/dead_letters?user_id="+userID, nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var res struct {
+		Result []DeadLetter `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &res))
+	return res.Result
+}
+
+func TestWebhookDeadLettersOwner(t *testing.T) {
+	storage := NewMemoryStorage()
+	dispatcher := newTestDispatcher(t, storage, "")
+	handler := newHandler(&Config{}, storage, Services{Webhooks: dispatcher})
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	// Подписка участника 35 не работает, событие создает организатор 34
+	broken := newWebhookReceiver(t, "broken")
+	broken.fail.Store(-1)
+	sub := subscribe(t, handler, url.Values{"url": {broken.URL}, "user_id": {"35"}, "secret": {"broken"}})
+	_, err := createEventAndGetID(ts, handler, "user_id=34&date=2024-03-04&name=action&attendees=35")
+	require.NoError(t, err)
+
+	// Недоставленное изменение видит владелец подписки, а не организатор события
+	var deadLetters []DeadLetter
+	require.Eventually(t, func() bool {
+		deadLetters = getDeadLetters(t, handler, "35")
+		return len(deadLetters) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Len(t, deadLetters, 1)
+	assert.Equal(t, "35", deadLetters[0].UserID)
+	assert.Equal(t, "34", deadLetters[0].Payload.UserID)
+	assert.Equal(t, sub.ID, deadLetters[0].Payload.SubscriptionID)
+	assert.Empty(t, getDeadLetters(t, handler, "34"))
+}
+
+func TestWebhookQueueLimit(t *testing.T) {
+	// Получатель не отвечает, пока его не отпустят
+	release := make(chan struct{})
+	received := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		var payload WebhookPayload
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		received <- payload.Event.Name
+	}))
+	defer ts.Close()
+	released := false
+	defer func() {
+		if !released {
+			close(release)
+		}
+	}()
+
+	d, err := NewWebhookDispatcher(WebhookConfig{Workers: 1, MaxPending: 2}, "")
+	require.NoError(t, err)
+	defer d.Close(context.Background())
+	sub, err := d.Subscribe(WebhookSubscription{URL: ts.URL, UserID: "34"})
+	require.NoError(t, err)
+	publish := func(name string) {
+		d.Publish([]Change{{Status: Created, Event: Event{UserID: "34", ID: name, Name: name}}})
+	}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		publish(name)
+	}
+
+	// Изменения сверх очереди подписки сразу попадают в список недоставленных
+	deadLetters := d.DeadLetters("34")
+	require.Len(t, deadLetters, 2)
+	for i, name := range []string{"c", "d"} {
+		assert.Equal(t, name, deadLetters[i].Payload.Event.Name)
+		assert.Equal(t, sub.ID, deadLetters[i].Payload.SubscriptionID)
+		assert.Equal(t, 0, deadLetters[i].Attempts)
+		assert.Equal(t, "delivery queue is full", deadLetters[i].LastError)
+	}
+
+	close(release)
+	released = true
+	for _, name := range []string{"a", "b"} {
+		select {
+		case got := <-received:
+			assert.Equal(t, name, got)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("webhook for %s is not delivered", name)
+		}
+	}
+	// Разобранная очередь снова принимает изменения
+	require.Eventually(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.pending[sub.ID] == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	publish("e")
+	select {
+	case got := <-received:
+		assert.Equal(t, "e", got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook for e is not delivered")
+	}
+	assert.Len(t, d.DeadLetters("34"), 2)
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	d := &WebhookDispatcher{cfg: WebhookConfig{InitialBackoff: Duration(time.Second), MaxBackoff: Duration(5 * time.Second)}}
+	var got []time.Duration
+	for attempts := 1; attempts <= 5; attempts++ {
+		got = append(got, d.backoff(attempts))
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, got)
+}
+
+func TestWebhookSubscriptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	storage := NewMemoryStorage()
+	dispatcher := newTestDispatcher(t, storage, path)
+	handler := newHandler(&Config{}, storage, Services{Webhooks: dispatcher})
+
+	sub := subscribe(t, handler, url.Values{"url": {"http://localhost:1/hook"}, "user_id": {"34"}})
+	assert.NotEmpty(t, sub.Secret)
+	subscribe(t, handler, url.Values{"url": {"http://localhost:1/other"}, "user_id": {"35"}})
+
+	list := func(query string) []WebhookSubscription {
+		req := httptest.NewRequest(http.MethodGet, "/webhooks/?"+query, nil)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code)
+		var res struct {
+			Result []WebhookSubscription `json:"result"`
+		}
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &res))
+		return res.Result
+	}
+	subs := list("user_id=34")
+	require.Len(t, subs, 1)
+	assert.Equal(t, sub.ID, subs[0].ID)
+	assert.Empty(t, subs[0].Secret)
+
+	// Подписки сохраняются между перезапусками
+	restored, err := NewWebhookDispatcher(WebhookConfig{}, path)
+	require.NoError(t, err)
+	defer restored.Close(context.Background())
+	assert.Len(t, restored.Subscriptions(""), 2)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"wrong url", http.MethodPost, "/webhooks/", "url=ftp://host/x", http.StatusBadRequest},
+		{"relative url", http.MethodPost, "/webhooks/", "url=/hook", http.StatusBadRequest},
+		{"other user", http.MethodDelete, "/webhooks/" + sub.ID + "?user_id=35", "", http.StatusNotFound},
+		{"delete", http.MethodDelete, "/webhooks/" + sub.ID + "?user_id=34", "", http.StatusNoContent},
+		{"delete again", http.MethodDelete, "/webhooks/" + sub.ID + "?user_id=34", "", http.StatusNotFound},
+		{"wrong method", http.MethodPut, "/webhooks/", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("content-type", "application/x-www-form-urlencoded")
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+			assert.Equal(t, tt.status, resp.Code, resp.Body.String())
+		})
+	}
+	assert.Empty(t, list("user_id=34"))
+}